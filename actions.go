@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Client message types.
+const (
+	actionLike  = "like"
+	actionReact = "react"
+)
+
+var (
+	errInvalidPayload  = errors.New("invalid payload")
+	errPictureNotFound = errors.New("picture not found")
+)
+
+// PictureAction is the payload of a like message.
+type PictureAction struct {
+	ID string `json:"id"`
+}
+
+// ReactPayload is the payload of a react message from a client and of the
+// reaction broadcast that results from it.
+type ReactPayload struct {
+	ID    string `json:"id"`
+	Emoji string `json:"emoji"`
+}
+
+func init() {
+	inboundHandlers[actionLike] = inboundHandler{minRole: RoleViewer, writes: true, fn: handleLikeAction}
+	inboundHandlers[actionReact] = inboundHandler{minRole: RoleViewer, writes: true, fn: handleReactAction}
+}
+
+// eventPicture returns the picture with the given ID if it belongs to
+// event. Pictures of other events and hidden pictures are reported as not
+// found.
+func eventPicture(id, event string) (*Picture, error) {
+	if id == "" {
+		return nil, errInvalidPayload
+	}
+	pic, err := db.GetPicture(id)
+	if err != nil || pic.EventID != event || pic.Hidden {
+		return nil, errPictureNotFound
+	}
+	return pic, nil
+}
+
+// handleLikeAction likes a picture of the client's event, like
+// POST /api/pictures/{id}/like. The new count reaches every client in the
+// next coalesced likes message.
+func handleLikeAction(c *client, payload json.RawMessage) error {
+	var action PictureAction
+	if err := json.Unmarshal(payload, &action); err != nil {
+		return errInvalidPayload
+	}
+	if _, err := eventPicture(action.ID, c.event); err != nil {
+		return err
+	}
+	if _, closed := likesClosedAt(c.event, time.Now()); closed {
+		return errLikesClosed
+	}
+	_, err := likePicture(c.device, action.ID)
+	var limited *rateLimitedError
+	if err != nil && !errors.As(err, &limited) && !errors.Is(err, errAlreadyLiked) && !errors.Is(err, errBanned) {
+		return errPictureNotFound
+	}
+	return err
+}
+
+// handleReactAction counts an emoji reaction to a picture, once per emoji
+// for the client's device or user, and broadcasts it as a transient
+// message.
+func handleReactAction(c *client, payload json.RawMessage) error {
+	var reaction ReactPayload
+	if err := json.Unmarshal(payload, &reaction); err != nil || !validReaction(reaction.Emoji) {
+		return errInvalidPayload
+	}
+	if _, err := eventPicture(reaction.ID, c.event); err != nil {
+		return err
+	}
+	if c.reactor != "" {
+		if _, err := db.AddReaction(reaction.ID, c.reactor, reaction.Emoji, time.Now()); err != nil {
+			logError("add reaction failed: %v", err)
+		}
+	}
+	hub.publishTransient(c.event, msgReaction, &reaction)
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The activity feed is the wall's live ticker: new pictures, likes
+// reaching a milestone and comments, newest first. Entries are recorded in
+// SQLite as they happen and broadcast as activity messages; the feed leaves
+// out those of pictures hidden since and of deleted comments.
+
+const (
+	activityUpload    = "upload"
+	activityMilestone = "milestone"
+	activityComment   = "comment"
+
+	// defaultActivityItems and maxActivityItems bound a page of the feed
+	defaultActivityItems = 20
+	maxActivityItems     = 100
+)
+
+// Activity is an entry of the activity feed.
+type Activity struct {
+	ID      int64  `json:"id"`
+	Kind    string `json:"kind"`
+	EventID string `json:"eventId"`
+	// PictureID is the picture uploaded, liked or commented on; URL and
+	// Blurhash are its image, for a thumbnail
+	PictureID  string `json:"pictureId"`
+	URL        string `json:"url"`
+	Blurhash   string `json:"blurhash,omitempty"`
+	UploadedBy string `json:"uploadedBy,omitempty"`
+	Caption    string `json:"caption,omitempty"`
+	// Likes is the milestone reached
+	Likes int `json:"likes,omitempty"`
+	// CommentID and Text are the comment's
+	CommentID int64     `json:"commentId,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ActivityPage is a page of the activity feed.
+type ActivityPage struct {
+	Items []*Activity `json:"items"`
+	// Next is the before value of the next page; omitted on the last one
+	Next int64 `json:"next,omitempty"`
+}
+
+// newActivity returns an entry of kind about pic.
+func newActivity(kind string, pic *Picture) *Activity {
+	return &Activity{
+		Kind:       kind,
+		EventID:    pic.EventID,
+		PictureID:  pic.ID,
+		URL:        pic.URL,
+		Blurhash:   pic.Blurhash,
+		UploadedBy: pic.UploadedBy,
+		Caption:    pic.Caption,
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+// recordActivity stores an entry and broadcasts it, unless it was already
+// recorded, and reports whether it did. Failures are logged; they don't
+// fail what happened.
+func recordActivity(a *Activity) bool {
+	added, err := db.AddActivity(a)
+	if err != nil {
+		logWarn("record %s activity of %s: %v", a.Kind, a.PictureID, err)
+		return false
+	}
+	if added {
+		hub.publishActivity(a)
+	}
+	return added
+}
+
+// recordUpload records a picture put on the wall.
+func recordUpload(pic *Picture) {
+	recordActivity(newActivity(activityUpload, pic))
+}
+
+// recordComment records a comment published on pic.
+func recordComment(c *Comment, pic *Picture) {
+	a := newActivity(activityComment, pic)
+	a.CommentID, a.Text = c.ID, c.Text
+	recordActivity(a)
+}
+
+// handleActivity returns a page of the request's event's activity feed,
+// newest first: the entries before ?before=, an entry ID, up to ?limit=.
+func handleActivity(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	var before int64
+	if v := r.URL.Query().Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+		before = n
+	}
+	limit := defaultActivityItems
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxActivityItems)
+	}
+
+	items, err := db.GetActivity(event, before, limit)
+	if err != nil {
+		logError("get activity failed: %v", err)
+		http.Error(w, "Error fetching activity", http.StatusInternalServerError)
+		return
+	}
+	page := &ActivityPage{Items: items}
+	if page.Items == nil {
+		page.Items = []*Activity{}
+	}
+	if len(items) == limit {
+		page.Next = items[len(items)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+)
+
+// Converting a picture again renames it, and stores its image under a new
+// key, which breaks the links guests already shared. The old ID and file
+// key stay behind as an alias in picture_aliases: GET /api/pictures/{id}
+// and /uploads/ answer them with a permanent redirect to the picture under
+// its current ID and file. Aliases of a picture converted again once more
+// move on to its newest ID, and go when it's deleted for good.
+
+// aliasedPicture returns the picture on the public wall an alias points
+// at, or nil if there is none.
+func aliasedPicture(id string, byKey bool) *Picture {
+	var current string
+	var err error
+	if byKey {
+		current, err = db.GetAliasedFilePictureID(id)
+	} else {
+		current, err = db.GetAliasedPictureID(id)
+	}
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logError("resolve picture alias failed: %v", err)
+		}
+		return nil
+	}
+	pic, err := db.GetPicture(current)
+	if err != nil || pic.Hidden {
+		return nil
+	}
+	return pic
+}
+
+// handleGetPicture returns a picture on the public wall, redirecting the
+// old IDs of renamed pictures to their current one.
+func handleGetPicture(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	pic, err := db.GetPicture(id)
+	if err != nil {
+		if aliased := aliasedPicture(id, false); aliased != nil {
+			target := &url.URL{Path: "/api/pictures/" + aliased.ID, RawQuery: r.URL.RawQuery}
+			http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+			return
+		}
+	}
+	if err != nil || pic.Hidden {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pic)
+}
+
+// redirectAliasedFile redirects a request for a file that was stored under
+// key before its picture was renamed to the picture's current image, and
+// reports whether it did.
+func redirectAliasedFile(w http.ResponseWriter, r *http.Request, key string) bool {
+	pic := aliasedPicture(key, true)
+	if pic == nil {
+		return false
+	}
+	http.Redirect(w, r, pic.URL, http.StatusMovedPermanently)
+	return true
+}
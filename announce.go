@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Announcement priorities. A high-priority announcement takes over the
+// presentation; a normal one is shown as a banner over the slideshow.
+const (
+	priorityNormal = "normal"
+	priorityHigh   = "high"
+)
+
+const (
+	defaultAnnouncementDuration = time.Minute
+	maxAnnouncementDuration     = time.Hour
+	maxAnnouncementLength       = 280
+)
+
+// Announcement is a timed text overlay shown on an event's presentation
+// displays until ExpiresAt.
+type Announcement struct {
+	ID       int64  `json:"id"`
+	EventID  string `json:"eventId"`
+	Message  string `json:"message"`
+	Priority string `json:"priority"`
+	// DisplayID, if set, is the only display the announcement is shown on.
+	DisplayID string    `json:"displayId,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// AnnounceRequest is the body of POST /api/admin/announce. Duration is in
+// seconds; zero means defaultAnnouncementDuration. Display, if set,
+// addresses the announcement to one display of the event.
+type AnnounceRequest struct {
+	Message  string `json:"message"`
+	Priority string `json:"priority"`
+	Duration int    `json:"duration"`
+	Display  string `json:"display"`
+}
+
+// handleAnnounce stores an announcement for the request's event and
+// broadcasts it to the event's clients. Displays that connect before it
+// expires receive it in their snapshot.
+func handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	var req AnnounceRequest
+	event, ok := decodeEventRequest(w, r, &req, 4<<10)
+	if !ok {
+		return
+	}
+	message := strings.TrimSpace(req.Message)
+	if message == "" || utf8.RuneCountInString(message) > maxAnnouncementLength {
+		http.Error(w, fmt.Sprintf("Message must be 1-%d characters", maxAnnouncementLength), http.StatusBadRequest)
+		return
+	}
+	priority := req.Priority
+	if priority == "" {
+		priority = priorityNormal
+	}
+	if priority != priorityNormal && priority != priorityHigh {
+		http.Error(w, "Invalid priority", http.StatusBadRequest)
+		return
+	}
+	duration := defaultAnnouncementDuration
+	if req.Duration != 0 {
+		duration = time.Duration(req.Duration) * time.Second
+		if duration < 0 || duration > maxAnnouncementDuration {
+			http.Error(w, fmt.Sprintf("Duration must be 1-%d seconds", int(maxAnnouncementDuration.Seconds())), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Display != "" {
+		if _, err := eventDisplay(req.Display, event); err != nil {
+			if !errors.Is(err, errUnknownDisplay) {
+				logError("get display failed: %v", err)
+			}
+			http.Error(w, "Unknown display", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	a := &Announcement{
+		EventID:   event,
+		Message:   message,
+		Priority:  priority,
+		DisplayID: req.Display,
+		CreatedAt: now,
+		ExpiresAt: now.Add(duration),
+	}
+	if err := db.AddAnnouncement(a); err != nil {
+		logError("add announcement failed: %v", err)
+		http.Error(w, "Error saving announcement", http.StatusInternalServerError)
+		return
+	}
+	hub.publishAnnouncement(a)
+
+	logInfo("announcement %d for event %s (priority=%s, expires=%s)", a.ID, event, priority, a.ExpiresAt.Format(time.RFC3339))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
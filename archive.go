@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// With KEEP_ORIGINALS the originals of uploads stay in the original store
+// after their conversion, recorded on their picture, instead of being
+// deleted. With ARCHIVE_BUCKET as well, the archiver ships those of
+// pictures older than ARCHIVE_AFTER hours to the bucket in
+// ARCHIVE_STORAGE_CLASS, such as GLACIER, records the object's s3://
+// location on the picture and deletes the local copy, so the venue
+// machine's disk only holds the originals of the last hours.
+var (
+	keepOriginals bool
+	archiveAfter  time.Duration
+	archive       *originalArchive
+
+	archivedOriginals     atomic.Uint64
+	archivedOriginalBytes atomic.Uint64
+	archiveFailures       atomic.Uint64
+)
+
+const (
+	// archiveCheckInterval is how often the archiver looks for originals
+	// due for archiving
+	archiveCheckInterval = 10 * time.Minute
+	// archiveBatch is how many originals are looked up at a time
+	archiveBatch = 100
+)
+
+// archiveStorageClasses are the S3 storage classes originals can be
+// archived in.
+var archiveStorageClasses = map[string]bool{
+	"STANDARD":            true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"INTELLIGENT_TIERING": true,
+	"GLACIER_IR":          true,
+	"GLACIER":             true,
+	"DEEP_ARCHIVE":        true,
+}
+
+// originalArchive is the bucket kept originals are archived to.
+type originalArchive struct {
+	client       *minio.Client
+	bucket       string
+	prefix       string
+	storageClass string
+}
+
+// setupArchive connects to ARCHIVE_BUCKET, if set.
+func setupArchive(cfg *Config) error {
+	if cfg.ArchiveBucket == "" {
+		return nil
+	}
+	client, err := newS3Client(cfg)
+	if err != nil {
+		return err
+	}
+	archive = &originalArchive{
+		client:       client,
+		bucket:       cfg.ArchiveBucket,
+		prefix:       cfg.ArchivePrefix,
+		storageClass: cfg.ArchiveStorageClass,
+	}
+	return nil
+}
+
+// location is the URL recorded for the archived original under key.
+func (a *originalArchive) location(key string) string {
+	return "s3://" + a.bucket + "/" + a.prefix + key
+}
+
+// put uploads a kept original to the bucket, records its location and
+// deletes the local copy.
+func (a *originalArchive) put(ctx context.Context, o *KeptOriginal) error {
+	f, err := originalStore.Get(ctx, o.Key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size := int64(-1)
+	if info, err := originalStore.Stat(ctx, o.Key); err == nil {
+		size = info.Size
+	}
+	if _, err := a.client.PutObject(ctx, a.bucket, a.prefix+o.Key, f, size, minio.PutObjectOptions{
+		ContentType:  mime.TypeByExtension(filepath.Ext(o.Key)),
+		StorageClass: a.storageClass,
+		PartSize:     s3PartSize,
+	}); err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+	if err := db.SetOriginalLocation(o.Key, a.location(o.Key)); err != nil {
+		return fmt.Errorf("record location: %w", err)
+	}
+	if err := originalStore.Delete(ctx, o.Key); err != nil {
+		logWarn("archive: remove %s: %v", o.Key, err)
+	}
+	archivedOriginals.Add(1)
+	if size > 0 {
+		archivedOriginalBytes.Add(uint64(size))
+	}
+	return nil
+}
+
+// remove deletes the archived original at location, which must be in the
+// bucket.
+func (a *originalArchive) remove(ctx context.Context, location string) error {
+	key, ok := strings.CutPrefix(location, "s3://"+a.bucket+"/")
+	if !ok {
+		return fmt.Errorf("%s is not in s3://%s", location, a.bucket)
+	}
+	return a.client.RemoveObject(ctx, a.bucket, key, minio.RemoveObjectOptions{})
+}
+
+// archiveOriginals archives the kept originals due, until none are left or
+// one fails; the failed ones are tried again on the next run.
+func archiveOriginals(ctx context.Context) (int, error) {
+	cutoff := time.Now().Add(-archiveAfter)
+	n := 0
+	for {
+		originals, err := db.GetOriginalsToArchive(cutoff, archiveBatch)
+		if err != nil {
+			return n, err
+		}
+		for _, o := range originals {
+			err := archive.put(ctx, o)
+			if errors.Is(err, fs.ErrNotExist) {
+				// Nothing left to archive; forget it so it isn't looked
+				// for again
+				logWarn("archive: original %s of picture %s is missing", o.Key, o.PictureID)
+				if err := db.SetPictureOriginal(o.PictureID, ""); err != nil {
+					return n, err
+				}
+				continue
+			}
+			if err != nil {
+				archiveFailures.Add(1)
+				return n, fmt.Errorf("original %s of picture %s: %w", o.Key, o.PictureID, err)
+			}
+			n++
+		}
+		if len(originals) < archiveBatch {
+			return n, nil
+		}
+	}
+}
+
+// runArchiver archives kept originals every archiveCheckInterval until
+// stop is closed, except in read-only mode.
+func runArchiver(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	ticker := time.NewTicker(archiveCheckInterval)
+	defer ticker.Stop()
+	for {
+		if !readOnly.Load() {
+			n, err := archiveOriginals(ctx)
+			if n > 0 {
+				logInfo("archive: shipped %d originals to s3://%s/%s", n, archive.bucket, archive.prefix)
+			}
+			if err != nil && ctx.Err() == nil {
+				logWarn("archive: %v", err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
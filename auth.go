@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Role is the privilege level of a request or WebSocket client. Higher
+// roles include everything lower roles may do. Moderators are only given
+// to user accounts: they may moderate what guests post, deleting
+// pictures to the trash and guestbook messages, ban guests and post
+// announcements, but not change the server.
+type Role int
+
+const (
+	RoleViewer Role = iota
+	RolePresenter
+	RoleModerator
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RolePresenter:
+		return "presenter"
+	case RoleModerator:
+		return "moderator"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return "viewer"
+	}
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "viewer":
+		*r = RoleViewer
+	case "presenter":
+		*r = RolePresenter
+	case "moderator":
+		*r = RoleModerator
+	case "admin":
+		*r = RoleAdmin
+	default:
+		return fmt.Errorf("unknown role %q", text)
+	}
+	return nil
+}
+
+var (
+	adminToken     string
+	presenterToken string
+)
+
+// requestToken returns the bearer token of a request, taken from the
+// Authorization header or, for WebSocket upgrades where browsers can't set
+// headers, the "token" query parameter.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.URL.Query().Get("token")
+}
+
+// tokenMatches compares a presented token with a configured one in constant
+// time. An unset configured token never matches.
+func tokenMatches(presented, configured string) bool {
+	if configured == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(configured)) == 1
+}
+
+// authenticate resolves the role of a request. Requests without a token
+// have the role of their signed-in user, or are anonymous viewers; ok is
+// false if a token was given but isn't valid.
+func authenticate(r *http.Request) (role Role, ok bool) {
+	token := requestToken(r)
+	switch {
+	case token == "" && userFromRequest(r) != nil:
+		return userFromRequest(r).Role, true
+	case token == "":
+		return RoleViewer, true
+	case tokenMatches(token, adminToken):
+		return RoleAdmin, true
+	case tokenMatches(token, presenterToken):
+		return RolePresenter, true
+	default:
+		return RoleViewer, false
+	}
+}
+
+// requireRole wraps an HTTP handler so it only runs for requests
+// authenticated with at least minRole. Anonymous requests get 401,
+// requests whose token or user has a lower role 403.
+func requireRole(minRole Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, ok := authenticate(r)
+		switch {
+		case !ok:
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+		case role < minRole && requestToken(r) == "" && userFromRequest(r) == nil:
+			http.Error(w, "Token required", http.StatusUnauthorized)
+		case role < minRole:
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		default:
+			next(w, r)
+		}
+	}
+}
+
+// requireRoleMiddleware is requireRole for every route of a router, such as
+// the /api/admin subtree.
+func requireRoleMiddleware(minRole Role) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return requireRole(minRole, next.ServeHTTP)
+	}
+}
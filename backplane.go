@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Backplane relays hub broadcasts between app instances, so clients
+// connected to one instance see likes and uploads handled by another.
+type Backplane interface {
+	// Publish sends data to every other instance.
+	Publish(data []byte) error
+	// Subscribe calls handle with everything published by any instance,
+	// including this one, until Close is called.
+	Subscribe(handle func(data []byte))
+	Close() error
+}
+
+// backplaneOutboxSize is the number of messages queued for publishing
+// before new ones are dropped.
+const backplaneOutboxSize = 1024
+
+// Backplane message kinds.
+const (
+	backplaneBroadcast = "broadcast"
+	backplanePresence  = "presence"
+	backplaneRevoke    = "revoke"
+)
+
+// backplaneMessage is the wire format between instances. Origin is the
+// sending hub's epoch, which is unique per process.
+type backplaneMessage struct {
+	Origin string `json:"origin"`
+	Kind   string `json:"kind"`
+
+	// Broadcast fields
+	Event   string `json:"event,omitempty"`
+	Type    string `json:"type,omitempty"`
+	MinRole Role   `json:"minRole"`
+	// Display is also the display to disconnect for a revoke message
+	Display   string          `json:"display,omitempty"`
+	Recipient string          `json:"recipient,omitempty"`
+	Transient bool            `json:"transient,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+
+	// Presence fields: the sender's client count per event
+	Counts map[string]int `json:"counts,omitempty"`
+}
+
+// remotePresence is the latest client count per event reported by another
+// instance.
+type remotePresence struct {
+	counts map[string]int
+	seen   time.Time
+}
+
+// hubBackplane connects a hub to a Backplane. Outgoing messages are
+// queued and published by a single goroutine so publishers never wait on
+// the network.
+type hubBackplane struct {
+	Backplane
+	mu     sync.RWMutex
+	closed bool
+	outbox chan []byte
+	done   chan struct{}
+}
+
+// attachBackplane starts relaying the hub's broadcasts through bp. It must
+// be called before run.
+func (h *Hub) attachBackplane(bp Backplane) {
+	h.backplane = &hubBackplane{
+		Backplane: bp,
+		outbox:    make(chan []byte, backplaneOutboxSize),
+		done:      make(chan struct{}),
+	}
+	go h.backplane.publishLoop()
+	go bp.Subscribe(h.receiveRemote)
+}
+
+// closeBackplane publishes the queued messages and disconnects from the
+// backplane. Later broadcasts stay local.
+func (h *Hub) closeBackplane() {
+	bp := h.backplane
+	if bp == nil {
+		return
+	}
+	bp.mu.Lock()
+	bp.closed = true
+	close(bp.outbox)
+	bp.mu.Unlock()
+	<-bp.done
+	if err := bp.Close(); err != nil {
+		logWarn("close backplane: %v", err)
+	}
+}
+
+func (bp *hubBackplane) publishLoop() {
+	defer close(bp.done)
+	for data := range bp.outbox {
+		if err := bp.Publish(data); err != nil {
+			logWarn("backplane publish failed: %v", err)
+		}
+	}
+}
+
+// send queues msg for publishing, dropping it if the outbox is full.
+func (bp *hubBackplane) send(msg *backplaneMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		logError("marshal backplane message: %v", err)
+		return
+	}
+	bp.mu.RLock()
+	defer bp.mu.RUnlock()
+	if bp.closed {
+		return
+	}
+	select {
+	case bp.outbox <- data:
+	default:
+		logWarn("backplane outbox full, dropped %s message", msg.Kind)
+	}
+}
+
+// forward relays a locally published envelope to the other instances.
+func (h *Hub) forward(env *Envelope) {
+	if h.backplane == nil {
+		return
+	}
+	payload, err := json.Marshal(env.Payload)
+	if err != nil {
+		logError("marshal backplane payload %s: %v", env.Type, err)
+		return
+	}
+	h.backplane.send(&backplaneMessage{
+		Origin:    h.epoch,
+		Kind:      backplaneBroadcast,
+		Event:     env.event,
+		Type:      env.Type,
+		MinRole:   env.minRole,
+		Display:   env.display,
+		Recipient: env.recipient,
+		Transient: env.transient,
+		Payload:   payload,
+	})
+}
+
+// forwardPresence reports this instance's client counts to the others.
+func (h *Hub) forwardPresence(counts map[string]int) {
+	if h.backplane == nil {
+		return
+	}
+	h.backplane.send(&backplaneMessage{Origin: h.epoch, Kind: backplanePresence, Counts: counts})
+}
+
+// forwardRevoke tells the other instances to disconnect a revoked display.
+func (h *Hub) forwardRevoke(display string) {
+	if h.backplane == nil {
+		return
+	}
+	h.backplane.send(&backplaneMessage{Origin: h.epoch, Kind: backplaneRevoke, Display: display})
+}
+
+// receiveRemote handles a message from the backplane. The hub's own
+// messages come back too and are ignored; they were delivered locally when
+// published.
+func (h *Hub) receiveRemote(data []byte) {
+	var msg backplaneMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		logWarn("malformed backplane message: %v", err)
+		return
+	}
+	if msg.Origin == h.epoch {
+		return
+	}
+	switch msg.Kind {
+	case backplaneBroadcast:
+		if !eventIDPattern.MatchString(msg.Event) {
+			logWarn("backplane message for invalid event %q", msg.Event)
+			return
+		}
+		env := &Envelope{
+			Type:      msg.Type,
+			Payload:   msg.Payload,
+			event:     msg.Event,
+			minRole:   msg.MinRole,
+			display:   msg.Display,
+			recipient: msg.Recipient,
+			transient: msg.Transient,
+			queuedAt:  time.Now(),
+		}
+		switch msg.Type {
+		case msgLikes, msgPictureAdded, msgPictureUpdated, msgPictureHidden, msgPictureShown:
+			// Written to the shared database by the other instance
+			db.PicturesChanged()
+		}
+		if msg.Type == msgLikes {
+			var likes LikesPayload
+			if err := json.Unmarshal(msg.Payload, &likes); err == nil {
+				h.rankLikes(env, likes.Likes)
+			}
+		}
+		h.broadcast <- env
+	case backplanePresence:
+		h.mu.Lock()
+		h.remotePresence[msg.Origin] = remotePresence{counts: msg.Counts, seen: time.Now()}
+		h.mu.Unlock()
+	case backplaneRevoke:
+		h.closeDisplay(msg.Display)
+	}
+}
+
+// remoteWatching returns the number of clients other instances reported
+// for event, forgetting instances that stopped reporting. Callers must hold
+// h.mu.
+func (h *Hub) remoteWatching(event string) int {
+	n := 0
+	for origin, p := range h.remotePresence {
+		if time.Since(p.seen) > 3*presenceInterval {
+			delete(h.remotePresence, origin)
+			continue
+		}
+		n += p.counts[event]
+	}
+	return n
+}
+
+// redisBackplane is a Backplane over a Redis pub/sub channel.
+type redisBackplane struct {
+	client  *redis.Client
+	pubsub  *redis.PubSub
+	channel string
+}
+
+// newRedisBackplane connects to the Redis server at url
+// (redis://[user:password@]host:port/db).
+func newRedisBackplane(url, channel string) (*redisBackplane, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parse REDIS_URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connect to redis: %w", err)
+	}
+	return &redisBackplane{
+		client:  client,
+		pubsub:  client.Subscribe(context.Background(), channel),
+		channel: channel,
+	}, nil
+}
+
+func (b *redisBackplane) Publish(data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return b.client.Publish(ctx, b.channel, data).Err()
+}
+
+func (b *redisBackplane) Subscribe(handle func(data []byte)) {
+	// The channel reconnects on its own and is closed by Close
+	for msg := range b.pubsub.Channel() {
+		handle([]byte(msg.Payload))
+	}
+}
+
+func (b *redisBackplane) Close() error {
+	b.pubsub.Close()
+	return b.client.Close()
+}
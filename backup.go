@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// With BACKUP_BUCKET or BACKUP_RCLONE set, the server backs up the database
+// and the image files offsite every BACKUP_INTERVAL seconds. Files are
+// stored once, under objects/ named after their SHA-256, so each backup
+// only uploads the files that are new or changed since the last one; a
+// backup is a snapshot of the database and a manifest of the files it
+// needs, written last, so that a backup stopped halfway doesn't count. The
+// last BACKUP_KEEP backups are kept, and the objects none of them needs
+// are deleted.
+//
+// On the remote, under BACKUP_PREFIX or the rclone path:
+//
+//	objects/ab/ab12….         file contents, by SHA-256
+//	20240115T103000Z/picsapp.db
+//	20240115T103000Z/manifest.json
+var (
+	backups *backupScheduler
+
+	backupRuns          atomic.Uint64
+	backupFailures      atomic.Uint64
+	backupUploadedBytes atomic.Uint64
+	backupLastSuccess   atomic.Int64
+)
+
+// backupIDFormat names backups after the time they started, so that they
+// sort in order.
+const backupIDFormat = "20060102T150405Z"
+
+// backupRemote is where backups are uploaded: a bucket or an rclone
+// remote. Keys are slash-separated paths.
+type backupRemote interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns the keys under prefix, recursively
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, key string) error
+	String() string
+}
+
+// BackupManifest lists the files of a backup.
+type BackupManifest struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Database is the key of the database snapshot
+	Database string       `json:"database"`
+	Files    []BackupFile `json:"files"`
+}
+
+// BackupFile is a file of a backup, stored as objects/{sha256[:2]}/{sha256}.
+type BackupFile struct {
+	// Area is the store of the file: original, uploads or projector
+	Area    string    `json:"area"`
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256"`
+}
+
+// BackupRun describes a backup run.
+type BackupRun struct {
+	ID         string    `json:"id"`
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+	// Files is the number of files in the backup, UploadedFiles those that
+	// weren't on the remote yet
+	Files         int   `json:"files"`
+	UploadedFiles int   `json:"uploadedFiles"`
+	UploadedBytes int64 `json:"uploadedBytes"`
+	DatabaseBytes int64 `json:"databaseBytes"`
+	// Pruned backups were older than the last BACKUP_KEEP, and pruned
+	// objects no longer needed by any backup
+	PrunedBackups int    `json:"prunedBackups"`
+	PrunedObjects int    `json:"prunedObjects"`
+	Error         string `json:"error,omitempty"`
+}
+
+// BackupStatus is the state of the backup scheduler.
+type BackupStatus struct {
+	Enabled         bool       `json:"enabled"`
+	Remote          string     `json:"remote,omitempty"`
+	IntervalSeconds int        `json:"intervalSeconds,omitempty"`
+	Keep            int        `json:"keep,omitempty"`
+	Running         bool       `json:"running"`
+	NextAt          *time.Time `json:"nextAt,omitempty"`
+	LastRun         *BackupRun `json:"lastRun,omitempty"`
+	LastSuccess     *BackupRun `json:"lastSuccess,omitempty"`
+	// Backups are the IDs of the backups on the remote, oldest first
+	Backups []string `json:"backups"`
+}
+
+// backupScheduler backs up to a remote every interval.
+type backupScheduler struct {
+	remote   backupRemote
+	interval time.Duration
+	keep     int
+
+	mu     sync.Mutex
+	status BackupStatus
+	// last is the manifest of the last backup, whose hashes are reused for
+	// the files that haven't changed
+	last *BackupManifest
+}
+
+// setupBackups connects to BACKUP_BUCKET or BACKUP_RCLONE, if set.
+func setupBackups(cfg *Config) error {
+	var remote backupRemote
+	switch {
+	case cfg.BackupBucket != "":
+		client, err := newS3Client(cfg)
+		if err != nil {
+			return err
+		}
+		remote = &s3BackupRemote{client: client, bucket: cfg.BackupBucket, prefix: cfg.BackupPrefix}
+	case cfg.BackupRclone != "":
+		remote = &rcloneBackupRemote{path: cfg.RclonePath, remote: strings.TrimSuffix(cfg.BackupRclone, "/") + "/"}
+	default:
+		return nil
+	}
+	backups = &backupScheduler{
+		remote:   remote,
+		interval: time.Duration(cfg.BackupInterval) * time.Second,
+		keep:     cfg.BackupKeep,
+		status: BackupStatus{
+			Enabled:         true,
+			Remote:          remote.String(),
+			IntervalSeconds: cfg.BackupInterval,
+			Keep:            cfg.BackupKeep,
+			Backups:         []string{},
+		},
+	}
+	return nil
+}
+
+// objectKey is the key of the object holding the contents with sum.
+func objectKey(sum string) string {
+	return "objects/" + sum[:2] + "/" + sum
+}
+
+// listBackups returns the IDs of the backups on the remote, oldest first.
+func (b *backupScheduler) listBackups(ctx context.Context) ([]string, error) {
+	keys, err := b.remote.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, key := range keys {
+		id, ok := strings.CutSuffix(key, "/manifest.json")
+		if !ok || strings.Contains(id, "/") {
+			continue
+		}
+		if _, err := time.Parse(backupIDFormat, id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// manifest reads the manifest of backup id.
+func (b *backupScheduler) manifest(ctx context.Context, id string) (*BackupManifest, error) {
+	r, err := b.remote.Get(ctx, id+"/manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var m BackupManifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("manifest of backup %s: %w", id, err)
+	}
+	return &m, nil
+}
+
+// backupSource is a file to back up.
+type backupSource struct {
+	area  string
+	store Storage
+	key   string
+}
+
+// backupSources returns the files of every picture, kept original and
+// pending conversion, as migrateStorage copies them.
+func backupSources() ([]backupSource, error) {
+	var sources []backupSource
+	seen := map[string]bool{}
+	add := func(area string, store Storage, key string) {
+		if !seen[area+"/"+key] {
+			seen[area+"/"+key] = true
+			sources = append(sources, backupSource{area, store, key})
+		}
+	}
+	pictures, err := db.LoadAllPictures()
+	if err != nil {
+		return nil, err
+	}
+	for _, pic := range pictures {
+		add("uploads", uploadStore, pic.FileKey)
+		if pic.ProjectorURL != "" {
+			add("projector", projectorStore, pic.FileKey)
+		}
+	}
+	originals, err := db.GetKeptOriginals()
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range originals {
+		if o.Location == "" {
+			add("original", originalStore, o.Key)
+		}
+	}
+	tasks, err := db.GetActiveConversionTasks()
+	if err != nil {
+		return nil, err
+	}
+	for _, task := range tasks {
+		if store, key, err := storedAt(task.OriginalPath); err == nil && store == originalStore {
+			add("original", originalStore, key)
+		}
+	}
+	return sources, nil
+}
+
+// run makes a backup and prunes the old ones.
+func (b *backupScheduler) run(ctx context.Context) *BackupRun {
+	run := &BackupRun{StartedAt: time.Now()}
+	run.ID = run.StartedAt.UTC().Format(backupIDFormat)
+	b.mu.Lock()
+	b.status.Running = true
+	b.mu.Unlock()
+
+	ids, err := b.backup(ctx, run)
+	if err == nil {
+		ids, err = b.prune(ctx, run, ids)
+	}
+	run.DurationMs = time.Since(run.StartedAt).Milliseconds()
+	backupRuns.Add(1)
+	backupUploadedBytes.Add(uint64(run.UploadedBytes))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status.Running = false
+	b.status.LastRun = run
+	if err != nil {
+		run.Error = err.Error()
+		backupFailures.Add(1)
+		return run
+	}
+	b.status.LastSuccess = run
+	b.status.Backups = ids
+	backupLastSuccess.Store(run.StartedAt.Unix())
+	return run
+}
+
+// backup uploads the files not on the remote yet, the database snapshot
+// and the manifest of backup run.ID, and returns the IDs of the backups
+// on the remote.
+func (b *backupScheduler) backup(ctx context.Context, run *BackupRun) ([]string, error) {
+	ids, err := b.listBackups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list backups: %w", err)
+	}
+	if b.last == nil && len(ids) > 0 {
+		if b.last, err = b.manifest(ctx, ids[len(ids)-1]); err != nil {
+			// Every file is hashed again
+			logWarn("backup: %v", err)
+		}
+	}
+	last := map[string]BackupFile{}
+	if b.last != nil {
+		for _, f := range b.last.Files {
+			last[f.Area+"/"+f.Key] = f
+		}
+	}
+	objects, err := b.remote.List(ctx, "objects/")
+	if err != nil {
+		return nil, fmt.Errorf("list objects: %w", err)
+	}
+	stored := make(map[string]bool, len(objects))
+	for _, key := range objects {
+		stored[filepath.Base(key)] = true
+	}
+
+	sources, err := backupSources()
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BackupManifest{ID: run.ID, CreatedAt: run.StartedAt, Database: run.ID + "/picsapp.db", Files: []BackupFile{}}
+	for _, src := range sources {
+		info, err := src.store.Stat(ctx, src.key)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Reported by the garbage collector
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s/%s: %w", src.area, src.key, err)
+		}
+		f := BackupFile{Area: src.area, Key: src.key, Size: info.Size, ModTime: info.ModTime.UTC()}
+		if prev, ok := last[src.area+"/"+src.key]; ok && prev.Size == f.Size && prev.ModTime.Equal(f.ModTime) {
+			f.SHA256 = prev.SHA256
+		}
+		if f.SHA256 == "" || !stored[f.SHA256] {
+			if f.SHA256, err = b.upload(ctx, src, stored); err != nil {
+				return nil, fmt.Errorf("%s/%s: %w", src.area, src.key, err)
+			}
+			run.UploadedFiles++
+			run.UploadedBytes += f.Size
+		}
+		manifest.Files = append(manifest.Files, f)
+	}
+	run.Files = len(manifest.Files)
+
+	if run.DatabaseBytes, err = b.uploadDatabase(ctx, manifest.Database); err != nil {
+		return nil, fmt.Errorf("database: %w", err)
+	}
+	run.UploadedBytes += run.DatabaseBytes
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.remote.Put(ctx, run.ID+"/manifest.json", bytes.NewReader(data), int64(len(data))); err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	b.last = manifest
+	return append(ids, run.ID), nil
+}
+
+// upload hashes a file and uploads it unless an object has its contents
+// already, returning its SHA-256.
+func (b *backupScheduler) upload(ctx context.Context, src backupSource, stored map[string]bool) (string, error) {
+	f, err := src.store.Get(ctx, src.key)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if stored[sum] {
+		return sum, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if err := b.remote.Put(ctx, objectKey(sum), f, size); err != nil {
+		return "", err
+	}
+	stored[sum] = true
+	return sum, nil
+}
+
+// uploadDatabase uploads a snapshot of the database under key and returns
+// its size.
+func (b *backupScheduler) uploadDatabase(ctx context.Context, key string) (int64, error) {
+	dir, err := os.MkdirTemp("", "picsapp-backup-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "picsapp.db")
+	if err := db.Snapshot(path); err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), b.remote.Put(ctx, key, f, info.Size())
+}
+
+// prune deletes the backups before the last b.keep from ids, then the
+// objects the remaining backups don't need, and returns the IDs of the
+// remaining backups.
+func (b *backupScheduler) prune(ctx context.Context, run *BackupRun, ids []string) ([]string, error) {
+	for len(ids) > b.keep {
+		id := ids[0]
+		// The manifest first, so that a backup is never left without
+		// its database
+		for _, key := range []string{id + "/manifest.json", id + "/picsapp.db"} {
+			if err := b.remote.Delete(ctx, key); err != nil {
+				return nil, fmt.Errorf("delete backup %s: %w", id, err)
+			}
+		}
+		run.PrunedBackups++
+		ids = ids[1:]
+	}
+	if run.PrunedBackups == 0 {
+		return ids, nil
+	}
+
+	needed := map[string]bool{}
+	for _, id := range ids {
+		m := b.last
+		if id != m.ID {
+			var err error
+			if m, err = b.manifest(ctx, id); err != nil {
+				return nil, err
+			}
+		}
+		for _, f := range m.Files {
+			needed[f.SHA256] = true
+		}
+	}
+	objects, err := b.remote.List(ctx, "objects/")
+	if err != nil {
+		return nil, fmt.Errorf("list objects: %w", err)
+	}
+	for _, key := range objects {
+		if needed[filepath.Base(key)] {
+			continue
+		}
+		if err := b.remote.Delete(ctx, key); err != nil {
+			return nil, fmt.Errorf("delete %s: %w", key, err)
+		}
+		run.PrunedObjects++
+	}
+	return ids, nil
+}
+
+// runBackups backs up every interval until stop is closed. The first
+// backup is made once the last one on the remote is interval old.
+func runBackups(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	b := backups
+	next := time.Now()
+	if ids, err := b.listBackups(ctx); err != nil {
+		logWarn("backup: list backups on %s: %v", b.remote, err)
+	} else if len(ids) > 0 {
+		last, _ := time.Parse(backupIDFormat, ids[len(ids)-1])
+		next = last.Add(b.interval)
+		b.mu.Lock()
+		b.status.Backups = ids
+		b.mu.Unlock()
+	}
+	for {
+		b.mu.Lock()
+		b.status.NextAt = &next
+		b.mu.Unlock()
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+		run := b.run(ctx)
+		if run.Error != "" {
+			if ctx.Err() == nil {
+				logError("backup %s to %s failed: %s", run.ID, b.remote, run.Error)
+			}
+		} else {
+			logInfo("backup %s to %s: %d files, %d uploaded (%.1f MB with the database), %d old backups pruned",
+				run.ID, b.remote, run.Files, run.UploadedFiles, float64(run.UploadedBytes)/(1<<20), run.PrunedBackups)
+		}
+		next = time.Now().Add(b.interval)
+	}
+}
+
+// handleBackupStatus returns the state of the backups.
+func handleBackupStatus(w http.ResponseWriter, r *http.Request) {
+	status := BackupStatus{Backups: []string{}}
+	if backups != nil {
+		backups.mu.Lock()
+		status = backups.status
+		backups.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// s3BackupRemote keeps backups under a prefix of a bucket.
+type s3BackupRemote struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func (s *s3BackupRemote) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, s.prefix+key, r, size, minio.PutObjectOptions{PartSize: s3PartSize})
+	return err
+}
+
+func (s *s3BackupRemote) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.prefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject doesn't send the request until the object is read
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *s3BackupRemote) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix + prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		keys = append(keys, strings.TrimPrefix(obj.Key, s.prefix))
+	}
+	return keys, nil
+}
+
+func (s *s3BackupRemote) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, s.prefix+key, minio.RemoveObjectOptions{})
+}
+
+func (s *s3BackupRemote) String() string {
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+// rcloneBackupRemote keeps backups under a path of an rclone remote, such
+// as gdrive:picsapp/, through the rclone command.
+type rcloneBackupRemote struct {
+	path   string
+	remote string
+}
+
+// rclone runs an rclone command with stdin and returns its output.
+func (s *rcloneBackupRemote) rclone(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, s.path, args...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("rclone %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (s *rcloneBackupRemote) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	_, err := s.rclone(ctx, r, "rcat", "--size", fmt.Sprint(size), s.remote+key)
+	return err
+}
+
+func (s *rcloneBackupRemote) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.rclone(ctx, nil, "cat", s.remote+key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(out)), nil
+}
+
+func (s *rcloneBackupRemote) List(ctx context.Context, prefix string) ([]string, error) {
+	out, err := s.rclone(ctx, nil, "lsf", "-R", "--files-only", s.remote+prefix)
+	if err != nil {
+		// A remote path that doesn't exist yet holds no backups
+		if strings.Contains(err.Error(), "directory not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var keys []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line != "" {
+			keys = append(keys, prefix+line)
+		}
+	}
+	return keys, nil
+}
+
+func (s *rcloneBackupRemote) Delete(ctx context.Context, key string) error {
+	_, err := s.rclone(ctx, nil, "deletefile", s.remote+key)
+	return err
+}
+
+func (s *rcloneBackupRemote) String() string {
+	return s.remote
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Moderators ban the IP or device of guests who abuse the wall, for good or
+// for a number of hours; banned guests get 403 when they upload, like or
+// comment, and can still watch. With AUTO_BAN_REJECTIONS or
+// AUTO_BAN_REPORTS, a device is also banned for AUTO_BAN_HOURS once that
+// many of its uploads were rejected, or other devices reported its
+// pictures that many times. Bans live in the database, so every instance
+// enforces them.
+const (
+	banIP     = "ip"
+	banDevice = "device"
+
+	// maxBanReasonLength bounds the note kept with a ban
+	maxBanReasonLength = 200
+)
+
+var (
+	autoBanRejections reloadable[int]
+	autoBanReports    reloadable[int]
+	autoBanHours      reloadable[int]
+
+	bannedRequests atomic.Uint64
+	autoBans       atomic.Uint64
+
+	deviceIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	errBanned = errors.New("banned")
+)
+
+// Ban is a banned IP or device.
+type Ban struct {
+	ID        int64     `json:"id"`
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	// CreatedBy is the moderator's username, "admin token" or "auto"
+	CreatedBy string `json:"createdBy"`
+	// ExpiresAt is nil for a ban that lasts until it is lifted
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// BanRequest is the body of POST /api/admin/bans. It names the IP or
+// device to ban, or a picture or comment whose device to ban.
+type BanRequest struct {
+	Kind      string `json:"kind"`
+	Value     string `json:"value"`
+	PictureID string `json:"pictureId"`
+	CommentID int64  `json:"commentId"`
+	Reason    string `json:"reason"`
+	// Hours is 0 for a ban until it is lifted
+	Hours int `json:"hours"`
+}
+
+// banned reports whether a device or its IP is banned. Errors are logged
+// and let the request through, so that a database hiccup doesn't lock
+// every guest out.
+func banned(d requestDevice) bool {
+	ok, err := db.IsBanned(d.ip, d.id, time.Now())
+	if err != nil {
+		logError("check ban failed: %v", err)
+		return false
+	}
+	if ok {
+		bannedRequests.Add(1)
+	}
+	return ok
+}
+
+// refuseBanned answers a request from a banned device or IP.
+func refuseBanned(w http.ResponseWriter) {
+	http.Error(w, "You are banned from posting", http.StatusForbidden)
+}
+
+// checkAutoBan bans a device whose uploads reached AUTO_BAN_REJECTIONS
+// rejections or AUTO_BAN_REPORTS reports, after one was rejected or
+// reported.
+func checkAutoBan(deviceID string) {
+	maxRejected, maxReported := autoBanRejections.Load(), autoBanReports.Load()
+	if deviceID == "" || (maxRejected <= 0 && maxReported <= 0) {
+		return
+	}
+	rejected, reported, err := db.GetDeviceStrikes(deviceID)
+	if err != nil {
+		logError("get device strikes failed: %v", err)
+		return
+	}
+	var reason string
+	switch {
+	case maxRejected > 0 && rejected >= maxRejected:
+		reason = fmt.Sprintf("%d rejected uploads", rejected)
+	case maxReported > 0 && reported >= maxReported:
+		reason = fmt.Sprintf("reported by %d devices", reported)
+	default:
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	ban := &Ban{Kind: banDevice, Value: deviceID, Reason: reason, CreatedAt: now, CreatedBy: "auto"}
+	if hours := autoBanHours.Load(); hours > 0 {
+		expiresAt := now.Add(time.Duration(hours) * time.Hour)
+		ban.ExpiresAt = &expiresAt
+	}
+	added, err := db.AddBan(ban)
+	if err != nil {
+		logError("auto-ban failed: %v", err)
+		return
+	}
+	if added {
+		autoBans.Add(1)
+		logInfo("device %s banned automatically: %s", deviceID, reason)
+	}
+}
+
+// handleListBans lists the bans in force, newest first.
+func handleListBans(w http.ResponseWriter, r *http.Request) {
+	bans, err := db.GetBans(time.Now())
+	if err != nil {
+		logError("get bans failed: %v", err)
+		http.Error(w, "Error fetching bans", http.StatusInternalServerError)
+		return
+	}
+	if bans == nil {
+		bans = []*Ban{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bans)
+}
+
+// handleAddBan bans an IP or device.
+func handleAddBan(w http.ResponseWriter, r *http.Request) {
+	var req BanRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Hours < 0 || len(req.Reason) > maxBanReasonLength {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case req.PictureID != "":
+		pic, err := db.GetPicture(req.PictureID)
+		if err != nil {
+			http.Error(w, "Picture not found", http.StatusNotFound)
+			return
+		}
+		req.Kind, req.Value = banDevice, pic.DeviceID
+	case req.CommentID != 0:
+		comment, err := db.GetComment(req.CommentID)
+		if err != nil {
+			http.Error(w, "Comment not found", http.StatusNotFound)
+			return
+		}
+		req.Kind, req.Value = banDevice, comment.DeviceID
+	}
+	switch req.Kind {
+	case banIP:
+		ip := net.ParseIP(req.Value)
+		if ip == nil {
+			http.Error(w, "Invalid IP address", http.StatusBadRequest)
+			return
+		}
+		req.Value = ip.String()
+	case banDevice:
+		if !deviceIDPattern.MatchString(req.Value) {
+			http.Error(w, "Invalid device, or the picture wasn't uploaded from one", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "kind must be ip or device", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	ban := &Ban{Kind: req.Kind, Value: req.Value, Reason: req.Reason, CreatedAt: now, CreatedBy: moderatorName(r)}
+	if req.Hours > 0 {
+		expiresAt := now.Add(time.Duration(req.Hours) * time.Hour)
+		ban.ExpiresAt = &expiresAt
+	}
+	added, err := db.AddBan(ban)
+	if err != nil {
+		logError("add ban failed: %v", err)
+		http.Error(w, "Error saving ban", http.StatusInternalServerError)
+		return
+	}
+	if !added {
+		http.Error(w, "Already banned", http.StatusConflict)
+		return
+	}
+	logInfo("%s %s banned by %s", ban.Kind, ban.Value, ban.CreatedBy)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ban)
+}
+
+// handleDeleteBan lifts a ban.
+func handleDeleteBan(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ban ID", http.StatusBadRequest)
+		return
+	}
+	if err := db.DeleteBan(id); err == sql.ErrNoRows {
+		http.Error(w, "Ban not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError("delete ban failed: %v", err)
+		http.Error(w, "Error deleting ban", http.StatusInternalServerError)
+		return
+	}
+	logInfo("ban %d lifted by %s", id, moderatorName(r))
+	w.WriteHeader(http.StatusNoContent)
+}
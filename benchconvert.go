@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// picsapp bench-convert is the performance test of the conversion path. It
+// runs convertToWebP, the CPU-bound part of a conversion, on sample images
+// with conversion_workers workers holding decode slots as the server's
+// do, and fails if the median conversion of a 12 MP image takes longer
+// than the target: 800ms on 4 cores with the default image settings.
+// BenchmarkConvertToWebP and TestConvertThroughput run the same
+// measurement under go test.
+
+const (
+	// benchPixels is the size the target is given for: a 12 MP photo,
+	// 4000x3000, as phones take them
+	benchPixels = 4000 * 3000
+
+	defaultBenchTarget = 800 * time.Millisecond
+	// benchCores are the cores the target is given for
+	benchCores = 4
+)
+
+// benchReport is the result of picsapp bench-convert.
+type benchReport struct {
+	Images  int `json:"images"`
+	Workers int `json:"workers"`
+	Cores   int `json:"cores"`
+	// Median and Max are the conversion times of single images, and
+	// MedianPer12MP the median scaled to a 12 MP image
+	Median        time.Duration `json:"medianNs"`
+	Max           time.Duration `json:"maxNs"`
+	MedianPer12MP time.Duration `json:"medianPer12MPNs"`
+	ImagesPerSec  float64       `json:"imagesPerSec"`
+	MPPerSec      float64       `json:"megapixelsPerSec"`
+	Target        time.Duration `json:"targetNs"`
+}
+
+func runBenchConvert(args []string) error {
+	var n, workers int
+	var target time.Duration
+	var asJSON bool
+	logger.SetOutput(os.Stderr)
+	fs := flag.NewFlagSet("picsapp bench-convert", flag.ContinueOnError)
+	fs.IntVar(&n, "n", 16, "images to convert")
+	fs.IntVar(&workers, "workers", 0, "images converted at once (default: conversion_workers)")
+	fs.DurationVar(&target, "target", defaultBenchTarget, "fail if the median conversion of a 12 MP image takes longer (0: report only)")
+	fs.BoolVar(&asJSON, "json", false, "print JSON")
+	cfg, _, _, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	applyConfig(cfg)
+	if n < 1 {
+		return fmt.Errorf("-n must be at least 1")
+	}
+	if workers == 0 {
+		workers = cfg.ConversionWorkers
+	}
+	if workers < 1 {
+		return fmt.Errorf("-workers must be at least 1")
+	}
+
+	// The files given, or a generated 12 MP JPEG
+	var samples [][]byte
+	for _, name := range fs.Args() {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		samples = append(samples, data)
+	}
+	if len(samples) == 0 {
+		data, err := benchSample()
+		if err != nil {
+			return err
+		}
+		samples = append(samples, data)
+	}
+	pixels := make([]int, len(samples))
+	for i, data := range samples {
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("%s: %w", fs.Arg(i), err)
+		}
+		pixels[i] = config.Width * config.Height
+	}
+
+	report, err := benchConvert(samples, pixels, n, workers)
+	if err != nil {
+		return err
+	}
+	report.Target = target
+	if asJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			return err
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "images\t%d\n", report.Images)
+		fmt.Fprintf(tw, "workers\t%d (decode slots: %d)\n", report.Workers, cfg.MaxConcurrentDecodes)
+		fmt.Fprintf(tw, "cores\t%d\n", report.Cores)
+		fmt.Fprintf(tw, "median\t%s (%s per 12 MP)\n", report.Median.Round(time.Millisecond), report.MedianPer12MP.Round(time.Millisecond))
+		fmt.Fprintf(tw, "max\t%s\n", report.Max.Round(time.Millisecond))
+		fmt.Fprintf(tw, "throughput\t%.2f images/s, %.1f MP/s\n", report.ImagesPerSec, report.MPPerSec)
+		tw.Flush()
+	}
+	if target > 0 && report.MedianPer12MP > target {
+		return fmt.Errorf("median conversion of %s per 12 MP image is over the %s target", report.MedianPer12MP.Round(time.Millisecond), target)
+	}
+	return nil
+}
+
+// benchConvert converts n of samples, whose sizes in pixels are pixels, in
+// turn with workers workers holding decode slots, after one warm-up
+// conversion, and reports the times.
+func benchConvert(samples [][]byte, pixels []int, n, workers int) (*benchReport, error) {
+	// Warm up, so the first conversions don't pay for the allocator
+	if _, err := convertToWebP(samples[0]); err != nil {
+		return nil, err
+	}
+
+	times := make([]time.Duration, n)
+	scaled := make([]time.Duration, n)
+	totalPixels := 0
+	for i := 0; i < n; i++ {
+		totalPixels += pixels[i%len(samples)]
+	}
+	jobs := make(chan int)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				decodeSlots.acquire()
+				began := time.Now()
+				_, err := convertToWebP(samples[i%len(samples)])
+				times[i] = time.Since(began)
+				decodeSlots.release()
+				if err != nil {
+					errs <- err
+					return
+				}
+				scaled[i] = times[i] * benchPixels / time.Duration(pixels[i%len(samples)])
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	elapsed := time.Since(start)
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	sort.Slice(scaled, func(i, j int) bool { return scaled[i] < scaled[j] })
+	report := &benchReport{
+		Images:        n,
+		Workers:       workers,
+		Cores:         runtime.GOMAXPROCS(0),
+		Median:        times[n/2],
+		Max:           times[n-1],
+		MedianPer12MP: scaled[n/2],
+		ImagesPerSec:  float64(n) / elapsed.Seconds(),
+		MPPerSec:      float64(totalPixels) / 1e6 / elapsed.Seconds(),
+	}
+	return report, nil
+}
+
+// benchSample generates a 12 MP JPEG with gradients and noise, which
+// compresses about as well as a photo.
+func benchSample() ([]byte, error) {
+	const width, height = 4000, 3000
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	rng := rand.New(rand.NewSource(1))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			noise := rng.Intn(16)
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(x*255/width/2 + noise),
+				G: uint8(y*255/height/2 + noise),
+				B: uint8((x+y)*255/(width+height)/2 + noise),
+				A: 255,
+			})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// benchSampleOnce generates the 12 MP sample once for all runs of the
+// benchmark, which go test calls again with larger b.N.
+var benchSampleOnce = sync.OnceValues(benchSample)
+
+// benchSetup applies the default image settings and returns the sample.
+func benchSetup(tb testing.TB) []byte {
+	tb.Helper()
+	applyConfig(defaultConfig())
+	sample, err := benchSampleOnce()
+	if err != nil {
+		tb.Fatalf("generate sample: %v", err)
+	}
+	return sample
+}
+
+// BenchmarkConvertToWebP converts a 12 MP JPEG with the default image
+// settings.
+func BenchmarkConvertToWebP(b *testing.B) {
+	sample := benchSetup(b)
+	if _, err := convertToWebP(sample); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := convertToWebP(sample); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(benchPixels)/1e6*float64(b.N)/b.Elapsed().Seconds(), "MP/s")
+}
+
+// TestConvertThroughput fails if the median conversion of a 12 MP image
+// takes longer than the target. The target is given for benchCores cores,
+// so the test is skipped on fewer, and with -short.
+func TestConvertThroughput(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipped with -short")
+	}
+	if cores := min(runtime.NumCPU(), runtime.GOMAXPROCS(0)); cores < benchCores {
+		t.Skipf("the target is for %d cores, have %d", benchCores, cores)
+	}
+	sample := benchSetup(t)
+	report, err := benchConvert([][]byte{sample}, []int{benchPixels}, 5, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.MedianPer12MP > defaultBenchTarget {
+		t.Errorf("median conversion of a 12 MP image took %v, target %v", report.MedianPer12MP.Round(time.Millisecond), defaultBenchTarget)
+	}
+}
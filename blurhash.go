@@ -0,0 +1,131 @@
+package main
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Blurhash (https://blurha.sh) encodes a blurred placeholder of an image in
+// a short string that clients decode into a few pixels and scale up while
+// the real image loads.
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurhashSampleSize is the size images are scaled down to before
+// encoding; a placeholder carries no detail a larger sample would add.
+const blurhashSampleSize = 32
+
+// encodeBlurhash returns the blurhash of img with 4 components along its
+// long side and 3 along the short one.
+func encodeBlurhash(img image.Image) string {
+	xComponents, yComponents := 4, 3
+	if b := img.Bounds(); b.Dy() > b.Dx() {
+		xComponents, yComponents = 3, 4
+	}
+	sample := imaging.Fit(img, blurhashSampleSize, blurhashSampleSize, imaging.Box)
+	width, height := sample.Bounds().Dx(), sample.Bounds().Dy()
+	if width == 0 || height == 0 {
+		return ""
+	}
+
+	// Linear RGB of every pixel
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*sample.Stride + x*4
+			linear[y*width+x] = [3]float64{
+				srgbToLinear(sample.Pix[i]),
+				srgbToLinear(sample.Pix[i+1]),
+				srgbToLinear(sample.Pix[i+2]),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			var f [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(width)) * math.Cos(math.Pi*float64(j*y)/float64(height))
+					for c := 0; c < 3; c++ {
+						f[c] += basis * linear[y*width+x][c]
+					}
+				}
+			}
+			scale := 2.0
+			if i == 0 && j == 0 {
+				scale = 1
+			}
+			scale /= float64(width * height)
+			for c := range f {
+				f[c] *= scale
+			}
+			factors = append(factors, f)
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(base83((xComponents-1)+(yComponents-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		sb.WriteString(base83(quantisedMax, 1))
+	} else {
+		sb.WriteString(base83(0, 1))
+	}
+
+	sb.WriteString(base83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, f := range ac {
+		value := 0
+		for _, v := range f {
+			q := int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+			value = value*19 + q
+		}
+		sb.WriteString(base83(value, 2))
+	}
+	return sb.String()
+}
+
+// base83 encodes value in length base83 digits.
+func base83(value, length int) string {
+	digits := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		digits[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(digits)
+}
+
+func srgbToLinear(v uint8) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	c := math.Max(0, math.Min(1, v))
+	if c <= 0.0031308 {
+		return int(c*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(c, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow raises |v| to exp, keeping the sign of v.
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
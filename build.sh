@@ -13,9 +13,9 @@ if [ $? -ne 0 ]; then
     exit 1
 fi
 
-# Build Go backend
+# Build Go backend with the frontend embedded
 echo "Building Go backend..."
-go build -o picsapp main.go database.go
+go build -tags embed -o picsapp .
 
 if [ $? -ne 0 ]; then
     echo "Error: Go build failed"
@@ -23,6 +23,6 @@ if [ $? -ne 0 ]; then
 fi
 
 echo "Build complete!"
-echo "Run the server with: ./picsapp"
+echo "Run the server with: ./picsapp (self-contained; build/ is embedded)"
 echo "Or set PORT environment variable: PORT=3000 ./picsapp"
 
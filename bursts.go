@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// A like burst is a picture receiving likeBurstThreshold likes within
+// likeBurstWindow. Displays answer it with a celebration animation.
+var (
+	likeBurstThreshold reloadable[int]
+	likeBurstWindow    reloadable[time.Duration]
+)
+
+// LikeBurstPayload is the payload of a like_burst message. Count is the
+// number of likes the picture received in the last Window seconds and
+// Magnitude how many times the threshold that is (1, 2, 3, ...).
+type LikeBurstPayload struct {
+	ID        string `json:"id"`
+	Count     int    `json:"count"`
+	Magnitude int    `json:"magnitude"`
+	Window    int    `json:"window"`
+}
+
+type burstKey struct {
+	event, id string
+}
+
+// burstState holds the recent like times of one picture, oldest first,
+// and the magnitude last announced for its current burst.
+type burstState struct {
+	hits      []time.Time
+	magnitude int
+}
+
+// likeBursts aggregates likes over a sliding window per picture.
+type likeBursts struct {
+	mu       sync.Mutex
+	pictures map[burstKey]*burstState
+}
+
+func newLikeBursts() *likeBursts {
+	return &likeBursts{pictures: make(map[burstKey]*burstState)}
+}
+
+// record counts a like received at now. It returns a payload when the
+// picture's likes within the window reach a new multiple of the threshold;
+// each level is announced once per burst, and the burst ends when the count
+// drops below the threshold again.
+func (b *likeBursts) record(event, id string, now time.Time) *LikeBurstPayload {
+	threshold := likeBurstThreshold.Load()
+	if threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := burstKey{event, id}
+	s, ok := b.pictures[key]
+	if !ok {
+		s = &burstState{}
+		b.pictures[key] = s
+	}
+	s.prune(now)
+	s.hits = append(s.hits, now)
+
+	magnitude := len(s.hits) / threshold
+	if magnitude <= s.magnitude {
+		return nil
+	}
+	s.magnitude = magnitude
+	return &LikeBurstPayload{
+		ID:        id,
+		Count:     len(s.hits),
+		Magnitude: magnitude,
+		Window:    int(likeBurstWindow.Load().Seconds()),
+	}
+}
+
+// prune drops the likes that fell out of the window and ends the burst
+// once the count is below the threshold.
+func (s *burstState) prune(now time.Time) {
+	cutoff := now.Add(-likeBurstWindow.Load())
+	i := 0
+	for i < len(s.hits) && !s.hits[i].After(cutoff) {
+		i++
+	}
+	s.hits = s.hits[i:]
+	if len(s.hits) < likeBurstThreshold.Load() {
+		s.magnitude = 0
+	}
+}
+
+// sweep forgets pictures without likes in the window.
+func (b *likeBursts) sweep(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, s := range b.pictures {
+		if s.prune(now); len(s.hits) == 0 {
+			delete(b.pictures, key)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// When a public event link leaks and spam uploads start coming in, admins
+// switch on a CAPTCHA with CAPTCHA_PROVIDER and a reload: uploads then
+// need a token from the hCaptcha or Turnstile widget, which the server
+// checks with the provider before accepting the file. The web app learns
+// the provider and site key from GET /api/upload/captcha. Presenters,
+// moderators, admins and photographers aren't challenged.
+const (
+	captchaHCaptcha  = "hcaptcha"
+	captchaTurnstile = "turnstile"
+
+	// captchaTimeout bounds a verification request to the provider
+	captchaTimeout = 10 * time.Second
+)
+
+var (
+	captchaConfig atomic.Pointer[captchaSettings]
+
+	// captchaVerifyURLs are the providers' siteverify endpoints
+	captchaVerifyURLs = map[string]string{
+		captchaHCaptcha:  "https://api.hcaptcha.com/siteverify",
+		captchaTurnstile: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	}
+	// captchaFields are the form fields the widgets put their token in,
+	// besides "captcha"
+	captchaFields = map[string]string{
+		captchaHCaptcha:  "h-captcha-response",
+		captchaTurnstile: "cf-turnstile-response",
+	}
+
+	captchaClient = &http.Client{Timeout: captchaTimeout}
+
+	captchaFailures atomic.Uint64
+	captchaErrors   atomic.Uint64
+)
+
+// captchaSettings are the CAPTCHA_ settings. provider is "" when uploads
+// aren't challenged.
+type captchaSettings struct {
+	provider string
+	siteKey  string
+	secret   string
+}
+
+// CaptchaConfig is the response of GET /api/upload/captcha.
+type CaptchaConfig struct {
+	// Provider is "" when uploads aren't challenged
+	Provider string `json:"provider"`
+	SiteKey  string `json:"siteKey,omitempty"`
+}
+
+// handleCaptchaConfig tells the web app which CAPTCHA widget to show.
+func handleCaptchaConfig(w http.ResponseWriter, r *http.Request) {
+	var resp CaptchaConfig
+	if c := captchaConfig.Load(); c != nil && c.provider != "" {
+		resp = CaptchaConfig{Provider: c.provider, SiteKey: c.siteKey}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// captchaExempt reports whether a request uploads without a challenge.
+func captchaExempt(r *http.Request) bool {
+	if role, ok := authenticate(r); ok && role >= RolePresenter {
+		return true
+	}
+	user := userFromRequest(r)
+	return user != nil && user.Photographer
+}
+
+// checkCaptcha verifies the CAPTCHA token of an upload's parsed form. It
+// returns an HTTP status and message if the upload must be refused.
+func checkCaptcha(r *http.Request) (int, string) {
+	c := captchaConfig.Load()
+	if c == nil || c.provider == "" || captchaExempt(r) {
+		return 0, ""
+	}
+	token := r.FormValue("captcha")
+	if token == "" {
+		token = r.FormValue(captchaFields[c.provider])
+	}
+	if token == "" {
+		captchaFailures.Add(1)
+		return http.StatusForbidden, "CAPTCHA required"
+	}
+	ok, err := verifyCaptcha(r.Context(), c, token, remoteIP(r))
+	if err != nil {
+		captchaErrors.Add(1)
+		logError("captcha verification failed: %v", err)
+		return http.StatusBadGateway, "Couldn't verify the CAPTCHA; please try again"
+	}
+	if !ok {
+		captchaFailures.Add(1)
+		return http.StatusForbidden, "CAPTCHA verification failed"
+	}
+	return 0, ""
+}
+
+// verifyCaptcha checks a token with the provider's siteverify endpoint.
+func verifyCaptcha(ctx context.Context, c *captchaSettings, token, ip string) (bool, error) {
+	form := url.Values{"secret": {c.secret}, "response": {token}, "remoteip": {ip}}
+	if c.provider == captchaHCaptcha {
+		form.Set("sitekey", c.siteKey)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, captchaVerifyURLs[c.provider], strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := captchaClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s siteverify: %s", c.provider, resp.Status)
+	}
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil {
+		return false, fmt.Errorf("%s siteverify: %w", c.provider, err)
+	}
+	if !result.Success {
+		logWarn("captcha rejected: %s", strings.Join(result.ErrorCodes, ", "))
+	}
+	return result.Success, nil
+}
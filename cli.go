@@ -0,0 +1,672 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// picsapp runs as `picsapp [command] [flags]`; without a command it serves.
+// Every command takes the configuration flags and reads the same config
+// file and environment as the server, so it works on the same database and
+// directories, and can run next to a live server.
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "", "Run the server (the default)", func(args []string) error { serve(args); return nil }},
+	{"migrate", "", "Create or upgrade the database schema and exit", runMigrate},
+	{"reconvert", "[-event id] [picture-id ...]", "Queue pictures for conversion again", runReconvert},
+	{"prune", "[-older-than days]", "Delete finished conversion tasks and orphaned image files", runPrune},
+	{"shard", "", "Move image files stored flat or outside their event's partition into the hash-sharded layout", runShard},
+	{"migrate-storage", "-to backend [-from backend] [-batch n]", "Copy the image files to another storage backend and point the pictures at them", runMigrateStorage},
+	{"gc", "[-json]", "Quarantine orphaned image files and delete those quarantined for GC_GRACE", runGC},
+	{"seed", "-dir path [-event id] [-workers n]", "Convert a directory of images into pictures of an event, to fill its wall before it starts", runSeed},
+	{"export", "[-event id] -o file.zip", "Write an event's pictures and their metadata to a zip file", runExport},
+	{"stats", "[-json]", "Print picture, like and conversion queue counts", runStats},
+	{"bench-convert", "[-n images] [-workers n] [-target duration] [-json] [image ...]", "Time WebP conversions and fail if a 12 MP image takes longer than the target", runBenchConvert},
+	{"create-token", "[-event id] -name name", "Create a kiosk display and print its token", runCreateToken},
+	{"create-user", "-username name [-role viewer|presenter|moderator|admin]", "Create a user account; the password is read from $PICSAPP_PASSWORD or stdin", runCreateUser},
+	{"set-role", "-username name -role viewer|presenter|moderator|admin", "Change the role of a user account", runSetRole},
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		serve(args)
+		return
+	}
+	name, args := args[0], args[1:]
+	if name == "help" {
+		printUsage(os.Stdout)
+		return
+	}
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		err := cmd.run(args)
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "picsapp %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "picsapp: unknown command %q\n\n", name)
+	printUsage(os.Stderr)
+	os.Exit(2)
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: picsapp [command] [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.usage, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Every command also takes the configuration flags; see picsapp <command> -h.")
+}
+
+// setupCommand parses a command's flags, defined by define, together with
+// the configuration, and opens the database. Logs go to stderr so they
+// don't mix with the command's output.
+func setupCommand(name string, args []string, define func(fs *flag.FlagSet)) (*flag.FlagSet, error) {
+	fs, _, err := setupCommandConfig(name, args, define)
+	return fs, err
+}
+
+// setupCommandConfig is setupCommand for commands that need the
+// configuration.
+func setupCommandConfig(name string, args []string, define func(fs *flag.FlagSet)) (*flag.FlagSet, *Config, error) {
+	logger.SetOutput(os.Stderr)
+	fs := flag.NewFlagSet("picsapp "+name, flag.ContinueOnError)
+	if define != nil {
+		define(fs)
+	}
+	cfg, _, _, err := loadConfig(fs, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	applyConfig(cfg)
+	if err := setupStorage(cfg); err != nil {
+		return nil, nil, err
+	}
+	if db, err = NewDatabase(dbPath); err != nil {
+		return nil, nil, err
+	}
+	return fs, cfg, nil
+}
+
+// noArgs rejects positional arguments to a command that takes none.
+func noArgs(fs *flag.FlagSet) error {
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	return nil
+}
+
+// validEvent checks an -event flag.
+func validEvent(event string) error {
+	if !eventIDPattern.MatchString(event) {
+		return fmt.Errorf("invalid event %q", event)
+	}
+	return nil
+}
+
+func runMigrate(args []string) error {
+	fs, err := setupCommand("migrate", args, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+	if err := db.Checkpoint(); err != nil {
+		return err
+	}
+	fmt.Printf("database %s is up to date\n", dbPath)
+	return nil
+}
+
+// runReconvert queues pictures for conversion from their projector
+// rendition, or their web image if they have none, for instance after
+// changing the image settings. A running server converts them.
+func runReconvert(args []string) error {
+	var event string
+	fs, err := setupCommand("reconvert", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&event, "event", "", "only pictures of this event (default: all events)")
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if event != "" {
+		if err := validEvent(event); err != nil {
+			return err
+		}
+	}
+
+	var pictures []*Picture
+	if fs.NArg() > 0 {
+		for _, id := range fs.Args() {
+			pic, err := db.GetPicture(id)
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("picture %s not found", id)
+			}
+			if err != nil {
+				return err
+			}
+			pictures = append(pictures, pic)
+		}
+	} else {
+		all, err := db.LoadAllPictures()
+		if err != nil {
+			return err
+		}
+		for _, pic := range all {
+			if event == "" || pic.EventID == event {
+				pictures = append(pictures, pic)
+			}
+		}
+	}
+
+	ctx := context.Background()
+	queued := 0
+	for _, pic := range pictures {
+		source := filepath.Join(projectorDir, filepath.FromSlash(pic.FileKey))
+		if _, err := projectorStore.Stat(ctx, pic.FileKey); err != nil {
+			source = filepath.Join(uploadDir, filepath.FromSlash(pic.FileKey))
+			if _, err := uploadStore.Stat(ctx, pic.FileKey); err != nil {
+				logWarn("skipping %s: no image file", pic.ID)
+				continue
+			}
+		}
+		if _, err := db.CreateConversionTask(source, pic.Filename, pic.ID, pic.EventID, "", "", "", "", 0, time.Time{}, ""); err != nil {
+			return fmt.Errorf("queue %s: %w", pic.ID, err)
+		}
+		queued++
+	}
+	fmt.Printf("queued %d pictures for conversion\n", queued)
+	return nil
+}
+
+// orphanGrace keeps prune away from files a running server has just
+// written and not yet recorded.
+const orphanGrace = time.Hour
+
+// runPrune deletes finished conversion tasks and image files no picture
+// refers to.
+func runPrune(args []string) error {
+	var olderThan int
+	fs, err := setupCommand("prune", args, func(fs *flag.FlagSet) {
+		fs.IntVar(&olderThan, "older-than", 30, "delete finished conversion tasks older than this many days")
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+	if olderThan < 0 {
+		return errors.New("-older-than must be 0 or more")
+	}
+
+	tasks, originals, err := db.PruneConversionTasks(time.Now().AddDate(0, 0, -olderThan))
+	if err != nil {
+		return fmt.Errorf("prune conversion tasks: %w", err)
+	}
+	fmt.Printf("deleted %d finished conversion tasks older than %d days\n", tasks, olderThan)
+	if n := deleteQuarantined(context.Background(), originals); n > 0 {
+		fmt.Printf("removed %d quarantined originals of failed conversions\n", n)
+	}
+
+	pictures, err := db.LoadAllPictures()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(pictures))
+	for _, pic := range pictures {
+		known[pic.FileKey] = true
+	}
+	var files int
+	var size int64
+	for _, dir := range []string{uploadDir, projectorDir} {
+		n, bytes, err := removeOrphans(dir, known)
+		if err != nil {
+			return err
+		}
+		files += n
+		size += bytes
+	}
+	fmt.Printf("removed %d orphaned image files (%.1f MB)\n", files, float64(size)/(1<<20))
+	return nil
+}
+
+// removeOrphans deletes the files in dir and its shard directories, older
+// than orphanGrace, whose key isn't a known picture file key. Other
+// subdirectories, such as the originals waiting for conversion, are left
+// alone.
+func removeOrphans(dir string, known map[string]bool) (int, int64, error) {
+	cutoff := time.Now().Add(-orphanGrace)
+	var n int
+	var size int64
+	err := walkDirStore(dir, func(key, path string, info os.FileInfo) error {
+		if known[key] || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			logWarn("remove %s: %v", path, err)
+			return nil
+		}
+		n++
+		size += info.Size()
+		return nil
+	})
+	return n, size, err
+}
+
+// runShard moves the files of pictures stored flat under their ID, before
+// the sharded layout, or outside their event's partition, before the
+// partitions, into it: each is copied to the key of its contents in its
+// event's partition and the picture pointed at the copy. The old files
+// stay for clients that still have their URLs, until prune removes them.
+func runShard(args []string) error {
+	fs, err := setupCommand("shard", args, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+
+	pictures, err := db.LoadAllPictures()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	moved := 0
+	for _, pic := range pictures {
+		// Pictures that aren't WebP yet are waiting for their conversion,
+		// which stores them sharded
+		if event, _ := splitEventKey(pic.FileKey); event != "" || !strings.HasSuffix(strings.ToLower(pic.ID), ".webp") {
+			continue
+		}
+		if err := shardPicture(ctx, pic); err != nil {
+			logWarn("skipping %s: %v", pic.ID, err)
+			continue
+		}
+		moved++
+	}
+	fmt.Printf("moved %d pictures to the sharded layout\n", moved)
+	return nil
+}
+
+// shardPicture copies a picture's image, and its projector rendition if it
+// has one, to the sharded key of the image's contents in its event's
+// partition.
+func shardPicture(ctx context.Context, pic *Picture) error {
+	f, err := uploadStore.Get(ctx, pic.FileKey)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	key := eventKey(pic.EventID, shardedKey(data, path.Ext(pic.ID)))
+	if err := uploadStore.Put(ctx, key, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if pic.ProjectorURL != "" {
+		f, err := projectorStore.Get(ctx, pic.FileKey)
+		if err != nil {
+			return fmt.Errorf("projector rendition: %w", err)
+		}
+		err = projectorStore.Put(ctx, key, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("projector rendition: %w", err)
+		}
+	}
+	return db.SetPictureFile(pic.ID, uploadStore.URL(key), key)
+}
+
+// runMigrateStorage copies the image files from one storage backend to
+// another; see storagemigration.go.
+func runMigrateStorage(args []string) error {
+	var from, to string
+	var batch int
+	fs, cfg, err := setupCommandConfig("migrate-storage", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&from, "from", "", "backend to copy from, local or s3 (default: the configured storage)")
+		fs.StringVar(&to, "to", "", "backend to copy to, local or s3")
+		fs.IntVar(&batch, "batch", 100, "pictures whose URLs are rewritten in one transaction")
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+	if from == "" {
+		from = cfg.Storage
+	}
+	for _, backend := range []string{from, to} {
+		// Memory stores are lost with the process
+		if backend != "local" && backend != "s3" {
+			return fmt.Errorf("invalid backend %q: must be local or s3", backend)
+		}
+	}
+	if from == to {
+		return errors.New("-from and -to must differ")
+	}
+	if (from == "s3" || to == "s3") && (cfg.S3Bucket == "" || cfg.S3Endpoint == "") {
+		return errors.New("s3_bucket and s3_endpoint must be set to migrate to or from s3")
+	}
+	if batch < 1 {
+		return errors.New("-batch must be 1 or more")
+	}
+
+	src, err := openStores(cfg, from)
+	if err != nil {
+		return err
+	}
+	dst, err := openStores(cfg, to)
+	if err != nil {
+		return err
+	}
+	target := storageTarget(cfg, to)
+	m, err := migrateStorage(context.Background(), src, dst, target, batch)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("copied %d files (%.1f MB) from %s to %s, %d copied before\n", m.Copied, float64(m.CopiedBytes)/(1<<20), from, target, m.Skipped)
+	fmt.Printf("pointed %d pictures at their new URLs\n", m.Rewritten)
+	if m.Missing > 0 {
+		fmt.Printf("%d files missing from %s\n", m.Missing, from)
+	}
+	if m.Failed > 0 {
+		return fmt.Errorf("%d files failed to copy; run again to retry them", m.Failed)
+	}
+	return nil
+}
+
+// runGC runs the garbage collector once and prints its report.
+func runGC(args []string) error {
+	var asJSON bool
+	fs, err := setupCommand("gc", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&asJSON, "json", false, "print JSON")
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+	report, err := collectGarbage(context.Background())
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	if !report.Collected {
+		fmt.Println("files are not in local directories; only checked for missing ones")
+	}
+	fmt.Printf("quarantined %d files (%.1f MB) in %s\n", report.Quarantined, float64(report.QuarantinedBytes)/(1<<20), quarantineDir)
+	fmt.Printf("restored %d files referred to again\n", report.Restored)
+	fmt.Printf("deleted %d quarantined files (%.1f MB reclaimed)\n", report.Deleted, float64(report.ReclaimedBytes)/(1<<20))
+	for _, id := range report.MissingImages {
+		fmt.Printf("missing image of picture %s\n", id)
+	}
+	for _, id := range report.MissingOriginals {
+		fmt.Printf("missing original of conversion task %d\n", id)
+	}
+	return nil
+}
+
+// runExport writes an event's pictures, hidden ones included, to a zip
+// file holding pictures.json and the images under images/, as
+// GET /api/pictures/export does with the visible ones.
+func runExport(args []string) error {
+	var event, output string
+	fs, err := setupCommand("export", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&event, "event", defaultEventID, "event to export")
+		fs.StringVar(&output, "o", "", "zip file to write, - for standard output")
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+	if err := validEvent(event); err != nil {
+		return err
+	}
+	if output == "" {
+		return errors.New("-o is required")
+	}
+
+	pictures, err := db.GetArchivedPictures(event)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeExport(context.Background(), w, pictures); err != nil {
+		return err
+	}
+	if output != "-" {
+		fmt.Printf("exported %d pictures of event %s to %s\n", len(pictures), event, output)
+	}
+	return nil
+}
+
+func runStats(args []string) error {
+	var asJSON bool
+	fs, err := setupCommand("stats", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&asJSON, "json", false, "print JSON")
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+
+	events, err := eventStats()
+	if err != nil {
+		return err
+	}
+	tasks, err := db.ConversionTaskCounts()
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"events":          events,
+			"conversionTasks": tasks,
+		})
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "EVENT\tPICTURES\tHIDDEN\tLIKES\tDOWNLOADS\tEXPORTS\tMB\tQUOTA MB\tSOURCES")
+	for _, e := range events {
+		quota := "-"
+		if e.QuotaBytes > 0 {
+			quota = fmt.Sprintf("%.1f", float64(e.QuotaBytes)/(1<<20))
+			if e.OverQuota {
+				quota += " (full)"
+			}
+		}
+		sources := make([]string, 0, len(e.Sources))
+		for source, n := range e.Sources {
+			sources = append(sources, fmt.Sprintf("%s=%d", source, n))
+		}
+		sort.Strings(sources)
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%.1f\t%s\t%s\n", e.EventID, e.Pictures, e.Hidden, e.Likes, e.Downloads, e.Exports, float64(e.Bytes)/(1<<20), quota, strings.Join(sources, " "))
+	}
+	tw.Flush()
+	statuses := make([]string, 0, len(tasks))
+	for status := range tasks {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	fmt.Print("\nconversion tasks:")
+	if len(statuses) == 0 {
+		fmt.Print(" none")
+	}
+	for _, status := range statuses {
+		fmt.Printf(" %s=%d", status, tasks[status])
+	}
+	fmt.Println()
+	return nil
+}
+
+// runCreateToken creates a kiosk display, like POST /api/admin/displays.
+func runCreateToken(args []string) error {
+	var event, name string
+	fs, err := setupCommand("create-token", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&event, "event", defaultEventID, "event the display shows")
+		fs.StringVar(&name, "name", "", "display name, e.g. \"Stage left\"")
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+	if err := validEvent(event); err != nil {
+		return err
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxDisplayNameLength {
+		return errors.New("-name must be 1-64 characters")
+	}
+
+	display, token, err := createDisplay(event, name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("display %s (%s) for event %s\n", display.ID, display.Name, event)
+	fmt.Printf("token: %s\n", token)
+	fmt.Printf("url:   %s\n", kioskURL(event, token))
+	return nil
+}
+
+// runCreateUser creates a user account. The password is taken from
+// PICSAPP_PASSWORD or the first line of stdin, so that it doesn't show up
+// in the process list or shell history.
+func runCreateUser(args []string) error {
+	var username, roleName string
+	fs, err := setupCommand("create-user", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&username, "username", "", "username, 3-32 characters from A-Z a-z 0-9 _ . -")
+		fs.StringVar(&roleName, "role", "viewer", "role: viewer, presenter, moderator or admin")
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+	var role Role
+	if err := role.UnmarshalText([]byte(roleName)); err != nil {
+		return fmt.Errorf("-role: %w", err)
+	}
+
+	password := os.Getenv("PICSAPP_PASSWORD")
+	if password == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	user, err := createUser(username, password, role)
+	if errors.Is(err, errUsernameTaken) {
+		return fmt.Errorf("username %s is taken", username)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("user %s (%s), id %d\n", user.Username, user.Role, user.ID)
+	return nil
+}
+
+// runSetRole changes the role of a user account, like PUT
+// /api/admin/users/{id}/role. It is how an account is promoted to admin
+// when none is left, or when ADMIN_USERNAME was taken.
+func runSetRole(args []string) error {
+	var username, roleName string
+	fs, err := setupCommand("set-role", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&username, "username", "", "username")
+		fs.StringVar(&roleName, "role", "", "role: viewer, presenter, moderator or admin")
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := noArgs(fs); err != nil {
+		return err
+	}
+	var role Role
+	if err := role.UnmarshalText([]byte(roleName)); err != nil {
+		return fmt.Errorf("-role: %w", err)
+	}
+
+	user, _, err := db.GetUserByUsername(username)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no user %s", username)
+	}
+	if err != nil {
+		return err
+	}
+	old := user.Role
+	if err := setUserRole(user, role); err != nil {
+		return err
+	}
+	fmt.Printf("user %s: %s -> %s\n", user.Username, old, user.Role)
+	return nil
+}
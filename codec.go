@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// WebSocket subprotocols. Clients pick a frame encoding with the
+// Sec-WebSocket-Protocol header; JSON is used when they don't ask.
+const (
+	protocolJSON    = "picsapp.json"
+	protocolMsgpack = "picsapp.msgpack"
+)
+
+type encoding int
+
+const (
+	encodingJSON encoding = iota
+	encodingMsgpack
+	numEncodings
+)
+
+// encodingFor returns the frame encoding of a negotiated subprotocol.
+func encodingFor(subprotocol string) encoding {
+	if subprotocol == protocolMsgpack {
+		return encodingMsgpack
+	}
+	return encodingJSON
+}
+
+// frame is an envelope ready to be written in any encoding. The JSON form
+// is built up front; the others are derived from it the first time a
+// client needs them, once per frame no matter how many clients share it.
+type frame struct {
+	msgType  string
+	data     []byte
+	once     [numEncodings]sync.Once
+	prepared [numEncodings]*websocket.PreparedMessage
+	sizes    [numEncodings]int
+	errs     [numEncodings]error
+}
+
+// prepareEnvelope marshals env into a frame. A prepared message is
+// compressed at most once per compression setting no matter how many
+// clients it is written to.
+func prepareEnvelope(env *Envelope) (*frame, error) {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	f := &frame{msgType: env.Type, data: data}
+	if _, _, err := f.encoded(encodingJSON); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// encoded returns the frame as a prepared message in enc and the size of
+// its uncompressed payload.
+func (f *frame) encoded(enc encoding) (*websocket.PreparedMessage, int, error) {
+	f.once[enc].Do(func() {
+		data, messageType := f.data, websocket.TextMessage
+		if enc == encodingMsgpack {
+			data, f.errs[enc] = jsonToMsgpack(f.data)
+			if f.errs[enc] != nil {
+				return
+			}
+			messageType = websocket.BinaryMessage
+		}
+		f.prepared[enc], f.errs[enc] = websocket.NewPreparedMessage(messageType, data)
+		f.sizes[enc] = len(data)
+	})
+	return f.prepared[enc], f.sizes[enc], f.errs[enc]
+}
+
+// jsonToMsgpack re-encodes a JSON document as msgpack. Going through JSON
+// keeps both encodings identical in shape: the same keys, times as
+// RFC 3339 strings, and integers as integers.
+func jsonToMsgpack(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(normalizeNumbers(v))
+}
+
+// normalizeNumbers replaces json.Number values with int64 or float64.
+func normalizeNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = normalizeNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeNumbers(item)
+		}
+	}
+	return v
+}
+
+// msgpackToJSON converts a msgpack frame from a client to JSON so inbound
+// messages are decoded the same way in either encoding.
+func msgpackToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := msgpack.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
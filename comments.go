@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxCommentLength bounds a comment, in characters
+	maxCommentLength = 280
+	// maxCommentsListed bounds the comments listed for a picture
+	maxCommentsListed = 100
+	// commentsPerMinute limits comments per device, like LIKE_RATE_LIMIT
+	commentsPerMinute = 10
+)
+
+var commentLimiter = &rateLimiter{perMinute: commentsPerMinute, buckets: map[string]*tokenBucket{}}
+
+// Comment is a guest's comment on a picture, after the text filter.
+type Comment struct {
+	ID        int64     `json:"id"`
+	PictureID string    `json:"pictureId"`
+	EventID   string    `json:"eventId"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Moderation is "pending" for a comment held back with MODERATE_TEXT
+	// until a moderator approves it, and "rejected" for one they refused
+	Moderation string `json:"moderation,omitempty"`
+	// DeviceID is the anonymous device that wrote the comment
+	DeviceID string `json:"-"`
+}
+
+// CommentRequest is the body of POST /api/pictures/{id}/comments.
+type CommentRequest struct {
+	Text string `json:"text"`
+}
+
+// handleListComments lists the last comments of a picture on the public
+// wall, oldest first.
+func handleListComments(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	pic, err := db.GetPicture(id)
+	if err != nil || pic.Hidden {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	comments, err := db.GetComments(id, maxCommentsListed)
+	if err != nil {
+		logError("get comments failed: %v", err)
+		http.Error(w, "Error fetching comments", http.StatusInternalServerError)
+		return
+	}
+	if comments == nil {
+		comments = []*Comment{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comments)
+}
+
+// handleAddComment stores a device's comment on a picture of the public
+// wall, after the text filter, and broadcasts it to the picture's event,
+// or with MODERATE_TEXT holds it back for a moderator.
+func handleAddComment(w http.ResponseWriter, r *http.Request) {
+	var req CommentRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	text := strings.TrimSpace(req.Text)
+	if text == "" || utf8.RuneCountInString(text) > maxCommentLength {
+		http.Error(w, fmt.Sprintf("Comment must be 1-%d characters", maxCommentLength), http.StatusBadRequest)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	pic, err := db.GetPicture(id)
+	if err != nil || pic.Hidden {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	if signinRequired(r) {
+		http.Error(w, "Sign in to post", http.StatusUnauthorized)
+		return
+	}
+	d := deviceFromRequest(r)
+	if banned(d) {
+		refuseBanned(w)
+		return
+	}
+	if ok, retryAfter := commentLimiter.allow(d.rateKey(), time.Now()); !ok {
+		tooManyRequests(w, "Too many comments from this device", retryAfter)
+		return
+	}
+	if text, err = filterText(text); err != nil {
+		http.Error(w, "Comment contains blocked words or contact details", http.StatusBadRequest)
+		return
+	}
+
+	comment := &Comment{
+		PictureID: id,
+		EventID:   pic.EventID,
+		Text:      text,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		DeviceID:  d.id,
+	}
+	if moderateText.Load() {
+		comment.Moderation = moderationPending
+	}
+	if err := db.AddComment(comment); err != nil {
+		logError("add comment failed: %v", err)
+		http.Error(w, "Error saving comment", http.StatusInternalServerError)
+		return
+	}
+	status := http.StatusAccepted
+	if comment.Moderation == "" {
+		hub.publishComment(comment)
+		recordComment(comment, pic)
+		status = http.StatusCreated
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(comment)
+}
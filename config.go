@@ -0,0 +1,719 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the server settings. Each one is read, in increasing
+// precedence, from its default, the config file, its environment variable
+// and its command-line flag, all named after its yaml key:
+// `max_ws_clients: 500` in the file, MAX_WS_CLIENTS=500 or
+// -max-ws-clients=500. Durations are in seconds. Settings tagged secret are
+// redacted from the startup summary; those tagged reload can be changed
+// without a restart (see reloadConfig).
+type Config struct {
+	Port         int    `yaml:"port"`
+	SocketPath   string `yaml:"socket_path"`
+	SocketMode   string `yaml:"socket_mode"`
+	DatabasePath string `yaml:"database_path"`
+	UploadDir    string `yaml:"upload_dir"`
+	ProjectorDir string `yaml:"projector_dir"`
+	RecapDir     string `yaml:"recap_dir"`
+	Storage      string `yaml:"storage"`
+	FrontendDir  string `yaml:"frontend_dir"`
+	LogLevel     string `yaml:"log_level" reload:"true"`
+
+	// PublicAssetBaseURL is the host, such as a CDN, clients fetch the
+	// converted images from instead of this server
+	PublicAssetBaseURL string `yaml:"public_asset_base_url" reload:"true"`
+
+	// File transfers handed to a reverse proxy: X-Accel-Redirect (nginx)
+	// or X-Sendfile (Apache, lighttpd)
+	SendfileHeader string `yaml:"sendfile_header"`
+	SendfilePrefix string `yaml:"sendfile_prefix"`
+
+	// Timeouts and limits
+	ReadHeaderTimeout int `yaml:"read_header_timeout"`
+	ReadTimeout       int `yaml:"read_timeout"`
+	WriteTimeout      int `yaml:"write_timeout"`
+	IdleTimeout       int `yaml:"idle_timeout"`
+	UploadTimeout     int `yaml:"upload_timeout"`
+	MaxHeaderKB       int `yaml:"max_header_kb"`
+
+	// HTTPS
+	TLSCertFile string `yaml:"tls_cert_file"`
+	TLSKeyFile  string `yaml:"tls_key_file"`
+	TLSDomains  string `yaml:"tls_domains"`
+	TLSCacheDir string `yaml:"tls_cache_dir"`
+	TLSEmail    string `yaml:"tls_email"`
+	HTTPPort    int    `yaml:"http_port"`
+
+	// Debugging
+	DebugAddr  string `yaml:"debug_addr"`
+	DebugAdmin bool   `yaml:"debug_admin"`
+
+	// Tracing
+	OTelExporterOTLPEndpoint string `yaml:"otel_exporter_otlp_endpoint"`
+	OTelServiceName          string `yaml:"otel_service_name"`
+
+	// S3-compatible object storage, with storage: s3
+	S3Endpoint      string `yaml:"s3_endpoint"`
+	S3Region        string `yaml:"s3_region"`
+	S3Bucket        string `yaml:"s3_bucket"`
+	S3Prefix        string `yaml:"s3_prefix"`
+	S3AccessKey     string `yaml:"s3_access_key" secret:"true"`
+	S3SecretKey     string `yaml:"s3_secret_key" secret:"true"`
+	S3UseSSL        bool   `yaml:"s3_use_ssl"`
+	S3PublicURL     string `yaml:"s3_public_url"`
+	S3PresignExpiry int    `yaml:"s3_presign_expiry"`
+
+	// Originals kept after conversion, archived with archive_bucket
+	// through s3_endpoint
+	KeepOriginals       bool   `yaml:"keep_originals"`
+	ArchiveBucket       string `yaml:"archive_bucket"`
+	ArchivePrefix       string `yaml:"archive_prefix"`
+	ArchiveStorageClass string `yaml:"archive_storage_class"`
+	ArchiveAfter        int    `yaml:"archive_after"`
+
+	// Offsite backups of the database and image files, to backup_bucket
+	// through s3_endpoint or to an rclone remote
+	BackupBucket   string `yaml:"backup_bucket"`
+	BackupPrefix   string `yaml:"backup_prefix"`
+	BackupRclone   string `yaml:"backup_rclone"`
+	RclonePath     string `yaml:"rclone_path"`
+	BackupInterval int    `yaml:"backup_interval"`
+	BackupKeep     int    `yaml:"backup_keep"`
+
+	// Full snapshot downloads from /api/admin/snapshot
+	SnapshotRateMB int `yaml:"snapshot_rate_mb" reload:"true"`
+
+	// Images
+	MaxUploadMB           int `yaml:"max_upload_mb" reload:"true"`
+	MaxImageDimension     int `yaml:"max_image_dimension" reload:"true"`
+	WebPQuality           int `yaml:"webp_quality" reload:"true"`
+	ProjectorMaxDimension int `yaml:"projector_max_dimension" reload:"true"`
+	ProjectorQuality      int `yaml:"projector_quality" reload:"true"`
+	ConversionTimeout     int `yaml:"conversion_timeout" reload:"true"`
+	ConversionMaxAttempts int `yaml:"conversion_max_attempts" reload:"true"`
+	MaxConcurrentUploads  int `yaml:"max_concurrent_uploads" reload:"true"`
+	MaxConcurrentDecodes  int `yaml:"max_concurrent_decodes" reload:"true"`
+	ConversionWorkers     int `yaml:"conversion_workers"`
+	MinFreeDiskMB         int `yaml:"min_free_disk_mb" reload:"true"`
+	EventQuotaMB          int `yaml:"event_quota_mb" reload:"true"`
+	HotImages             int `yaml:"hot_images"`
+	MaxGalleryPictures    int `yaml:"max_gallery_pictures"`
+	SnapshotTop           int `yaml:"snapshot_top"`
+	SnapshotNewest        int `yaml:"snapshot_newest"`
+
+	// Garbage collection of orphaned files
+	GCInterval int `yaml:"gc_interval" reload:"true"`
+	GCGrace    int `yaml:"gc_grace" reload:"true"`
+
+	// Trash of pictures deleted by moderators
+	TrashHours int `yaml:"trash_hours" reload:"true"`
+
+	// Read-only mode, for the gallery after the event or maintenance on
+	// the database
+	ReadOnly bool `yaml:"read_only" reload:"true"`
+
+	// Hot folder whose images are adopted as uploads
+	IngestDir    string `yaml:"ingest_dir"`
+	IngestEvent  string `yaml:"ingest_event"`
+	IngestSettle int    `yaml:"ingest_settle"`
+
+	// Cache of picture variants generated on request
+	VariantCacheDir string `yaml:"variant_cache_dir"`
+	VariantCacheMB  int    `yaml:"variant_cache_mb"`
+
+	// Clients and roles
+	AdminToken          string `yaml:"admin_token" secret:"true"`
+	PresenterToken      string `yaml:"presenter_token" secret:"true"`
+	AdminUsername       string `yaml:"admin_username"`
+	AdminPassword       string `yaml:"admin_password" secret:"true"`
+	AllowSignup         bool   `yaml:"allow_signup"`
+	SessionTTL          int    `yaml:"session_ttl"`
+	SessionCookieSecure bool   `yaml:"session_cookie_secure"`
+	RequireSignin       bool   `yaml:"require_signin" reload:"true"`
+	AllowedOrigins      string `yaml:"allowed_origins"`
+	DevMode             bool   `yaml:"dev_mode"`
+	WSCompression       string `yaml:"ws_compression"`
+	MaxWSClients        int    `yaml:"max_ws_clients" reload:"true"`
+	RedisURL            string `yaml:"redis_url" secret:"true"`
+	RedisChannel        string `yaml:"redis_channel"`
+
+	// Sign-in with OAuth providers. PublicURL is the address the server
+	// is reached at, which providers redirect back to and share links
+	// point at
+	PublicURL               string `yaml:"public_url"`
+	OAuthGoogleClientID     string `yaml:"oauth_google_client_id"`
+	OAuthGoogleClientSecret string `yaml:"oauth_google_client_secret" secret:"true"`
+	OAuthGoogleDomains      string `yaml:"oauth_google_domains"`
+
+	// Devices
+	DeviceSecret      string `yaml:"device_secret" secret:"true"`
+	LikeRateLimit     int    `yaml:"like_rate_limit" reload:"true"`
+	UploadRateLimit   int    `yaml:"upload_rate_limit" reload:"true"`
+	DeviceUploadLimit int    `yaml:"device_upload_limit" reload:"true"`
+	UserUploadLimit   int    `yaml:"user_upload_limit" reload:"true"`
+
+	// Moderation
+	ModerateUploads   bool   `yaml:"moderate_uploads" reload:"true"`
+	ModerateText      bool   `yaml:"moderate_text" reload:"true"`
+	FilterWords       string `yaml:"filter_words" reload:"true"`
+	FilterPII         bool   `yaml:"filter_pii" reload:"true"`
+	FilterAction      string `yaml:"filter_action" reload:"true"`
+	AutoBanRejections int    `yaml:"auto_ban_rejections" reload:"true"`
+	AutoBanReports    int    `yaml:"auto_ban_reports" reload:"true"`
+	AutoBanHours      int    `yaml:"auto_ban_hours" reload:"true"`
+	CaptchaProvider   string `yaml:"captcha_provider" reload:"true"`
+	CaptchaSiteKey    string `yaml:"captcha_site_key" reload:"true"`
+	CaptchaSecret     string `yaml:"captcha_secret" secret:"true" reload:"true"`
+
+	// Terms of use guests accept with their first upload
+	TermsText    string `yaml:"terms_text" reload:"true"`
+	TermsVersion string `yaml:"terms_version" reload:"true"`
+
+	// Presentation
+	LikeBurstThreshold int `yaml:"like_burst_threshold" reload:"true"`
+	LikeBurstWindow    int `yaml:"like_burst_window" reload:"true"`
+	SpotlightCooldown  int `yaml:"spotlight_cooldown" reload:"true"`
+	NewPictureMinutes  int `yaml:"new_picture_minutes" reload:"true"`
+	RotationMinutes    int `yaml:"rotation_minutes" reload:"true"`
+
+	// Like milestones, celebrated on the wall and notified to the
+	// organizers' webhook
+	LikeMilestones      string `yaml:"like_milestones" reload:"true"`
+	MilestoneWebhookURL string `yaml:"milestone_webhook_url" secret:"true" reload:"true"`
+
+	// Notifications to the organizers' chat
+	SlackWebhookURL   string `yaml:"slack_webhook_url" secret:"true" reload:"true"`
+	DiscordWebhookURL string `yaml:"discord_webhook_url" secret:"true" reload:"true"`
+	NotifyEvents      string `yaml:"notify_events" reload:"true"`
+
+	// Recaps
+	FFmpegPath    string `yaml:"ffmpeg_path"`
+	RecapMusicDir string `yaml:"recap_music_dir"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:                  8080,
+		SocketMode:            "0660",
+		DatabasePath:          "picsapp.db",
+		UploadDir:             "uploads",
+		ProjectorDir:          "projector",
+		RecapDir:              "recaps",
+		VariantCacheDir:       "cache",
+		VariantCacheMB:        512,
+		Storage:               "local",
+		S3Endpoint:            "s3.amazonaws.com",
+		S3UseSSL:              true,
+		S3PresignExpiry:       3600,
+		ArchivePrefix:         "originals/",
+		ArchiveStorageClass:   "GLACIER",
+		ArchiveAfter:          24,
+		BackupPrefix:          "backups/",
+		RclonePath:            "rclone",
+		BackupInterval:        3600,
+		BackupKeep:            24,
+		SnapshotRateMB:        20,
+		LogLevel:              "info",
+		SendfilePrefix:        "/internal/",
+		ReadHeaderTimeout:     10,
+		ReadTimeout:           30,
+		WriteTimeout:          60,
+		IdleTimeout:           120,
+		UploadTimeout:         300,
+		MaxHeaderKB:           64,
+		TLSCacheDir:           "certs",
+		OTelServiceName:       "picsapp",
+		MaxUploadMB:           10,
+		MaxImageDimension:     1600,
+		WebPQuality:           82,
+		ProjectorMaxDimension: 3840,
+		ProjectorQuality:      90,
+		ConversionTimeout:     600,
+		ConversionMaxAttempts: 3,
+		MaxConcurrentUploads:  8,
+		MaxConcurrentDecodes:  2,
+		ConversionWorkers:     2,
+		MinFreeDiskMB:         500,
+		MaxGalleryPictures:    5000,
+		SnapshotTop:           200,
+		SnapshotNewest:        50,
+		GCInterval:            3600,
+		GCGrace:               86400,
+		TrashHours:            24,
+		IngestEvent:           defaultEventID,
+		IngestSettle:          3,
+		AdminUsername:         "admin",
+		SessionTTL:            720,
+		WSCompression:         "on",
+		MaxWSClients:          2000,
+		RedisChannel:          "picsapp:hub",
+		LikeRateLimit:         30,
+		UploadRateLimit:       20,
+		FilterAction:          filterMask,
+		AutoBanHours:          24,
+		LikeBurstThreshold:    10,
+		LikeBurstWindow:       10,
+		LikeMilestones:        "10,25,50,100,250,500,1000",
+		NotifyEvents:          strings.Join(noticeKinds, ","),
+		SpotlightCooldown:     1800,
+		NewPictureMinutes:     10,
+		RotationMinutes:       60,
+		FFmpegPath:            "ffmpeg",
+		RecapMusicDir:         "music",
+	}
+}
+
+// defaultConfigFile is read when no file is named with -config or
+// PICSAPP_CONFIG, if it exists.
+const defaultConfigFile = "picsapp.yaml"
+
+// Sources of a setting, for the startup summary.
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// loadConfig reads the configuration from the file, environment and
+// command-line arguments (without the program and command names), parsed
+// by fs with the command's own flags; positional arguments are left in
+// fs.Args(). It returns the path of the file read, "" if none, and the
+// source of every setting by key.
+func loadConfig(fs *flag.FlagSet, args []string) (cfg *Config, file string, sources map[string]string, err error) {
+	cfg = defaultConfig()
+	fields := configFields(cfg)
+	sources = make(map[string]string, len(fields))
+	for _, f := range fields {
+		sources[f.key] = sourceDefault
+	}
+
+	configPath := fs.String("config", "", "config file (default: $PICSAPP_CONFIG, else "+defaultConfigFile+" if it exists)")
+	flagValues := make(map[string]string)
+	for _, f := range fields {
+		key := f.key
+		fs.Func(strings.ReplaceAll(key, "_", "-"), "overrides $"+strings.ToUpper(key), func(v string) error {
+			flagValues[key] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, "", nil, err
+	}
+
+	file = *configPath
+	if file == "" {
+		file = os.Getenv("PICSAPP_CONFIG")
+	}
+	if file == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			file = defaultConfigFile
+		}
+	}
+	if file != "" {
+		if err := readConfigFile(file, cfg, sources); err != nil {
+			return nil, "", nil, err
+		}
+	}
+
+	for _, f := range fields {
+		env := strings.ToUpper(f.key)
+		if v := os.Getenv(env); v != "" {
+			if err := setConfigField(f.value, v); err != nil {
+				return nil, "", nil, fmt.Errorf("%s: %w", env, err)
+			}
+			sources[f.key] = sourceEnv
+		}
+		if v, ok := flagValues[f.key]; ok {
+			if err := setConfigField(f.value, v); err != nil {
+				return nil, "", nil, fmt.Errorf("-%s: %w", strings.ReplaceAll(f.key, "_", "-"), err)
+			}
+			sources[f.key] = sourceFlag
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, "", nil, err
+	}
+	return cfg, file, sources, nil
+}
+
+// readConfigFile reads a YAML config file into cfg, rejecting unknown keys,
+// and marks the keys it sets in sources.
+func readConfigFile(path string, cfg *Config, sources map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	var keys map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	for key := range keys {
+		sources[key] = sourceFile
+	}
+	return nil
+}
+
+// validate checks that every setting is in range.
+func (c *Config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.Port >= 1 && c.Port <= 65535, "port must be 1-65535")
+	mode, err := strconv.ParseUint(c.SocketMode, 8, 32)
+	check(err == nil && mode <= 0777, "socket_mode must be octal permissions such as 0660")
+	check(c.DatabasePath != "", "database_path must be set")
+	check(c.UploadDir != "", "upload_dir must be set")
+	check(c.ProjectorDir != "", "projector_dir must be set")
+	check(c.RecapDir != "", "recap_dir must be set")
+	check(storageBackends[c.Storage], "storage must be local, memory or s3")
+	if c.Storage == "s3" {
+		check(c.S3Bucket != "", "s3_bucket must be set with storage: s3")
+	}
+	if c.Storage == "s3" || c.ArchiveBucket != "" || c.BackupBucket != "" {
+		check(c.S3Endpoint != "" && !strings.Contains(c.S3Endpoint, "://"), "s3_endpoint must be a host[:port], without a scheme")
+		check((c.S3AccessKey == "") == (c.S3SecretKey == ""), "s3_access_key and s3_secret_key must be set together")
+	}
+	check(c.S3PublicURL == "" || strings.HasPrefix(c.S3PublicURL, "http://") || strings.HasPrefix(c.S3PublicURL, "https://"), "s3_public_url must be an http:// or https:// URL")
+	check(c.PublicAssetBaseURL == "" || strings.HasPrefix(c.PublicAssetBaseURL, "http://") || strings.HasPrefix(c.PublicAssetBaseURL, "https://"), "public_asset_base_url must be an http:// or https:// URL")
+	check(sendfileHeaders[c.SendfileHeader], "sendfile_header must be X-Accel-Redirect, X-Sendfile or empty")
+	check(strings.HasPrefix(c.SendfilePrefix, "/") && strings.HasSuffix(c.SendfilePrefix, "/"), "sendfile_prefix must start and end with /")
+	check(c.S3PresignExpiry >= 1 && c.S3PresignExpiry <= 604800, "s3_presign_expiry must be 1-604800 (7 days)")
+	check(c.ArchiveBucket == "" || c.KeepOriginals, "archive_bucket needs keep_originals")
+	check(archiveStorageClasses[c.ArchiveStorageClass], "archive_storage_class must be STANDARD, STANDARD_IA, ONEZONE_IA, INTELLIGENT_TIERING, GLACIER_IR, GLACIER or DEEP_ARCHIVE")
+	check(c.ArchiveAfter >= 0, "archive_after must be 0 or more")
+	check(c.BackupBucket == "" || c.BackupRclone == "", "backup_bucket and backup_rclone can't be set together")
+	check(c.BackupPrefix == "" || strings.HasSuffix(c.BackupPrefix, "/"), "backup_prefix must end with /")
+	check(c.BackupRclone == "" || strings.Contains(c.BackupRclone, ":"), "backup_rclone must be an rclone remote:path")
+	check(c.RclonePath != "", "rclone_path must be set")
+	check(c.BackupInterval >= 60, "backup_interval must be at least 60")
+	check(c.BackupKeep >= 1, "backup_keep must be at least 1")
+	check(c.SnapshotRateMB >= 0, "snapshot_rate_mb must be 0 (no limit) or more")
+	_, ok := logLevels[c.LogLevel]
+	check(ok, "log_level must be info, warn or error")
+	check(filepath.Clean(c.ProjectorDir) != filepath.Clean(c.UploadDir), "projector_dir must not be upload_dir, which is served publicly")
+	check(c.ReadHeaderTimeout >= 1, "read_header_timeout must be at least 1")
+	check(c.ReadTimeout >= 0, "read_timeout must be 0 (no limit) or more")
+	check(c.WriteTimeout >= 0, "write_timeout must be 0 (no limit) or more")
+	check(c.IdleTimeout >= 1, "idle_timeout must be at least 1")
+	check(c.UploadTimeout >= 0, "upload_timeout must be 0 (no limit) or more")
+	check(c.MaxHeaderKB >= 4, "max_header_kb must be at least 4")
+	check((c.TLSCertFile == "") == (c.TLSKeyFile == ""), "tls_cert_file and tls_key_file must be set together")
+	check(c.TLSCertFile == "" || c.TLSDomains == "", "tls_domains can't be used with tls_cert_file")
+	check(c.TLSDomains == "" || len(parseDomains(c.TLSDomains)) > 0, "tls_domains must name a domain")
+	check(c.TLSDomains == "" || c.TLSCacheDir != "", "tls_cache_dir must be set with tls_domains")
+	check(c.HTTPPort >= 0 && c.HTTPPort <= 65535, "http_port must be 0 (off) or 1-65535")
+	check(c.HTTPPort == 0 || c.TLSCertFile != "" || c.TLSDomains != "", "http_port needs tls_cert_file or tls_domains")
+	check(c.HTTPPort == 0 || c.HTTPPort != c.Port, "http_port must differ from port")
+	if c.DebugAddr != "" {
+		_, _, err := net.SplitHostPort(c.DebugAddr)
+		check(err == nil, "debug_addr must be host:port, e.g. 127.0.0.1:6060")
+	}
+	if c.OTelExporterOTLPEndpoint != "" {
+		u, err := url.Parse(c.OTelExporterOTLPEndpoint)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"otel_exporter_otlp_endpoint must be an http(s) URL, e.g. http://collector:4318")
+	}
+	check(c.OTelServiceName != "", "otel_service_name must be set")
+	check(c.MaxUploadMB >= 1, "max_upload_mb must be at least 1")
+	check(c.MaxImageDimension >= 64, "max_image_dimension must be at least 64")
+	check(c.WebPQuality >= 1 && c.WebPQuality <= 100, "webp_quality must be 1-100")
+	check(c.ProjectorMaxDimension == 0 || c.ProjectorMaxDimension > c.MaxImageDimension,
+		"projector_max_dimension must be 0 (off) or larger than max_image_dimension")
+	check(c.ProjectorQuality >= 1 && c.ProjectorQuality <= 100, "projector_quality must be 1-100")
+	check(c.ConversionTimeout >= 1, "conversion_timeout must be at least 1")
+	check(c.ConversionMaxAttempts >= 1, "conversion_max_attempts must be at least 1")
+	check(c.MaxConcurrentUploads >= 0, "max_concurrent_uploads must be 0 (no limit) or more")
+	check(c.MaxConcurrentDecodes >= 0, "max_concurrent_decodes must be 0 (no limit) or more")
+	check(c.ConversionWorkers >= 1, "conversion_workers must be at least 1")
+	check(c.MinFreeDiskMB >= 0, "min_free_disk_mb must be 0 (off) or more")
+	check(c.EventQuotaMB >= 0, "event_quota_mb must be 0 (no quota) or more")
+	check(c.SessionTTL >= 1, "session_ttl must be at least 1")
+	check(c.AdminPassword == "" || validCredentials(c.AdminUsername, c.AdminPassword) == nil,
+		"admin_username must be 3-32 characters from A-Z a-z 0-9 _ . - and admin_password 8-72 bytes")
+	check(c.HotImages >= 0, "hot_images must be 0 (off) or more")
+	check(c.MaxGalleryPictures >= 1, "max_gallery_pictures must be at least 1")
+	check(c.SnapshotTop >= 0, "snapshot_top must be 0 or more")
+	check(c.SnapshotNewest >= 30, "snapshot_newest must be at least 30, the pictures of the home page")
+	check(c.GCInterval >= 0, "gc_interval must be 0 (off) or more")
+	check(c.GCGrace >= 0, "gc_grace must be 0 or more")
+	check(c.TrashHours >= 1, "trash_hours must be at least 1")
+	if c.IngestDir != "" {
+		ingest := filepath.Clean(c.IngestDir)
+		check(ingest != filepath.Clean(c.UploadDir) && ingest != filepath.Join(c.UploadDir, "original"), "ingest_dir must not be upload_dir or its original directory")
+	}
+	check(eventIDPattern.MatchString(c.IngestEvent), "ingest_event must be an event ID")
+	check(c.IngestSettle >= 1, "ingest_settle must be at least 1")
+	check(c.VariantCacheMB >= 0, "variant_cache_mb must be 0 (off) or more")
+	check(c.VariantCacheMB == 0 || c.VariantCacheDir != "", "variant_cache_dir must be set with variant_cache_mb")
+	check(c.WSCompression == "on" || c.WSCompression == "off", "ws_compression must be on or off")
+	check(c.MaxWSClients >= 0, "max_ws_clients must be 0 (no limit) or more")
+	check(c.RedisChannel != "", "redis_channel must be set")
+	if c.PublicURL != "" {
+		u, err := url.Parse(c.PublicURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.RawQuery == "",
+			"public_url must be an http(s) URL, e.g. https://pics.example.com")
+	}
+	check((c.OAuthGoogleClientID == "") == (c.OAuthGoogleClientSecret == ""), "oauth_google_client_id and oauth_google_client_secret must be set together")
+	check(c.OAuthGoogleClientID == "" || c.PublicURL != "", "public_url must be set with oauth_google_client_id")
+	check(c.LikeRateLimit >= 0, "like_rate_limit must be 0 (no limit) or more")
+	check(c.UploadRateLimit >= 0, "upload_rate_limit must be 0 (no limit) or more")
+	check(c.DeviceUploadLimit >= 0, "device_upload_limit must be 0 (no limit) or more")
+	check(c.UserUploadLimit >= 0, "user_upload_limit must be 0 (no limit) or more")
+	check(c.FilterAction == filterMask || c.FilterAction == filterReject, "filter_action must be mask or reject")
+	check(c.AutoBanRejections >= 0, "auto_ban_rejections must be 0 (off) or more")
+	check(c.AutoBanReports >= 0, "auto_ban_reports must be 0 (off) or more")
+	check(c.AutoBanHours >= 0, "auto_ban_hours must be 0 (until lifted) or more")
+	check(c.CaptchaProvider == "" || c.CaptchaProvider == captchaHCaptcha || c.CaptchaProvider == captchaTurnstile,
+		"captcha_provider must be hcaptcha, turnstile or empty")
+	check(c.CaptchaProvider == "" || (c.CaptchaSiteKey != "" && c.CaptchaSecret != ""),
+		"captcha_site_key and captcha_secret must be set with captcha_provider")
+	check(c.TermsVersion == "" || c.TermsText != "", "terms_version needs terms_text")
+	check(c.LikeBurstThreshold >= 0, "like_burst_threshold must be 0 (off) or more")
+	check(c.LikeBurstWindow >= 1, "like_burst_window must be at least 1")
+	check(c.SpotlightCooldown >= 0, "spotlight_cooldown must be 0 or more")
+	check(c.NewPictureMinutes >= 0, "new_picture_minutes must be 0 (off) or more")
+	check(c.RotationMinutes >= 0, "rotation_minutes must be 0 (off) or more")
+	_, milestonesErr := parseMilestones(c.LikeMilestones)
+	check(milestonesErr == nil, "like_milestones must be comma-separated like counts, e.g. 10,50,100")
+	if c.MilestoneWebhookURL != "" {
+		u, err := url.Parse(c.MilestoneWebhookURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "milestone_webhook_url must be an http(s) URL")
+	}
+	if c.SlackWebhookURL != "" {
+		u, err := url.Parse(c.SlackWebhookURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "slack_webhook_url must be an http(s) URL")
+	}
+	if c.DiscordWebhookURL != "" {
+		u, err := url.Parse(c.DiscordWebhookURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "discord_webhook_url must be an http(s) URL")
+	}
+	_, kindsErr := parseNoticeKinds(c.NotifyEvents)
+	check(kindsErr == nil, "notify_events must list "+strings.Join(noticeKinds, ", "))
+	check(c.FFmpegPath != "", "ffmpeg_path must be set")
+	if c.RedisURL != "" {
+		_, err := url.Parse(c.RedisURL)
+		check(err == nil, "redis_url is not a URL")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// applyConfig sets the server's settings from cfg.
+func applyConfig(cfg *Config) {
+	port = strconv.Itoa(cfg.Port)
+	socketPath = cfg.SocketPath
+	mode, _ := strconv.ParseUint(cfg.SocketMode, 8, 32)
+	socketMode = fs.FileMode(mode)
+	dbPath = cfg.DatabasePath
+	uploadDir = cfg.UploadDir
+	originalDir = filepath.Join(cfg.UploadDir, "original")
+	quarantineDir = filepath.Join(cfg.UploadDir, "quarantine")
+	trashDir = filepath.Join(cfg.UploadDir, "trash")
+	projectorDir = cfg.ProjectorDir
+	recapDir = cfg.RecapDir
+	variantCacheDir = cfg.VariantCacheDir
+	variantCacheBytes = int64(cfg.VariantCacheMB) << 20
+	hotImageCount = cfg.HotImages
+	maxGalleryPictures = cfg.MaxGalleryPictures
+	conversionWorkers = cfg.ConversionWorkers
+	snapshotTop = cfg.SnapshotTop
+	snapshotNewest = cfg.SnapshotNewest
+	ingestDir = cfg.IngestDir
+	ingestEvent = cfg.IngestEvent
+	ingestSettle = time.Duration(cfg.IngestSettle) * time.Second
+	frontendDir = cfg.FrontendDir
+	sendfileHeader = cfg.SendfileHeader
+	sendfilePrefix = cfg.SendfilePrefix
+	keepOriginals = cfg.KeepOriginals
+	archiveAfter = time.Duration(cfg.ArchiveAfter) * time.Hour
+
+	readHeaderTimeout = time.Duration(cfg.ReadHeaderTimeout) * time.Second
+	readTimeout = time.Duration(cfg.ReadTimeout) * time.Second
+	writeTimeout = time.Duration(cfg.WriteTimeout) * time.Second
+	idleTimeout = time.Duration(cfg.IdleTimeout) * time.Second
+	uploadTimeout = time.Duration(cfg.UploadTimeout) * time.Second
+	maxHeaderBytes = cfg.MaxHeaderKB << 10
+
+	tlsCertFile = cfg.TLSCertFile
+	tlsKeyFile = cfg.TLSKeyFile
+	tlsDomains = parseDomains(cfg.TLSDomains)
+	tlsCacheDir = cfg.TLSCacheDir
+	tlsEmail = cfg.TLSEmail
+	httpPort = ""
+	if cfg.HTTPPort != 0 {
+		httpPort = strconv.Itoa(cfg.HTTPPort)
+	}
+
+	debugAddr = cfg.DebugAddr
+	debugAdmin = cfg.DebugAdmin
+
+	otlpEndpoint = cfg.OTelExporterOTLPEndpoint
+	otelServiceName = cfg.OTelServiceName
+
+	adminToken = cfg.AdminToken
+	presenterToken = cfg.PresenterToken
+	adminUsername = cfg.AdminUsername
+	adminPassword = cfg.AdminPassword
+	allowSignup = cfg.AllowSignup
+	sessionTTL = time.Duration(cfg.SessionTTL) * time.Hour
+	sessionCookieSecure = cfg.SessionCookieSecure
+	allowedOrigins = parseOrigins(cfg.AllowedOrigins)
+	devMode = cfg.DevMode
+	upgrader.EnableCompression = cfg.WSCompression != "off"
+	redisURL = cfg.RedisURL
+	redisChannel = cfg.RedisChannel
+	configuredDeviceSecret = cfg.DeviceSecret
+	oauthProviders = configuredOAuthProviders(cfg)
+	publicURL = strings.TrimSuffix(cfg.PublicURL, "/")
+
+	ffmpegPath = cfg.FFmpegPath
+	recapMusicDir = cfg.RecapMusicDir
+
+	applyReloadable(cfg)
+}
+
+// applyReloadable sets the settings tagged reload, which a reload changes
+// while the server runs.
+func applyReloadable(cfg *Config) {
+	logLevel.Store(logLevels[cfg.LogLevel])
+	publicAssetBaseURL.Store(strings.TrimSuffix(cfg.PublicAssetBaseURL, "/"))
+
+	maxUploadBytes.Store(int64(cfg.MaxUploadMB) << 20)
+	maxImageDimension.Store(cfg.MaxImageDimension)
+	webpQuality.Store(cfg.WebPQuality)
+	projectorMaxDimension.Store(cfg.ProjectorMaxDimension)
+	projectorQuality.Store(cfg.ProjectorQuality)
+	conversionTimeout.Store(time.Duration(cfg.ConversionTimeout) * time.Second)
+	maxConversionAttempts.Store(cfg.ConversionMaxAttempts)
+	uploadSlots.setLimit(cfg.MaxConcurrentUploads)
+	decodeSlots.setLimit(cfg.MaxConcurrentDecodes)
+	minFreeDiskBytes.Store(uint64(cfg.MinFreeDiskMB) << 20)
+	defaultEventQuota.Store(int64(cfg.EventQuotaMB) << 20)
+	gcInterval.Store(time.Duration(cfg.GCInterval) * time.Second)
+	gcGrace.Store(time.Duration(cfg.GCGrace) * time.Second)
+	trashRetention.Store(time.Duration(cfg.TrashHours) * time.Hour)
+	readOnly.Store(cfg.ReadOnly)
+	snapshotRate.Store(int64(cfg.SnapshotRateMB) << 20)
+
+	maxWSClients.Store(cfg.MaxWSClients)
+	likeLimiter.setRate(cfg.LikeRateLimit)
+	uploadLimiter.setRate(cfg.UploadRateLimit)
+	deviceUploadLimit.Store(cfg.DeviceUploadLimit)
+	userUploadLimit.Store(cfg.UserUploadLimit)
+	moderateUploads.Store(cfg.ModerateUploads)
+	moderateText.Store(cfg.ModerateText)
+	textFilterConfig.Store(newTextFilter(cfg.FilterWords, cfg.FilterPII, cfg.FilterAction))
+	autoBanRejections.Store(cfg.AutoBanRejections)
+	autoBanReports.Store(cfg.AutoBanReports)
+	autoBanHours.Store(cfg.AutoBanHours)
+	requireSignin.Store(cfg.RequireSignin)
+	captchaConfig.Store(&captchaSettings{provider: cfg.CaptchaProvider, siteKey: cfg.CaptchaSiteKey, secret: cfg.CaptchaSecret})
+	termsConfig.Store(newTermsSettings(strings.TrimSpace(cfg.TermsText), cfg.TermsVersion))
+
+	likeBurstThreshold.Store(cfg.LikeBurstThreshold)
+	likeBurstWindow.Store(time.Duration(cfg.LikeBurstWindow) * time.Second)
+	spotlightCooldown.Store(time.Duration(cfg.SpotlightCooldown) * time.Second)
+	newPictureWindow.Store(time.Duration(cfg.NewPictureMinutes) * time.Minute)
+	rotationPeriod.Store(time.Duration(cfg.RotationMinutes) * time.Minute)
+
+	milestones, _ := parseMilestones(cfg.LikeMilestones)
+	likeMilestones.Store(milestones)
+	milestoneWebhookURL.Store(cfg.MilestoneWebhookURL)
+
+	kinds, _ := parseNoticeKinds(cfg.NotifyEvents)
+	notifyEvents.Store(kinds)
+	slackWebhookURL.Store(cfg.SlackWebhookURL)
+	discordWebhookURL.Store(cfg.DiscordWebhookURL)
+}
+
+// logConfig logs the effective value and source of every setting.
+func logConfig(cfg *Config, file string, sources map[string]string) {
+	if file != "" {
+		logInfo("config file: %s", file)
+	}
+	for _, f := range configFields(cfg) {
+		value := fmt.Sprint(f.value.Interface())
+		if f.secret && value != "" {
+			value = "********"
+		}
+		logInfo("config: %s=%s (%s)", f.key, value, sources[f.key])
+	}
+}
+
+// configField is a setting of Config.
+type configField struct {
+	key    string
+	value  reflect.Value
+	secret bool
+	reload bool
+}
+
+// configFields returns the settings of cfg in declaration order.
+func configFields(cfg *Config) []configField {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	fields := make([]configField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		fields = append(fields, configField{
+			key:    t.Field(i).Tag.Get("yaml"),
+			value:  v.Field(i),
+			secret: t.Field(i).Tag.Get("secret") == "true",
+			reload: t.Field(i).Tag.Get("reload") == "true",
+		})
+	}
+	return fields
+}
+
+// setConfigField parses an environment variable or flag value into a
+// setting.
+func setConfigField(v reflect.Value, raw string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Kind())
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Bounds of a contest round's title and pictures.
+const (
+	maxContestTitle    = 100
+	minContestPictures = 2
+	maxContestPictures = 100
+)
+
+// Seconds displays count down before revealing the winners of an
+// announced round.
+const (
+	defaultRevealCountdown = 10
+	maxRevealCountdown     = 120
+)
+
+var (
+	errContestOpen      = errors.New("a contest round is already open")
+	errContestAnnounced = errors.New("the contest round is already announced")
+)
+
+// ContestRound is a vote between some of an event's pictures. Likes a
+// picture receives while the round is open count as its votes; closing
+// the round freezes the tally and decides the winners. An event has at
+// most one open round.
+type ContestRound struct {
+	ID       int64           `json:"id"`
+	EventID  string          `json:"eventId"`
+	Title    string          `json:"title"`
+	OpenedAt time.Time       `json:"openedAt"`
+	ClosedAt *time.Time      `json:"closedAt,omitempty"`
+	Entries  []*ContestEntry `json:"entries"`
+	// Winners are the pictures with the most votes once the round is
+	// closed; several on a tie, none if nobody voted. Announcing the
+	// round stores them.
+	Winners []string `json:"winners,omitempty"`
+	// AnnouncedAt is when the winners were announced, and RevealAt when
+	// displays reveal them after the countdown; unset until announced.
+	AnnouncedAt *time.Time `json:"announcedAt,omitempty"`
+	RevealAt    *time.Time `json:"revealAt,omitempty"`
+}
+
+// ContestEntry is a picture of a round and the votes it received.
+type ContestEntry struct {
+	PictureID string `json:"pictureId"`
+	Votes     int    `json:"votes"`
+}
+
+// OpenContestRequest is the body of POST /api/admin/contest/rounds.
+type OpenContestRequest struct {
+	Title    string   `json:"title"`
+	Pictures []string `json:"pictures"`
+}
+
+// AnnounceContestRequest is the optional body of POST
+// /api/admin/contest/{id}/announce.
+type AnnounceContestRequest struct {
+	// Countdown is the seconds before the winners are revealed, 10 if
+	// unset
+	Countdown *int `json:"countdown"`
+}
+
+// ContestReveal is the payload of a contest_reveal message.
+type ContestReveal struct {
+	Round *ContestRound `json:"round"`
+	// Countdown is the seconds from the announcement to Round.RevealAt
+	Countdown int `json:"countdown"`
+}
+
+// ContestResults is the response of GET /api/contest/{id}/results: the
+// announced round and its winning pictures.
+type ContestResults struct {
+	*ContestRound
+	// WinnerPictures are the pictures of Winners, in order, leaving out
+	// those deleted or hidden since
+	WinnerPictures []*Picture `json:"winnerPictures"`
+}
+
+// tally sorts a round's entries by votes, keeping the order they were
+// entered in on ties, and sets the winners of a closed round.
+func (c *ContestRound) tally() {
+	sort.SliceStable(c.Entries, func(i, j int) bool {
+		return c.Entries[i].Votes > c.Entries[j].Votes
+	})
+	c.Winners = nil
+	if c.ClosedAt == nil {
+		return
+	}
+	for _, e := range c.Entries {
+		if e.Votes == 0 || e.Votes < c.Entries[0].Votes {
+			break
+		}
+		c.Winners = append(c.Winners, e.PictureID)
+	}
+}
+
+// handleOpenContest opens a voting round over some of the request event's
+// pictures.
+func handleOpenContest(w http.ResponseWriter, r *http.Request) {
+	var req OpenContestRequest
+	event, ok := decodeEventRequest(w, r, &req, 64<<10)
+	if !ok {
+		return
+	}
+	if req.Title == "" || len(req.Title) > maxContestTitle {
+		http.Error(w, fmt.Sprintf("Title must be 1-%d bytes", maxContestTitle), http.StatusBadRequest)
+		return
+	}
+	if len(req.Pictures) < minContestPictures || len(req.Pictures) > maxContestPictures {
+		http.Error(w, fmt.Sprintf("A round has %d-%d pictures", minContestPictures, maxContestPictures), http.StatusBadRequest)
+		return
+	}
+	round := &ContestRound{
+		EventID:  event,
+		Title:    req.Title,
+		OpenedAt: time.Now().UTC().Truncate(time.Second),
+		Entries:  make([]*ContestEntry, 0, len(req.Pictures)),
+	}
+	seen := make(map[string]bool, len(req.Pictures))
+	for _, id := range req.Pictures {
+		if seen[id] {
+			http.Error(w, fmt.Sprintf("Duplicate picture %q", id), http.StatusBadRequest)
+			return
+		}
+		seen[id] = true
+		if _, err := eventPicture(id, event); err != nil {
+			http.Error(w, fmt.Sprintf("Unknown picture %q", id), http.StatusBadRequest)
+			return
+		}
+		round.Entries = append(round.Entries, &ContestEntry{PictureID: id})
+	}
+
+	if err := db.OpenContestRound(round); errors.Is(err, errContestOpen) {
+		http.Error(w, "A round is already open", http.StatusConflict)
+		return
+	} else if err != nil {
+		logError("open contest round failed: %v", err)
+		http.Error(w, "Error opening round", http.StatusInternalServerError)
+		return
+	}
+	hub.publish(event, msgContest, round)
+
+	logInfo("contest round %d opened with %d pictures (event=%s)", round.ID, len(round.Entries), event)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(round)
+}
+
+// handleCloseContest closes a round, freezing its votes, and announces
+// the winners.
+func handleCloseContest(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	}
+	if err := db.CloseContestRound(id, time.Now().UTC().Truncate(time.Second)); err == sql.ErrNoRows {
+		// Either unknown or already closed
+		if _, err := db.GetContestRound(id); err == nil {
+			http.Error(w, "Round already closed", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError("close contest round failed: %v", err)
+		http.Error(w, "Error closing round", http.StatusInternalServerError)
+		return
+	}
+	round, err := db.GetContestRound(id)
+	if err != nil {
+		logError("get contest round failed: %v", err)
+		http.Error(w, "Error closing round", http.StatusInternalServerError)
+		return
+	}
+	hub.publish(round.EventID, msgContest, round)
+
+	logInfo("contest round %d closed, winners %v (event=%s)", round.ID, round.Winners, round.EventID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(round)
+}
+
+// handleListContests lists the request event's rounds, newest first, with
+// their current tallies.
+func handleListContests(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	rounds, err := db.GetContestRounds(event)
+	if err != nil {
+		logError("get contest rounds failed: %v", err)
+		http.Error(w, "Error fetching rounds", http.StatusInternalServerError)
+		return
+	}
+	if rounds == nil {
+		rounds = []*ContestRound{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rounds)
+}
+
+// handleContestResults returns one round's tally, and its winners once
+// it is closed.
+func handleContestResults(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	}
+	round, err := db.GetContestRound(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("get contest round failed: %v", err)
+		http.Error(w, "Error fetching round", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(round)
+}
+
+// handleAnnounceContest closes a round if it is still open, stores its
+// winners and has the event's displays reveal them after a countdown.
+func handleAnnounceContest(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	}
+	var req AnnounceContestRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	countdown := defaultRevealCountdown
+	if req.Countdown != nil {
+		countdown = *req.Countdown
+	}
+	if countdown < 0 || countdown > maxRevealCountdown {
+		http.Error(w, fmt.Sprintf("Countdown must be 0-%d seconds", maxRevealCountdown), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	// Freeze the votes; a round closed before keeps its closing time
+	if err := db.CloseContestRound(id, now); err != nil && err != sql.ErrNoRows {
+		logError("close contest round failed: %v", err)
+		http.Error(w, "Error announcing round", http.StatusInternalServerError)
+		return
+	}
+	round, err := db.GetContestRound(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("get contest round failed: %v", err)
+		http.Error(w, "Error announcing round", http.StatusInternalServerError)
+		return
+	}
+	revealAt := now.Add(time.Duration(countdown) * time.Second)
+	round.AnnouncedAt, round.RevealAt = &now, &revealAt
+	if err := db.AnnounceContestRound(round); errors.Is(err, errContestAnnounced) {
+		http.Error(w, "Round already announced", http.StatusConflict)
+		return
+	} else if err != nil {
+		logError("announce contest round failed: %v", err)
+		http.Error(w, "Error announcing round", http.StatusInternalServerError)
+		return
+	}
+	hub.publishTransient(round.EventID, msgContestReveal, &ContestReveal{Round: round, Countdown: countdown})
+
+	logInfo("contest round %d announced, winners %v revealed in %ds (event=%s)", round.ID, round.Winners, countdown, round.EventID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(round)
+}
+
+// handleAnnouncedResults returns an announced round with its winning
+// pictures, for the results page. Like displays, the page should hold the
+// winners back until RevealAt.
+func handleAnnouncedResults(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	}
+	round, err := db.GetContestRound(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("get contest round failed: %v", err)
+		http.Error(w, "Error fetching results", http.StatusInternalServerError)
+		return
+	}
+	if round.AnnouncedAt == nil {
+		http.Error(w, "Results not announced yet", http.StatusNotFound)
+		return
+	}
+	results := &ContestResults{ContestRound: round, WinnerPictures: []*Picture{}}
+	for _, pictureID := range round.Winners {
+		pic, err := db.GetPicture(pictureID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			logError("get picture failed: %v", err)
+			http.Error(w, "Error fetching results", http.StatusInternalServerError)
+			return
+		}
+		if !pic.Hidden {
+			results.WinnerPictures = append(results.WinnerPictures, pic)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+var errUnknownPlaylist = errors.New("unknown playlist")
+
+// actionControl is the client message type of presentation remote-control
+// commands.
+const actionControl = "control"
+
+// Remote-control commands. Displays keep their own slideshow position and
+// apply each command as it arrives.
+const (
+	controlNext        = "next"
+	controlPrevious    = "previous"
+	controlPause       = "pause"
+	controlResume      = "resume"
+	controlJump        = "jump"
+	controlLeaderboard = "leaderboard"
+	controlPlaylist    = "playlist"
+)
+
+var controlCommands = map[string]bool{
+	controlNext:        true,
+	controlPrevious:    true,
+	controlPause:       true,
+	controlResume:      true,
+	controlJump:        true,
+	controlLeaderboard: true,
+	controlPlaylist:    true,
+}
+
+// ControlPayload is the payload of a control message from a presenter and
+// of the control broadcast relayed to displays. ID is the picture to show
+// for jump, or for playlist the playlist to run the slideshow from (empty
+// for the event's setting); other commands don't use it. Display, if set,
+// addresses the command to one display instead of every display of the
+// event.
+type ControlPayload struct {
+	Command string `json:"command"`
+	ID      string `json:"id,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+func init() {
+	inboundHandlers[actionControl] = inboundHandler{minRole: RolePresenter, fn: handleControlAction}
+}
+
+// handleControlAction relays a presenter's command to every display of the
+// client's event. Commands aren't stored: they are sent as transient
+// messages so a display that reconnects doesn't replay old clicks.
+func handleControlAction(c *client, payload json.RawMessage) error {
+	var control ControlPayload
+	if err := json.Unmarshal(payload, &control); err != nil || !controlCommands[control.Command] {
+		return errInvalidPayload
+	}
+	switch control.Command {
+	case controlJump:
+		if _, err := eventPicture(control.ID, c.event); err != nil {
+			return err
+		}
+	case controlPlaylist:
+		if control.ID != "" {
+			exists, err := db.PlaylistExists(c.event, control.ID)
+			if err != nil {
+				logError("check playlist failed: %v", err)
+			}
+			if !exists {
+				return errUnknownPlaylist
+			}
+		}
+	default:
+		control.ID = ""
+	}
+	if control.Display != "" {
+		if _, err := eventDisplay(control.Display, c.event); err != nil {
+			if !errors.Is(err, errUnknownDisplay) {
+				logError("get display failed: %v", err)
+			}
+			return errUnknownDisplay
+		}
+		logInfo("presentation control %s (event=%s role=%s display=%s)", control.Command, c.event, c.role, control.Display)
+		hub.publishToDisplay(c.event, control.Display, msgControl, &control)
+		return nil
+	}
+	logInfo("presentation control %s (event=%s role=%s)", control.Command, c.event, c.role)
+	hub.publishTransient(c.event, msgControl, &control)
+	return nil
+}
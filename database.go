@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -12,6 +17,17 @@ import (
 
 type Database struct {
 	db *sql.DB
+
+	// picturesVersion counts the writes to pictures; see PicturesVersion
+	picturesVersion atomic.Uint64
+
+	// addMu serializes AddPicture, so two pictures added at once can't
+	// both take the same free filename
+	addMu sync.Mutex
+
+	// trashColumns are the columns of pictures, copied whole to and from
+	// trashed_pictures
+	trashColumns string
 }
 
 func NewDatabase(dbPath string) (*Database, error) {
@@ -37,7 +53,13 @@ func (d *Database) initSchema() error {
 		filename TEXT NOT NULL,
 		url TEXT NOT NULL,
 		likes INTEGER DEFAULT 0,
-		uploaded_at DATETIME NOT NULL
+		uploaded_at DATETIME NOT NULL,
+		event_id TEXT NOT NULL DEFAULT 'default',
+		hidden INTEGER NOT NULL DEFAULT 0,
+		width INTEGER NOT NULL DEFAULT 0,
+		height INTEGER NOT NULL DEFAULT 0,
+		blurhash TEXT NOT NULL DEFAULT '',
+		projector_url TEXT NOT NULL DEFAULT ''
 	);
 	
 	CREATE INDEX IF NOT EXISTS idx_uploaded_at ON pictures(uploaded_at);
@@ -48,13 +70,320 @@ func (d *Database) initSchema() error {
 		original_path TEXT NOT NULL UNIQUE,
 		original_name TEXT,
 		picture_id TEXT,
+		event_id TEXT NOT NULL DEFAULT 'default',
 		status TEXT NOT NULL DEFAULT 'pending',
 		error TEXT,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		trace_parent TEXT NOT NULL DEFAULT '',
 		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_conversion_status ON conversion_tasks(status);
+
+	CREATE TABLE IF NOT EXISTS announcements (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id TEXT NOT NULL,
+		message TEXT NOT NULL,
+		priority TEXT NOT NULL DEFAULT 'normal',
+		display_id TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_announcements_event_expires ON announcements(event_id, expires_at);
+
+	CREATE TABLE IF NOT EXISTS presentation_settings (
+		event_id TEXT PRIMARY KEY,
+		ordering TEXT NOT NULL DEFAULT 'likes',
+		slide_interval INTEGER NOT NULL DEFAULT 8,
+		transition TEXT NOT NULL DEFAULT 'fade',
+		show_likes INTEGER NOT NULL DEFAULT 1,
+		interrupt_on_upload INTEGER NOT NULL DEFAULT 0,
+		playlist TEXT NOT NULL DEFAULT '',
+		likes_close_at TEXT NOT NULL DEFAULT '',
+		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS displays (
+		id TEXT PRIMARY KEY,
+		event_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at DATETIME NOT NULL,
+		last_seen_at DATETIME,
+		revoked_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_displays_event ON displays(event_id);
+
+	CREATE TABLE IF NOT EXISTS presentation_schedule (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id TEXT NOT NULL,
+		mode TEXT NOT NULL,
+		starts_at DATETIME NOT NULL,
+		ends_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_schedule_event_starts ON presentation_schedule(event_id, starts_at);
+
+	CREATE TABLE IF NOT EXISTS playlists (
+		event_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY (event_id, name)
+	);
+
+	CREATE TABLE IF NOT EXISTS playlist_pictures (
+		event_id TEXT NOT NULL,
+		playlist TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		picture_id TEXT NOT NULL,
+		PRIMARY KEY (event_id, playlist, position)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_playlist_pictures_picture ON playlist_pictures(picture_id);
+
+	CREATE TABLE IF NOT EXISTS spotlight_shows (
+		event_id TEXT NOT NULL,
+		display TEXT NOT NULL,
+		picture_id TEXT NOT NULL,
+		shown_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_spotlight_display_shown ON spotlight_shows(event_id, display, shown_at);
+
+	CREATE TABLE IF NOT EXISTS slides_shown (
+		display_id TEXT NOT NULL,
+		picture_id TEXT NOT NULL,
+		shown_at DATETIME NOT NULL,
+		PRIMARY KEY (display_id, picture_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_slides_shown_picture ON slides_shown(picture_id);
+
+	CREATE TABLE IF NOT EXISTS contest_rounds (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id TEXT NOT NULL,
+		title TEXT NOT NULL,
+		opened_at DATETIME NOT NULL,
+		closed_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_contest_rounds_event ON contest_rounds(event_id, closed_at);
+
+	CREATE TABLE IF NOT EXISTS contest_entries (
+		round_id INTEGER NOT NULL,
+		picture_id TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		votes INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (round_id, picture_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_contest_entries_picture ON contest_entries(picture_id);
+
+	CREATE TABLE IF NOT EXISTS contest_winners (
+		round_id INTEGER NOT NULL,
+		picture_id TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		votes INTEGER NOT NULL,
+		PRIMARY KEY (round_id, picture_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_contest_winners_picture ON contest_winners(picture_id);
+
+	CREATE TABLE IF NOT EXISTS recap_tasks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		progress REAL NOT NULL DEFAULT 0,
+		pictures INTEGER NOT NULL,
+		duration INTEGER NOT NULL,
+		music TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		finished_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_recap_tasks_event ON recap_tasks(event_id);
+	CREATE INDEX IF NOT EXISTS idx_recap_tasks_status ON recap_tasks(status);
+
+	CREATE TABLE IF NOT EXISTS storage_migrations (
+		target TEXT NOT NULL,
+		area TEXT NOT NULL,
+		key TEXT NOT NULL,
+		sha256 TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		migrated_at DATETIME NOT NULL,
+		PRIMARY KEY (target, area, key)
+	);
+
+	CREATE TABLE IF NOT EXISTS event_quotas (
+		event_id TEXT PRIMARY KEY,
+		quota_bytes INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS event_access_codes (
+		event_id TEXT PRIMARY KEY,
+		code TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS event_exports (
+		event_id TEXT PRIMARY KEY,
+		exports INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'viewer',
+		created_at DATETIME NOT NULL,
+		last_login_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS user_identities (
+		provider TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id INTEGER NOT NULL,
+		email TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (provider, subject)
+	);
+	CREATE INDEX IF NOT EXISTS idx_user_identities_user ON user_identities(user_id);
+
+	CREATE TABLE IF NOT EXISTS bans (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind TEXT NOT NULL,
+		value TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		created_by TEXT NOT NULL,
+		expires_at DATETIME,
+		UNIQUE (kind, value)
+	);
+
+	CREATE TABLE IF NOT EXISTS upload_counts (
+		event_id TEXT NOT NULL,
+		uploader TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (event_id, uploader)
+	);
+
+	CREATE TABLE IF NOT EXISTS sessions (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+	CREATE INDEX IF NOT EXISTS idx_sessions_expires ON sessions(expires_at);
+
+	CREATE TABLE IF NOT EXISTS likes (
+		picture_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		liked_at DATETIME NOT NULL,
+		PRIMARY KEY (picture_id, device_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_likes_device ON likes(device_id);
+	CREATE INDEX IF NOT EXISTS idx_likes_liked_at ON likes(liked_at);
+
+	CREATE TABLE IF NOT EXISTS reactions (
+		picture_id TEXT NOT NULL,
+		reactor TEXT NOT NULL,
+		emoji TEXT NOT NULL,
+		reacted_at DATETIME NOT NULL,
+		PRIMARY KEY (picture_id, reactor, emoji)
+	);
+
+	CREATE TABLE IF NOT EXISTS share_codes (
+		code TEXT PRIMARY KEY,
+		picture_id TEXT NOT NULL UNIQUE,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS secrets (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS reports (
+		picture_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		reported_at DATETIME NOT NULL,
+		PRIMARY KEY (picture_id, device_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS comments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		picture_id TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		device_id TEXT NOT NULL DEFAULT '',
+		text TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_comments_picture ON comments(picture_id, id);
+
+	CREATE TABLE IF NOT EXISTS activity (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		picture_id TEXT NOT NULL,
+		comment_id INTEGER NOT NULL DEFAULT 0,
+		likes INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_activity_event ON activity(event_id, id);
+	CREATE INDEX IF NOT EXISTS idx_activity_picture ON activity(picture_id);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_activity_milestone ON activity(picture_id, likes) WHERE kind = 'milestone';
+
+	CREATE TABLE IF NOT EXISTS guestbook (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		text TEXT NOT NULL,
+		device_id TEXT NOT NULL DEFAULT '',
+		user_id INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		moderation TEXT NOT NULL DEFAULT '',
+		moderated_at DATETIME,
+		moderated_by TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS idx_guestbook_event ON guestbook(event_id, id);
+
+	CREATE TABLE IF NOT EXISTS terms_acceptances (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		version TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		device_id TEXT NOT NULL DEFAULT '',
+		user_id INTEGER NOT NULL DEFAULT 0,
+		accepted_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_terms_device ON terms_acceptances(device_id, version);
+	CREATE INDEX IF NOT EXISTS idx_terms_user ON terms_acceptances(user_id, version) WHERE user_id != 0;
+
+	CREATE TABLE IF NOT EXISTS privacy_deletions (
+		id TEXT PRIMARY KEY,
+		deleted_at DATETIME NOT NULL,
+		device INTEGER NOT NULL,
+		account INTEGER NOT NULL,
+		pictures INTEGER NOT NULL,
+		pending_uploads INTEGER NOT NULL,
+		likes INTEGER NOT NULL,
+		comments INTEGER NOT NULL,
+		reports INTEGER NOT NULL,
+		reactions INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS picture_aliases (
+		old_id TEXT PRIMARY KEY,
+		picture_id TEXT NOT NULL,
+		old_key TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_picture_aliases_picture ON picture_aliases(picture_id);
+	CREATE INDEX IF NOT EXISTS idx_picture_aliases_key ON picture_aliases(old_key) WHERE old_key != '';
 	`
 
 	if _, err := d.db.Exec(query); err != nil {
@@ -68,26 +397,331 @@ func (d *Database) initSchema() error {
 		}
 	}
 
+	// Event columns for legacy DBs; existing rows belong to the default event
+	d.addColumn("pictures", "event_id", "TEXT NOT NULL DEFAULT '"+defaultEventID+"'")
+	d.addColumn("conversion_tasks", "event_id", "TEXT NOT NULL DEFAULT '"+defaultEventID+"'")
+
+	// Conversions started, so images that crash the worker are given up on
+	d.addColumn("conversion_tasks", "attempts", "INTEGER NOT NULL DEFAULT 0")
+
+	// Trace context of the upload, so its conversion joins the trace
+	d.addColumn("conversion_tasks", "trace_parent", "TEXT NOT NULL DEFAULT ''")
+
+	// Display settings added after the ordering
+	d.addColumn("presentation_settings", "slide_interval", "INTEGER NOT NULL DEFAULT 8")
+	d.addColumn("presentation_settings", "transition", "TEXT NOT NULL DEFAULT 'fade'")
+	d.addColumn("presentation_settings", "show_likes", "INTEGER NOT NULL DEFAULT 1")
+	d.addColumn("presentation_settings", "interrupt_on_upload", "INTEGER NOT NULL DEFAULT 0")
+	d.addColumn("presentation_settings", "playlist", "TEXT NOT NULL DEFAULT ''")
+	d.addColumn("presentation_settings", "likes_close_at", "TEXT NOT NULL DEFAULT ''")
+
+	// Announcements addressed to one display; '' means every display
+	d.addColumn("announcements", "display_id", "TEXT NOT NULL DEFAULT ''")
+
+	// Pictures kept in the archive but left off the public wall
+	d.addColumn("pictures", "hidden", "INTEGER NOT NULL DEFAULT 0")
+
+	// Image size and placeholder for slideshow preloading; 0 and '' until
+	// known
+	d.addColumn("pictures", "width", "INTEGER NOT NULL DEFAULT 0")
+	d.addColumn("pictures", "height", "INTEGER NOT NULL DEFAULT 0")
+	d.addColumn("pictures", "blurhash", "TEXT NOT NULL DEFAULT ''")
+
+	// Projector rendition, '' if the picture has none
+	d.addColumn("pictures", "projector_url", "TEXT NOT NULL DEFAULT ''")
+
+	// Version of the picture's file, counting the conversions that
+	// rewrote it; see assetURL
+	d.addColumn("pictures", "file_version", "INTEGER NOT NULL DEFAULT 1")
+
+	// Key of the picture's files in the stores; '' for files stored flat
+	// under the ID, before the sharded layout
+	d.addColumn("pictures", "file_key", "TEXT NOT NULL DEFAULT ''")
+
+	// Original kept with KEEP_ORIGINALS, by its key in the original store,
+	// and where it was archived to; '' for none and not yet
+	d.addColumn("pictures", "original_key", "TEXT NOT NULL DEFAULT ''")
+	d.addColumn("pictures", "original_location", "TEXT NOT NULL DEFAULT ''")
+
+	// Size of the picture's image and projector rendition, counted against
+	// its event's quota; 0 until known
+	d.addColumn("pictures", "file_bytes", "INTEGER NOT NULL DEFAULT 0")
+
+	// Anonymous device that uploaded the picture; '' for pictures that
+	// didn't come through /api/upload or came before devices
+	d.addColumn("conversion_tasks", "device_id", "TEXT NOT NULL DEFAULT ''")
+	d.addColumn("pictures", "device_id", "TEXT NOT NULL DEFAULT ''")
+
+	// Caption given with the upload, after the text filter; '' for none
+	d.addColumn("conversion_tasks", "caption", "TEXT NOT NULL DEFAULT ''")
+	d.addColumn("pictures", "caption", "TEXT NOT NULL DEFAULT ''")
+
+	// Moderation state of hidden pictures, 'pending' or 'rejected', and
+	// who last approved, rejected or restored the picture and when
+	d.addColumn("pictures", "moderation", "TEXT NOT NULL DEFAULT ''")
+	d.addColumn("pictures", "moderated_at", "DATETIME")
+	d.addColumn("pictures", "moderated_by", "TEXT NOT NULL DEFAULT ''")
+
+	// Photographers aren't held to the upload limits
+	d.addColumn("users", "photographer", "INTEGER NOT NULL DEFAULT 0")
+
+	// Real name of a user, from their OAuth provider; '' for none. Uploads
+	// of signed-in users are attributed to it, or to their username
+	d.addColumn("users", "name", "TEXT NOT NULL DEFAULT ''")
+	d.addColumn("conversion_tasks", "uploaded_by", "TEXT NOT NULL DEFAULT ''")
+	d.addColumn("pictures", "uploaded_by", "TEXT NOT NULL DEFAULT ''")
+
+	// Signed-in user who uploaded the picture, for deleting their data; 0
+	// for anonymous uploads and those from before
+	d.addColumn("conversion_tasks", "user_id", "INTEGER NOT NULL DEFAULT 0")
+	d.addColumn("pictures", "user_id", "INTEGER NOT NULL DEFAULT 0")
+
+	// Caption held back with MODERATE_TEXT until a moderator approves it
+	// into caption; '' for none
+	d.addColumn("pictures", "pending_caption", "TEXT NOT NULL DEFAULT ''")
+
+	// Moderation state of comments, 'pending' with MODERATE_TEXT until
+	// approved or 'rejected', and who decided and when
+	d.addColumn("comments", "moderation", "TEXT NOT NULL DEFAULT ''")
+	d.addColumn("comments", "moderated_at", "DATETIME")
+	d.addColumn("comments", "moderated_by", "TEXT NOT NULL DEFAULT ''")
+
+	// Guestbook messages a deletion removed; 0 on receipts from before the
+	// guestbook
+	d.addColumn("privacy_deletions", "guestbook", "INTEGER NOT NULL DEFAULT 0")
+
+	// When a contest round's winners were announced and are revealed;
+	// NULL until announced
+	d.addColumn("contest_rounds", "announced_at", "DATETIME")
+	d.addColumn("contest_rounds", "reveal_at", "DATETIME")
+
+	// Downloads of the picture's original from /api/pictures/{id}/original
+	d.addColumn("pictures", "downloads", "INTEGER NOT NULL DEFAULT 0")
+
+	// How the picture arrived ('web', 'api', 'hot_folder', 'recovered');
+	// '' for pictures from before it was recorded
+	d.addColumn("conversion_tasks", "source", "TEXT NOT NULL DEFAULT ''")
+	d.addColumn("pictures", "source", "TEXT NOT NULL DEFAULT ''")
+
+	// When a picture scheduled by an admin is published; '' for pictures
+	// published as they're converted or already published
+	d.addColumn("conversion_tasks", "publish_at", "TEXT NOT NULL DEFAULT ''")
+	d.addColumn("pictures", "publish_at", "TEXT NOT NULL DEFAULT ''")
+
+	// The picture a completed task converted, for the uploader's receipt;
+	// '' until then
+	d.addColumn("conversion_tasks", "result_id", "TEXT NOT NULL DEFAULT ''")
+
+	// Pictures a moderator deleted wait in trashed_pictures, with every
+	// column of pictures, until restored or purged after TRASH_HOURS
+	if err := d.initTrash(); err != nil {
+		return err
+	}
+	if _, err := d.db.Exec(`
+	CREATE INDEX IF NOT EXISTS idx_event_uploaded_at ON pictures(event_id, uploaded_at);
+	CREATE INDEX IF NOT EXISTS idx_event_likes ON pictures(event_id, likes);
+	CREATE INDEX IF NOT EXISTS idx_pictures_publish_at ON pictures(publish_at) WHERE publish_at != '';
+	`); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// addColumn adds a column to an existing table, ignoring the error SQLite
+// returns when the column is already present.
+func (d *Database) addColumn(table, column, definition string) {
+	query := fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition)
+	if _, err := d.db.Exec(query); err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") {
+			log.Printf("warning: unable to add %s.%s column: %v", table, column, err)
+		}
+	}
+}
+
+// initTrash creates trashed_pictures as a copy of the pictures table, and
+// adds to it the columns pictures gained since, so that trashing and
+// restoring a picture copy its whole row.
+func (d *Database) initTrash() error {
+	if _, err := d.db.Exec(`CREATE TABLE IF NOT EXISTS trashed_pictures AS SELECT * FROM pictures WHERE 0`); err != nil {
+		return err
+	}
+	columns, definitions, err := d.tableColumns("pictures")
+	if err != nil {
+		return err
+	}
+	_, trashed, err := d.tableColumns("trashed_pictures")
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		if _, ok := trashed[column]; !ok {
+			d.addColumn("trashed_pictures", column, definitions[column])
+		}
+	}
+	d.addColumn("trashed_pictures", "deleted_at", "TEXT NOT NULL DEFAULT ''")
+	d.addColumn("trashed_pictures", "deleted_by", "TEXT NOT NULL DEFAULT ''")
+	d.trashColumns = strings.Join(columns, ", ")
+	_, err = d.db.Exec(`
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_trashed_pictures_id ON trashed_pictures(id);
+	CREATE INDEX IF NOT EXISTS idx_trashed_pictures_deleted_at ON trashed_pictures(deleted_at);
+	`)
+	return err
+}
+
+// tableColumns returns the columns of a table in order, and their type and
+// default as given to ADD COLUMN.
+func (d *Database) tableColumns(table string) ([]string, map[string]string, error) {
+	rows, err := d.db.Query(`SELECT name, type, dflt_value FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	definitions := map[string]string{}
+	for rows.Next() {
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&name, &typ, &dflt); err != nil {
+			return nil, nil, err
+		}
+		if dflt.Valid {
+			typ += " DEFAULT " + dflt.String
+		}
+		columns = append(columns, name)
+		definitions[name] = typ
+	}
+	return columns, definitions, rows.Err()
+}
+
+// Ping checks that the database answers.
+func (d *Database) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+// Checkpoint flushes the write-ahead log into the database file, when the
+// database uses one, and lets SQLite update its query planner statistics,
+// as it recommends before closing.
+func (d *Database) Checkpoint() error {
+	if _, err := d.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return err
+	}
+	_, err := d.db.Exec(`PRAGMA optimize`)
+	return err
+}
+
+// Snapshot writes a consistent copy of the database to path, which must
+// not exist, while it is in use.
+func (d *Database) Snapshot(path string) error {
+	_, err := d.db.Exec(`VACUUM INTO ?`, path)
+	return err
+}
+
 func (d *Database) Close() error {
 	return d.db.Close()
 }
 
+// PicturesVersion changes whenever a picture is added or changed, so that
+// results read from the pictures can be cached until it does.
+func (d *Database) PicturesVersion() uint64 {
+	return d.picturesVersion.Load()
+}
+
+// PicturesChanged changes PicturesVersion, for changes made elsewhere such
+// as by other instances.
+func (d *Database) PicturesChanged() {
+	d.picturesVersion.Add(1)
+}
+
+const pictureColumns = `id, filename, url, likes, uploaded_at, event_id, hidden, width, height, blurhash, projector_url, file_version, file_key, device_id, moderation, caption, uploaded_by, user_id, pending_caption, source, publish_at`
+
+// prefixedPictureColumns is pictureColumns qualified with a table alias,
+// for queries joining pictures with another table.
+func prefixedPictureColumns(alias string) string {
+	columns := strings.Split(pictureColumns, ", ")
+	for i, c := range columns {
+		columns[i] = alias + "." + c
+	}
+	return strings.Join(columns, ", ")
+}
+
+// AddPicture inserts picture, numbering its filename ("stem (2).ext") if
+// another picture of its event already has it.
 func (d *Database) AddPicture(picture *Picture) error {
-	query := `INSERT INTO pictures (id, filename, url, likes, uploaded_at) VALUES (?, ?, ?, ?, ?)`
-	_, err := d.db.Exec(query, picture.ID, picture.Filename, picture.URL, picture.Likes, picture.UploadedAt.Format(time.RFC3339))
+	d.addMu.Lock()
+	defer d.addMu.Unlock()
+	filename, err := d.freeFilename(picture.EventID, picture.Filename)
+	if err != nil {
+		return err
+	}
+	picture.Filename = filename
+	picture.IsNew = picture.isNew(time.Now())
+	query := `INSERT INTO pictures (id, filename, url, likes, uploaded_at, event_id, hidden, width, height, blurhash, projector_url, file_key, device_id, moderation, caption, uploaded_by, user_id, pending_caption, source, publish_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = d.db.Exec(query, picture.ID, picture.Filename, picture.URL, picture.Likes, picture.UploadedAt.Format(time.RFC3339), picture.EventID, picture.Hidden,
+		picture.Width, picture.Height, picture.Blurhash, picture.ProjectorURL, picture.FileKey, picture.DeviceID, picture.Moderation, picture.Caption, picture.UploadedBy, picture.UserID, picture.PendingCaption, picture.Source, formatPublishAt(picture.PublishAt))
+	d.PicturesChanged()
 	return err
 }
 
+// freeFilename is name, or name numbered with the lowest number no picture
+// of event has it with.
+func (d *Database) freeFilename(event, name string) (string, error) {
+	if name == "" {
+		return name, nil
+	}
+	stem, ext := splitExtension(name)
+	escape := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	rows, err := d.db.Query(`SELECT filename FROM pictures WHERE event_id = ? AND (filename = ? OR filename LIKE ? ESCAPE '\')`,
+		event, name, escape.Replace(stem)+" (%)"+escape.Replace(ext))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	taken := map[string]bool{}
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			return "", err
+		}
+		taken[filename] = true
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	n := 1
+	for taken[numberedFilename(name, n)] {
+		n++
+	}
+	return numberedFilename(name, n), nil
+}
+
+// GetPicturesUploadedBetween returns the visible pictures of every event
+// uploaded after from and by to, oldest first.
+func (d *Database) GetPicturesUploadedBetween(from, to time.Time) ([]*Picture, error) {
+	query := `SELECT ` + pictureColumns + ` FROM pictures WHERE hidden = 0 AND uploaded_at > ? AND uploaded_at <= ? ORDER BY uploaded_at`
+	return d.queryPictures(query, from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339))
+}
+
 func (d *Database) GetPicture(id string) (*Picture, error) {
-	query := `SELECT id, filename, url, likes, uploaded_at FROM pictures WHERE id = ?`
-	row := d.db.QueryRow(query, id)
+	return scanPicture(d.db.QueryRow(`SELECT `+pictureColumns+` FROM pictures WHERE id = ?`, id))
+}
+
+// scanFunc is a Scan method, for scanning a row of pictureColumns followed
+// by more columns with scanPicture.
+type scanFunc func(dest ...interface{}) error
+
+func (f scanFunc) Scan(dest ...interface{}) error {
+	return f(dest...)
+}
 
+// scanPicture scans a row of pictureColumns.
+func scanPicture(row interface{ Scan(...interface{}) error }) (*Picture, error) {
 	var picture Picture
-	var uploadedAtStr string
-	err := row.Scan(&picture.ID, &picture.Filename, &picture.URL, &picture.Likes, &uploadedAtStr)
+	var uploadedAtStr, publishAtStr string
+	var version int
+	err := row.Scan(&picture.ID, &picture.Filename, &picture.URL, &picture.Likes, &uploadedAtStr, &picture.EventID, &picture.Hidden,
+		&picture.Width, &picture.Height, &picture.Blurhash, &picture.ProjectorURL, &version, &picture.FileKey, &picture.DeviceID, &picture.Moderation, &picture.Caption, &picture.UploadedBy, &picture.UserID, &picture.PendingCaption, &picture.Source, &publishAtStr)
 	if err != nil {
 		return nil, err
 	}
@@ -96,110 +730,666 @@ func (d *Database) GetPicture(id string) (*Picture, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse time: %w", err)
 	}
+	if picture.PublishAt, err = parsePublishAt(publishAtStr); err != nil {
+		return nil, fmt.Errorf("failed to parse time: %w", err)
+	}
+	picture.URL = assetURL(picture.URL, version)
+	picture.IsNew = picture.isNew(time.Now())
+	if picture.FileKey == "" {
+		picture.FileKey = picture.ID
+	}
 
 	return &picture, nil
 }
 
-func (d *Database) GetLastPictures(n int) ([]*Picture, error) {
-	query := `SELECT id, filename, url, likes, uploaded_at FROM pictures ORDER BY uploaded_at DESC LIMIT ?`
-	rows, err := d.db.Query(query, n)
+// GetLastPictures, GetAllPicturesSortedByLikes and GetTopLikes only see
+// the pictures on the public wall; hidden pictures are left out.
+func (d *Database) GetLastPictures(eventID string, n int) ([]*Picture, error) {
+	query := `SELECT ` + pictureColumns + ` FROM pictures WHERE event_id = ? AND hidden = 0 ORDER BY uploaded_at DESC LIMIT ?`
+	return d.queryPictures(query, eventID, n)
+}
+
+// GetAllPicturesSortedByLikes returns the visible pictures of an event,
+// most liked first, up to maxGalleryPictures of them.
+func (d *Database) GetAllPicturesSortedByLikes(eventID string) ([]*Picture, error) {
+	query := `SELECT ` + pictureColumns + ` FROM pictures WHERE event_id = ? AND hidden = 0 ORDER BY likes DESC, uploaded_at DESC LIMIT ?`
+	return d.queryPictures(query, eventID, maxGalleryPictures)
+}
+
+// EachPictureSortedByLikes calls fn with limit of the visible pictures of
+// an event from offset, in the order of GetAllPicturesSortedByLikes, as
+// the rows are read.
+func (d *Database) EachPictureSortedByLikes(eventID string, offset, limit int, fn func(*Picture) error) error {
+	query := `SELECT ` + pictureColumns + ` FROM pictures WHERE event_id = ? AND hidden = 0 ORDER BY likes DESC, uploaded_at DESC LIMIT ? OFFSET ?`
+	return d.eachPicture(fn, query, eventID, limit, offset)
+}
+
+// GetTopPictures returns the n most liked visible pictures of an event,
+// most liked first.
+func (d *Database) GetTopPictures(eventID string, n int) ([]*Picture, error) {
+	query := `SELECT ` + pictureColumns + ` FROM pictures WHERE event_id = ? AND hidden = 0 ORDER BY likes DESC, uploaded_at DESC LIMIT ?`
+	return d.queryPictures(query, eventID, n)
+}
+
+// GetTopFileKeys returns the file keys of the n most liked visible
+// pictures of every event, in the order of GetTopPictures.
+func (d *Database) GetTopFileKeys(n int) ([]string, error) {
+	rows, err := d.db.Query(`SELECT CASE WHEN file_key = '' THEN id ELSE file_key END FROM (
+		SELECT id, file_key, ROW_NUMBER() OVER (PARTITION BY event_id ORDER BY likes DESC, uploaded_at DESC) AS rank
+		FROM pictures WHERE hidden = 0
+	) WHERE rank <= ?`, n)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var pictures []*Picture
+	var keys []string
 	for rows.Next() {
-		var picture Picture
-		var uploadedAtStr string
-		if err := rows.Scan(&picture.ID, &picture.Filename, &picture.URL, &picture.Likes, &uploadedAtStr); err != nil {
+		var key string
+		if err := rows.Scan(&key); err != nil {
 			return nil, err
 		}
-
-		picture.UploadedAt, err = time.Parse(time.RFC3339, uploadedAtStr)
-		if err != nil {
-			log.Printf("Warning: failed to parse time for picture %s: %v", picture.ID, err)
-			continue
-		}
-
-		pictures = append(pictures, &picture)
+		keys = append(keys, key)
 	}
+	return keys, rows.Err()
+}
 
-	return pictures, rows.Err()
+// GetArchivedPictures returns every picture of an event, hidden ones
+// included, newest first.
+func (d *Database) GetArchivedPictures(eventID string) ([]*Picture, error) {
+	query := `SELECT ` + pictureColumns + ` FROM pictures WHERE event_id = ? ORDER BY uploaded_at DESC`
+	return d.queryPictures(query, eventID)
 }
 
-func (d *Database) GetAllPicturesSortedByLikes() ([]*Picture, error) {
-	query := `SELECT id, filename, url, likes, uploaded_at FROM pictures ORDER BY likes DESC, uploaded_at DESC`
-	rows, err := d.db.Query(query)
+// GetPictureGroups returns the visible pictures of an event grouped by the
+// hour, or the day, they were uploaded in a time zone offset minutes east
+// of UTC, newest first. Count covers every picture of a group; at most per
+// of the newest are listed (0 for all), and no more than
+// maxGalleryPictures in all.
+func (d *Database) GetPictureGroups(eventID string, byDay bool, offset, per int) ([]*PictureGroup, error) {
+	bucketFormat, layout := `%Y-%m-%dT%H:00:00`, "2006-01-02T15:00:00"
+	if byDay {
+		bucketFormat, layout = `%Y-%m-%d`, "2006-01-02"
+	}
+	modifier := fmt.Sprintf("%+d minutes", offset)
+	zone := time.FixedZone("", offset*60)
+	if per == 0 {
+		per = maxGalleryPictures
+	}
+
+	rows, err := d.db.Query(`SELECT strftime(?, uploaded_at, ?) AS bucket, COUNT(*) FROM pictures
+		WHERE event_id = ? AND hidden = 0 AND bucket IS NOT NULL GROUP BY bucket ORDER BY bucket DESC`,
+		bucketFormat, modifier, eventID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var pictures []*Picture
+	var groups []*PictureGroup
+	byBucket := map[string]*PictureGroup{}
 	for rows.Next() {
-		var picture Picture
-		var uploadedAtStr string
-		if err := rows.Scan(&picture.ID, &picture.Filename, &picture.URL, &picture.Likes, &uploadedAtStr); err != nil {
+		var bucket string
+		group := &PictureGroup{Pictures: []*Picture{}}
+		if err := rows.Scan(&bucket, &group.Count); err != nil {
 			return nil, err
 		}
-
-		picture.UploadedAt, err = time.Parse(time.RFC3339, uploadedAtStr)
-		if err != nil {
-			log.Printf("Warning: failed to parse time for picture %s: %v", picture.ID, err)
-			continue
+		if group.Start, err = time.ParseInLocation(layout, bucket, zone); err != nil {
+			return nil, err
 		}
-
-		pictures = append(pictures, &picture)
+		groups = append(groups, group)
+		byBucket[bucket] = group
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return pictures, rows.Err()
+	query := `SELECT ` + pictureColumns + ` FROM (
+		SELECT *, ROW_NUMBER() OVER (PARTITION BY strftime(?, uploaded_at, ?) ORDER BY uploaded_at DESC) AS rank
+		FROM pictures WHERE event_id = ? AND hidden = 0
+	) WHERE rank <= ? ORDER BY uploaded_at DESC LIMIT ?`
+	err = d.eachPicture(func(p *Picture) error {
+		if group := byBucket[p.UploadedAt.In(zone).Format(layout)]; group != nil {
+			group.Pictures = append(group.Pictures, p)
+		}
+		return nil
+	}, query, bucketFormat, modifier, eventID, per, maxGalleryPictures)
+	return groups, err
 }
 
-func (d *Database) IncrementLikes(id string) error {
-	query := `UPDATE pictures SET likes = likes + 1 WHERE id = ?`
-	result, err := d.db.Exec(query, id)
-	if err != nil {
-		return err
+// CountLikes counts the likes given to the pictures of an event, or to one
+// of them when pictureID is set, in [from, to) by interval: counts[i] is
+// the likes of the interval starting at from + i*interval.
+func (d *Database) CountLikes(eventID, pictureID string, from, to time.Time, interval time.Duration) ([]int, error) {
+	step := int64(interval / time.Second)
+	query := `SELECT (CAST(strftime('%s', l.liked_at) AS INTEGER) - ?) / ? AS slot, COUNT(*)
+		FROM likes l JOIN pictures p ON p.id = l.picture_id
+		WHERE p.event_id = ? AND l.liked_at >= ? AND l.liked_at < ?`
+	args := []interface{}{from.Unix(), step, eventID, from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339)}
+	if pictureID != "" {
+		query += ` AND l.picture_id = ?`
+		args = append(args, pictureID)
 	}
-
-	rowsAffected, err := result.RowsAffected()
+	rows, err := d.db.Query(query+` GROUP BY slot`, args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("picture not found")
+	counts := make([]int, (to.Unix()-from.Unix()+step-1)/step)
+	for rows.Next() {
+		var slot sql.NullInt64
+		var n int
+		if err := rows.Scan(&slot, &n); err != nil {
+			return nil, err
+		}
+		if slot.Valid && slot.Int64 >= 0 && slot.Int64 < int64(len(counts)) {
+			counts[slot.Int64] = n
+		}
 	}
+	return counts, rows.Err()
+}
 
-	return nil
+// GetMostLikedBetween returns the n visible pictures of an event that got
+// the most likes in [from, to), most first.
+func (d *Database) GetMostLikedBetween(eventID string, from, to time.Time, n int) ([]*Picture, error) {
+	query := `SELECT ` + prefixedPictureColumns("p") + ` FROM pictures p JOIN likes l ON l.picture_id = p.id
+		WHERE p.event_id = ? AND p.hidden = 0 AND l.liked_at >= ? AND l.liked_at < ?
+		GROUP BY p.id ORDER BY COUNT(*) DESC, p.uploaded_at DESC LIMIT ?`
+	return d.queryPictures(query, eventID, from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339), n)
 }
 
-func (d *Database) LoadAllPictures() ([]*Picture, error) {
-	return d.GetAllPicturesSortedByLikes()
+// GetTopLikes returns the n highest like counts of an event, highest
+// first.
+func (d *Database) GetTopLikes(eventID string, n int) ([]int, error) {
+	rows, err := d.db.Query(`SELECT likes FROM pictures WHERE event_id = ? AND hidden = 0 ORDER BY likes DESC LIMIT ?`, eventID, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ranks := []int{}
+	for rows.Next() {
+		var likes int
+		if err := rows.Scan(&likes); err != nil {
+			return nil, err
+		}
+		ranks = append(ranks, likes)
+	}
+	return ranks, rows.Err()
 }
 
-func (d *Database) UpdatePictureFile(oldID, newID, newURL string) error {
-	query := `UPDATE pictures SET id = ?, url = ? WHERE id = ?`
-	_, err := d.db.Exec(query, newID, newURL, oldID)
-	return err
+// queryPictures runs a query selecting pictureColumns and scans every row.
+// Rows with unparseable timestamps are skipped with a warning.
+func (d *Database) queryPictures(query string, args ...interface{}) ([]*Picture, error) {
+	var pictures []*Picture
+	err := d.eachPicture(func(p *Picture) error {
+		pictures = append(pictures, p)
+		return nil
+	}, query, args...)
+	return pictures, err
 }
 
-type ConversionTask struct {
-	ID           int64
-	OriginalPath string
-	OriginalName string
-	PictureID    *string
+// eachPicture is like queryPictures but calls fn with each picture as its
+// row is read, stopping at the first error fn returns.
+func (d *Database) eachPicture(fn func(*Picture) error, query string, args ...interface{}) error {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var picture Picture
+		var uploadedAtStr, publishAtStr string
+		var version int
+		if err := rows.Scan(&picture.ID, &picture.Filename, &picture.URL, &picture.Likes, &uploadedAtStr, &picture.EventID, &picture.Hidden,
+			&picture.Width, &picture.Height, &picture.Blurhash, &picture.ProjectorURL, &version, &picture.FileKey, &picture.DeviceID, &picture.Moderation, &picture.Caption, &picture.UploadedBy, &picture.UserID, &picture.PendingCaption, &picture.Source, &publishAtStr); err != nil {
+			return err
+		}
+
+		picture.UploadedAt, err = time.Parse(time.RFC3339, uploadedAtStr)
+		if err != nil {
+			log.Printf("Warning: failed to parse time for picture %s: %v", picture.ID, err)
+			continue
+		}
+		if picture.PublishAt, err = parsePublishAt(publishAtStr); err != nil {
+			log.Printf("Warning: failed to parse publish time for picture %s: %v", picture.ID, err)
+			continue
+		}
+		picture.URL = assetURL(picture.URL, version)
+		picture.IsNew = picture.isNew(time.Now())
+		if picture.FileKey == "" {
+			picture.FileKey = picture.ID
+		}
+
+		if err := fn(&picture); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// AddLike adds a device's like to a picture on the public wall and returns
+// the picture with its new like count, read back by the update itself; nil
+// if the device already liked it, as a device likes a picture once. Hidden
+// pictures are reported as sql.ErrNoRows. The like counts as a vote if the
+// picture is in its event's open contest round, in the same transaction so
+// a like storm commits once per like.
+func (d *Database) AddLike(id, deviceID string) (*Picture, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT OR IGNORE INTO likes (picture_id, device_id, liked_at) VALUES (?, ?, ?)`, id, deviceID, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+	pic, err := scanPicture(tx.QueryRow(`UPDATE pictures SET likes = likes + 1 WHERE id = ? AND hidden = 0 RETURNING `+pictureColumns, id))
+	if err != nil {
+		return nil, err
+	}
+	vote := `UPDATE contest_entries SET votes = votes + 1 WHERE picture_id = ?
+	AND round_id IN (SELECT id FROM contest_rounds WHERE event_id = ? AND closed_at IS NULL)`
+	if _, err := tx.Exec(vote, pic.ID, pic.EventID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	d.PicturesChanged()
+	return pic, nil
+}
+
+// AddReaction records a reaction of a reactor (a device or user) to a
+// picture and reports whether it did: each reactor's first reaction with
+// an emoji is counted.
+func (d *Database) AddReaction(pictureID, reactor, emoji string, at time.Time) (bool, error) {
+	result, err := d.db.Exec(`INSERT OR IGNORE INTO reactions (picture_id, reactor, emoji, reacted_at) VALUES (?, ?, ?, ?)`,
+		pictureID, reactor, emoji, at.UTC().Format(time.RFC3339))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetReactions returns the number of reactions to a picture by emoji, and
+// the emojis reactor sent.
+func (d *Database) GetReactions(pictureID, reactor string) (map[string]int, map[string]bool, error) {
+	rows, err := d.db.Query(`SELECT emoji, COUNT(*), MAX(reactor = ?) FROM reactions WHERE picture_id = ? GROUP BY emoji`, reactor, pictureID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	mine := map[string]bool{}
+	for rows.Next() {
+		var emoji string
+		var count int
+		var reacted bool
+		if err := rows.Scan(&emoji, &count, &reacted); err != nil {
+			return nil, nil, err
+		}
+		counts[emoji] = count
+		mine[emoji] = reacted
+	}
+	return counts, mine, rows.Err()
+}
+
+// LoadAllPictures returns the pictures of every event.
+func (d *Database) LoadAllPictures() ([]*Picture, error) {
+	query := `SELECT ` + pictureColumns + ` FROM pictures ORDER BY uploaded_at`
+	return d.queryPictures(query)
+}
+
+// SetPictureHidden hides a picture from the public wall or shows it again.
+// Showing a picture pending moderation or rejected also ends that, and
+// either cancels its scheduled publishing. It returns sql.ErrNoRows if no
+// picture has that ID.
+func (d *Database) SetPictureHidden(id string, hidden bool) error {
+	result, err := d.db.Exec(`UPDATE pictures SET hidden = ?, moderation = CASE WHEN ? THEN moderation ELSE '' END, publish_at = '' WHERE id = ?`, hidden, hidden, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	d.PicturesChanged()
+	return nil
+}
+
+// SetPicturePublishAt hides a picture until at, when PublishDuePictures
+// publishes it. It returns sql.ErrNoRows if no picture has that ID.
+func (d *Database) SetPicturePublishAt(id string, at time.Time) error {
+	result, err := d.db.Exec(`UPDATE pictures SET hidden = 1, publish_at = ? WHERE id = ?`, formatPublishAt(at), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	d.PicturesChanged()
+	return nil
+}
+
+// PublishDuePictures publishes the pictures scheduled for now or earlier
+// and returns them, oldest schedule first. A published picture takes its
+// publish time as its upload time, so it comes first on the wall like a
+// new upload. Pictures another instance published meanwhile are left out,
+// so that each is announced once.
+func (d *Database) PublishDuePictures(now time.Time) ([]*Picture, error) {
+	query := `SELECT ` + pictureColumns + ` FROM pictures WHERE publish_at != '' AND publish_at <= ? AND hidden = 1 AND moderation = '' ORDER BY publish_at`
+	due, err := d.queryPictures(query, now.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	var published []*Picture
+	for _, pic := range due {
+		result, err := d.db.Exec(`UPDATE pictures SET hidden = 0, uploaded_at = publish_at, publish_at = '' WHERE id = ? AND publish_at != '' AND hidden = 1`, pic.ID)
+		if err != nil {
+			return published, err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return published, err
+		} else if n == 0 {
+			continue
+		}
+		pic.Hidden = false
+		pic.UploadedAt, pic.PublishAt = pic.PublishAt, time.Time{}
+		pic.IsNew = pic.isNew(now)
+		published = append(published, pic)
+	}
+	if len(published) > 0 {
+		d.PicturesChanged()
+	}
+	return published, nil
+}
+
+// SetPictureImage stores the size and blurhash of a picture's converted
+// image.
+func (d *Database) SetPictureImage(id string, width, height int, blurhash string) error {
+	_, err := d.db.Exec(`UPDATE pictures SET width = ?, height = ?, blurhash = ? WHERE id = ?`, width, height, blurhash, id)
+	d.PicturesChanged()
+	return err
+}
+
+// SetPictureBytes stores the size of a picture's image and projector
+// rendition together.
+func (d *Database) SetPictureBytes(id string, bytes int64) error {
+	_, err := d.db.Exec(`UPDATE pictures SET file_bytes = ? WHERE id = ?`, bytes, id)
+	return err
+}
+
+// GetPicturesWithoutBytes returns the pictures whose size isn't known,
+// stored by older versions.
+func (d *Database) GetPicturesWithoutBytes() ([]*Picture, error) {
+	return d.queryPictures(`SELECT ` + pictureColumns + ` FROM pictures WHERE file_bytes = 0`)
+}
+
+// SetPictureProjector stores the URL of a picture's projector rendition, or
+// clears it if url is empty.
+func (d *Database) SetPictureProjector(id, url string) error {
+	_, err := d.db.Exec(`UPDATE pictures SET projector_url = ? WHERE id = ?`, url, id)
+	d.PicturesChanged()
+	return err
+}
+
+// UpdatePictureFile points a re-converted picture at its new file, renaming
+// it if its ID changed while keeping its playlist memberships and contest
+// entries, and counts the new version of its file. A renamed picture keeps
+// an alias from its old ID and file key.
+func (d *Database) UpdatePictureFile(oldID, newID, newURL, fileKey string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	if oldID != newID {
+		var oldKey string
+		if err := tx.QueryRow(`SELECT CASE WHEN file_key = '' THEN id ELSE file_key END FROM pictures WHERE id = ?`, oldID).Scan(&oldKey); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if oldKey == fileKey {
+			oldKey = ""
+		}
+		// Links shared with the old ID, and with any before it, lead to the
+		// picture under its new one
+		if _, err := tx.Exec(`UPDATE picture_aliases SET picture_id = ? WHERE picture_id = ?`, newID, oldID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM picture_aliases WHERE old_id = ?`, newID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO picture_aliases (old_id, picture_id, old_key, created_at) VALUES (?, ?, ?, ?)`, oldID, newID, oldKey, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE pictures SET id = ?, url = ?, file_key = ?, projector_url = '', file_version = file_version + 1 WHERE id = ?`, newID, newURL, fileKey, oldID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE playlist_pictures SET picture_id = ? WHERE picture_id = ?`, newID, oldID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE contest_entries SET picture_id = ? WHERE picture_id = ?`, newID, oldID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE contest_winners SET picture_id = ? WHERE picture_id = ?`, newID, oldID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE likes SET picture_id = ? WHERE picture_id = ?`, newID, oldID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE reports SET picture_id = ? WHERE picture_id = ?`, newID, oldID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE comments SET picture_id = ? WHERE picture_id = ?`, newID, oldID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE reactions SET picture_id = ? WHERE picture_id = ?`, newID, oldID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE share_codes SET picture_id = ? WHERE picture_id = ?`, newID, oldID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE activity SET picture_id = ? WHERE picture_id = ?`, newID, oldID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE spotlight_shows SET picture_id = ? WHERE picture_id = ?`, newID, oldID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE slides_shown SET picture_id = ? WHERE picture_id = ?`, newID, oldID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.PicturesChanged()
+	return nil
+}
+
+// SetPictureFile points a picture at a copy of its file under another key,
+// as when moving it into the sharded layout.
+func (d *Database) SetPictureFile(id, url, fileKey string) error {
+	_, err := d.db.Exec(`UPDATE pictures SET url = ?, file_key = ? WHERE id = ?`, url, fileKey, id)
+	d.PicturesChanged()
+	return err
+}
+
+// SetPictureURLs points pictures, by ID, at new URLs of their files in one
+// transaction, as when moving them to another store, and returns how many
+// changed.
+func (d *Database) SetPictureURLs(urls map[string]string) (int, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	for id, url := range urls {
+		result, err := tx.Exec(`UPDATE pictures SET url = ? WHERE id = ? AND url != ?`, url, id, url)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		changed += int(n)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	d.PicturesChanged()
+	return changed, nil
+}
+
+// FileInUse reports whether a picture's files are stored under key. Files
+// stored flat are under the picture's ID.
+func (d *Database) FileInUse(key string) (bool, error) {
+	var n int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM pictures WHERE file_key = ? OR (file_key = '' AND id = ?)`, key, key).Scan(&n)
+	return n > 0, err
+}
+
+// KeptOriginal is the original of a picture kept after its conversion.
+type KeptOriginal struct {
+	PictureID  string
+	Key        string
+	UploadedAt time.Time
+	// Location is the URL of the archived copy, such as
+	// s3://bucket/originals/1700000000000000000.jpg, "" while the original
+	// is in the original store
+	Location string
+}
+
+// GetPictureOriginal returns the key of a picture's kept original and
+// where it was archived to, "" for none and not archived.
+func (d *Database) GetPictureOriginal(id string) (key, location string, err error) {
+	err = d.db.QueryRow(`SELECT original_key, original_location FROM pictures WHERE id = ?`, id).Scan(&key, &location)
+	return key, location, err
+}
+
+// SetPictureOriginal records the key of a picture's kept original.
+func (d *Database) SetPictureOriginal(id, key string) error {
+	_, err := d.db.Exec(`UPDATE pictures SET original_key = ?, original_location = '' WHERE id = ?`, key, id)
+	return err
+}
+
+// GetKeptOriginals returns the kept originals, archived or not.
+func (d *Database) GetKeptOriginals() ([]*KeptOriginal, error) {
+	return d.queryKeptOriginals(`SELECT id, original_key, uploaded_at, original_location FROM pictures WHERE original_key != ''`)
+}
+
+// GetOriginalsToArchive returns up to limit kept originals not archived
+// yet, of pictures uploaded before cutoff, oldest first. Upload times are
+// compared with datetime() as they carry the server's time zone.
+func (d *Database) GetOriginalsToArchive(cutoff time.Time, limit int) ([]*KeptOriginal, error) {
+	return d.queryKeptOriginals(`SELECT id, original_key, uploaded_at, original_location FROM pictures
+		WHERE original_key != '' AND original_location = '' AND datetime(uploaded_at) < datetime(?)
+		ORDER BY datetime(uploaded_at) LIMIT ?`,
+		cutoff.UTC().Format(time.RFC3339), limit)
+}
+
+// SetOriginalLocation records where the kept original under key was
+// archived to. The original is found by key as its picture may have been
+// renamed by a conversion in the meantime.
+func (d *Database) SetOriginalLocation(key, location string) error {
+	_, err := d.db.Exec(`UPDATE pictures SET original_location = ? WHERE original_key = ?`, location, key)
+	return err
+}
+
+func (d *Database) queryKeptOriginals(query string, args ...interface{}) ([]*KeptOriginal, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var originals []*KeptOriginal
+	for rows.Next() {
+		var o KeptOriginal
+		var uploadedAtStr string
+		if err := rows.Scan(&o.PictureID, &o.Key, &uploadedAtStr, &o.Location); err != nil {
+			return nil, err
+		}
+		o.UploadedAt, _ = time.Parse(time.RFC3339, uploadedAtStr)
+		originals = append(originals, &o)
+	}
+	return originals, rows.Err()
+}
+
+type ConversionTask struct {
+	ID           int64
+	OriginalPath string
+	OriginalName string
+	PictureID    *string
+	EventID      string
 	Status       string
 	Error        *string
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+	Attempts     int
+	// TraceParent is the W3C traceparent of the upload that queued the
+	// task, "" if it wasn't traced
+	TraceParent string
+	// DeviceID is the anonymous device that uploaded the original, ""
+	// for other sources
+	DeviceID string
+	// Caption is the uploader's caption, filtered, "" for none
+	Caption string
+	// UploadedBy is the name of the signed-in uploader, "" for none, and
+	// UserID their ID, 0 for none
+	UploadedBy string
+	UserID     int64
+	// Source is how the original arrived (sourceWeb...), "" for
+	// conversions of existing pictures
+	Source string
+	// PublishAt is when the picture is published, zero to publish it as
+	// soon as it's converted
+	PublishAt time.Time
+	// ResultID is the picture a completed task converted, "" until then
+	ResultID  string
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
-func (d *Database) CreateConversionTask(path, name, pictureID string) error {
-	query := `INSERT OR IGNORE INTO conversion_tasks (original_path, original_name, picture_id) VALUES (?, ?, NULLIF(?, ''))`
-	_, err := d.db.Exec(query, path, name, pictureID)
-	return err
+// CreateConversionTask queues the conversion of an original and returns
+// the task's ID, 0 if the original was queued already.
+func (d *Database) CreateConversionTask(path, name, pictureID, eventID, source, deviceID, caption, uploadedBy string, userID int64, publishAt time.Time, traceParent string) (int64, error) {
+	query := `INSERT OR IGNORE INTO conversion_tasks (original_path, original_name, picture_id, event_id, source, device_id, caption, uploaded_by, user_id, publish_at, trace_parent) VALUES (?, ?, NULLIF(?, ''), ?, ?, ?, ?, ?, ?, ?, ?)`
+	res, err := d.db.Exec(query, path, name, pictureID, eventID, source, deviceID, caption, uploadedBy, userID, formatPublishAt(publishAt), traceParent)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return 0, err
+	}
+	return res.LastInsertId()
 }
 
 func (d *Database) ClaimNextTask() (*ConversionTask, error) {
@@ -208,11 +1398,12 @@ func (d *Database) ClaimNextTask() (*ConversionTask, error) {
 		return nil, err
 	}
 
-	row := tx.QueryRow(`SELECT id, original_path, original_name, picture_id, status, error, created_at, updated_at FROM conversion_tasks WHERE status = 'pending' ORDER BY created_at LIMIT 1`)
+	row := tx.QueryRow(`SELECT id, original_path, original_name, picture_id, event_id, status, error, attempts, trace_parent, device_id, caption, uploaded_by, user_id, source, publish_at, created_at, updated_at FROM conversion_tasks WHERE status = 'pending' ORDER BY created_at LIMIT 1`)
 	var task ConversionTask
+	var publishAtStr string
 	var errStr sql.NullString
 	var pictureID sql.NullString
-	if err := row.Scan(&task.ID, &task.OriginalPath, &task.OriginalName, &pictureID, &task.Status, &errStr, &task.CreatedAt, &task.UpdatedAt); err != nil {
+	if err := row.Scan(&task.ID, &task.OriginalPath, &task.OriginalName, &pictureID, &task.EventID, &task.Status, &errStr, &task.Attempts, &task.TraceParent, &task.DeviceID, &task.Caption, &task.UploadedBy, &task.UserID, &task.Source, &publishAtStr, &task.CreatedAt, &task.UpdatedAt); err != nil {
 		if err == sql.ErrNoRows {
 			tx.Rollback()
 			return nil, nil
@@ -220,6 +1411,10 @@ func (d *Database) ClaimNextTask() (*ConversionTask, error) {
 		tx.Rollback()
 		return nil, err
 	}
+	if task.PublishAt, err = parsePublishAt(publishAtStr); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 	if pictureID.Valid {
 		task.PictureID = &pictureID.String
 	}
@@ -227,7 +1422,7 @@ func (d *Database) ClaimNextTask() (*ConversionTask, error) {
 		task.Error = &errStr.String
 	}
 
-	res, err := tx.Exec(`UPDATE conversion_tasks SET status = 'processing', updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = 'pending'`, task.ID)
+	res, err := tx.Exec(`UPDATE conversion_tasks SET status = 'processing', attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = 'pending'`, task.ID)
 	if err != nil {
 		tx.Rollback()
 		return nil, err
@@ -248,8 +1443,61 @@ func (d *Database) ClaimNextTask() (*ConversionTask, error) {
 	return &task, nil
 }
 
-func (d *Database) MarkTaskCompleted(id int64) error {
-	_, err := d.db.Exec(`UPDATE conversion_tasks SET status = 'completed', error = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, id)
+// RequeueTask puts a task being processed back to pending. The attempt is
+// not counted against the task.
+func (d *Database) RequeueTask(id int64) error {
+	_, err := d.db.Exec(`UPDATE conversion_tasks SET status = 'pending', attempts = max(attempts - 1, 0), updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = 'processing'`, id)
+	return err
+}
+
+// RecoverStaleTasks handles tasks left processing for longer than
+// staleAfter, whose conversion was interrupted by a crash: tasks with
+// maxAttempts attempts fail, the others go back to pending. It returns how
+// many tasks were requeued, and the tasks that failed with their ID,
+// original path and name and event.
+func (d *Database) RecoverStaleTasks(staleAfter time.Duration, maxAttempts int) (requeued int64, failed []*ConversionTask, err error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+	// updated_at is CURRENT_TIMESTAMP's UTC "YYYY-MM-DD HH:MM:SS"
+	cutoff := time.Now().UTC().Add(-staleAfter).Format("2006-01-02 15:04:05")
+	stale := `status = 'processing' AND updated_at <= ? AND attempts >= ?`
+	rows, err := tx.Query(`SELECT id, original_path, original_name, event_id FROM conversion_tasks WHERE `+stale, cutoff, maxAttempts)
+	if err != nil {
+		return 0, nil, err
+	}
+	for rows.Next() {
+		var task ConversionTask
+		if err := rows.Scan(&task.ID, &task.OriginalPath, &task.OriginalName, &task.EventID); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		failed = append(failed, &task)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	if _, err := tx.Exec(`UPDATE conversion_tasks SET status = 'failed', error = printf('gave up after %d interrupted attempts', attempts), updated_at = CURRENT_TIMESTAMP
+	WHERE `+stale, cutoff, maxAttempts); err != nil {
+		return 0, nil, err
+	}
+	res, err := tx.Exec(`UPDATE conversion_tasks SET status = 'pending', updated_at = CURRENT_TIMESTAMP WHERE status = 'processing' AND updated_at <= ?`, cutoff)
+	if err != nil {
+		return 0, nil, err
+	}
+	if requeued, err = res.RowsAffected(); err != nil {
+		return 0, nil, err
+	}
+	return requeued, failed, tx.Commit()
+}
+
+// MarkTaskCompleted marks a task completed, recording the picture it
+// converted.
+func (d *Database) MarkTaskCompleted(id int64, resultID string) error {
+	_, err := d.db.Exec(`UPDATE conversion_tasks SET status = 'completed', error = NULL, result_id = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, resultID, id)
 	return err
 }
 
@@ -257,3 +1505,2205 @@ func (d *Database) MarkTaskFailed(id int64, msg string) error {
 	_, err := d.db.Exec(`UPDATE conversion_tasks SET status = 'failed', error = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, msg, id)
 	return err
 }
+
+// SetTaskOriginalPath records where a task's original was moved to.
+func (d *Database) SetTaskOriginalPath(id int64, path string) error {
+	_, err := d.db.Exec(`UPDATE conversion_tasks SET original_path = ? WHERE id = ?`, path, id)
+	return err
+}
+
+// PruneConversionTasks deletes completed and failed conversion tasks last
+// updated before cutoff, and returns how many were deleted and the
+// original paths of the failed ones, whose files the caller deletes.
+func (d *Database) PruneConversionTasks(cutoff time.Time) (int64, []string, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+	// updated_at is CURRENT_TIMESTAMP's UTC "YYYY-MM-DD HH:MM:SS"
+	before := cutoff.UTC().Format("2006-01-02 15:04:05")
+	rows, err := tx.Query(`SELECT original_path FROM conversion_tasks WHERE status = 'failed' AND updated_at < ?`, before)
+	if err != nil {
+		return 0, nil, err
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	res, err := tx.Exec(`DELETE FROM conversion_tasks WHERE status IN ('completed', 'failed') AND updated_at < ?`, before)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, paths, tx.Commit()
+}
+
+// GetConversionTask returns a conversion task, or sql.ErrNoRows if there
+// is none.
+func (d *Database) GetConversionTask(id int64) (*ConversionTask, error) {
+	tasks, err := d.queryConversionTasks(`WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return tasks[0], nil
+}
+
+// GetFailedConversionTasks returns an event's failed conversion tasks,
+// last failed first.
+func (d *Database) GetFailedConversionTasks(eventID string) ([]*ConversionTask, error) {
+	return d.queryConversionTasks(`WHERE status = 'failed' AND event_id = ? ORDER BY updated_at DESC, id DESC`, eventID)
+}
+
+func (d *Database) queryConversionTasks(where string, args ...interface{}) ([]*ConversionTask, error) {
+	rows, err := d.db.Query(`SELECT id, original_path, original_name, picture_id, event_id, status, error, attempts, trace_parent, device_id, caption, uploaded_by, user_id, source, publish_at, result_id, created_at, updated_at
+		FROM conversion_tasks `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []*ConversionTask
+	for rows.Next() {
+		var task ConversionTask
+		var publishAtStr string
+		var errStr, pictureID sql.NullString
+		if err := rows.Scan(&task.ID, &task.OriginalPath, &task.OriginalName, &pictureID, &task.EventID, &task.Status, &errStr, &task.Attempts, &task.TraceParent, &task.DeviceID, &task.Caption, &task.UploadedBy, &task.UserID, &task.Source, &publishAtStr, &task.ResultID, &task.CreatedAt, &task.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if task.PublishAt, err = parsePublishAt(publishAtStr); err != nil {
+			return nil, err
+		}
+		if pictureID.Valid {
+			task.PictureID = &pictureID.String
+		}
+		if errStr.Valid {
+			task.Error = &errStr.String
+		}
+		tasks = append(tasks, &task)
+	}
+	return tasks, rows.Err()
+}
+
+// GetActiveConversionTasks returns the pending and processing conversion
+// tasks, with their ID, original path and status.
+func (d *Database) GetActiveConversionTasks() ([]*ConversionTask, error) {
+	rows, err := d.db.Query(`SELECT id, original_path, status FROM conversion_tasks WHERE status IN ('pending', 'processing') ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tasks []*ConversionTask
+	for rows.Next() {
+		var task ConversionTask
+		if err := rows.Scan(&task.ID, &task.OriginalPath, &task.Status); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, &task)
+	}
+	return tasks, rows.Err()
+}
+
+// ConversionTaskCounts returns the number of conversion tasks by status.
+func (d *Database) ConversionTaskCounts() (map[string]int, error) {
+	rows, err := d.db.Query(`SELECT status, COUNT(*) FROM conversion_tasks GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+	return counts, rows.Err()
+}
+
+// EventStats summarizes an event's pictures.
+type EventStats struct {
+	EventID  string `json:"eventId"`
+	Pictures int    `json:"pictures"`
+	Hidden   int    `json:"hidden"`
+	Likes    int    `json:"likes"`
+	// Bytes is the size of the event's files, counted against its quota
+	Bytes int64 `json:"bytes"`
+	// QuotaBytes is the event's quota, 0 for none; set by eventStats
+	QuotaBytes int64 `json:"quotaBytes"`
+	OverQuota  bool  `json:"overQuota"`
+	// Downloads counts the downloads of the event's originals, and
+	// Exports those of its ZIP export
+	Downloads int `json:"downloads"`
+	Exports   int `json:"exports"`
+	// Sources counts the event's pictures by how they arrived, those from
+	// before it was recorded as sourceUnknown
+	Sources map[string]int `json:"sources"`
+}
+
+// eventFiles selects the files of the pictures of an event, once each as
+// pictures with the same image share them within an event.
+const eventFiles = `SELECT event_id, MAX(file_bytes) AS bytes FROM pictures
+	GROUP BY event_id, CASE WHEN file_key = '' THEN id ELSE file_key END`
+
+// GetEventStats returns the picture counts, likes, file sizes and downloads
+// of every event with pictures, by event ID.
+func (d *Database) GetEventStats() ([]*EventStats, error) {
+	rows, err := d.db.Query(`SELECT p.event_id, COUNT(*), SUM(p.hidden), COALESCE(SUM(p.likes), 0),
+		(SELECT COALESCE(SUM(f.bytes), 0) FROM (` + eventFiles + `) f WHERE f.event_id = p.event_id),
+		COALESCE(SUM(p.downloads), 0), COALESCE((SELECT e.exports FROM event_exports e WHERE e.event_id = p.event_id), 0)
+		FROM pictures p GROUP BY p.event_id ORDER BY p.event_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := []*EventStats{}
+	byEvent := map[string]*EventStats{}
+	for rows.Next() {
+		s := &EventStats{Sources: map[string]int{}}
+		if err := rows.Scan(&s.EventID, &s.Pictures, &s.Hidden, &s.Likes, &s.Bytes, &s.Downloads, &s.Exports); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+		byEvent[s.EventID] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sources, err := d.db.Query(`SELECT event_id, CASE source WHEN '' THEN ? ELSE source END, COUNT(*)
+		FROM pictures GROUP BY 1, 2`, sourceUnknown)
+	if err != nil {
+		return nil, err
+	}
+	defer sources.Close()
+	for sources.Next() {
+		var event, source string
+		var n int
+		if err := sources.Scan(&event, &source, &n); err != nil {
+			return nil, err
+		}
+		if s, ok := byEvent[event]; ok {
+			s.Sources[source] = n
+		}
+	}
+	return stats, sources.Err()
+}
+
+// RecordDownload counts a download of a picture's original.
+func (d *Database) RecordDownload(id string) error {
+	_, err := d.db.Exec(`UPDATE pictures SET downloads = downloads + 1 WHERE id = ?`, id)
+	return err
+}
+
+// RecordExport counts a download of an event's ZIP export.
+func (d *Database) RecordExport(eventID string) error {
+	_, err := d.db.Exec(`INSERT INTO event_exports (event_id, exports) VALUES (?, 1)
+		ON CONFLICT(event_id) DO UPDATE SET exports = exports + 1`, eventID)
+	return err
+}
+
+// GetEventExports returns how many times an event's ZIP export was
+// downloaded.
+func (d *Database) GetEventExports(eventID string) (int, error) {
+	var n int
+	err := d.db.QueryRow(`SELECT exports FROM event_exports WHERE event_id = ?`, eventID).Scan(&n)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return n, err
+}
+
+// GetMostDownloaded returns the n pictures of an event, hidden ones
+// included, whose originals were downloaded most, most first. Pictures
+// never downloaded are left out.
+func (d *Database) GetMostDownloaded(eventID string, n int) ([]*PictureDownloads, error) {
+	rows, err := d.db.Query(`SELECT `+pictureColumns+`, downloads FROM pictures
+		WHERE event_id = ? AND downloads > 0 ORDER BY downloads DESC, uploaded_at DESC LIMIT ?`, eventID, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	downloads := []*PictureDownloads{}
+	for rows.Next() {
+		var count int
+		pic, err := scanPicture(scanFunc(func(dest ...interface{}) error {
+			return rows.Scan(append(dest, &count)...)
+		}))
+		if err != nil {
+			return nil, err
+		}
+		downloads = append(downloads, &PictureDownloads{Picture: pic, Downloads: count})
+	}
+	return downloads, rows.Err()
+}
+
+// GetEventBytes returns the size of an event's files.
+func (d *Database) GetEventBytes(eventID string) (int64, error) {
+	var bytes int64
+	err := d.db.QueryRow(`SELECT COALESCE(SUM(bytes), 0) FROM (`+eventFiles+`) WHERE event_id = ?`, eventID).Scan(&bytes)
+	return bytes, err
+}
+
+// GetEventQuota returns the quota set for an event, and false if none is,
+// so that the default applies.
+func (d *Database) GetEventQuota(eventID string) (int64, bool, error) {
+	var bytes int64
+	err := d.db.QueryRow(`SELECT quota_bytes FROM event_quotas WHERE event_id = ?`, eventID).Scan(&bytes)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return bytes, err == nil, err
+}
+
+// SetEventQuota sets an event's quota; 0 means none, whatever the default.
+func (d *Database) SetEventQuota(eventID string, bytes int64) error {
+	_, err := d.db.Exec(`INSERT INTO event_quotas (event_id, quota_bytes) VALUES (?, ?)
+	ON CONFLICT(event_id) DO UPDATE SET quota_bytes = excluded.quota_bytes`, eventID, bytes)
+	return err
+}
+
+// DeleteEventQuota removes an event's quota, so that the default applies.
+func (d *Database) DeleteEventQuota(eventID string) error {
+	_, err := d.db.Exec(`DELETE FROM event_quotas WHERE event_id = ?`, eventID)
+	return err
+}
+
+// GetEventAccessCode returns the access code of an event, "" if it is
+// public.
+func (d *Database) GetEventAccessCode(eventID string) (string, error) {
+	var code string
+	err := d.db.QueryRow(`SELECT code FROM event_access_codes WHERE event_id = ?`, eventID).Scan(&code)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return code, err
+}
+
+// SetEventAccessCode makes an event invite-only, with code.
+func (d *Database) SetEventAccessCode(eventID, code string) error {
+	_, err := d.db.Exec(`INSERT INTO event_access_codes (event_id, code) VALUES (?, ?)
+	ON CONFLICT(event_id) DO UPDATE SET code = excluded.code`, eventID, code)
+	return err
+}
+
+// DeleteEventAccessCode makes an event public.
+func (d *Database) DeleteEventAccessCode(eventID string) error {
+	_, err := d.db.Exec(`DELETE FROM event_access_codes WHERE event_id = ?`, eventID)
+	return err
+}
+
+// AddAnnouncement stores an announcement and sets its ID.
+func (d *Database) AddAnnouncement(a *Announcement) error {
+	query := `INSERT INTO announcements (event_id, message, priority, display_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`
+	result, err := d.db.Exec(query, a.EventID, a.Message, a.Priority, a.DisplayID, a.CreatedAt.UTC().Format(time.RFC3339), a.ExpiresAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	a.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetActiveAnnouncements returns the announcements of an event that haven't
+// expired at now, oldest first. Announcements addressed to a display are
+// only included when displayID is that display.
+func (d *Database) GetActiveAnnouncements(eventID, displayID string, now time.Time) ([]*Announcement, error) {
+	query := `SELECT id, event_id, message, priority, display_id, created_at, expires_at FROM announcements
+	WHERE event_id = ? AND expires_at > ? AND (display_id = '' OR display_id = ?) ORDER BY id`
+	rows, err := d.db.Query(query, eventID, now.UTC().Format(time.RFC3339), displayID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var announcements []*Announcement
+	for rows.Next() {
+		var a Announcement
+		var createdAtStr, expiresAtStr string
+		if err := rows.Scan(&a.ID, &a.EventID, &a.Message, &a.Priority, &a.DisplayID, &createdAtStr, &expiresAtStr); err != nil {
+			return nil, err
+		}
+		if a.CreatedAt, err = time.Parse(time.RFC3339, createdAtStr); err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		if a.ExpiresAt, err = time.Parse(time.RFC3339, expiresAtStr); err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		announcements = append(announcements, &a)
+	}
+	return announcements, rows.Err()
+}
+
+// GetPresentationSettings returns an event's presentation settings, or the
+// defaults if none are stored.
+func (d *Database) GetPresentationSettings(eventID string) (*PresentationSettings, error) {
+	settings := defaultPresentationSettings(eventID)
+	var likesCloseAtStr string
+	query := `SELECT ordering, slide_interval, transition, show_likes, interrupt_on_upload, playlist, likes_close_at FROM presentation_settings WHERE event_id = ?`
+	err := d.db.QueryRow(query, eventID).Scan(&settings.Ordering, &settings.SlideInterval, &settings.Transition, &settings.ShowLikes, &settings.InterruptOnUpload, &settings.Playlist, &likesCloseAtStr)
+	if err == sql.ErrNoRows {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if likesCloseAtStr != "" {
+		at, err := time.Parse(time.RFC3339, likesCloseAtStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		settings.LikesCloseAt = &at
+	}
+	return settings, nil
+}
+
+// SavePresentationSettings stores an event's presentation settings,
+// replacing any previous ones.
+func (d *Database) SavePresentationSettings(settings *PresentationSettings) error {
+	likesCloseAt := ""
+	if settings.LikesCloseAt != nil {
+		likesCloseAt = settings.LikesCloseAt.UTC().Format(time.RFC3339)
+	}
+	query := `INSERT INTO presentation_settings (event_id, ordering, slide_interval, transition, show_likes, interrupt_on_upload, playlist, likes_close_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(event_id) DO UPDATE SET ordering = excluded.ordering, slide_interval = excluded.slide_interval, transition = excluded.transition,
+		show_likes = excluded.show_likes, interrupt_on_upload = excluded.interrupt_on_upload, playlist = excluded.playlist,
+		likes_close_at = excluded.likes_close_at, updated_at = excluded.updated_at`
+	_, err := d.db.Exec(query, settings.EventID, settings.Ordering, settings.SlideInterval, settings.Transition, settings.ShowLikes, settings.InterruptOnUpload, settings.Playlist,
+		likesCloseAt, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetLikeCutoffs returns the like cutoff of every event that has one.
+func (d *Database) GetLikeCutoffs() (map[string]time.Time, error) {
+	rows, err := d.db.Query(`SELECT event_id, likes_close_at FROM presentation_settings WHERE likes_close_at != ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cutoffs := make(map[string]time.Time)
+	for rows.Next() {
+		var event, atStr string
+		if err := rows.Scan(&event, &atStr); err != nil {
+			return nil, err
+		}
+		at, err := time.Parse(time.RFC3339, atStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		cutoffs[event] = at
+	}
+	return cutoffs, rows.Err()
+}
+
+// AddDisplay stores a new display. Only the hash of its token is kept.
+func (d *Database) AddDisplay(display *Display, tokenHash string) error {
+	query := `INSERT INTO displays (id, event_id, name, token_hash, created_at) VALUES (?, ?, ?, ?, ?)`
+	_, err := d.db.Exec(query, display.ID, display.EventID, display.Name, tokenHash, display.CreatedAt.UTC().Format(time.RFC3339))
+	return err
+}
+
+const displayColumns = `id, event_id, name, created_at, last_seen_at, revoked_at`
+
+func scanDisplay(row interface{ Scan(...interface{}) error }) (*Display, error) {
+	var display Display
+	var createdAtStr string
+	var lastSeenAtStr, revokedAtStr sql.NullString
+	if err := row.Scan(&display.ID, &display.EventID, &display.Name, &createdAtStr, &lastSeenAtStr, &revokedAtStr); err != nil {
+		return nil, err
+	}
+	var err error
+	if display.CreatedAt, err = time.Parse(time.RFC3339, createdAtStr); err != nil {
+		return nil, fmt.Errorf("failed to parse time: %w", err)
+	}
+	if display.LastSeenAt, err = parseNullTime(lastSeenAtStr); err != nil {
+		return nil, err
+	}
+	if display.RevokedAt, err = parseNullTime(revokedAtStr); err != nil {
+		return nil, err
+	}
+	return &display, nil
+}
+
+func parseNullTime(s sql.NullString) (*time.Time, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s.String)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse time: %w", err)
+	}
+	return &t, nil
+}
+
+// GetDisplayByTokenHash returns the display a token was minted for, or
+// sql.ErrNoRows if there is none. Revoked displays are returned too.
+func (d *Database) GetDisplayByTokenHash(tokenHash string) (*Display, error) {
+	return scanDisplay(d.db.QueryRow(`SELECT `+displayColumns+` FROM displays WHERE token_hash = ?`, tokenHash))
+}
+
+// GetDisplay returns a display by ID, or sql.ErrNoRows if there is none.
+func (d *Database) GetDisplay(id string) (*Display, error) {
+	return scanDisplay(d.db.QueryRow(`SELECT `+displayColumns+` FROM displays WHERE id = ?`, id))
+}
+
+// GetDisplays returns the displays of an event, oldest first.
+func (d *Database) GetDisplays(eventID string) ([]*Display, error) {
+	rows, err := d.db.Query(`SELECT `+displayColumns+` FROM displays WHERE event_id = ? ORDER BY created_at, id`, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var displays []*Display
+	for rows.Next() {
+		display, err := scanDisplay(rows)
+		if err != nil {
+			return nil, err
+		}
+		displays = append(displays, display)
+	}
+	return displays, rows.Err()
+}
+
+// TouchDisplay records that a display connected at seen.
+func (d *Database) TouchDisplay(id string, seen time.Time) error {
+	_, err := d.db.Exec(`UPDATE displays SET last_seen_at = ? WHERE id = ?`, seen.UTC().Format(time.RFC3339), id)
+	return err
+}
+
+// RevokeDisplay marks a display revoked so its token is no longer
+// accepted. Revoking an already revoked display keeps the original time.
+func (d *Database) RevokeDisplay(id string, revokedAt time.Time) error {
+	_, err := d.db.Exec(`UPDATE displays SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ?`, revokedAt.UTC().Format(time.RFC3339), id)
+	return err
+}
+
+// AddScheduleEntry stores a schedule entry and sets its ID.
+func (d *Database) AddScheduleEntry(e *ScheduleEntry) error {
+	query := `INSERT INTO presentation_schedule (event_id, mode, starts_at, ends_at) VALUES (?, ?, ?, ?)`
+	result, err := d.db.Exec(query, e.EventID, e.Mode, e.StartsAt.UTC().Format(time.RFC3339), e.EndsAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	e.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetSchedule returns an event's schedule entries ordered by start time.
+func (d *Database) GetSchedule(eventID string) ([]*ScheduleEntry, error) {
+	query := `SELECT id, event_id, mode, starts_at, ends_at FROM presentation_schedule WHERE event_id = ? ORDER BY starts_at, id`
+	rows, err := d.db.Query(query, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*ScheduleEntry
+	for rows.Next() {
+		var e ScheduleEntry
+		var startsAtStr, endsAtStr string
+		if err := rows.Scan(&e.ID, &e.EventID, &e.Mode, &startsAtStr, &endsAtStr); err != nil {
+			return nil, err
+		}
+		if e.StartsAt, err = time.Parse(time.RFC3339, startsAtStr); err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		if e.EndsAt, err = time.Parse(time.RFC3339, endsAtStr); err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
+
+// GetScheduledEvents returns the events that have schedule entries.
+func (d *Database) GetScheduledEvents() ([]string, error) {
+	rows, err := d.db.Query(`SELECT DISTINCT event_id FROM presentation_schedule`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []string
+	for rows.Next() {
+		var event string
+		if err := rows.Scan(&event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// DeleteScheduleEntry removes a schedule entry. It returns sql.ErrNoRows
+// if there is none with that ID.
+func (d *Database) DeleteScheduleEntry(id int64) error {
+	result, err := d.db.Exec(`DELETE FROM presentation_schedule WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SavePlaylist creates a playlist or replaces its pictures and their
+// order.
+func (d *Database) SavePlaylist(p *Playlist) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO playlists (event_id, name, updated_at) VALUES (?, ?, ?)
+	ON CONFLICT(event_id, name) DO UPDATE SET updated_at = excluded.updated_at`
+	if _, err := tx.Exec(query, p.EventID, p.Name, p.UpdatedAt.UTC().Format(time.RFC3339)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM playlist_pictures WHERE event_id = ? AND playlist = ?`, p.EventID, p.Name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i, id := range p.Pictures {
+		if _, err := tx.Exec(`INSERT INTO playlist_pictures (event_id, playlist, position, picture_id) VALUES (?, ?, ?, ?)`, p.EventID, p.Name, i, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetPlaylists returns an event's playlists by name, with their pictures
+// in order.
+func (d *Database) GetPlaylists(eventID string) ([]*Playlist, error) {
+	rows, err := d.db.Query(`SELECT name, updated_at FROM playlists WHERE event_id = ? ORDER BY name`, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var playlists []*Playlist
+	byName := make(map[string]*Playlist)
+	for rows.Next() {
+		p := &Playlist{EventID: eventID, Pictures: []string{}}
+		var updatedAtStr string
+		if err := rows.Scan(&p.Name, &updatedAtStr); err != nil {
+			return nil, err
+		}
+		if p.UpdatedAt, err = time.Parse(time.RFC3339, updatedAtStr); err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		playlists = append(playlists, p)
+		byName[p.Name] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	members, err := d.db.Query(`SELECT playlist, picture_id FROM playlist_pictures WHERE event_id = ? ORDER BY playlist, position`, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer members.Close()
+	for members.Next() {
+		var name, id string
+		if err := members.Scan(&name, &id); err != nil {
+			return nil, err
+		}
+		if p, ok := byName[name]; ok {
+			p.Pictures = append(p.Pictures, id)
+		}
+	}
+	return playlists, members.Err()
+}
+
+// PlaylistExists reports whether an event has a playlist with that name.
+func (d *Database) PlaylistExists(eventID, name string) (bool, error) {
+	var n int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM playlists WHERE event_id = ? AND name = ?`, eventID, name).Scan(&n)
+	return n > 0, err
+}
+
+// GetPlaylistPictures returns the visible pictures of a playlist in
+// playlist order.
+func (d *Database) GetPlaylistPictures(eventID, name string) ([]*Picture, error) {
+	query := `SELECT ` + prefixedPictureColumns("p") + ` FROM playlist_pictures m
+	JOIN pictures p ON p.id = m.picture_id AND p.event_id = m.event_id
+	WHERE m.event_id = ? AND m.playlist = ? AND p.hidden = 0 ORDER BY m.position`
+	return d.queryPictures(query, eventID, name)
+}
+
+// DeletePlaylist deletes a playlist and its memberships. It returns
+// sql.ErrNoRows if the event has no playlist with that name.
+func (d *Database) DeletePlaylist(eventID, name string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`DELETE FROM playlists WHERE event_id = ? AND name = ?`, eventID, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		tx.Rollback()
+		return err
+	} else if n == 0 {
+		tx.Rollback()
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec(`DELETE FROM playlist_pictures WHERE event_id = ? AND playlist = ?`, eventID, name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecordSpotlight stores that a display showed a picture at shownAt, and
+// forgets the shows of every display before cutoff.
+func (d *Database) RecordSpotlight(eventID, display, pictureID string, shownAt, cutoff time.Time) error {
+	query := `INSERT INTO spotlight_shows (event_id, display, picture_id, shown_at) VALUES (?, ?, ?, ?)`
+	if _, err := d.db.Exec(query, eventID, display, pictureID, shownAt.UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	_, err := d.db.Exec(`DELETE FROM spotlight_shows WHERE shown_at < ?`, cutoff.UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetSpotlightHistory returns when a display last showed each picture it
+// showed since since.
+func (d *Database) GetSpotlightHistory(eventID, display string, since time.Time) (map[string]time.Time, error) {
+	query := `SELECT picture_id, MAX(shown_at) FROM spotlight_shows WHERE event_id = ? AND display = ? AND shown_at >= ? GROUP BY picture_id`
+	rows, err := d.db.Query(query, eventID, display, since.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shown := make(map[string]time.Time)
+	for rows.Next() {
+		var id, shownAtStr string
+		if err := rows.Scan(&id, &shownAtStr); err != nil {
+			return nil, err
+		}
+		shownAt, err := time.Parse(time.RFC3339, shownAtStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		shown[id] = shownAt
+	}
+	return shown, rows.Err()
+}
+
+// RecordSlideShown stores that a display last showed a picture as a slide
+// at shownAt.
+func (d *Database) RecordSlideShown(displayID, pictureID string, shownAt time.Time) error {
+	query := `INSERT OR REPLACE INTO slides_shown (display_id, picture_id, shown_at) VALUES (?, ?, ?)`
+	_, err := d.db.Exec(query, displayID, pictureID, shownAt.UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetSlidesShown returns when a display last showed each picture it ever
+// showed as a slide.
+func (d *Database) GetSlidesShown(displayID string) (map[string]time.Time, error) {
+	rows, err := d.db.Query(`SELECT picture_id, shown_at FROM slides_shown WHERE display_id = ?`, displayID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shown := make(map[string]time.Time)
+	for rows.Next() {
+		var id, shownAtStr string
+		if err := rows.Scan(&id, &shownAtStr); err != nil {
+			return nil, err
+		}
+		shownAt, err := time.Parse(time.RFC3339, shownAtStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		shown[id] = shownAt
+	}
+	return shown, rows.Err()
+}
+
+// OpenContestRound stores a new open round with its entries and sets its
+// ID. It returns errContestOpen if the event already has an open round.
+func (d *Database) OpenContestRound(c *ContestRound) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO contest_rounds (event_id, title, opened_at)
+	SELECT ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM contest_rounds WHERE event_id = ? AND closed_at IS NULL)`
+	result, err := tx.Exec(query, c.EventID, c.Title, c.OpenedAt.UTC().Format(time.RFC3339), c.EventID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		tx.Rollback()
+		return err
+	} else if n == 0 {
+		tx.Rollback()
+		return errContestOpen
+	}
+	if c.ID, err = result.LastInsertId(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i, e := range c.Entries {
+		if _, err := tx.Exec(`INSERT INTO contest_entries (round_id, picture_id, position) VALUES (?, ?, ?)`, c.ID, e.PictureID, i); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CloseContestRound closes an open round. It returns sql.ErrNoRows if no
+// open round has that ID.
+func (d *Database) CloseContestRound(id int64, closedAt time.Time) error {
+	result, err := d.db.Exec(`UPDATE contest_rounds SET closed_at = ? WHERE id = ? AND closed_at IS NULL`, closedAt.UTC().Format(time.RFC3339), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetContestRound returns a round with its tallied entries. It returns
+// sql.ErrNoRows if no round has that ID.
+func (d *Database) GetContestRound(id int64) (*ContestRound, error) {
+	rounds, err := d.queryContestRounds(`SELECT id, event_id, title, opened_at, closed_at, announced_at, reveal_at FROM contest_rounds WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(rounds) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return rounds[0], nil
+}
+
+// GetContestRounds returns an event's rounds, newest first, with their
+// tallied entries.
+func (d *Database) GetContestRounds(eventID string) ([]*ContestRound, error) {
+	return d.queryContestRounds(`SELECT id, event_id, title, opened_at, closed_at, announced_at, reveal_at FROM contest_rounds WHERE event_id = ? ORDER BY id DESC`, eventID)
+}
+
+// queryContestRounds runs a query selecting contest rounds, loads their
+// entries and tallies them.
+func (d *Database) queryContestRounds(query string, args ...interface{}) ([]*ContestRound, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rounds []*ContestRound
+	for rows.Next() {
+		c := &ContestRound{Entries: []*ContestEntry{}}
+		var openedAtStr string
+		var closedAtStr, announcedAtStr, revealAtStr sql.NullString
+		if err := rows.Scan(&c.ID, &c.EventID, &c.Title, &openedAtStr, &closedAtStr, &announcedAtStr, &revealAtStr); err != nil {
+			return nil, err
+		}
+		if c.OpenedAt, err = time.Parse(time.RFC3339, openedAtStr); err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		if c.ClosedAt, err = parseNullTime(closedAtStr); err != nil {
+			return nil, err
+		}
+		if c.AnnouncedAt, err = parseNullTime(announcedAtStr); err != nil {
+			return nil, err
+		}
+		if c.RevealAt, err = parseNullTime(revealAtStr); err != nil {
+			return nil, err
+		}
+		rounds = append(rounds, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, c := range rounds {
+		entries, err := d.db.Query(`SELECT picture_id, votes FROM contest_entries WHERE round_id = ? ORDER BY position`, c.ID)
+		if err != nil {
+			return nil, err
+		}
+		for entries.Next() {
+			e := &ContestEntry{}
+			if err := entries.Scan(&e.PictureID, &e.Votes); err != nil {
+				entries.Close()
+				return nil, err
+			}
+			c.Entries = append(c.Entries, e)
+		}
+		err = entries.Err()
+		entries.Close()
+		if err != nil {
+			return nil, err
+		}
+		c.tally()
+		if c.AnnouncedAt != nil {
+			// The winners stored when announced
+			if c.Winners, err = d.getContestWinners(c.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rounds, nil
+}
+
+// getContestWinners returns the stored winners of an announced round.
+func (d *Database) getContestWinners(roundID int64) ([]string, error) {
+	rows, err := d.db.Query(`SELECT picture_id FROM contest_winners WHERE round_id = ? ORDER BY position`, roundID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var winners []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		winners = append(winners, id)
+	}
+	return winners, rows.Err()
+}
+
+// AnnounceContestRound records the announcement of a closed round, at
+// c.AnnouncedAt to be revealed at c.RevealAt, and stores its winners. It
+// returns errContestAnnounced if the round was announced before.
+func (d *Database) AnnounceContestRound(c *ContestRound) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`UPDATE contest_rounds SET announced_at = ?, reveal_at = ? WHERE id = ? AND announced_at IS NULL`,
+		c.AnnouncedAt.UTC().Format(time.RFC3339), c.RevealAt.UTC().Format(time.RFC3339), c.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		tx.Rollback()
+		return err
+	} else if n == 0 {
+		tx.Rollback()
+		return errContestAnnounced
+	}
+	votes := make(map[string]int, len(c.Entries))
+	for _, e := range c.Entries {
+		votes[e.PictureID] = e.Votes
+	}
+	for i, id := range c.Winners {
+		if _, err := tx.Exec(`INSERT INTO contest_winners (round_id, picture_id, position, votes) VALUES (?, ?, ?, ?)`, c.ID, id, i, votes[id]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddRecapTask stores a pending recap and sets its ID.
+func (d *Database) AddRecapTask(t *RecapTask) error {
+	query := `INSERT INTO recap_tasks (event_id, status, pictures, duration, music, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	result, err := d.db.Exec(query, t.EventID, t.Status, t.Pictures, t.Duration, t.Music, t.CreatedAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	t.ID, err = result.LastInsertId()
+	return err
+}
+
+const recapColumns = `id, event_id, status, progress, pictures, duration, music, error, created_at, finished_at`
+
+// GetRecapTask returns a recap, or sql.ErrNoRows if there is none with
+// that ID.
+func (d *Database) GetRecapTask(id int64) (*RecapTask, error) {
+	tasks, err := d.queryRecapTasks(`SELECT `+recapColumns+` FROM recap_tasks WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return tasks[0], nil
+}
+
+// GetRecapTasks returns an event's recaps, newest first.
+func (d *Database) GetRecapTasks(eventID string) ([]*RecapTask, error) {
+	return d.queryRecapTasks(`SELECT `+recapColumns+` FROM recap_tasks WHERE event_id = ? ORDER BY id DESC`, eventID)
+}
+
+// ClaimNextRecapTask marks the oldest pending recap as running and returns
+// it, or nil if none is pending.
+func (d *Database) ClaimNextRecapTask() (*RecapTask, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var id int64
+	if err := tx.QueryRow(`SELECT id FROM recap_tasks WHERE status = 'pending' ORDER BY id LIMIT 1`).Scan(&id); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE recap_tasks SET status = 'running', progress = 0 WHERE id = ?`, id); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return d.GetRecapTask(id)
+}
+
+// SetRecapProgress stores how much of a running recap is rendered, from 0
+// to 1.
+func (d *Database) SetRecapProgress(id int64, progress float64) error {
+	_, err := d.db.Exec(`UPDATE recap_tasks SET progress = ? WHERE id = ? AND status = 'running'`, progress, id)
+	return err
+}
+
+// FinishRecapTask marks a recap as completed or failed with an error.
+func (d *Database) FinishRecapTask(id int64, status, msg string, finishedAt time.Time) error {
+	_, err := d.db.Exec(`UPDATE recap_tasks SET status = ?, error = ?, progress = CASE WHEN ? = 'completed' THEN 1 ELSE progress END, finished_at = ? WHERE id = ?`,
+		status, msg, status, finishedAt.UTC().Format(time.RFC3339), id)
+	return err
+}
+
+// RequeueRunningRecapTasks puts recaps left running by an interrupted run
+// back in the queue.
+func (d *Database) RequeueRunningRecapTasks() error {
+	_, err := d.db.Exec(`UPDATE recap_tasks SET status = 'pending', progress = 0 WHERE status = 'running'`)
+	return err
+}
+
+// queryRecapTasks runs a query selecting recapColumns.
+func (d *Database) queryRecapTasks(query string, args ...interface{}) ([]*RecapTask, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []*RecapTask
+	for rows.Next() {
+		t := &RecapTask{}
+		var createdAtStr string
+		var finishedAtStr sql.NullString
+		if err := rows.Scan(&t.ID, &t.EventID, &t.Status, &t.Progress, &t.Pictures, &t.Duration, &t.Music, &t.Error, &createdAtStr, &finishedAtStr); err != nil {
+			return nil, err
+		}
+		if t.CreatedAt, err = time.Parse(time.RFC3339, createdAtStr); err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		if finishedAtStr.Valid {
+			finishedAt, err := time.Parse(time.RFC3339, finishedAtStr.String)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse time: %w", err)
+			}
+			t.FinishedAt = &finishedAt
+		}
+		if t.Status == recapCompleted {
+			t.DownloadURL = fmt.Sprintf("/api/admin/recap/%d/video", t.ID)
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+// GetMigratedFiles returns the files already copied to the storage target,
+// as "area/key": the area is original, uploads or projector.
+func (d *Database) GetMigratedFiles(target string) (map[string]bool, error) {
+	rows, err := d.db.Query(`SELECT area, key FROM storage_migrations WHERE target = ?`, target)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := map[string]bool{}
+	for rows.Next() {
+		var area, key string
+		if err := rows.Scan(&area, &key); err != nil {
+			return nil, err
+		}
+		files[area+"/"+key] = true
+	}
+	return files, rows.Err()
+}
+
+// AddMigratedFile records a file copied to the storage target and verified
+// there, with the SHA-256 and size of its contents.
+func (d *Database) AddMigratedFile(target, area, key, sha256 string, size int64) error {
+	_, err := d.db.Exec(`INSERT INTO storage_migrations (target, area, key, sha256, size, migrated_at) VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT(target, area, key) DO UPDATE SET sha256 = excluded.sha256, size = excluded.size, migrated_at = excluded.migrated_at`,
+		target, area, key, sha256, size, time.Now().Format(time.RFC3339))
+	return err
+}
+
+// AddUser stores a new user with its password hash and sets its ID. It
+// returns errUsernameTaken if the username is in use, ignoring case.
+func (d *Database) AddUser(user *User, passwordHash string) error {
+	result, err := d.db.Exec(`INSERT INTO users (username, password_hash, role, created_at) VALUES (?, ?, ?, ?)
+	ON CONFLICT(username) DO NOTHING`,
+		user.Username, passwordHash, user.Role.String(), user.CreatedAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errUsernameTaken
+	}
+	user.ID, err = result.LastInsertId()
+	return err
+}
+
+const userColumns = `users.id, users.username, users.name, users.role, users.photographer, users.created_at, users.last_login_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*User, error) {
+	var user User
+	var role, createdAtStr string
+	var lastLoginAtStr sql.NullString
+	if err := row.Scan(append([]interface{}{&user.ID, &user.Username, &user.Name, &role, &user.Photographer, &createdAtStr, &lastLoginAtStr}, extra...)...); err != nil {
+		return nil, err
+	}
+	if err := user.Role.UnmarshalText([]byte(role)); err != nil {
+		return nil, err
+	}
+	var err error
+	if user.CreatedAt, err = time.Parse(time.RFC3339, createdAtStr); err != nil {
+		return nil, fmt.Errorf("failed to parse time: %w", err)
+	}
+	if user.LastLoginAt, err = parseNullTime(lastLoginAtStr); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetUserByUsername returns a user, ignoring the case of the username, and
+// its password hash, or sql.ErrNoRows if there is none.
+func (d *Database) GetUserByUsername(username string) (*User, string, error) {
+	var hash string
+	user, err := scanUser(d.db.QueryRow(`SELECT `+userColumns+`, users.password_hash FROM users WHERE username = ?`, username), &hash)
+	return user, hash, err
+}
+
+// GetUser returns a user by ID, or sql.ErrNoRows if there is none.
+func (d *Database) GetUser(id int64) (*User, error) {
+	return scanUser(d.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+}
+
+// GetUsers returns every user, oldest first.
+func (d *Database) GetUsers() ([]*User, error) {
+	rows, err := d.db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// GetUserByIdentity returns the user an OAuth identity is linked to, or
+// sql.ErrNoRows if there is none.
+func (d *Database) GetUserByIdentity(provider, subject string) (*User, error) {
+	return scanUser(d.db.QueryRow(`SELECT `+userColumns+` FROM user_identities JOIN users ON users.id = user_identities.user_id
+	WHERE user_identities.provider = ? AND user_identities.subject = ?`, provider, subject))
+}
+
+// AddUserIdentity links an OAuth identity to a user. It returns
+// errIdentityTaken if the identity is linked to another user.
+func (d *Database) AddUserIdentity(provider, subject, email string, userID int64, at time.Time) error {
+	result, err := d.db.Exec(`INSERT INTO user_identities (provider, subject, user_id, email, created_at) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(provider, subject) DO UPDATE SET email = excluded.email WHERE user_id = excluded.user_id`,
+		provider, subject, userID, email, at.UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errIdentityTaken
+	}
+	return nil
+}
+
+// SetUserName changes the real name of a user.
+func (d *Database) SetUserName(id int64, name string) error {
+	_, err := d.db.Exec(`UPDATE users SET name = ? WHERE id = ?`, name, id)
+	return err
+}
+
+// CountUsersWithRole returns how many users have a role.
+func (d *Database) CountUsersWithRole(role Role) (int, error) {
+	var n int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM users WHERE role = ?`, role.String()).Scan(&n)
+	return n, err
+}
+
+// SetUserRole changes the role of a user, or returns sql.ErrNoRows if
+// there is none.
+func (d *Database) SetUserRole(id int64, role Role) error {
+	result, err := d.db.Exec(`UPDATE users SET role = ? WHERE id = ?`, role.String(), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetUserPhotographer marks a user as a photographer or not, or returns
+// sql.ErrNoRows if there is none.
+func (d *Database) SetUserPhotographer(id int64, photographer bool) error {
+	result, err := d.db.Exec(`UPDATE users SET photographer = ? WHERE id = ?`, photographer, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// TakeUpload counts an upload of an uploader (a device or user) to an
+// event, unless it has already uploaded limit pictures. It returns false if
+// it has.
+func (d *Database) TakeUpload(eventID, uploader string, limit int) (bool, error) {
+	result, err := d.db.Exec(`INSERT INTO upload_counts (event_id, uploader, count) VALUES (?, ?, 1)
+	ON CONFLICT(event_id, uploader) DO UPDATE SET count = count + 1 WHERE count < ?`, eventID, uploader, limit)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ReturnUpload takes back an upload counted by TakeUpload.
+func (d *Database) ReturnUpload(eventID, uploader string) error {
+	_, err := d.db.Exec(`UPDATE upload_counts SET count = count - 1 WHERE event_id = ? AND uploader = ? AND count > 0`, eventID, uploader)
+	return err
+}
+
+// TouchUserLogin records that a user signed in at at.
+func (d *Database) TouchUserLogin(id int64, at time.Time) error {
+	_, err := d.db.Exec(`UPDATE users SET last_login_at = ? WHERE id = ?`, at.UTC().Format(time.RFC3339), id)
+	return err
+}
+
+// AddSession stores a session of a user. Only the hash of its token is
+// kept.
+func (d *Database) AddSession(tokenHash string, userID int64, createdAt, expiresAt time.Time) error {
+	_, err := d.db.Exec(`INSERT INTO sessions (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		tokenHash, userID, createdAt.UTC().Format(time.RFC3339), expiresAt.UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetSessionUser returns the user of a session that hasn't expired by now,
+// or sql.ErrNoRows if there is none.
+func (d *Database) GetSessionUser(tokenHash string, now time.Time) (*User, error) {
+	return scanUser(d.db.QueryRow(`SELECT `+userColumns+` FROM sessions JOIN users ON users.id = sessions.user_id
+	WHERE sessions.token_hash = ? AND sessions.expires_at > ?`, tokenHash, now.UTC().Format(time.RFC3339)))
+}
+
+// DeleteSession ends a session.
+func (d *Database) DeleteSession(tokenHash string) error {
+	_, err := d.db.Exec(`DELETE FROM sessions WHERE token_hash = ?`, tokenHash)
+	return err
+}
+
+// DeleteExpiredSessions removes the sessions that expired by now.
+func (d *Database) DeleteExpiredSessions(now time.Time) error {
+	_, err := d.db.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, now.UTC().Format(time.RFC3339))
+	return err
+}
+
+// pictureTables are the tables with rows of pictures, by picture_id, that
+// go when a picture is deleted for good.
+var pictureTables = []string{"likes", "reports", "comments", "reactions", "share_codes", "playlist_pictures", "contest_entries", "contest_winners", "spotlight_shows", "slides_shown", "activity", "picture_aliases"}
+
+// DeletedData is what DeletePersonalData removed. The files of Pictures,
+// Originals and Uploads are left to the caller.
+type DeletedData struct {
+	// Pictures are those the device or user uploaded
+	Pictures []*Picture
+	// Originals are the originals kept of Pictures
+	Originals []*KeptOriginal
+	// Uploads are the original paths of their conversion tasks
+	Uploads []string
+	// PendingUploads counts the tasks that weren't converted yet
+	PendingUploads int
+	Likes          int
+	Comments       int
+	Reports        int
+	Reactions      int
+	// Guestbook are the device's and user's guestbook messages
+	Guestbook []*GuestbookMessage
+	// Account is whether the user's account was deleted
+	Account bool
+}
+
+// DeletePersonalData removes, in one transaction, the uploads, likes,
+// comments, reports, reactions and guestbook messages of a device and of
+// a user, and the
+// user's account; "" and 0 leave either out. Conversions running
+// meanwhile are left alone.
+func (d *Database) DeletePersonalData(deviceID string, userID int64) (*DeletedData, error) {
+	// Uploaders and reactors are keyed as by uploaderKey and reactorKey
+	device, user := "device:"+deviceID, "user:"+strconv.FormatInt(userID, 10)
+	if deviceID == "" {
+		device = ""
+	}
+	if userID == 0 {
+		user = ""
+	}
+	subject := `((device_id = ? AND device_id != '') OR (user_id = ? AND user_id != 0))`
+	args := []interface{}{deviceID, userID}
+
+	var data DeletedData
+	var err error
+	if data.Pictures, err = d.queryPictures(`SELECT `+pictureColumns+` FROM pictures WHERE `+subject, args...); err != nil {
+		return nil, err
+	}
+	if data.Originals, err = d.queryKeptOriginals(`SELECT id, original_key, uploaded_at, original_location FROM pictures
+		WHERE original_key != '' AND `+subject, args...); err != nil {
+		return nil, err
+	}
+	if data.Guestbook, err = d.queryGuestbook(`SELECT `+guestbookColumns+` FROM guestbook WHERE `+subject, args...); err != nil {
+		return nil, err
+	}
+	rows, err := d.db.Query(`SELECT original_path FROM conversion_tasks WHERE status != 'processing' AND `+subject, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		data.Uploads = append(data.Uploads, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// exec runs a statement, adding the rows it changed to n if not nil
+	exec := func(n *int, query string, args ...interface{}) error {
+		result, err := tx.Exec(query, args...)
+		if err != nil || n == nil {
+			return err
+		}
+		changed, err := result.RowsAffected()
+		*n += int(changed)
+		return err
+	}
+	uploads := `SELECT id FROM pictures WHERE ` + subject
+	for _, table := range pictureTables {
+		if err := exec(nil, `DELETE FROM `+table+` WHERE picture_id IN (`+uploads+`)`, args...); err != nil {
+			return nil, err
+		}
+	}
+	if err := exec(nil, `DELETE FROM pictures WHERE `+subject, args...); err != nil {
+		return nil, err
+	}
+	if err := exec(&data.PendingUploads, `DELETE FROM conversion_tasks WHERE status = 'pending' AND `+subject, args...); err != nil {
+		return nil, err
+	}
+	if err := exec(nil, `DELETE FROM conversion_tasks WHERE status NOT IN ('pending', 'processing') AND `+subject, args...); err != nil {
+		return nil, err
+	}
+	if deviceID != "" {
+		if err := exec(nil, `UPDATE pictures SET likes = likes - 1 WHERE likes > 0 AND id IN (SELECT picture_id FROM likes WHERE device_id = ?)`, deviceID); err != nil {
+			return nil, err
+		}
+		if err := exec(&data.Likes, `DELETE FROM likes WHERE device_id = ?`, deviceID); err != nil {
+			return nil, err
+		}
+		if err := exec(nil, `DELETE FROM activity WHERE comment_id IN (SELECT id FROM comments WHERE device_id = ?)`, deviceID); err != nil {
+			return nil, err
+		}
+		if err := exec(&data.Comments, `DELETE FROM comments WHERE device_id = ?`, deviceID); err != nil {
+			return nil, err
+		}
+		if err := exec(&data.Reports, `DELETE FROM reports WHERE device_id = ?`, deviceID); err != nil {
+			return nil, err
+		}
+	}
+	if err := exec(&data.Reactions, `DELETE FROM reactions WHERE reactor IN (?, ?)`, device, user); err != nil {
+		return nil, err
+	}
+	if err := exec(nil, `DELETE FROM upload_counts WHERE uploader IN (?, ?)`, device, user); err != nil {
+		return nil, err
+	}
+	if err := exec(nil, `DELETE FROM guestbook WHERE `+subject, args...); err != nil {
+		return nil, err
+	}
+	// Acceptances of the terms stay on the venue's record, without the
+	// device and account
+	if err := exec(nil, `UPDATE terms_acceptances SET device_id = '', user_id = 0 WHERE `+subject, args...); err != nil {
+		return nil, err
+	}
+	if userID != 0 {
+		if err := exec(nil, `DELETE FROM sessions WHERE user_id = ?`, userID); err != nil {
+			return nil, err
+		}
+		if err := exec(nil, `DELETE FROM user_identities WHERE user_id = ?`, userID); err != nil {
+			return nil, err
+		}
+		var n int
+		if err := exec(&n, `DELETE FROM users WHERE id = ?`, userID); err != nil {
+			return nil, err
+		}
+		data.Account = n > 0
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	d.PicturesChanged()
+	return &data, nil
+}
+
+// AddDeletionReceipt stores the receipt of a deletion of personal data.
+// It holds counts only, nothing of whom it was for.
+func (d *Database) AddDeletionReceipt(r *DeletionReceipt) error {
+	_, err := d.db.Exec(`INSERT INTO privacy_deletions (id, deleted_at, device, account, pictures, pending_uploads, likes, comments, reports, reactions, guestbook)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, r.ID, r.DeletedAt.UTC().Format(time.RFC3339), r.Device, r.Account,
+		r.Deleted.Pictures, r.Deleted.PendingUploads, r.Deleted.Likes, r.Deleted.Comments, r.Deleted.Reports, r.Deleted.Reactions, r.Deleted.Guestbook)
+	return err
+}
+
+// GetDeletionReceipt returns a stored deletion receipt, or sql.ErrNoRows
+// if there is none.
+func (d *Database) GetDeletionReceipt(id string) (*DeletionReceipt, error) {
+	var r DeletionReceipt
+	var deletedAtStr string
+	err := d.db.QueryRow(`SELECT id, deleted_at, device, account, pictures, pending_uploads, likes, comments, reports, reactions, guestbook
+	FROM privacy_deletions WHERE id = ?`, id).Scan(&r.ID, &deletedAtStr, &r.Device, &r.Account,
+		&r.Deleted.Pictures, &r.Deleted.PendingUploads, &r.Deleted.Likes, &r.Deleted.Comments, &r.Deleted.Reports, &r.Deleted.Reactions, &r.Deleted.Guestbook)
+	if err != nil {
+		return nil, err
+	}
+	r.DeletedAt, _ = time.Parse(time.RFC3339, deletedAtStr)
+	return &r, nil
+}
+
+// GetOrCreateShareCode returns the share code of a picture, storing one
+// generate returns if it has none yet. A generated code that is taken is
+// replaced, up to attempts times.
+func (d *Database) GetOrCreateShareCode(pictureID string, generate func() (string, error), attempts int) (string, error) {
+	var code string
+	err := d.db.QueryRow(`SELECT code FROM share_codes WHERE picture_id = ?`, pictureID).Scan(&code)
+	if err != sql.ErrNoRows {
+		return code, err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for i := 0; i < attempts; i++ {
+		if code, err = generate(); err != nil {
+			return "", err
+		}
+		// Ignored if the code is taken, or a concurrent share stored the
+		// picture's code first
+		if _, err := d.db.Exec(`INSERT OR IGNORE INTO share_codes (code, picture_id, created_at) VALUES (?, ?, ?)`, code, pictureID, now); err != nil {
+			return "", err
+		}
+		err = d.db.QueryRow(`SELECT code FROM share_codes WHERE picture_id = ?`, pictureID).Scan(&code)
+		if err != sql.ErrNoRows {
+			return code, err
+		}
+	}
+	return "", fmt.Errorf("no free share code after %d attempts", attempts)
+}
+
+// GetAliasedPictureID returns the current ID of a picture renamed from
+// oldID, or sql.ErrNoRows if no picture was.
+func (d *Database) GetAliasedPictureID(oldID string) (string, error) {
+	var id string
+	err := d.db.QueryRow(`SELECT picture_id FROM picture_aliases WHERE old_id = ?`, oldID).Scan(&id)
+	return id, err
+}
+
+// GetAliasedFilePictureID returns the current ID of a picture whose files
+// were stored under key before it was renamed, the latest alias if several
+// were, or sql.ErrNoRows if none were.
+func (d *Database) GetAliasedFilePictureID(key string) (string, error) {
+	var id string
+	err := d.db.QueryRow(`SELECT picture_id FROM picture_aliases WHERE old_key = ? ORDER BY created_at DESC, rowid DESC LIMIT 1`, key).Scan(&id)
+	return id, err
+}
+
+// GetSharedPictureID returns the ID of the picture a share code points at,
+// or sql.ErrNoRows if the code is unknown.
+func (d *Database) GetSharedPictureID(code string) (string, error) {
+	var id string
+	err := d.db.QueryRow(`SELECT picture_id FROM share_codes WHERE code = ?`, code).Scan(&id)
+	return id, err
+}
+
+// GetOrCreateSecret returns the secret stored under name, storing the one
+// generate returns if there is none yet.
+func (d *Database) GetOrCreateSecret(name string, generate func() (string, error)) (string, error) {
+	value, err := generate()
+	if err != nil {
+		return "", err
+	}
+	if _, err := d.db.Exec(`INSERT OR IGNORE INTO secrets (name, value) VALUES (?, ?)`, name, value); err != nil {
+		return "", err
+	}
+	err = d.db.QueryRow(`SELECT value FROM secrets WHERE name = ?`, name).Scan(&value)
+	return value, err
+}
+
+// ModeratePicture sets whether a picture is hidden and its moderation
+// state, recording who did it, cancels its scheduled publishing and
+// resolves its reports. It returns
+// sql.ErrNoRows if no picture has that ID.
+func (d *Database) ModeratePicture(id string, hidden bool, moderation, by string, at time.Time) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE pictures SET hidden = ?, moderation = ?, moderated_at = ?, moderated_by = ?, publish_at = '' WHERE id = ?`,
+		hidden, moderation, at.UTC().Format(time.RFC3339), by, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec(`DELETE FROM reports WHERE picture_id = ?`, id); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.PicturesChanged()
+	return nil
+}
+
+// GetPendingPictures returns an event's pictures waiting for approval,
+// oldest first.
+func (d *Database) GetPendingPictures(eventID string) ([]*Picture, error) {
+	query := `SELECT ` + pictureColumns + ` FROM pictures WHERE event_id = ? AND moderation = 'pending' ORDER BY uploaded_at`
+	return d.queryPictures(query, eventID)
+}
+
+// GetPendingCaptions returns the pictures of an event whose caption waits
+// for a moderator, oldest first.
+func (d *Database) GetPendingCaptions(eventID string) ([]*Picture, error) {
+	query := `SELECT ` + pictureColumns + ` FROM pictures WHERE event_id = ? AND pending_caption != '' ORDER BY uploaded_at`
+	return d.queryPictures(query, eventID)
+}
+
+// ModerateCaption makes a picture's pending caption its caption if
+// approved, or drops it, and returns sql.ErrNoRows if the picture has
+// none.
+func (d *Database) ModerateCaption(id string, approved bool) error {
+	result, err := d.db.Exec(`UPDATE pictures SET caption = CASE WHEN ? THEN pending_caption ELSE caption END, pending_caption = ''
+		WHERE id = ? AND pending_caption != ''`, approved, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	d.PicturesChanged()
+	return nil
+}
+
+// GetRejectedPictures returns the last n pictures of an event rejected by a
+// moderator, most recently rejected first.
+func (d *Database) GetRejectedPictures(eventID string, n int) ([]*RejectedPicture, error) {
+	rows, err := d.db.Query(`SELECT id, moderated_at, moderated_by FROM pictures
+		WHERE event_id = ? AND moderation = 'rejected' ORDER BY moderated_at DESC LIMIT ?`, eventID, n)
+	if err != nil {
+		return nil, err
+	}
+	type rejection struct {
+		id, by string
+		at     sql.NullString
+	}
+	var rejections []rejection
+	for rows.Next() {
+		var r rejection
+		if err := rows.Scan(&r.id, &r.at, &r.by); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rejections = append(rejections, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var pictures []*RejectedPicture
+	for _, r := range rejections {
+		pic, err := d.GetPicture(r.id)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rejected := &RejectedPicture{Picture: pic, RejectedBy: r.by}
+		if at, err := parseNullTime(r.at); err == nil && at != nil {
+			rejected.RejectedAt = *at
+		}
+		pictures = append(pictures, rejected)
+	}
+	return pictures, nil
+}
+
+// AddReport records a device's report of a picture and reports whether it
+// did: a device reports a picture once.
+func (d *Database) AddReport(id, deviceID, reason string, at time.Time) (bool, error) {
+	result, err := d.db.Exec(`INSERT OR IGNORE INTO reports (picture_id, device_id, reason, reported_at) VALUES (?, ?, ?, ?)`,
+		id, deviceID, reason, at.UTC().Format(time.RFC3339))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetReportedPictures returns an event's pictures with unresolved reports
+// and their count per reason, most reported first. Rejected pictures are
+// left out.
+func (d *Database) GetReportedPictures(eventID string) ([]*ReportedPicture, error) {
+	rows, err := d.db.Query(`SELECT r.picture_id, r.reason, COUNT(*), MAX(r.reported_at) FROM reports r
+		JOIN pictures p ON p.id = r.picture_id
+		WHERE p.event_id = ? AND p.moderation != 'rejected'
+		GROUP BY r.picture_id, r.reason`, eventID)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[string]*ReportedPicture{}
+	var ids []string
+	for rows.Next() {
+		var id, reason, last string
+		var count int
+		if err := rows.Scan(&id, &reason, &count, &last); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		reported := byID[id]
+		if reported == nil {
+			reported = &ReportedPicture{Reasons: map[string]int{}}
+			byID[id] = reported
+			ids = append(ids, id)
+		}
+		reported.Reports += count
+		reported.Reasons[reason] = count
+		if t, err := time.Parse(time.RFC3339, last); err == nil && t.After(reported.LastReportedAt) {
+			reported.LastReportedAt = t
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var pictures []*ReportedPicture
+	for _, id := range ids {
+		pic, err := d.GetPicture(id)
+		if err != nil {
+			return nil, err
+		}
+		byID[id].Picture = pic
+		pictures = append(pictures, byID[id])
+	}
+	sort.Slice(pictures, func(i, j int) bool {
+		if pictures[i].Reports != pictures[j].Reports {
+			return pictures[i].Reports > pictures[j].Reports
+		}
+		return pictures[i].LastReportedAt.After(pictures[j].LastReportedAt)
+	})
+	return pictures, nil
+}
+
+// AddComment stores a comment and sets its ID.
+func (d *Database) AddComment(c *Comment) error {
+	result, err := d.db.Exec(`INSERT INTO comments (picture_id, event_id, device_id, text, created_at, moderation) VALUES (?, ?, ?, ?, ?, ?)`,
+		c.PictureID, c.EventID, c.DeviceID, c.Text, c.CreatedAt.UTC().Format(time.RFC3339), c.Moderation)
+	if err != nil {
+		return err
+	}
+	c.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetComments returns the last n published comments of a picture, oldest
+// first.
+func (d *Database) GetComments(pictureID string, n int) ([]*Comment, error) {
+	return d.queryComments(`SELECT id, picture_id, event_id, device_id, text, created_at, moderation FROM (
+		SELECT * FROM comments WHERE picture_id = ? AND moderation = '' ORDER BY id DESC LIMIT ?
+	) ORDER BY id`, pictureID, n)
+}
+
+// GetPendingComments returns the comments of an event waiting for a
+// moderator, oldest first.
+func (d *Database) GetPendingComments(eventID string) ([]*Comment, error) {
+	return d.queryComments(`SELECT id, picture_id, event_id, device_id, text, created_at, moderation FROM comments
+		WHERE event_id = ? AND moderation = 'pending' ORDER BY id`, eventID)
+}
+
+// ModerateComment sets the moderation state of a pending comment, or
+// returns sql.ErrNoRows if there is no pending comment with that ID.
+func (d *Database) ModerateComment(id int64, moderation, by string, at time.Time) error {
+	result, err := d.db.Exec(`UPDATE comments SET moderation = ?, moderated_at = ?, moderated_by = ? WHERE id = ? AND moderation = 'pending'`,
+		moderation, at.UTC().Format(time.RFC3339), by, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (d *Database) queryComments(query string, args ...interface{}) ([]*Comment, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []*Comment
+	for rows.Next() {
+		var c Comment
+		var createdAt string
+		if err := rows.Scan(&c.ID, &c.PictureID, &c.EventID, &c.DeviceID, &c.Text, &createdAt, &c.Moderation); err != nil {
+			return nil, err
+		}
+		if c.CreatedAt, err = time.Parse(time.RFC3339, createdAt); err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		comments = append(comments, &c)
+	}
+	return comments, rows.Err()
+}
+
+// GetComment returns a comment by ID, or sql.ErrNoRows if there is none.
+func (d *Database) GetComment(id int64) (*Comment, error) {
+	var c Comment
+	var createdAt string
+	err := d.db.QueryRow(`SELECT id, picture_id, event_id, device_id, text, created_at, moderation FROM comments WHERE id = ?`, id).
+		Scan(&c.ID, &c.PictureID, &c.EventID, &c.DeviceID, &c.Text, &createdAt, &c.Moderation)
+	if err != nil {
+		return nil, err
+	}
+	if c.CreatedAt, err = time.Parse(time.RFC3339, createdAt); err != nil {
+		return nil, fmt.Errorf("failed to parse time: %w", err)
+	}
+	return &c, nil
+}
+
+const guestbookColumns = `id, event_id, name, text, device_id, user_id, created_at, moderation`
+
+// AddGuestbookMessage stores a guestbook message and sets its ID.
+func (d *Database) AddGuestbookMessage(m *GuestbookMessage) error {
+	result, err := d.db.Exec(`INSERT INTO guestbook (event_id, name, text, device_id, user_id, created_at, moderation) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		m.EventID, m.Name, m.Text, m.DeviceID, m.UserID, m.CreatedAt.UTC().Format(time.RFC3339), m.Moderation)
+	if err != nil {
+		return err
+	}
+	m.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetGuestbookMessages returns the last n published guestbook messages of
+// an event, oldest first.
+func (d *Database) GetGuestbookMessages(eventID string, n int) ([]*GuestbookMessage, error) {
+	return d.queryGuestbook(`SELECT `+guestbookColumns+` FROM (
+		SELECT * FROM guestbook WHERE event_id = ? AND moderation = '' ORDER BY id DESC LIMIT ?
+	) ORDER BY id`, eventID, n)
+}
+
+// GetPendingGuestbookMessages returns the guestbook messages of an event
+// waiting for a moderator, oldest first.
+func (d *Database) GetPendingGuestbookMessages(eventID string) ([]*GuestbookMessage, error) {
+	return d.queryGuestbook(`SELECT `+guestbookColumns+` FROM guestbook
+		WHERE event_id = ? AND moderation = 'pending' ORDER BY id`, eventID)
+}
+
+// GetGuestbookMessage returns a guestbook message by ID, or sql.ErrNoRows
+// if there is none.
+func (d *Database) GetGuestbookMessage(id int64) (*GuestbookMessage, error) {
+	messages, err := d.queryGuestbook(`SELECT `+guestbookColumns+` FROM guestbook WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return messages[0], nil
+}
+
+// ModerateGuestbookMessage sets the moderation state of a pending
+// guestbook message, or returns sql.ErrNoRows if there is no pending
+// message with that ID.
+func (d *Database) ModerateGuestbookMessage(id int64, moderation, by string, at time.Time) error {
+	result, err := d.db.Exec(`UPDATE guestbook SET moderation = ?, moderated_at = ?, moderated_by = ? WHERE id = ? AND moderation = 'pending'`,
+		moderation, at.UTC().Format(time.RFC3339), by, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteGuestbookMessage deletes a guestbook message, or returns
+// sql.ErrNoRows if there is none.
+func (d *Database) DeleteGuestbookMessage(id int64) error {
+	result, err := d.db.Exec(`DELETE FROM guestbook WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (d *Database) queryGuestbook(query string, args ...interface{}) ([]*GuestbookMessage, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []*GuestbookMessage
+	for rows.Next() {
+		var m GuestbookMessage
+		var createdAt string
+		if err := rows.Scan(&m.ID, &m.EventID, &m.Name, &m.Text, &m.DeviceID, &m.UserID, &createdAt, &m.Moderation); err != nil {
+			return nil, err
+		}
+		if m.CreatedAt, err = time.Parse(time.RFC3339, createdAt); err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		messages = append(messages, &m)
+	}
+	return messages, rows.Err()
+}
+
+// AddActivity stores an entry of the activity feed and sets its ID. It
+// returns false if it was a milestone the picture already reached.
+func (d *Database) AddActivity(a *Activity) (bool, error) {
+	result, err := d.db.Exec(`INSERT OR IGNORE INTO activity (event_id, kind, picture_id, comment_id, likes, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		a.EventID, a.Kind, a.PictureID, a.CommentID, a.Likes, a.CreatedAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	a.ID, err = result.LastInsertId()
+	return err == nil, err
+}
+
+// GetActivity returns the last n entries of an event's activity feed
+// before the entry with ID before, or the last n if before is 0, newest
+// first. Entries of hidden pictures and of comments that aren't published
+// are left out.
+func (d *Database) GetActivity(eventID string, before int64, n int) ([]*Activity, error) {
+	query := `SELECT a.id, a.kind, a.event_id, a.picture_id, p.url, p.file_version, p.blurhash, p.uploaded_by, p.caption,
+		a.likes, a.comment_id, COALESCE(c.text, ''), a.created_at
+	FROM activity a
+	JOIN pictures p ON p.id = a.picture_id AND p.hidden = 0
+	LEFT JOIN comments c ON c.id = a.comment_id
+	WHERE a.event_id = ? AND (a.comment_id = 0 OR c.moderation = '') AND (? = 0 OR a.id < ?)
+	ORDER BY a.id DESC LIMIT ?`
+	rows, err := d.db.Query(query, eventID, before, before, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []*Activity
+	for rows.Next() {
+		var a Activity
+		var version int
+		var createdAt string
+		if err := rows.Scan(&a.ID, &a.Kind, &a.EventID, &a.PictureID, &a.URL, &version, &a.Blurhash, &a.UploadedBy, &a.Caption,
+			&a.Likes, &a.CommentID, &a.Text, &createdAt); err != nil {
+			return nil, err
+		}
+		if a.CreatedAt, err = time.Parse(time.RFC3339, createdAt); err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		a.URL = assetURL(a.URL, version)
+		items = append(items, &a)
+	}
+	return items, rows.Err()
+}
+
+// AddBan stores a ban and sets its ID, replacing an expired ban of the same
+// IP or device. It returns false if one is still in force.
+func (d *Database) AddBan(ban *Ban) (bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	createdAt := ban.CreatedAt.UTC().Format(time.RFC3339)
+	if _, err := tx.Exec(`DELETE FROM bans WHERE kind = ? AND value = ? AND expires_at <= ?`, ban.Kind, ban.Value, createdAt); err != nil {
+		return false, err
+	}
+	var expiresAt sql.NullString
+	if ban.ExpiresAt != nil {
+		expiresAt = sql.NullString{String: ban.ExpiresAt.UTC().Format(time.RFC3339), Valid: true}
+	}
+	result, err := tx.Exec(`INSERT OR IGNORE INTO bans (kind, value, reason, created_at, created_by, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		ban.Kind, ban.Value, ban.Reason, createdAt, ban.CreatedBy, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if ban.ID, err = result.LastInsertId(); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// GetBans returns the bans in force at now, newest first.
+func (d *Database) GetBans(now time.Time) ([]*Ban, error) {
+	rows, err := d.db.Query(`SELECT id, kind, value, reason, created_at, created_by, expires_at FROM bans
+		WHERE expires_at IS NULL OR expires_at > ? ORDER BY id DESC`, now.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []*Ban
+	for rows.Next() {
+		var ban Ban
+		var createdAt string
+		var expiresAt sql.NullString
+		if err := rows.Scan(&ban.ID, &ban.Kind, &ban.Value, &ban.Reason, &createdAt, &ban.CreatedBy, &expiresAt); err != nil {
+			return nil, err
+		}
+		if ban.CreatedAt, err = time.Parse(time.RFC3339, createdAt); err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		if ban.ExpiresAt, err = parseNullTime(expiresAt); err != nil {
+			return nil, err
+		}
+		bans = append(bans, &ban)
+	}
+	return bans, rows.Err()
+}
+
+// DeleteBan lifts a ban, or returns sql.ErrNoRows if there is none.
+func (d *Database) DeleteBan(id int64) error {
+	result, err := d.db.Exec(`DELETE FROM bans WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// IsBanned reports whether an IP or device is banned at now.
+func (d *Database) IsBanned(ip, deviceID string, now time.Time) (bool, error) {
+	var n int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM bans WHERE ((kind = 'ip' AND value = ?) OR (kind = 'device' AND value = ?))
+		AND (expires_at IS NULL OR expires_at > ?)`, ip, deviceID, now.UTC().Format(time.RFC3339)).Scan(&n)
+	return n > 0, err
+}
+
+// GetDeviceStrikes returns how many of a device's uploads are rejected,
+// and how many other devices have unresolved reports on them.
+func (d *Database) GetDeviceStrikes(deviceID string) (rejected, reported int, err error) {
+	err = d.db.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM pictures WHERE device_id = ? AND moderation = 'rejected'),
+		(SELECT COUNT(DISTINCT r.device_id) FROM reports r JOIN pictures p ON p.id = r.picture_id WHERE p.device_id = ?)`,
+		deviceID, deviceID).Scan(&rejected, &reported)
+	return rejected, reported, err
+}
+
+// AddTermsAcceptance records an acceptance of the terms and sets its ID.
+func (d *Database) AddTermsAcceptance(a *TermsAcceptance) error {
+	result, err := d.db.Exec(`INSERT INTO terms_acceptances (version, event_id, device_id, user_id, accepted_at) VALUES (?, ?, ?, ?, ?)`,
+		a.Version, a.EventID, a.DeviceID, a.UserID, a.AcceptedAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	a.ID, err = result.LastInsertId()
+	return err
+}
+
+// HasAcceptedTerms reports whether a device, or a signed-in user on any
+// device, accepted a version of the terms. userID is 0 for anonymous
+// guests.
+func (d *Database) HasAcceptedTerms(version, deviceID string, userID int64) (bool, error) {
+	var n int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM terms_acceptances
+		WHERE version = ? AND ((device_id != '' AND device_id = ?) OR (user_id != 0 AND user_id = ?))`,
+		version, deviceID, userID).Scan(&n)
+	return n > 0, err
+}
+
+// GetTermsAcceptances returns the recorded acceptances of the terms with
+// their account's username, oldest first; those of one version unless
+// version is "".
+func (d *Database) GetTermsAcceptances(version string) ([]*TermsAcceptance, error) {
+	rows, err := d.db.Query(`SELECT t.id, t.version, t.event_id, t.device_id, t.user_id, COALESCE(u.username, ''), t.accepted_at
+		FROM terms_acceptances t LEFT JOIN users u ON u.id = t.user_id
+		WHERE ? = '' OR t.version = ? ORDER BY t.id`, version, version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var acceptances []*TermsAcceptance
+	for rows.Next() {
+		var a TermsAcceptance
+		var acceptedAt string
+		if err := rows.Scan(&a.ID, &a.Version, &a.EventID, &a.DeviceID, &a.UserID, &a.Username, &acceptedAt); err != nil {
+			return nil, err
+		}
+		if a.AcceptedAt, err = time.Parse(time.RFC3339, acceptedAt); err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		acceptances = append(acceptances, &a)
+	}
+	return acceptances, rows.Err()
+}
+
+// TrashPicture moves a picture to the trash, recording who deleted it and
+// when, and returns it; sql.ErrNoRows if there is no such picture. Its
+// likes, comments and other rows are kept for a restore.
+func (d *Database) TrashPicture(id, by string, at time.Time) (*TrashedPicture, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`INSERT INTO trashed_pictures (`+d.trashColumns+`, deleted_at, deleted_by)
+		SELECT `+d.trashColumns+`, ?, ? FROM pictures WHERE id = ?`, at.UTC().Format(time.RFC3339), by, id)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM pictures WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	d.PicturesChanged()
+	return d.GetTrashedPicture(id)
+}
+
+// RestorePicture moves a picture out of the trash and returns it, numbering
+// its filename if another picture of its event took it meanwhile;
+// sql.ErrNoRows if the picture isn't in the trash.
+func (d *Database) RestorePicture(id string) (*Picture, error) {
+	d.addMu.Lock()
+	defer d.addMu.Unlock()
+	var event, filename string
+	if err := d.db.QueryRow(`SELECT event_id, filename FROM trashed_pictures WHERE id = ?`, id).Scan(&event, &filename); err != nil {
+		return nil, err
+	}
+	filename, err := d.freeFilename(event, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO pictures (`+d.trashColumns+`) SELECT `+d.trashColumns+` FROM trashed_pictures WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE pictures SET filename = ? WHERE id = ?`, filename, id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM trashed_pictures WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	d.PicturesChanged()
+	return d.GetPicture(id)
+}
+
+// GetTrashedPicture returns a picture in the trash, or sql.ErrNoRows if
+// it isn't.
+func (d *Database) GetTrashedPicture(id string) (*TrashedPicture, error) {
+	trashed, err := d.queryTrash(`id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(trashed) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return trashed[0], nil
+}
+
+// GetTrash returns the pictures of an event in the trash, last deleted
+// first.
+func (d *Database) GetTrash(eventID string) ([]*TrashedPicture, error) {
+	return d.queryTrash(`event_id = ?`, eventID)
+}
+
+// GetTrashDeletedBefore returns the pictures in the trash deleted before
+// cutoff.
+func (d *Database) GetTrashDeletedBefore(cutoff time.Time) ([]*TrashedPicture, error) {
+	return d.queryTrash(`deleted_at < ?`, cutoff.UTC().Format(time.RFC3339))
+}
+
+// GetTrashOf returns the pictures in the trash a device or a user
+// uploaded; "" and 0 leave either out.
+func (d *Database) GetTrashOf(deviceID string, userID int64) ([]*TrashedPicture, error) {
+	return d.queryTrash(`((device_id = ? AND device_id != '') OR (user_id = ? AND user_id != 0))`, deviceID, userID)
+}
+
+// queryTrash returns the pictures in the trash matching where, last
+// deleted first.
+func (d *Database) queryTrash(where string, args ...interface{}) ([]*TrashedPicture, error) {
+	pictures, err := d.queryPictures(`SELECT `+pictureColumns+` FROM trashed_pictures WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[string]*Picture{}
+	for _, pic := range pictures {
+		byID[pic.ID] = pic
+	}
+
+	rows, err := d.db.Query(`SELECT id, deleted_at, deleted_by, original_key, original_location FROM trashed_pictures
+		WHERE `+where+` ORDER BY deleted_at DESC, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var trashed []*TrashedPicture
+	for rows.Next() {
+		var t TrashedPicture
+		var id, deletedAt string
+		if err := rows.Scan(&id, &deletedAt, &t.DeletedBy, &t.OriginalKey, &t.OriginalLocation); err != nil {
+			return nil, err
+		}
+		if t.Picture = byID[id]; t.Picture == nil {
+			continue
+		}
+		if t.DeletedAt, err = time.Parse(time.RFC3339, deletedAt); err != nil {
+			return nil, fmt.Errorf("failed to parse time: %w", err)
+		}
+		trashed = append(trashed, &t)
+	}
+	return trashed, rows.Err()
+}
+
+// PurgeTrashedPicture deletes a picture in the trash for good, with its
+// likes, comments and other rows.
+func (d *Database) PurgeTrashedPicture(id string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range pictureTables {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE picture_id = ?`, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM trashed_pictures WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// FileTrashed reports whether a picture in the trash has its files stored
+// under key.
+func (d *Database) FileTrashed(key string) (bool, error) {
+	var n int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM trashed_pictures WHERE file_key = ? OR (file_key = '' AND id = ?)`, key, key).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// The runtime debug endpoints, net/http/pprof under /debug/pprof/ and
+// expvar under /debug/vars, are served on debugAddr, meant to be a
+// loopback or internal address, and, with debugAdmin, on the main server
+// to admins. Both are off by default.
+var (
+	debugAddr  string
+	debugAdmin bool
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("hub", expvar.Func(func() interface{} {
+		return map[string]interface{}{
+			"connections":    hub.connections.Load(),
+			"connects":       wsConnects.Load(),
+			"disconnects":    wsDisconnects.Load(),
+			"rejected":       wsRejected.Load(),
+			"messagesSent":   wsMessagesSent.Load(),
+			"bytesSent":      wsBytesSent.Load(),
+			"sendQueueDrops": wsSendQueueDrops.Load(),
+			"clientsDropped": wsClientsDropped.Load(),
+			"broadcasts":     hubBroadcastLatency.count.Load(),
+		}
+	}))
+}
+
+// isLoopback reports whether host is localhost or a loopback address.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// debugHandler serves the pprof and expvar endpoints.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every browser gets an anonymous device ID on its first request, in a
+// cookie signed with a server secret so that guests can't make up IDs. A
+// device likes a picture once, its uploads are attributed to it, and likes
+// and uploads are rate limited per device rather than per IP, as a whole
+// venue shares one NAT address. Requests without a valid cookie get a new
+// device, and are rate limited by IP until they send it back, so clients
+// that drop cookies gain nothing from it.
+var (
+	configuredDeviceSecret string
+	deviceSecret           []byte
+
+	likeLimiter   = newRateLimiter()
+	uploadLimiter = newRateLimiter()
+
+	likesDuplicate     atomic.Uint64
+	likesRateLimited   atomic.Uint64
+	uploadsRateLimited atomic.Uint64
+
+	errAlreadyLiked = errors.New("already liked")
+)
+
+const (
+	deviceCookieName = "picsapp_device"
+	deviceCookieTTL  = 365 * 24 * time.Hour
+	// deviceSecretName is the name of the generated secret in the
+	// database, used when DEVICE_SECRET isn't set
+	deviceSecretName = "device"
+)
+
+// loadDeviceSecret sets the key device IDs are signed with: DEVICE_SECRET,
+// or else a random secret generated on first start and kept in the
+// database, so that devices survive restarts.
+func loadDeviceSecret() error {
+	if configuredDeviceSecret != "" {
+		deviceSecret = []byte(configuredDeviceSecret)
+		return nil
+	}
+	secret, err := db.GetOrCreateSecret(deviceSecretName, func() (string, error) { return randomHex(32) })
+	if err != nil {
+		return err
+	}
+	deviceSecret = []byte(secret)
+	return nil
+}
+
+// signDevice returns the cookie value of a device ID.
+func signDevice(id string) string {
+	mac := hmac.New(sha256.New, deviceSecret)
+	mac.Write([]byte(id))
+	return id + "." + hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// verifyDevice returns the device ID of a cookie value, or "" if it isn't
+// one signed by this server.
+func verifyDevice(value string) string {
+	id, _, ok := strings.Cut(value, ".")
+	if !ok || len(id) != 32 || !hmac.Equal([]byte(value), []byte(signDevice(id))) {
+		return ""
+	}
+	return id
+}
+
+type deviceContextKey struct{}
+
+// requestDevice is the device of a request. known is false for a device
+// issued with this response, whose cookie the client hasn't sent back yet.
+type requestDevice struct {
+	id    string
+	known bool
+	ip    string
+}
+
+// rateKey is the key a request is rate limited by: its device, or its IP
+// until the client has shown that it keeps the cookie.
+func (d requestDevice) rateKey() string {
+	if d.known {
+		return d.id
+	}
+	return "ip:" + d.ip
+}
+
+// deviceFromRequest returns the device of a request.
+func deviceFromRequest(r *http.Request) requestDevice {
+	if d, ok := r.Context().Value(deviceContextKey{}).(requestDevice); ok {
+		return d
+	}
+	return requestDevice{ip: remoteIP(r)}
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// deviceMiddleware attaches the device of a request to it, issuing a new
+// device cookie when the request has no valid one.
+func deviceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := requestDevice{ip: remoteIP(r)}
+		if cookie, err := r.Cookie(deviceCookieName); err == nil {
+			d.id = verifyDevice(cookie.Value)
+			d.known = d.id != ""
+		}
+		if !d.known {
+			id, err := randomHex(16)
+			if err != nil {
+				logError("new device: %v", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			d.id = id
+			http.SetCookie(w, &http.Cookie{
+				Name:     deviceCookieName,
+				Value:    signDevice(id),
+				Path:     "/",
+				MaxAge:   int(deviceCookieTTL.Seconds()),
+				HttpOnly: true,
+				Secure:   r.TLS != nil || sessionCookieSecure,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), deviceContextKey{}, d)))
+	})
+}
+
+// rateLimiter is a token bucket per key: each holds up to a minute's worth
+// of tokens and refills at the per-minute rate. A rate of 0 means no limit.
+type rateLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*tokenBucket{}}
+}
+
+// setRate changes the rate, on a configuration reload.
+func (l *rateLimiter) setRate(perMinute int) {
+	l.mu.Lock()
+	l.perMinute = perMinute
+	l.mu.Unlock()
+}
+
+// allow takes a token from the bucket of key. If there is none it returns
+// false and how long until there is.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.perMinute <= 0 {
+		return true, 0
+	}
+	capacity := float64(l.perMinute)
+	perSecond := capacity / 60
+	// Full buckets hold nothing worth keeping
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*perSecond >= capacity {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rateLimitedError is returned for an action refused by a rate limiter.
+type rateLimitedError struct {
+	msg        string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitedError) Error() string { return e.msg }
+
+// tooManyRequests answers a rate-limited request.
+func tooManyRequests(w http.ResponseWriter, msg string, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// likePicture adds a device's like to a picture of the public wall, once,
+// and hands the new count to the hub, which broadcasts counts in batches.
+func likePicture(d requestDevice, id string) (*Picture, error) {
+	if banned(d) {
+		return nil, errBanned
+	}
+	if ok, retryAfter := likeLimiter.allow(d.rateKey(), time.Now()); !ok {
+		likesRateLimited.Add(1)
+		return nil, &rateLimitedError{msg: "too many likes", retryAfter: retryAfter}
+	}
+	pic, err := db.AddLike(id, d.id)
+	if err != nil {
+		return nil, err
+	}
+	if pic == nil {
+		likesDuplicate.Add(1)
+		return nil, errAlreadyLiked
+	}
+	hub.publishLike(pic)
+	checkMilestone(pic)
+	return pic, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Uploads are refused, and conversions wait, while the volume holding
+// uploadDir has less than minFreeDiskBytes free, so a full disk can't
+// corrupt the database or leave half-written images. 0 turns the guard off.
+var (
+	minFreeDiskBytes reloadable[uint64]
+
+	diskFree            atomic.Uint64 // at the last check
+	diskLow             atomic.Bool
+	uploadsRejectedDisk atomic.Uint64
+)
+
+// diskRecheckInterval is how often the conversion worker checks for free
+// space again while the disk is low.
+const diskRecheckInterval = 10 * time.Second
+
+// errDiskSpaceUnsupported is returned by freeDiskSpace where free space
+// can't be read; the guard is then off.
+var errDiskSpaceUnsupported = errors.New("free disk space not supported on this platform")
+
+// checkDiskSpace reads the free space of the upload volume and returns an
+// error if it is below minFreeDiskBytes. It logs when the volume runs low
+// and when it recovers.
+func checkDiskSpace() error {
+	minFree := minFreeDiskBytes.Load()
+	if minFree == 0 {
+		return nil
+	}
+	free, err := freeDiskSpace(uploadDir)
+	if errors.Is(err, errDiskSpaceUnsupported) {
+		return nil
+	}
+	if err != nil {
+		logWarn("read free disk space of %s: %v", uploadDir, err)
+		return nil
+	}
+	diskFree.Store(free)
+	low := free < minFree
+	if diskLow.Swap(low) != low {
+		if low {
+			logError("disk space low: %d MB free on %s, below %d MB; refusing uploads", free>>20, uploadDir, minFree>>20)
+			notify(&notice{kind: noticeDiskLow, text: fmt.Sprintf("💾 Disk space low: %d MB free, below %d MB; uploads are refused", free>>20, minFree>>20)})
+		} else {
+			logInfo("disk space recovered: %d MB free on %s; accepting uploads", free>>20, uploadDir)
+			notify(&notice{kind: noticeDiskLow, text: fmt.Sprintf("✅ Disk space recovered: %d MB free; uploads are accepted again", free>>20)})
+		}
+	}
+	if low {
+		return fmt.Errorf("%d MB free, below %d MB", free>>20, minFree>>20)
+	}
+	return nil
+}
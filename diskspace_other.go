@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+func freeDiskSpace(dir string) (uint64, error) {
+	return 0, errDiskSpaceUnsupported
+}
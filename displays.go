@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// displayTokenPrefix marks kiosk display tokens so they can be told apart
+// from the presenter and admin tokens without a database lookup.
+const displayTokenPrefix = "dsp_"
+
+const maxDisplayNameLength = 64
+
+// displayRevokedReason is the close reason sent with ClosePolicyViolation
+// to the connections of a display that was revoked.
+const displayRevokedReason = "display revoked"
+
+var (
+	errUnknownDisplay = errors.New("unknown display")
+	errDisplayRevoked = errors.New("display revoked")
+)
+
+// Display is a presentation screen registered by an admin. It connects
+// with a long-lived token that identifies it, so broadcasts can be
+// addressed to it and a leaked kiosk URL can be revoked.
+type Display struct {
+	ID         string     `json:"id"`
+	EventID    string     `json:"eventId"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastSeenAt *time.Time `json:"lastSeenAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+// DisplayStatus is a display with its live connection stats on this
+// instance.
+type DisplayStatus struct {
+	*Display
+	Connected   int        `json:"connected"`
+	ConnectedAt *time.Time `json:"connectedAt,omitempty"`
+	FramesSent  uint64     `json:"framesSent"`
+}
+
+// CreateDisplayRequest is the body of POST /api/admin/displays.
+type CreateDisplayRequest struct {
+	Name string `json:"name"`
+}
+
+// CreateDisplayResponse returns a new display with its token and kiosk
+// URL. The token is only shown once; the server keeps its hash.
+type CreateDisplayResponse struct {
+	Display *Display `json:"display"`
+	Token   string   `json:"token"`
+	URL     string   `json:"url"`
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashDisplayToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// displayFromRequest returns the display whose token a request carries. It
+// returns nil without an error when the token isn't a display token, and
+// errUnknownDisplay or errDisplayRevoked when it is one that can't be used.
+func displayFromRequest(r *http.Request) (*Display, error) {
+	token := requestToken(r)
+	if !strings.HasPrefix(token, displayTokenPrefix) {
+		return nil, nil
+	}
+	display, err := db.GetDisplayByTokenHash(hashDisplayToken(token))
+	if err == sql.ErrNoRows {
+		return nil, errUnknownDisplay
+	}
+	if err != nil {
+		return nil, err
+	}
+	if display.RevokedAt != nil {
+		return nil, errDisplayRevoked
+	}
+	return display, nil
+}
+
+// eventDisplay returns an unrevoked display of event.
+func eventDisplay(id, event string) (*Display, error) {
+	display, err := db.GetDisplay(id)
+	if err == sql.ErrNoRows || (err == nil && (display.EventID != event || display.RevokedAt != nil)) {
+		return nil, errUnknownDisplay
+	}
+	return display, err
+}
+
+// createDisplay registers a display for event and returns it with its
+// token, which only the caller ever sees.
+func createDisplay(event, name string) (*Display, string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", fmt.Errorf("generate display id: %w", err)
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return nil, "", fmt.Errorf("generate display token: %w", err)
+	}
+	token := displayTokenPrefix + secret
+	display := &Display{
+		ID:        id,
+		EventID:   event,
+		Name:      name,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if err := db.AddDisplay(display, hashDisplayToken(token)); err != nil {
+		return nil, "", fmt.Errorf("add display: %w", err)
+	}
+	return display, token, nil
+}
+
+// kioskURL is the presentation URL a display opens with its token.
+func kioskURL(event, token string) string {
+	query := url.Values{"event": {event}, "token": {token}}
+	return "/presentation?" + query.Encode()
+}
+
+// handleCreateDisplay mints a display and its token for the request's
+// event.
+func handleCreateDisplay(w http.ResponseWriter, r *http.Request) {
+	var req CreateDisplayRequest
+	event, ok := decodeEventRequest(w, r, &req, 4<<10)
+	if !ok {
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxDisplayNameLength {
+		http.Error(w, "Name must be 1-64 characters", http.StatusBadRequest)
+		return
+	}
+
+	display, token, err := createDisplay(event, name)
+	if err != nil {
+		logError("create display failed: %v", err)
+		http.Error(w, "Error creating display", http.StatusInternalServerError)
+		return
+	}
+
+	logInfo("display %s (%s) created for event %s", display.ID, display.Name, event)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&CreateDisplayResponse{
+		Display: display,
+		Token:   token,
+		URL:     kioskURL(event, token),
+	})
+}
+
+// handleListDisplays lists the request event's displays, including revoked
+// ones, with their connection stats.
+func handleListDisplays(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	displays, err := db.GetDisplays(event)
+	if err != nil {
+		logError("get displays failed: %v", err)
+		http.Error(w, "Error fetching displays", http.StatusInternalServerError)
+		return
+	}
+
+	stats := hub.displayStats(event)
+	statuses := make([]*DisplayStatus, 0, len(displays))
+	for _, display := range displays {
+		status := stats[display.ID]
+		status.Display = display
+		statuses = append(statuses, &status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// handleRevokeDisplay revokes a display's token and disconnects it.
+func handleRevokeDisplay(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	display, err := db.GetDisplay(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Display not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("get display failed: %v", err)
+		http.Error(w, "Error revoking display", http.StatusInternalServerError)
+		return
+	}
+	if err := db.RevokeDisplay(id, time.Now()); err != nil {
+		logError("revoke display failed: %v", err)
+		http.Error(w, "Error revoking display", http.StatusInternalServerError)
+		return
+	}
+	hub.revokeDisplay(id)
+
+	logInfo("display %s (%s) revoked for event %s", display.ID, display.Name, display.EventID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Guests save pictures with GET /api/pictures/{id}/original and whole
+// events with the ZIP of GET /api/pictures/export. Both are counted, per
+// picture and per event, so photographers can see in the admin stats
+// which shots people actually kept.
+
+const (
+	// maxConcurrentExports is how many ZIP exports are streamed at a time;
+	// more get a 429
+	maxConcurrentExports = 2
+	exportRetryAfter     = time.Minute
+
+	defaultDownloadsLimit = 20
+	maxDownloadsLimit     = 100
+)
+
+var exportSlots = make(chan struct{}, maxConcurrentExports)
+
+// PictureDownloads is a picture and how many times its original was
+// downloaded.
+type PictureDownloads struct {
+	Picture   *Picture `json:"picture"`
+	Downloads int      `json:"downloads"`
+}
+
+// DownloadStats is what of an event was downloaded, for admins.
+type DownloadStats struct {
+	Event string `json:"event"`
+	// Exports counts the downloads of the event's ZIP export
+	Exports  int                 `json:"exports"`
+	Pictures []*PictureDownloads `json:"pictures"`
+}
+
+// handleDownloadOriginal serves a visible picture's original as an
+// attachment: the file uploaded if it was kept with KEEP_ORIGINALS and
+// isn't archived, the converted image otherwise. Requests for the start
+// of the file count as a download; those resuming one with a Range don't.
+func handleDownloadOriginal(w http.ResponseWriter, r *http.Request) {
+	pic, err := db.GetPicture(mux.Vars(r)["id"])
+	if err != nil || pic.Hidden {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	key, location, err := db.GetPictureOriginal(pic.ID)
+	if err != nil {
+		logError("get original failed: %v", err)
+		http.Error(w, "Error fetching picture", http.StatusInternalServerError)
+		return
+	}
+	store, name := uploadStore, pic.FileKey
+	if key != "" && location == "" {
+		store, name = originalStore, key
+	}
+	info, err := store.Stat(r.Context(), name)
+	if err != nil {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	f, err := store.Get(r.Context(), name)
+	if err != nil {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	if rng := r.Header.Get("Range"); !readOnly.Load() && (rng == "" || strings.HasPrefix(rng, "bytes=0-")) {
+		if err := db.RecordDownload(pic.ID); err != nil {
+			logWarn("count download of %s: %v", pic.ID, err)
+		}
+	}
+	ext := path.Ext(name)
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Content-Disposition", downloadDisposition(pic, ext))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	// The proxy's internal location has no originals; those are served
+	// from here
+	if store == uploadStore && sendStored(w, store, "uploads", name) {
+		return
+	}
+	http.ServeContent(w, r, "", info.ModTime, f)
+}
+
+// handleExport streams a ZIP of the request's event's visible pictures,
+// laid out as picsapp export's, and counts it as a download of the
+// event's export.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	select {
+	case exportSlots <- struct{}{}:
+		defer func() { <-exportSlots }()
+	default:
+		w.Header().Set("Retry-After", strconv.Itoa(int(exportRetryAfter.Seconds())))
+		http.Error(w, "Too many exports in progress", http.StatusTooManyRequests)
+		return
+	}
+	all, err := db.GetArchivedPictures(event)
+	if err != nil {
+		logError("get pictures for export failed: %v", err)
+		http.Error(w, "Error fetching pictures", http.StatusInternalServerError)
+		return
+	}
+	pictures := []*Picture{}
+	for _, pic := range all {
+		if !pic.Hidden {
+			pictures = append(pictures, pic)
+		}
+	}
+	if !readOnly.Load() {
+		if err := db.RecordExport(event); err != nil {
+			logWarn("count export of %s: %v", event, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+event+`.zip"`)
+	// The route has no write deadline; the writer pushes it back as long
+	// as the client reads
+	tw := &throttledWriter{w: w, rc: http.NewResponseController(w), start: time.Now()}
+	if err := writeExport(r.Context(), tw, pictures); err != nil {
+		// Too late for an error status; the client gets a truncated ZIP
+		logWarn("export of %s: %v", event, err)
+	}
+}
+
+// writeExport writes a ZIP of pictures to w: pictures.json with their
+// metadata and the images under images/. Images that can't be read are
+// logged and left out.
+func writeExport(ctx context.Context, w io.Writer, pictures []*Picture) error {
+	zw := zip.NewWriter(w)
+	meta, err := zw.Create("pictures.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(meta)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(pictures); err != nil {
+		return err
+	}
+	for _, pic := range pictures {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := addZipFile(ctx, zw, "images/"+pic.ID, uploadStore, pic.FileKey); err != nil {
+			logWarn("export %s: %v", pic.ID, err)
+		}
+	}
+	return zw.Close()
+}
+
+// addZipFile copies the file under key in store into zw as name. WebP
+// images are already compressed, so they are stored as is.
+func addZipFile(ctx context.Context, zw *zip.Writer, name string, store Storage, key string) error {
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	f, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := &zip.FileHeader{Name: name, Method: zip.Store, Modified: info.ModTime}
+	header.SetMode(0644)
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// handleDownloadStats returns how many times an event's export was
+// downloaded and its ?limit= (default 20) pictures whose originals were
+// downloaded most.
+func handleDownloadStats(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	limit := defaultDownloadsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxDownloadsLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	stats := &DownloadStats{Event: event}
+	var err error
+	if stats.Exports, err = db.GetEventExports(event); err == nil {
+		stats.Pictures, err = db.GetMostDownloaded(event, limit)
+	}
+	if err != nil {
+		logError("get download stats failed: %v", err)
+		http.Error(w, "Error fetching download stats", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
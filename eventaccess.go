@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// An event with an access code is invite-only: viewing its gallery,
+// presentation and pictures, and connecting to its WebSocket feed, need
+// the code, not only uploading. Guests enter it once and get a cookie for
+// the event, signed with the device secret over the code, so changing the
+// code locks out everyone who entered the old one. Presenters, moderators,
+// admins and the event's displays don't need it. Image files aren't
+// guarded: their URLs carry a hash of the file, so they can't be guessed.
+
+const (
+	accessCookiePrefix = "picsapp_access_"
+	accessCookieTTL    = 30 * 24 * time.Hour
+	// minAccessCodeLength and maxAccessCodeLength bound a code, in
+	// characters
+	minAccessCodeLength = 4
+	maxAccessCodeLength = 64
+	// accessAttemptsPerMinute limits code attempts per device
+	accessAttemptsPerMinute = 10
+)
+
+var (
+	accessLimiter = &rateLimiter{perMinute: accessAttemptsPerMinute, buckets: map[string]*tokenBucket{}}
+
+	accessDenied   atomic.Uint64
+	accessFailures atomic.Uint64
+)
+
+// guardedRoutes are the routes, besides those of a picture, share code or
+// contest round, guarded by the access code of their "event" query value.
+var guardedRoutes = map[string]bool{
+	"/api/pictures":               true,
+	"/api/pictures/grouped":       true,
+	"/api/pictures/export":        true,
+	"/api/presentation":           true,
+	"/api/presentation/spotlight": true,
+	"/api/presentation/manifest":  true,
+	"/api/presentation/settings":  true,
+	"/api/playlists":              true,
+	"/api/contest/rounds":         true,
+	"/api/stats":                  true,
+	"/api/activity":               true,
+	"/api/guestbook":              true,
+	"/ws":                         true,
+}
+
+// EventAccess is whether an event needs an access code, and whether the
+// request has access to it.
+type EventAccess struct {
+	Event    string `json:"event"`
+	Required bool   `json:"required"`
+	Granted  bool   `json:"granted"`
+}
+
+// AccessCodeRequest is the body of POST /api/access and PUT
+// /api/admin/access.
+type AccessCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// EventAccessCode is an event's access code, for admins; "" if the event
+// is public.
+type EventAccessCode struct {
+	Event string `json:"event"`
+	Code  string `json:"code"`
+}
+
+// accessCookieName is the name of the cookie granting access to event;
+// event IDs are valid cookie names.
+func accessCookieName(event string) string {
+	return accessCookiePrefix + event
+}
+
+// accessToken returns the cookie value granting access to an event while
+// its code is code.
+func accessToken(event, code string) string {
+	mac := hmac.New(sha256.New, deviceSecret)
+	mac.Write([]byte("access\x00" + event + "\x00" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// accessEvent returns the event whose access code guards a request: the
+// event of the picture, share code or contest round in its route, or its
+// "event" query value. ok is false for routes that aren't guarded, and for
+// unknown pictures, codes and rounds, which their handlers answer 404. The query is read
+// rather than the form so that upload bodies aren't parsed ahead of their
+// limits; handleUpload checks the event of its form itself.
+func accessEvent(r *http.Request) (event string, ok bool) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "", false
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return "", false
+	}
+	vars := mux.Vars(r)
+	switch {
+	case strings.HasPrefix(tmpl, "/api/pictures/{id}"):
+		pic, err := db.GetPicture(vars["id"])
+		if err != nil {
+			return "", false
+		}
+		return pic.EventID, true
+	case tmpl == "/api/share/{code}" || tmpl == "/p/{code}":
+		id, err := db.GetSharedPictureID(vars["code"])
+		if err != nil {
+			return "", false
+		}
+		pic, err := db.GetPicture(id)
+		if err != nil {
+			return "", false
+		}
+		return pic.EventID, true
+	case tmpl == "/api/contest/rounds/{id}" || tmpl == "/api/contest/{id}/results":
+		id, err := strconv.ParseInt(vars["id"], 10, 64)
+		if err != nil {
+			return "", false
+		}
+		round, err := db.GetContestRound(id)
+		if err != nil {
+			return "", false
+		}
+		return round.EventID, true
+	case guardedRoutes[tmpl]:
+		event := r.URL.Query().Get("event")
+		if event == "" {
+			event = defaultEventID
+		}
+		return event, true
+	}
+	return "", false
+}
+
+// hasEventAccess reports whether a request may see event: the event is
+// public, the request carries the event's access cookie, a presenter's
+// or higher role, or a display token of the event.
+func hasEventAccess(r *http.Request, event string) (required, granted bool, err error) {
+	code, err := db.GetEventAccessCode(event)
+	if err != nil {
+		return false, false, err
+	}
+	if code == "" {
+		return false, true, nil
+	}
+	if role, ok := authenticate(r); ok && role >= RolePresenter {
+		return true, true, nil
+	}
+	if display, err := displayFromRequest(r); err == nil && display != nil && display.EventID == event {
+		return true, true, nil
+	}
+	cookie, err := r.Cookie(accessCookieName(event))
+	return true, err == nil && hmac.Equal([]byte(cookie.Value), []byte(accessToken(event, code))), nil
+}
+
+// checkEventAccess answers 403 and returns false if a request may not see
+// event.
+func checkEventAccess(w http.ResponseWriter, r *http.Request, event string) bool {
+	_, granted, err := hasEventAccess(r, event)
+	if err != nil {
+		logError("get access code failed: %v", err)
+		http.Error(w, "Error checking event access", http.StatusInternalServerError)
+		return false
+	}
+	if !granted {
+		accessDenied.Add(1)
+		http.Error(w, "This event needs an access code", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// eventAccessMiddleware refuses guarded routes of invite-only events to
+// requests without access.
+func eventAccessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if event, ok := accessEvent(r); ok && !checkEventAccess(w, r, event) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleGetAccess returns whether the request's event needs an access
+// code and whether the request has access.
+func handleGetAccess(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	required, granted, err := hasEventAccess(r, event)
+	if err != nil {
+		logError("get access code failed: %v", err)
+		http.Error(w, "Error checking event access", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EventAccess{Event: event, Required: required, Granted: granted})
+}
+
+// handleEnterAccessCode grants the request access to its event if it
+// sends the event's code, in a cookie.
+func handleEnterAccessCode(w http.ResponseWriter, r *http.Request) {
+	var req AccessCodeRequest
+	event, ok := decodeEventRequest(w, r, &req, 4<<10)
+	if !ok {
+		return
+	}
+	if ok, retryAfter := accessLimiter.allow(deviceFromRequest(r).rateKey(), time.Now()); !ok {
+		tooManyRequests(w, "Too many attempts from this device", retryAfter)
+		return
+	}
+	code, err := db.GetEventAccessCode(event)
+	if err != nil {
+		logError("get access code failed: %v", err)
+		http.Error(w, "Error checking event access", http.StatusInternalServerError)
+		return
+	}
+	if code != "" {
+		if !hmac.Equal([]byte(strings.TrimSpace(req.Code)), []byte(code)) {
+			accessFailures.Add(1)
+			http.Error(w, "Wrong access code", http.StatusForbidden)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     accessCookieName(event),
+			Value:    accessToken(event, code),
+			Path:     "/",
+			MaxAge:   int(accessCookieTTL / time.Second),
+			HttpOnly: true,
+			Secure:   r.TLS != nil || sessionCookieSecure,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EventAccess{Event: event, Required: code != "", Granted: true})
+}
+
+// handleAccessCode returns an event's access code, after setting it with
+// PUT or making the event public with DELETE.
+func handleAccessCode(w http.ResponseWriter, r *http.Request) {
+	var req AccessCodeRequest
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Code = strings.TrimSpace(req.Code)
+		if n := utf8.RuneCountInString(req.Code); n < minAccessCodeLength || n > maxAccessCodeLength {
+			http.Error(w, "Access code must be 4-64 characters", http.StatusBadRequest)
+			return
+		}
+	}
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		if err = db.SetEventAccessCode(event, req.Code); err == nil {
+			logInfo("access code of event %s set", event)
+		}
+	case http.MethodDelete:
+		if err = db.DeleteEventAccessCode(event); err == nil {
+			logInfo("event %s made public", event)
+		}
+	}
+	if err != nil {
+		logError("set access code failed: %v", err)
+		http.Error(w, "Error setting access code", http.StatusInternalServerError)
+		return
+	}
+	code, err := db.GetEventAccessCode(event)
+	if err != nil {
+		logError("get access code failed: %v", err)
+		http.Error(w, "Error fetching access code", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EventAccessCode{Event: event, Code: code})
+}
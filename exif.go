@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// The converted images carry no EXIF, so the photo details of a picture
+// are read from its original, kept with KEEP_ORIGINALS. Only a whitelist
+// is returned: the camera, the exposure, when it was taken and the
+// orientation. GPS positions, serial numbers, owner names and maker notes
+// are never read.
+
+// maxExifBytes bounds the EXIF block read from an original; JPEG's is
+// under 64 KB anyway.
+const maxExifBytes = 1 << 20
+
+// EXIF tags of the whitelist, in IFD0 and the Exif IFD.
+const (
+	tagMake               = 0x010F
+	tagModel              = 0x0110
+	tagOrientation        = 0x0112
+	tagExifIFD            = 0x8769
+	tagExposureTime       = 0x829A
+	tagFNumber            = 0x829D
+	tagISO                = 0x8827
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagFocalLength        = 0x920A
+	tagLensModel          = 0xA434
+)
+
+var (
+	errNoExif  = errors.New("no EXIF data")
+	errBadExif = errors.New("malformed EXIF data")
+)
+
+// PictureMetadata is the whitelisted EXIF data of a picture's original.
+// Fields the camera didn't record are omitted.
+type PictureMetadata struct {
+	PictureID string            `json:"pictureId"`
+	Camera    *CameraMetadata   `json:"camera,omitempty"`
+	Exposure  *ExposureMetadata `json:"exposure,omitempty"`
+	// TakenAt is when the picture was taken, in RFC 3339 when the camera
+	// recorded its offset from UTC, and in the camera's local time without
+	// one otherwise, such as 2024-01-15T21:42:07
+	TakenAt string `json:"takenAt,omitempty"`
+	// Orientation is the EXIF orientation, 1 to 8, which the converted
+	// images are already rotated by
+	Orientation int `json:"orientation,omitempty"`
+}
+
+// CameraMetadata is the camera and lens a picture was taken with.
+type CameraMetadata struct {
+	Make  string `json:"make,omitempty"`
+	Model string `json:"model,omitempty"`
+	Lens  string `json:"lens,omitempty"`
+}
+
+// ExposureMetadata is how a picture was exposed.
+type ExposureMetadata struct {
+	// Time is the shutter speed in seconds, as photographers write it:
+	// 1/125, 0.5 or 2
+	Time        string  `json:"time,omitempty"`
+	FNumber     float64 `json:"fNumber,omitempty"`
+	ISO         int     `json:"iso,omitempty"`
+	FocalLength float64 `json:"focalLength,omitempty"`
+}
+
+// handlePictureMetadata returns the whitelisted EXIF data of a visible
+// picture's original. Originals without EXIF give a PictureMetadata with
+// only the ID; pictures whose original isn't kept, or was archived, 404.
+func handlePictureMetadata(w http.ResponseWriter, r *http.Request) {
+	pic, err := db.GetPicture(mux.Vars(r)["id"])
+	if err != nil || pic.Hidden {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	key, location, err := db.GetPictureOriginal(pic.ID)
+	if err != nil {
+		logError("get original failed: %v", err)
+		http.Error(w, "Error fetching metadata", http.StatusInternalServerError)
+		return
+	}
+	if key == "" || location != "" {
+		http.Error(w, "Original not available", http.StatusNotFound)
+		return
+	}
+	f, err := originalStore.Get(r.Context(), key)
+	if err != nil {
+		http.Error(w, "Original not available", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	meta := &PictureMetadata{PictureID: pic.ID}
+	tiff, err := findExif(f)
+	if err == nil {
+		err = parseExif(tiff, meta)
+	}
+	if err != nil && !errors.Is(err, errNoExif) {
+		logWarn("read EXIF of %s: %v", pic.ID, err)
+	}
+	// An original's EXIF never changes, but the picture may be hidden
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	json.NewEncoder(w).Encode(meta)
+}
+
+// findExif returns the TIFF-structured EXIF block of a JPEG, PNG or WebP
+// file, seeking past the image data rather than reading it.
+func findExif(r io.ReadSeeker) ([]byte, error) {
+	var magic [12]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, errNoExif
+	}
+	switch {
+	case magic[0] == 0xFF && magic[1] == 0xD8:
+		return findJPEGExif(r)
+	case bytes.Equal(magic[:8], []byte("\x89PNG\r\n\x1a\n")):
+		return findChunk(r, 8, true, "eXIf")
+	case string(magic[:4]) == "RIFF" && string(magic[8:]) == "WEBP":
+		return findChunk(r, 12, false, "EXIF")
+	}
+	return nil, errNoExif
+}
+
+// findJPEGExif returns the EXIF block of the APP1 segment of a JPEG file.
+func findJPEGExif(r io.ReadSeeker) ([]byte, error) {
+	if _, err := r.Seek(2, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, errNoExif
+		}
+		// Metadata segments come before the first scan
+		if header[0] != 0xFF || header[1] == 0xDA || header[1] == 0xD9 {
+			return nil, errNoExif
+		}
+		size := int64(binary.BigEndian.Uint16(header[2:])) - 2
+		if size < 0 {
+			return nil, errBadExif
+		}
+		if header[1] == 0xE1 && size > 6 {
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, errBadExif
+			}
+			if tiff, ok := bytes.CutPrefix(data, []byte("Exif\x00\x00")); ok {
+				return tiff, nil
+			}
+			// An XMP segment; EXIF may follow
+			continue
+		}
+		if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// findChunk returns the data of the first chunk of type name in a PNG
+// (big-endian lengths, CRCs after the data) or else RIFF (little-endian
+// lengths, padded to even sizes) file, from offset. WebP encoders may put
+// the EXIF header of JPEG before the block.
+func findChunk(r io.ReadSeeker, offset int64, png bool, name string) ([]byte, error) {
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, errNoExif
+		}
+		var size int64
+		var kind string
+		if png {
+			size, kind = int64(binary.BigEndian.Uint32(header[:4])), string(header[4:])
+		} else {
+			kind, size = string(header[:4]), int64(binary.LittleEndian.Uint32(header[4:]))
+		}
+		if kind == name {
+			if size > maxExifBytes {
+				return nil, errBadExif
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, errBadExif
+			}
+			data, _ = bytes.CutPrefix(data, []byte("Exif\x00\x00"))
+			return data, nil
+		}
+		if png && kind == "IEND" {
+			return nil, errNoExif
+		}
+		skip := size
+		if png {
+			skip += 4
+		} else {
+			skip += size & 1
+		}
+		if _, err := r.Seek(skip, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// tiffReader reads the IFDs of a TIFF-structured EXIF block, checking
+// every offset against its bounds.
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// ifdEntry is an entry of an IFD, with its value's bytes.
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// maxIFDEntries bounds the entries read from an IFD.
+const maxIFDEntries = 512
+
+// tiffTypeSizes are the sizes of the TIFF field types by type number.
+var tiffTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// ifd returns the entries of the IFD at offset by tag, leaving out those
+// of unknown types or out of bounds.
+func (t *tiffReader) ifd(offset uint32) (map[uint16]ifdEntry, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil, errBadExif
+	}
+	n := int(t.order.Uint16(t.data[offset:]))
+	if n > maxIFDEntries {
+		return nil, errBadExif
+	}
+	entries := make(map[uint16]ifdEntry, n)
+	for i := 0; i < n; i++ {
+		start := uint64(offset) + 2 + uint64(i)*12
+		if start+12 > uint64(len(t.data)) {
+			return nil, errBadExif
+		}
+		raw := t.data[start : start+12]
+		e := ifdEntry{typ: t.order.Uint16(raw[2:]), count: t.order.Uint32(raw[4:])}
+		size, ok := tiffTypeSizes[e.typ]
+		if !ok {
+			continue
+		}
+		length := uint64(size) * uint64(e.count)
+		if length <= 4 {
+			e.value = raw[8 : 8+length]
+		} else {
+			at := uint64(t.order.Uint32(raw[8:]))
+			if at+length > uint64(len(t.data)) {
+				continue
+			}
+			e.value = t.data[at : at+length]
+		}
+		entries[t.order.Uint16(raw)] = e
+	}
+	return entries, nil
+}
+
+// text returns an ASCII value, trimmed and at most 64 bytes.
+func (t *tiffReader) text(e ifdEntry, ok bool) string {
+	if !ok || e.typ != 2 {
+		return ""
+	}
+	s := string(e.value)
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimSpace(strings.ToValidUTF8(s, ""))
+	for len(s) > 64 {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+	}
+	return s
+}
+
+// integer returns the first value of a SHORT or LONG, 0 for others.
+func (t *tiffReader) integer(e ifdEntry, ok bool) uint32 {
+	switch {
+	case !ok || e.count == 0:
+		return 0
+	case e.typ == 3:
+		return uint32(t.order.Uint16(e.value))
+	case e.typ == 4:
+		return t.order.Uint32(e.value)
+	}
+	return 0
+}
+
+// rational returns the first value of a RATIONAL, 0 for others and
+// divisions by zero.
+func (t *tiffReader) rational(e ifdEntry, ok bool) (num, den uint32) {
+	if !ok || e.typ != 5 || e.count == 0 {
+		return 0, 0
+	}
+	num, den = t.order.Uint32(e.value), t.order.Uint32(e.value[4:])
+	if den == 0 {
+		return 0, 0
+	}
+	return num, den
+}
+
+// parseExif fills meta with the whitelisted fields of a TIFF-structured
+// EXIF block.
+func parseExif(data []byte, meta *PictureMetadata) error {
+	if len(data) < 8 {
+		return errBadExif
+	}
+	t := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return errBadExif
+	}
+	ifd0, err := t.ifd(t.order.Uint32(data[4:]))
+	if err != nil {
+		return err
+	}
+	camera := &CameraMetadata{
+		Make:  t.text(lookup(ifd0, tagMake)),
+		Model: t.text(lookup(ifd0, tagModel)),
+	}
+	if o := t.integer(lookup(ifd0, tagOrientation)); o >= 1 && o <= 8 {
+		meta.Orientation = int(o)
+	}
+
+	var exif map[uint16]ifdEntry
+	if offset := t.integer(lookup(ifd0, tagExifIFD)); offset != 0 {
+		if exif, err = t.ifd(offset); err != nil {
+			return err
+		}
+	}
+	camera.Lens = t.text(lookup(exif, tagLensModel))
+	if *camera != (CameraMetadata{}) {
+		meta.Camera = camera
+	}
+	exposure := &ExposureMetadata{
+		Time:        exposureTime(t.rational(lookup(exif, tagExposureTime))),
+		FNumber:     roundedRatio(t.rational(lookup(exif, tagFNumber))),
+		ISO:         int(t.integer(lookup(exif, tagISO))),
+		FocalLength: roundedRatio(t.rational(lookup(exif, tagFocalLength))),
+	}
+	if *exposure != (ExposureMetadata{}) {
+		meta.Exposure = exposure
+	}
+	meta.TakenAt = takenAt(t.text(lookup(exif, tagDateTimeOriginal)), t.text(lookup(exif, tagOffsetTimeOriginal)))
+	return nil
+}
+
+func lookup(entries map[uint16]ifdEntry, tag uint16) (ifdEntry, bool) {
+	e, ok := entries[tag]
+	return e, ok
+}
+
+// roundedRatio is num/den to one decimal, as f-numbers and focal lengths
+// are written.
+func roundedRatio(num, den uint32) float64 {
+	if den == 0 {
+		return 0
+	}
+	return math.Round(float64(num)/float64(den)*10) / 10
+}
+
+// exposureTime writes a shutter speed as photographers do: 1/125 below a
+// second, 0.5 or 2 otherwise.
+func exposureTime(num, den uint32) string {
+	if num == 0 || den == 0 {
+		return ""
+	}
+	seconds := float64(num) / float64(den)
+	if seconds < 0.5 {
+		return "1/" + strconv.Itoa(int(math.Round(1/seconds)))
+	}
+	return strconv.FormatFloat(math.Round(seconds*10)/10, 'f', -1, 64)
+}
+
+// takenAt formats an EXIF date and time, 2006:01:02 15:04:05, with its
+// offset, such as +01:00, if the camera recorded one.
+func takenAt(datetime, offset string) string {
+	local, err := time.Parse("2006:01:02 15:04:05", datetime)
+	if err != nil || local.Year() < 1900 {
+		return ""
+	}
+	if zone, err := time.Parse("-07:00", offset); err == nil {
+		_, seconds := zone.Zone()
+		return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), 0,
+			time.FixedZone("", seconds)).Format(time.RFC3339)
+	}
+	return local.Format("2006-01-02T15:04:05")
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// An upload whose conversion fails for good, with an error or after
+// crashing the process CONVERSION_MAX_ATTEMPTS times, keeps its original
+// in quarantine: under failed/ in the original store, uploads/original/
+// failed/ with local storage, where neither the garbage collector nor the
+// recovery of originals without a task looks. Its task stays failed and
+// points at it, so an admin can list the failed conversions and download
+// the offending file to find out what's wrong with it. picsapp prune
+// deletes it with its task.
+
+// failedKeyPrefix is where failed originals are kept in the original
+// store.
+const failedKeyPrefix = "failed/"
+
+// FailedConversion is a conversion that failed for good, as
+// GET /api/admin/conversions/failed lists it.
+type FailedConversion struct {
+	ID           int64  `json:"id"`
+	OriginalName string `json:"originalName"`
+	EventID      string `json:"eventId"`
+	// PictureID is the picture converted again, "" for uploads
+	PictureID string    `json:"pictureId,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	FailedAt  time.Time `json:"failedAt"`
+	// Quarantined is whether the original is kept for download
+	Quarantined bool `json:"quarantined"`
+}
+
+func failedConversion(task *ConversionTask) *FailedConversion {
+	f := &FailedConversion{
+		ID:           task.ID,
+		OriginalName: task.OriginalName,
+		EventID:      task.EventID,
+		Source:       task.Source,
+		Attempts:     task.Attempts,
+		FailedAt:     task.UpdatedAt,
+		Quarantined:  quarantined(task.OriginalPath),
+	}
+	if task.PictureID != nil {
+		f.PictureID = *task.PictureID
+	}
+	if task.Error != nil {
+		f.Error = *task.Error
+	}
+	return f
+}
+
+// quarantined reports whether a task's original path is in quarantine.
+func quarantined(path string) bool {
+	store, key, err := storedAt(path)
+	return err == nil && store == originalStore && strings.HasPrefix(key, failedKeyPrefix)
+}
+
+// quarantineOriginal moves the original of a task that failed for good
+// into quarantine, and points the task at it. Pictures converted again
+// keep their files where they are.
+func quarantineOriginal(ctx context.Context, task *ConversionTask) {
+	store, key, err := storedAt(task.OriginalPath)
+	if err != nil || store != originalStore || strings.HasPrefix(key, failedKeyPrefix) {
+		return
+	}
+	dst := failedKeyPrefix + key
+	if err := moveStored(ctx, store, key, dst); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			logWarn("quarantine original of task %d: %s is gone", task.ID, task.OriginalPath)
+		} else {
+			logWarn("quarantine original of task %d: %v", task.ID, err)
+		}
+		return
+	}
+	moved := filepath.Join(originalDir, filepath.FromSlash(dst))
+	if err := db.SetTaskOriginalPath(task.ID, moved); err != nil {
+		logError("record quarantined original of task %d: %v", task.ID, err)
+		return
+	}
+	task.OriginalPath = moved
+	logInfo("original of failed conversion task %d quarantined at %s", task.ID, moved)
+}
+
+// moveStored moves the file under key to dst in store: renamed in a
+// directory store, copied and deleted in the others.
+func moveStored(ctx context.Context, store Storage, key, dst string) error {
+	if ds, ok := store.(*dirStorage); ok {
+		src, err := ds.path(key)
+		if err != nil {
+			return err
+		}
+		to, err := ds.path(dst)
+		if err != nil {
+			return err
+		}
+		return moveFile(src, to)
+	}
+	f, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := store.Put(ctx, dst, f); err != nil {
+		return err
+	}
+	return store.Delete(ctx, key)
+}
+
+// deleteQuarantined deletes the quarantined originals among the original
+// paths of pruned tasks.
+func deleteQuarantined(ctx context.Context, paths []string) int {
+	var n int
+	for _, p := range paths {
+		if !quarantined(p) {
+			continue
+		}
+		_, key, _ := storedAt(p)
+		if err := originalStore.Delete(ctx, key); err != nil {
+			logWarn("remove quarantined original %s: %v", p, err)
+			continue
+		}
+		n++
+	}
+	if _, ok := originalStore.(*dirStorage); ok {
+		removeEmptyDirs(filepath.Join(originalDir, filepath.FromSlash(failedKeyPrefix)))
+	}
+	return n
+}
+
+// handleListFailedConversions lists the failed conversions of the
+// request's event, last failed first.
+func handleListFailedConversions(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	tasks, err := db.GetFailedConversionTasks(event)
+	if err != nil {
+		logError("get failed conversions failed: %v", err)
+		http.Error(w, "Error fetching conversions", http.StatusInternalServerError)
+		return
+	}
+	failed := make([]*FailedConversion, len(tasks))
+	for i, task := range tasks {
+		failed[i] = failedConversion(task)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(failed)
+}
+
+// handleDownloadFailedOriginal serves the quarantined original of a failed
+// conversion as an attachment, never as something for the browser to
+// render.
+func handleDownloadFailedOriginal(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Conversion task not found", http.StatusNotFound)
+		return
+	}
+	task, err := db.GetConversionTask(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Conversion task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("get conversion task failed: %v", err)
+		http.Error(w, "Error fetching original", http.StatusInternalServerError)
+		return
+	}
+	if task.Status != "failed" {
+		http.Error(w, "Conversion task hasn't failed", http.StatusConflict)
+		return
+	}
+	if !quarantined(task.OriginalPath) {
+		http.Error(w, "Original not kept", http.StatusNotFound)
+		return
+	}
+	_, key, _ := storedAt(task.OriginalPath)
+	info, err := originalStore.Stat(r.Context(), key)
+	if err != nil {
+		http.Error(w, "Original not kept", http.StatusNotFound)
+		return
+	}
+	f, err := originalStore.Get(r.Context(), key)
+	if err != nil {
+		http.Error(w, "Original not kept", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	name := task.OriginalName
+	if name == "" {
+		name = path.Base(key)
+	}
+	name = sanitizeFilename(name)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, "", info.ModTime, f)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The name a guest's file had is kept on its picture and given back to
+// whoever downloads it, so it is cleaned on the way in: browsers send
+// C:\fakepath\IMG_0001.JPG, phones send names in decomposed Unicode, and
+// anything could be in a crafted form. Names are made unique within an
+// event as pictures are added, IMG_0001 (2).JPG after IMG_0001.JPG, so
+// that a guest saving several pictures doesn't overwrite one with another.
+
+const (
+	// maxFilenameLength bounds a filename in characters, extension
+	// included
+	maxFilenameLength = 100
+	// maxExtensionLength bounds what is kept as an extension, the dot
+	// included
+	maxExtensionLength = 10
+	// defaultFilename is the stem of a name that was empty once cleaned
+	defaultFilename = "picture"
+)
+
+// sanitizeFilename returns name without its directories, in NFC, with
+// control characters dropped, characters file systems or headers reject
+// replaced by _, without leading dots and spaces, and shortened to
+// maxFilenameLength characters with its extension kept.
+func sanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = norm.NFC.String(strings.ToValidUTF8(name, ""))
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r), r == unicode.ReplacementChar:
+			return -1
+		case strings.ContainsRune(`"*:<>?|`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(strings.TrimLeft(name, ". "), ". ")
+
+	stem, ext := splitExtension(name)
+	if stem == "" {
+		stem = defaultFilename
+	}
+	if extra := utf8.RuneCountInString(stem) + utf8.RuneCountInString(ext) - maxFilenameLength; extra > 0 {
+		runes := []rune(stem)
+		stem = strings.TrimRight(string(runes[:len(runes)-extra]), ". ")
+	}
+	return stem + ext
+}
+
+// splitExtension splits name before its extension, "" if it has none or
+// one longer than maxExtensionLength.
+func splitExtension(name string) (stem, ext string) {
+	ext = path.Ext(name)
+	if len(ext) <= 1 || len(ext) > maxExtensionLength || strings.ContainsRune(ext, ' ') {
+		return name, ""
+	}
+	return strings.TrimSuffix(name, ext), ext
+}
+
+// numberedFilename is the nth of the pictures of an event named name:
+// name itself for the first, "stem (n).ext" for the others.
+func numberedFilename(name string, n int) string {
+	if n <= 1 {
+		return name
+	}
+	stem, ext := splitExtension(name)
+	return fmt.Sprintf("%s (%d)%s", stem, n, ext)
+}
+
+// downloadDisposition is the Content-Disposition of a picture downloaded
+// as a file with extension ext: an attachment under the name it was
+// uploaded with, its extension swapped for ext when the file served is a
+// conversion. Names that aren't ASCII are given RFC 2231 encoded.
+func downloadDisposition(pic *Picture, ext string) string {
+	stem, uploaded := splitExtension(sanitizeFilename(pic.Filename))
+	if pic.Filename == "" {
+		stem = strings.TrimSuffix(pic.ID, path.Ext(pic.ID))
+	}
+	if !strings.EqualFold(uploaded, ext) {
+		uploaded = ext
+	}
+	return mime.FormatMediaType("attachment", map[string]string{"filename": stem + uploaded})
+}
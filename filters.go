@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxFilterTop bounds the leaderboard size a client may filter on.
+const maxFilterTop = 100
+
+// filterableTypes are the broadcast types a client may select with the
+// types filter. Snapshots and replies are always sent.
+var filterableTypes = map[string]bool{
+	msgLikes:          true,
+	msgPictureAdded:   true,
+	msgPictureUpdated: true,
+	msgPictureHidden:  true,
+	msgPictureShown:   true,
+	msgPicturesAged:   true,
+	msgPresence:       true,
+	msgReaction:       true,
+	msgControl:        true,
+	msgAnnouncement:   true,
+	msgSettings:       true,
+	msgLikeBurst:      true,
+	msgMode:           true,
+	msgPlaylist:       true,
+	msgContest:        true,
+	msgContestReveal:  true,
+	msgLikesClosed:    true,
+	msgComment:        true,
+}
+
+var errInvalidFilter = errors.New("invalid filter")
+
+// subscriptionFilter limits the broadcasts a client receives. types, if
+// set, lists the message types delivered. top, if set, drops likes
+// messages that can't change the first top places of the leaderboard. A
+// nil filter delivers everything.
+type subscriptionFilter struct {
+	types map[string]bool
+	top   int
+}
+
+// filterFromQuery parses the types and top query parameters of a WebSocket
+// request. It returns nil when neither is set.
+func filterFromQuery(q url.Values) (*subscriptionFilter, error) {
+	var f subscriptionFilter
+	if v := q.Get("types"); v != "" {
+		f.types = make(map[string]bool)
+		for _, t := range strings.Split(v, ",") {
+			t = strings.TrimSpace(t)
+			if !filterableTypes[t] {
+				return nil, fmt.Errorf("%w: unknown message type %q", errInvalidFilter, t)
+			}
+			f.types[t] = true
+		}
+	}
+	if v := q.Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxFilterTop {
+			return nil, fmt.Errorf("%w: top must be between 1 and %d", errInvalidFilter, maxFilterTop)
+		}
+		f.top = n
+	}
+	if f.types == nil && f.top == 0 {
+		return nil, nil
+	}
+	return &f, nil
+}
+
+// acceptsType reports whether messages of msgType pass the types filter.
+func (f *subscriptionFilter) acceptsType(msgType string) bool {
+	return f == nil || f.types == nil || f.types[msgType]
+}
+
+// accepts reports whether env should be delivered to a client with this
+// filter. Likes messages that weren't ranked are delivered.
+func (f *subscriptionFilter) accepts(env *Envelope) bool {
+	if f == nil {
+		return true
+	}
+	if !f.acceptsType(env.Type) {
+		return false
+	}
+	if f.top > 0 && env.Type == msgLikes && env.ranks != nil {
+		return len(env.ranks) < f.top || env.peak >= env.ranks[f.top-1]
+	}
+	return true
+}
+
+// maxTop returns the largest leaderboard size any client of event filters
+// on, or 0 if none does.
+func (h *Hub) maxTop(event string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	top := 0
+	if r, ok := h.rooms[event]; ok {
+		for c := range r.clients {
+			if c.filter != nil && c.filter.top > top {
+				top = c.filter.top
+			}
+		}
+	}
+	return top
+}
+
+// rankLikes records where a likes message lands on its event's leaderboard
+// so deliver can skip clients whose top filter it can't affect. Like
+// counts only grow, so a picture that enters the first N places is in the
+// message with at least the N-th highest count.
+func (h *Hub) rankLikes(env *Envelope, likes []LikePayload) {
+	top := h.maxTop(env.event)
+	if top == 0 {
+		return
+	}
+	ranks, err := db.GetTopLikes(env.event, top)
+	if err != nil {
+		logError("rank likes for event %s: %v", env.event, err)
+		return
+	}
+	peak := 0
+	for _, like := range likes {
+		if like.Likes > peak {
+			peak = like.Likes
+		}
+	}
+	env.ranks = ranks
+	env.peak = peak
+}
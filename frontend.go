@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// The React build is served from frontendDir on disk, or, in a binary built
+// with -tags embed, from the copy of build/ embedded at compile time, which
+// makes the binary self-contained. Setting frontendDir serves from disk
+// even then, so a development build picks up `npm run build` without being
+// recompiled.
+var (
+	frontendDir string
+
+	// embeddedFrontend is build/, set by frontend_embed.go; nil without the
+	// embed tag.
+	embeddedFrontend fs.FS
+)
+
+// defaultFrontendDir is served from when frontendDir is unset and nothing
+// is embedded.
+const defaultFrontendDir = "build"
+
+// frontendFS returns the React build to serve and describes it for the log.
+func frontendFS() (fs.FS, string) {
+	if frontendDir == "" && embeddedFrontend != nil {
+		return embeddedFrontend, "embedded frontend"
+	}
+	dir := frontendDir
+	if dir == "" {
+		dir = defaultFrontendDir
+	}
+	return os.DirFS(dir), "frontend from " + dir
+}
+
+// immutableCache is the Cache-Control of files under static/, whose names
+// carry a hash of their content.
+const immutableCache = "public, max-age=31536000, immutable"
+
+// spaHandler serves the React build: its files as they are, and index.html
+// for any other path, so client-side routes such as /presentation survive
+// a refresh. Files under static/ are cached for a year; everything else,
+// index.html above all, is revalidated so a new build shows up at once.
+// Missing static/ files, paths with an extension and unknown /api/ routes
+// are 404s rather than index.html.
+func spaHandler(fsys fs.FS) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if name != "" && serveFrontendFile(w, r, fsys, name) {
+			return
+		}
+		if strings.HasPrefix(name, "static/") || strings.HasPrefix(name, "api/") || path.Ext(name) != "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !serveFrontendFile(w, r, fsys, "index.html") {
+			http.Error(w, "Frontend not built", http.StatusNotFound)
+		}
+	})
+}
+
+// serveFrontendFile serves the named file of fsys with its Cache-Control,
+// and reports whether it was a regular file.
+func serveFrontendFile(w http.ResponseWriter, r *http.Request, fsys fs.FS, name string) bool {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return false
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(name, "static/") {
+		w.Header().Set("Cache-Control", immutableCache)
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+	return true
+}
@@ -0,0 +1,21 @@
+//go:build embed
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// build/ must exist, from `npm run build`, before building with -tags embed.
+//
+//go:embed all:build
+var embeddedBuild embed.FS
+
+func init() {
+	sub, err := fs.Sub(embeddedBuild, "build")
+	if err != nil {
+		panic(err)
+	}
+	embeddedFrontend = sub
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// When the MC says "check the wall", hundreds of phones ask for the same
+// gallery at once. The gallery JSON of each event, and the pictures behind
+// it, are cached in memory until db.PicturesVersion changes, which every
+// write to the pictures does; pictures changed by other instances change
+// it through the backplane. Requests for a stale entry wait for one of
+// them to rebuild it. With HOT_IMAGES, the image files of each event's
+// most liked pictures are kept in memory too.
+var (
+	galleries = &galleryCache{slots: map[galleryKey]*gallerySlot{}}
+	hot       = &hotImages{}
+
+	hotImageCount int
+
+	galleryCacheHits   atomic.Uint64
+	galleryCacheMisses atomic.Uint64
+	hotImageHits       atomic.Uint64
+)
+
+const (
+	// galleryLatest is the home grid, the last 30 pictures; galleryByLikes
+	// every visible picture, most liked first
+	galleryLatest = iota
+	galleryByLikes
+
+	// maxGallerySlots bounds the cached galleries; they are all dropped
+	// beyond it, as requests name events freely
+	maxGallerySlots = 1000
+
+	// hotImagesRefresh is how often the most liked pictures are looked up
+	// again while likes come in
+	hotImagesRefresh = 5 * time.Second
+)
+
+type galleryKey struct {
+	event string
+	kind  int
+}
+
+// gallery is a cached gallery: its pictures, which must not be changed,
+// and their JSON.
+type gallery struct {
+	version  uint64
+	pictures []*Picture
+	body     []byte
+
+	snapshotOnce     sync.Once
+	snapshotPictures []*Picture
+	ranked           int
+}
+
+type gallerySlot struct {
+	mu      sync.Mutex
+	gallery *gallery
+}
+
+type galleryCache struct {
+	mu    sync.Mutex
+	slots map[galleryKey]*gallerySlot
+}
+
+// get returns the gallery of kind for event, from the cache unless the
+// pictures have changed since it was read.
+func (c *galleryCache) get(event string, kind int) (*gallery, error) {
+	key := galleryKey{event, kind}
+	c.mu.Lock()
+	slot, ok := c.slots[key]
+	if !ok {
+		if len(c.slots) >= maxGallerySlots {
+			c.slots = map[galleryKey]*gallerySlot{}
+		}
+		slot = &gallerySlot{}
+		c.slots[key] = slot
+	}
+	c.mu.Unlock()
+
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	// Read before the pictures, so a write in between leaves it stale
+	version := db.PicturesVersion()
+	if g := slot.gallery; g != nil && g.version == version {
+		galleryCacheHits.Add(1)
+		return g, nil
+	}
+	galleryCacheMisses.Add(1)
+	var pictures []*Picture
+	var err error
+	switch kind {
+	case galleryLatest:
+		pictures, err = db.GetLastPictures(event, 30) // 5x6 = 30
+	default:
+		pictures, err = db.GetAllPicturesSortedByLikes(event)
+	}
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(pictures)
+	if err != nil {
+		return nil, err
+	}
+	// As json.Encoder writes it
+	body = append(body, '\n')
+	slot.gallery = &gallery{version: version, pictures: pictures, body: body}
+	return slot.gallery, nil
+}
+
+// hotImages keeps the image files of the hotImageCount most liked pictures
+// of every event in memory, read from the upload store on first request.
+type hotImages struct {
+	mu        sync.Mutex
+	version   uint64
+	refreshed time.Time
+	files     map[string]*hotImage // by key; nil until read
+}
+
+type hotImage struct {
+	data    []byte
+	modTime time.Time
+}
+
+// get returns the file under key if it is one of the most liked pictures.
+func (h *hotImages) get(ctx context.Context, key string) (*hotImage, bool) {
+	if hotImageCount == 0 {
+		return nil, false
+	}
+	h.mu.Lock()
+	version := db.PicturesVersion()
+	if h.refreshed.IsZero() || version != h.version && time.Since(h.refreshed) >= hotImagesRefresh {
+		h.refreshLocked(version)
+	}
+	img, hot := h.files[key]
+	h.mu.Unlock()
+	if !hot {
+		return nil, false
+	}
+	if img == nil {
+		var err error
+		if img, err = readHotImage(ctx, key); err != nil {
+			return nil, false
+		}
+		h.mu.Lock()
+		if _, ok := h.files[key]; ok {
+			h.files[key] = img
+		}
+		h.mu.Unlock()
+	}
+	hotImageHits.Add(1)
+	return img, true
+}
+
+// refreshLocked looks up the most liked pictures again, keeping the files
+// of those still among them.
+func (h *hotImages) refreshLocked(version uint64) {
+	h.refreshed = time.Now()
+	keys, err := db.GetTopFileKeys(hotImageCount)
+	if err != nil {
+		logWarn("look up hot images: %v", err)
+		return
+	}
+	files := make(map[string]*hotImage, len(keys))
+	for _, key := range keys {
+		files[key] = h.files[key]
+	}
+	h.files = files
+	h.version = version
+}
+
+// stats returns the number and total size of the files in memory.
+func (h *hotImages) stats() (files int, bytes int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, img := range h.files {
+		if img != nil {
+			files++
+			bytes += int64(len(img.data))
+		}
+	}
+	return files, bytes
+}
+
+func readHotImage(ctx context.Context, key string) (*hotImage, error) {
+	info, err := uploadStore.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := uploadStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return &hotImage{data: data, modTime: info.ModTime}, nil
+}
+
+// serveHotImage serves the file under key from memory if it is hot.
+func serveHotImage(w http.ResponseWriter, r *http.Request, key string) bool {
+	img, ok := hot.get(r.Context(), key)
+	if !ok {
+		return false
+	}
+	http.ServeContent(w, r, key, img.modTime, bytes.NewReader(img.data))
+	return true
+}
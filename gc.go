@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The garbage collector moves image files that no picture, kept original
+// or pending conversion task refers to, such as the originals of failed
+// conversions and files left by crashes, into quarantineDir, and deletes
+// them once they have been there for gcGrace. A file referred to again in the meantime is
+// moved back. Every run also reports the pictures whose image is missing
+// and the pending tasks whose original is. It runs every gcInterval, on
+// POST /api/admin/gc and as picsapp gc; only the directories of
+// STORAGE=local are collected.
+var (
+	quarantineDir string
+	gcInterval    reloadable[time.Duration]
+	gcGrace       reloadable[time.Duration]
+
+	gcMu   sync.Mutex
+	lastGC atomic.Pointer[GCReport]
+
+	gcRuns            atomic.Uint64
+	gcQuarantined     atomic.Uint64
+	gcDeleted         atomic.Uint64
+	gcReclaimedBytes  atomic.Uint64
+	gcMissingImages   atomic.Uint64
+	gcMissingOriginal atomic.Uint64
+)
+
+// gcCheckInterval is how often the server checks whether a collection is
+// due, so that a reloaded gcInterval takes effect.
+const gcCheckInterval = time.Minute
+
+// GCReport describes a garbage collection run.
+type GCReport struct {
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+	// Collected is false when the stores aren't directories; only missing
+	// files are reported then
+	Collected bool `json:"collected"`
+	// Quarantined files were referred to by nothing
+	Quarantined      int   `json:"quarantined"`
+	QuarantinedBytes int64 `json:"quarantinedBytes"`
+	// Restored files were referred to again before their grace period
+	// ended
+	Restored int `json:"restored"`
+	// Deleted files had been quarantined for the grace period
+	Deleted        int   `json:"deleted"`
+	ReclaimedBytes int64 `json:"reclaimedBytes"`
+	// MissingImages are the IDs of the pictures whose image is missing,
+	// MissingOriginals those of the pending conversion tasks whose original
+	// is
+	MissingImages    []string `json:"missingImages"`
+	MissingOriginals []int64  `json:"missingOriginals"`
+}
+
+// gcArea is a directory store collected into its own quarantine directory.
+type gcArea struct {
+	name  string
+	dir   string
+	store Storage
+}
+
+func gcAreas() []gcArea {
+	return []gcArea{
+		{"original", originalDir, originalStore},
+		{"uploads", uploadDir, uploadStore},
+		{"projector", projectorDir, projectorStore},
+	}
+}
+
+// errGCRunning is returned by collectGarbage while another run is going.
+var errGCRunning = errors.New("garbage collection already running")
+
+// collectGarbage runs the garbage collector once.
+func collectGarbage(ctx context.Context) (*GCReport, error) {
+	if !gcMu.TryLock() {
+		return nil, errGCRunning
+	}
+	defer gcMu.Unlock()
+	report := &GCReport{StartedAt: time.Now(), MissingImages: []string{}, MissingOriginals: []int64{}}
+
+	pictures, err := db.LoadAllPictures()
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := db.GetActiveConversionTasks()
+	if err != nil {
+		return nil, err
+	}
+	originals, err := db.GetKeptOriginals()
+	if err != nil {
+		return nil, err
+	}
+	known := map[Storage]map[string]bool{
+		originalStore:  {},
+		uploadStore:    {},
+		projectorStore: {},
+	}
+	for _, pic := range pictures {
+		known[uploadStore][pic.FileKey] = true
+		known[projectorStore][pic.FileKey] = true
+	}
+	for _, task := range tasks {
+		if store, key, err := storedAt(task.OriginalPath); err == nil {
+			known[store][key] = true
+		}
+	}
+	for _, o := range originals {
+		known[originalStore][o.Key] = true
+	}
+
+	if _, ok := uploadStore.(*dirStorage); ok {
+		report.Collected = true
+		for _, area := range gcAreas() {
+			if err := quarantineOrphans(area, known[area.store], report); err != nil {
+				return nil, err
+			}
+			if err := sweepQuarantine(area, known[area.store], report); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Files are only looked for once restored
+	for _, pic := range pictures {
+		if _, err := uploadStore.Stat(ctx, pic.FileKey); errors.Is(err, fs.ErrNotExist) {
+			report.MissingImages = append(report.MissingImages, pic.ID)
+		}
+	}
+	for _, task := range tasks {
+		store, key, err := storedAt(task.OriginalPath)
+		if err != nil || task.Status != "pending" {
+			continue
+		}
+		if _, err := store.Stat(ctx, key); errors.Is(err, fs.ErrNotExist) {
+			report.MissingOriginals = append(report.MissingOriginals, task.ID)
+		}
+	}
+	sort.Strings(report.MissingImages)
+
+	report.DurationMs = time.Since(report.StartedAt).Milliseconds()
+	lastGC.Store(report)
+	gcRuns.Add(1)
+	gcQuarantined.Add(uint64(report.Quarantined))
+	gcDeleted.Add(uint64(report.Deleted))
+	gcReclaimedBytes.Add(uint64(report.ReclaimedBytes))
+	gcMissingImages.Store(uint64(len(report.MissingImages)))
+	gcMissingOriginal.Store(uint64(len(report.MissingOriginals)))
+	for _, id := range report.MissingImages {
+		logWarn("gc: image of picture %s is missing", id)
+	}
+	for _, id := range report.MissingOriginals {
+		logWarn("gc: original of conversion task %d is missing", id)
+	}
+	logInfo("gc: quarantined %d files (%.1f MB), restored %d, deleted %d (%.1f MB reclaimed)",
+		report.Quarantined, float64(report.QuarantinedBytes)/(1<<20), report.Restored,
+		report.Deleted, float64(report.ReclaimedBytes)/(1<<20))
+	return report, nil
+}
+
+// quarantineOrphans moves the files of area that nothing refers to, older
+// than orphanGrace so as to leave alone files being recorded, into the
+// area's quarantine directory.
+func quarantineOrphans(area gcArea, known map[string]bool, report *GCReport) error {
+	cutoff := time.Now().Add(-orphanGrace)
+	return walkDirStore(area.dir, func(key, path string, info fs.FileInfo) error {
+		if known[key] || info.ModTime().After(cutoff) {
+			return nil
+		}
+		dst := filepath.Join(quarantineDir, area.name, filepath.FromSlash(key))
+		if err := moveFile(path, dst); err != nil {
+			logWarn("gc: quarantine %s: %v", path, err)
+			return nil
+		}
+		// The grace period starts now
+		now := time.Now()
+		if err := os.Chtimes(dst, now, now); err != nil {
+			logWarn("gc: %v", err)
+		}
+		logInfo("gc: quarantined %s", path)
+		report.Quarantined++
+		report.QuarantinedBytes += info.Size()
+		return nil
+	})
+}
+
+// sweepQuarantine moves the quarantined files of area that are referred to
+// again back, and deletes those quarantined for longer than gcGrace.
+func sweepQuarantine(area gcArea, known map[string]bool, report *GCReport) error {
+	qdir := filepath.Join(quarantineDir, area.name)
+	cutoff := time.Now().Add(-gcGrace.Load())
+	err := walkDirStore(qdir, func(key, path string, info fs.FileInfo) error {
+		dst := filepath.Join(area.dir, filepath.FromSlash(key))
+		if _, err := os.Stat(dst); known[key] && errors.Is(err, fs.ErrNotExist) {
+			if err := moveFile(path, dst); err != nil {
+				logWarn("gc: restore %s: %v", dst, err)
+				return nil
+			}
+			logInfo("gc: restored %s", dst)
+			report.Restored++
+			return nil
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			logWarn("gc: %v", err)
+			return nil
+		}
+		report.Deleted++
+		report.ReclaimedBytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	removeEmptyDirs(qdir)
+	return nil
+}
+
+// removeEmptyDirs removes the empty directories under root, deepest first.
+func removeEmptyDirs(root string) {
+	var dirs []string
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// Fails, as wanted, if the directory isn't empty
+		os.Remove(dirs[i])
+	}
+}
+
+// moveFile moves a file to dst, creating its directory, and copies it where
+// the two are on different file systems, as Docker volumes may be.
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Restored files are served again, so never partly copied
+	_, err = writeFileAtomic(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// runGCSchedule collects garbage every gcInterval until stop is closed,
+// except in read-only mode.
+func runGCSchedule(stop <-chan struct{}) {
+	ticker := time.NewTicker(gcCheckInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			interval := gcInterval.Load()
+			if interval == 0 || readOnly.Load() || time.Since(last) < interval {
+				continue
+			}
+			last = time.Now()
+			if _, err := collectGarbage(context.Background()); err != nil {
+				logError("gc: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// handleGCReport returns the report of the last collection.
+func handleGCReport(w http.ResponseWriter, r *http.Request) {
+	report := lastGC.Load()
+	if report == nil {
+		http.Error(w, "No garbage collection has run yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleGC collects garbage now and returns the report.
+func handleGC(w http.ResponseWriter, r *http.Request) {
+	report, err := collectGarbage(r.Context())
+	if errors.Is(err, errGCRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logError("gc: %v", err)
+		http.Error(w, "Garbage collection failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// The guestbook holds guests' written wishes to the couple, text only,
+// next to the pictures of an event. The presentation interleaves them
+// between slides; new and removed messages are broadcast as guestbook and
+// guestbook_removed messages.
+
+const (
+	// maxGuestbookLength bounds a message, in characters
+	maxGuestbookLength = 500
+	// maxGuestbookNameLength bounds the name a message is signed with
+	maxGuestbookNameLength = 60
+	// maxGuestbookListed bounds the messages listed for an event
+	maxGuestbookListed = 200
+	// guestbookPerMinute limits messages per device
+	guestbookPerMinute = 3
+)
+
+var guestbookLimiter = &rateLimiter{perMinute: guestbookPerMinute, buckets: map[string]*tokenBucket{}}
+
+// GuestbookMessage is a guest's message to the couple, after the text
+// filter.
+type GuestbookMessage struct {
+	ID      int64  `json:"id"`
+	EventID string `json:"eventId"`
+	// Name is who signed the message: the name given, else the signed-in
+	// user's; "" if anonymous
+	Name      string    `json:"name,omitempty"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Moderation is "pending" for a message held back with MODERATE_TEXT
+	// until a moderator approves it, and "rejected" for one they refused
+	Moderation string `json:"moderation,omitempty"`
+	// DeviceID and UserID are the device and signed-in user that wrote it
+	DeviceID string `json:"-"`
+	UserID   int64  `json:"-"`
+}
+
+// GuestbookRequest is the body of POST /api/guestbook.
+type GuestbookRequest struct {
+	Name string `json:"name"`
+	Text string `json:"text"`
+}
+
+// handleListGuestbook lists the last published messages of the request's
+// event, oldest first.
+func handleListGuestbook(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	messages, err := db.GetGuestbookMessages(event, maxGuestbookListed)
+	if err != nil {
+		logError("get guestbook failed: %v", err)
+		http.Error(w, "Error fetching guestbook", http.StatusInternalServerError)
+		return
+	}
+	if messages == nil {
+		messages = []*GuestbookMessage{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// handleAddGuestbookMessage stores a guest's message to the request's
+// event, after the text filter, and broadcasts it, or with MODERATE_TEXT
+// holds it back for a moderator.
+func handleAddGuestbookMessage(w http.ResponseWriter, r *http.Request) {
+	var req GuestbookRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 8<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	text := strings.TrimSpace(req.Text)
+	if text == "" || utf8.RuneCountInString(text) > maxGuestbookLength {
+		http.Error(w, fmt.Sprintf("Message must be 1-%d characters", maxGuestbookLength), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = uploaderName(r)
+	}
+	if utf8.RuneCountInString(name) > maxGuestbookNameLength {
+		http.Error(w, fmt.Sprintf("Name must be at most %d characters", maxGuestbookNameLength), http.StatusBadRequest)
+		return
+	}
+
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	if signinRequired(r) {
+		http.Error(w, "Sign in to post", http.StatusUnauthorized)
+		return
+	}
+	d := deviceFromRequest(r)
+	if banned(d) {
+		refuseBanned(w)
+		return
+	}
+	if ok, retryAfter := guestbookLimiter.allow(d.rateKey(), time.Now()); !ok {
+		tooManyRequests(w, "Too many messages from this device", retryAfter)
+		return
+	}
+	var err error
+	if text, err = filterText(text); err != nil {
+		http.Error(w, "Message contains blocked words or contact details", http.StatusBadRequest)
+		return
+	}
+	if name, err = filterText(name); err != nil {
+		http.Error(w, "Name contains blocked words or contact details", http.StatusBadRequest)
+		return
+	}
+
+	msg := &GuestbookMessage{
+		EventID:   event,
+		Name:      name,
+		Text:      text,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		DeviceID:  d.id,
+		UserID:    uploaderID(r),
+	}
+	if moderateText.Load() {
+		msg.Moderation = moderationPending
+	}
+	if err := db.AddGuestbookMessage(msg); err != nil {
+		logError("add guestbook message failed: %v", err)
+		http.Error(w, "Error saving message", http.StatusInternalServerError)
+		return
+	}
+	status := http.StatusAccepted
+	if msg.Moderation == "" {
+		hub.publishGuestbook(msg)
+		status = http.StatusCreated
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(msg)
+}
+
+// handleDeleteGuestbookMessage removes a message, taking it off the
+// presentation.
+func handleDeleteGuestbookMessage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	msg, err := db.GetGuestbookMessage(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = db.DeleteGuestbookMessage(id)
+	}
+	if err != nil {
+		logError("delete guestbook message failed: %v", err)
+		http.Error(w, "Error deleting message", http.StatusInternalServerError)
+		return
+	}
+	if msg.Moderation == "" {
+		hub.publishGuestbookRemoved(msg)
+	}
+	logInfo("guestbook message %d deleted by %s (event=%s)", id, moderatorName(r), msg.EventID)
+	w.WriteHeader(http.StatusNoContent)
+}
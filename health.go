@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Orchestrators probe /livez to restart a stuck process and /readyz to
+// decide whether to route traffic to it. The server is ready once startup
+// has finished, after the schema is created and legacy files are queued,
+// and stops being ready as soon as shutdown starts, so a rolling deploy
+// only sends requests to instances that can serve them.
+const (
+	stateStarting int32 = iota
+	stateReady
+	stateStopping
+)
+
+var serverState atomic.Int32
+
+// stateNames are the startup check of /readyz for each state.
+var stateNames = map[int32]string{
+	stateStarting: "starting",
+	stateReady:    "ok",
+	stateStopping: "shutting down",
+}
+
+// HealthResponse is the body of GET /healthz and GET /readyz.
+type HealthResponse struct {
+	// Status is ok, degraded (serving, but refusing uploads) or unhealthy;
+	// for /readyz, ok or unavailable
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// healthCheckTimeout bounds the database check of /healthz and /readyz.
+const healthCheckTimeout = 2 * time.Second
+
+// handleHealthz reports whether the database answers and the upload volume
+// has room. Low disk space and read-only mode only degrade the server,
+// which still serves the wall, so it answers 200; a failing database
+// answers 503.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	resp := &HealthResponse{Status: "ok", Checks: map[string]string{"database": "ok", "disk": "ok"}}
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	if err := db.Ping(ctx); err != nil {
+		resp.Status = "unhealthy"
+		resp.Checks["database"] = err.Error()
+	}
+	if err := checkDiskSpace(); err != nil {
+		resp.Checks["disk"] = "low: " + err.Error()
+		if resp.Status == "ok" {
+			resp.Status = "degraded"
+		}
+	}
+	if readOnly.Load() {
+		resp.Checks["writes"] = "read-only"
+		if resp.Status == "ok" {
+			resp.Status = "degraded"
+		}
+	}
+	status := http.StatusOK
+	if resp.Status == "unhealthy" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleLivez reports that the process is up and serving requests.
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether the server should get traffic: startup has
+// finished, the database answers and the image directories are writable.
+// Low disk space doesn't make it unready, as the wall is still served.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	resp := &HealthResponse{Status: "ok", Checks: map[string]string{
+		"startup":  stateNames[serverState.Load()],
+		"database": "ok",
+		"storage":  "ok",
+	}}
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	if err := db.Ping(ctx); err != nil {
+		resp.Checks["database"] = err.Error()
+	}
+	for _, store := range []Storage{uploadStore, originalStore, projectorStore} {
+		if err := checkWritable(r.Context(), store); err != nil {
+			resp.Checks["storage"] = err.Error()
+			break
+		}
+	}
+	status := http.StatusOK
+	for _, check := range resp.Checks {
+		if check != "ok" {
+			resp.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// checkWritable puts and deletes a file in store.
+func checkWritable(ctx context.Context, store Storage) error {
+	key := fmt.Sprintf(".readyz-%d", time.Now().UnixNano())
+	if err := store.Put(ctx, key, strings.NewReader("")); err != nil {
+		return err
+	}
+	return store.Delete(ctx, key)
+}
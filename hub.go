@@ -0,0 +1,906 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Hub message types. Clients receive a snapshot on connect and incremental
+// updates afterwards instead of the whole gallery on every change.
+const (
+	msgSnapshot         = "snapshot"
+	msgLikes            = "likes"
+	msgPictureAdded     = "picture_added"
+	msgPictureUpdated   = "picture_updated"
+	msgPictureHidden    = "picture_hidden"
+	msgPictureShown     = "picture_shown"
+	msgPicturesAged     = "pictures_aged"
+	msgPresence         = "presence"
+	msgReaction         = "reaction"
+	msgControl          = "control"
+	msgAnnouncement     = "announcement"
+	msgSettings         = "settings"
+	msgLikeBurst        = "like_burst"
+	msgMode             = "mode"
+	msgPlaylist         = "playlist"
+	msgContest          = "contest"
+	msgContestReveal    = "contest_reveal"
+	msgLikesClosed      = "likes_closed"
+	msgComment          = "comment"
+	msgActivity         = "activity"
+	msgGuestbook        = "guestbook"
+	msgGuestbookRemoved = "guestbook_removed"
+	msgMilestone        = "milestone"
+	msgOwnMilestone     = "own_milestone"
+	msgUploadReceipt    = "upload_receipt"
+	msgPictures         = "pictures"
+	msgError            = "error"
+)
+
+// Envelope wraps every frame sent to WebSocket clients so they can dispatch
+// on Type. Seq increases by one for each broadcast; a snapshot carries the
+// sequence number of the last broadcast it already reflects. Sequence
+// numbers are counted per event.
+type Envelope struct {
+	Type    string      `json:"type"`
+	Seq     uint64      `json:"seq"`
+	Payload interface{} `json:"payload"`
+
+	// event is the room the message is routed to and minRole the lowest
+	// role that receives it. display, if set, is the only display that
+	// receives it, and recipient the only user ("user:<id>") or device
+	// ("device:<id>"). Transient messages are sent with seq 0 and aren't
+	// buffered for replay. ranks and peak are set on likes messages by
+	// rankLikes. None of these are sent.
+	event     string
+	minRole   Role
+	display   string
+	recipient string
+	transient bool
+	queuedAt  time.Time
+	ranks     []int
+	peak      int
+}
+
+// InboundMessage is a frame sent by a client. Its payload is decoded by the
+// handler registered for its type.
+type InboundMessage struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type SnapshotPayload struct {
+	Epoch    string     `json:"epoch"`
+	Role     Role       `json:"role"`
+	Pictures []*Picture `json:"pictures"`
+	// Pictures are the Ranked most liked pictures of the gallery, then
+	// some of the newest. Total is the size of the gallery; clients page
+	// through it from Ranked with more messages or
+	// /api/presentation?order=likes&offset=
+	Ranked        int                   `json:"ranked"`
+	Total         int                   `json:"total"`
+	Announcements []*Announcement       `json:"announcements,omitempty"`
+	Settings      *PresentationSettings `json:"settings"`
+	Mode          *ModePayload          `json:"mode,omitempty"`
+}
+
+// ErrorPayload is sent directly to a client whose message was rejected.
+type ErrorPayload struct {
+	RequestType string `json:"requestType,omitempty"`
+	Message     string `json:"message"`
+}
+
+// PresencePayload reports how many clients are watching an event.
+type PresencePayload struct {
+	Watching int `json:"watching"`
+}
+
+type LikePayload struct {
+	ID    string `json:"id"`
+	Likes int    `json:"likes"`
+}
+
+// LikesPayload carries every like count that changed during one coalescing
+// window.
+type LikesPayload struct {
+	Likes []LikePayload `json:"likes"`
+}
+
+type PictureAddedPayload struct {
+	Picture *Picture `json:"picture"`
+}
+
+type PictureUpdatedPayload struct {
+	PreviousID string   `json:"previousId"`
+	Picture    *Picture `json:"picture"`
+}
+
+// PictureHiddenPayload removes a hidden picture from the wall.
+type PictureHiddenPayload struct {
+	ID string `json:"id"`
+}
+
+type SettingsPayload struct {
+	Settings *PresentationSettings `json:"settings"`
+}
+
+type AnnouncementPayload struct {
+	Announcement *Announcement `json:"announcement"`
+}
+
+type CommentPayload struct {
+	Comment *Comment `json:"comment"`
+}
+
+// MilestonePayload celebrates a picture whose likes reached a milestone.
+type MilestonePayload struct {
+	ID      string   `json:"id"`
+	Likes   int      `json:"likes"`
+	Picture *Picture `json:"picture"`
+}
+
+type GuestbookPayload struct {
+	Message *GuestbookMessage `json:"message"`
+}
+
+// GuestbookRemovedPayload takes a deleted guestbook message off the wall.
+type GuestbookRemovedPayload struct {
+	ID int64 `json:"id"`
+}
+
+type ActivityPayload struct {
+	Activity *Activity `json:"activity"`
+}
+
+const (
+	// clientSendBuffer is the number of frames queued per client before the
+	// hub gives up on a slow reader and drops the connection.
+	clientSendBuffer = 256
+
+	// maxInboundMessageSize limits frames sent by clients.
+	maxInboundMessageSize = 4 << 10
+
+	// inboundRate and inboundBurst bound how many messages a client may
+	// send: inboundRate per second on average, up to inboundBurst at once.
+	inboundRate  = 5
+	inboundBurst = 10
+
+	// replayBufferSize is the number of recent frames kept per event so a
+	// reconnecting client can resume with ?since= instead of a new snapshot.
+	replayBufferSize = 128
+
+	// likeFlushInterval bounds how often like counts are broadcast. Likes
+	// arriving within one interval are merged into a single "likes" message.
+	likeFlushInterval = 250 * time.Millisecond
+
+	// presenceInterval is how often changed viewer counts are broadcast.
+	presenceInterval = 5 * time.Second
+
+	// serverFullReason is the close reason sent with CloseTryAgainLater when
+	// MAX_WS_CLIENTS is reached. It points clients at the REST fallback.
+	serverFullReason = "server full; poll /api/presentation and retry later"
+
+	// shutdownReason is the close reason sent with CloseServiceRestart when
+	// the server shuts down.
+	shutdownReason = "server restarting"
+)
+
+var (
+	errServerFull        = errors.New("server full")
+	errHubClosed         = errors.New("hub closed")
+	errReplayUnavailable = errors.New("replay unavailable")
+)
+
+// client is a single WebSocket connection subscribed to one event's room.
+type client struct {
+	conn  *websocket.Conn
+	event string
+	role  Role
+	send  chan *frame
+
+	// display is the ID of the kiosk display the client authenticated as,
+	// if any. connectedAt and framesSent feed the per-display stats.
+	display     string
+	connectedAt time.Time
+	framesSent  atomic.Uint64
+
+	// device is the anonymous device the client connected from, which
+	// its likes count for.
+	device requestDevice
+	// reactor is the key its reactions are counted under (reactorKey).
+	reactor string
+
+	// encoding is the frame encoding negotiated at connect.
+	encoding encoding
+
+	// filter, if set, limits the broadcasts delivered to the client. It is
+	// fixed at connect.
+	filter *subscriptionFilter
+
+	// allowance and lastMessage implement the client's message rate limit
+	// (see allowMessage).
+	allowance   float64
+	lastMessage time.Time
+
+	// closeCode and closeReason, if set before send is closed, are sent in
+	// a close frame once the queued frames are written.
+	closeCode   int
+	closeReason string
+
+	// sendMu guards closing send against reply, which runs on readPump
+	// rather than under the hub's lock; closed is set once send is.
+	sendMu sync.Mutex
+	closed bool
+}
+
+// inboundHandler handles one client message type. Clients below minRole
+// are rejected before fn runs, as are messages that write in read-only
+// mode.
+type inboundHandler struct {
+	minRole Role
+	writes  bool
+	fn      func(c *client, payload json.RawMessage) error
+}
+
+// inboundHandlers maps client message types to their handlers.
+var inboundHandlers = map[string]inboundHandler{}
+
+// readPump reads client frames until the connection fails, dispatching each
+// to its handler.
+func (c *client) readPump(h *Hub) {
+	defer func() { h.unregister <- c }()
+	c.conn.SetReadLimit(maxInboundMessageSize)
+	for {
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			logWarn("websocket read error: %v", err)
+			return
+		}
+		if !c.allowMessage(time.Now()) {
+			c.reply(msgError, &ErrorPayload{Message: "rate limited"})
+			continue
+		}
+		if messageType == websocket.BinaryMessage {
+			data, err = msgpackToJSON(data)
+		}
+		var msg InboundMessage
+		if err == nil {
+			err = json.Unmarshal(data, &msg)
+		}
+		if err != nil {
+			c.reply(msgError, &ErrorPayload{Message: "malformed message"})
+			continue
+		}
+		h.dispatch(c, &msg)
+	}
+}
+
+// receives reports whether the client is recipient, a user's or device's
+// key as used by publishToRecipient, or recipient is "" for everyone.
+func (c *client) receives(recipient string) bool {
+	return recipient == "" || recipient == c.reactor || recipient == "device:"+c.device.id
+}
+
+// allowMessage takes one token from the client's rate limit bucket. Only
+// readPump calls it, so the bucket needs no locking.
+func (c *client) allowMessage(now time.Time) bool {
+	if c.lastMessage.IsZero() {
+		c.allowance = inboundBurst
+	} else {
+		c.allowance += now.Sub(c.lastMessage).Seconds() * inboundRate
+		if c.allowance > inboundBurst {
+			c.allowance = inboundBurst
+		}
+	}
+	c.lastMessage = now
+	if c.allowance < 1 {
+		return false
+	}
+	c.allowance--
+	return true
+}
+
+// reply sends a message to this client only. Replies aren't part of the
+// event's stream and carry seq 0. A reply that doesn't fit in the send
+// queue is dropped.
+func (c *client) reply(msgType string, payload interface{}) {
+	f, err := prepareEnvelope(&Envelope{Type: msgType, Payload: payload})
+	if err != nil {
+		logError("prepare reply %s: %v", msgType, err)
+		return
+	}
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- f:
+	default:
+		wsSendQueueDrops.Add(1)
+	}
+}
+
+// closeSend closes the client's send queue, which ends writePump. It is
+// the only way send is closed, so a reply racing a disconnect is dropped
+// instead of sent on a closed channel.
+func (c *client) closeSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+// writePump delivers queued frames to the connection. It is the only
+// goroutine that writes to conn. It owns the connection's slot in the
+// hub's connection count and releases it on exit.
+func (c *client) writePump(h *Hub) {
+	defer h.release()
+	defer c.conn.Close()
+	for f := range c.send {
+		message, size, err := f.encoded(c.encoding)
+		if err != nil {
+			logError("encode websocket frame: %v", err)
+			continue
+		}
+		if err := c.conn.WritePreparedMessage(message); err != nil {
+			logWarn("websocket write failed: %v", err)
+			return
+		}
+		wsMessagesSent.Add(1)
+		wsBytesSent.Add(uint64(size))
+		c.framesSent.Add(1)
+	}
+	if c.closeCode != 0 {
+		closeFrame := websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+		c.conn.WriteControl(websocket.CloseMessage, closeFrame, time.Now().Add(time.Second))
+	}
+}
+
+// room holds the clients watching one event, that event's broadcast
+// sequence counter and the most recent frames for replay. history[i] has
+// sequence number seq-len(history)+1+i. lastPresence is the client count
+// most recently broadcast in a presence message.
+type room struct {
+	clients      map[*client]bool
+	seq          uint64
+	history      []*frame
+	lastPresence int
+}
+
+type Hub struct {
+	// epoch identifies this process's sequence numbering. Sequence numbers
+	// restart at zero when the server restarts, so a resume is only valid
+	// against the epoch the client last saw.
+	epoch      string
+	mu         sync.Mutex
+	rooms      map[string]*room
+	broadcast  chan *Envelope
+	unregister chan *client
+	stop       chan chan struct{}
+
+	// closing is set by shutdown; no clients are accepted afterwards. It is
+	// guarded by mu.
+	closing bool
+
+	// connections counts open WebSocket connections across all rooms,
+	// including ones still waiting for their snapshot. conns tracks the
+	// same connections so shutdown can wait for them to close.
+	connections atomic.Int64
+	conns       sync.WaitGroup
+
+	// backplane, if set, relays broadcasts to and from other instances.
+	// remotePresence holds their client counts by origin and is guarded by
+	// mu.
+	backplane      *hubBackplane
+	remotePresence map[string]remotePresence
+
+	// pendingLikes holds the latest like count per picture per event until
+	// the next flush.
+	likesMu      sync.Mutex
+	pendingLikes map[string]map[string]int
+
+	// bursts detects pictures receiving many likes in a short window.
+	bursts *likeBursts
+
+	// trends tracks how fast pictures are being liked, for spotlights.
+	trends *likeTrends
+}
+
+func newHub() *Hub {
+	return &Hub{
+		epoch:          strconv.FormatInt(time.Now().UnixNano(), 36),
+		rooms:          make(map[string]*room),
+		broadcast:      make(chan *Envelope),
+		unregister:     make(chan *client),
+		stop:           make(chan chan struct{}),
+		remotePresence: make(map[string]remotePresence),
+		pendingLikes:   make(map[string]map[string]int),
+		bursts:         newLikeBursts(),
+		trends:         newLikeTrends(),
+	}
+}
+
+// acquire reserves a connection slot. It fails with errServerFull when
+// MAX_WS_CLIENTS connections are already open (a limit of 0 or less means
+// no limit) and with errHubClosed once shutdown has started.
+func (h *Hub) acquire() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closing {
+		return errHubClosed
+	}
+	if n, max := h.connections.Add(1), maxWSClients.Load(); max > 0 && n > int64(max) {
+		h.connections.Add(-1)
+		return errServerFull
+	}
+	h.conns.Add(1)
+	return nil
+}
+
+func (h *Hub) release() {
+	h.connections.Add(-1)
+	h.conns.Done()
+}
+
+// room returns the room for event, creating it if needed. Callers must
+// hold h.mu.
+func (h *Hub) room(event string) *room {
+	r, ok := h.rooms[event]
+	if !ok {
+		r = &room{clients: make(map[*client]bool)}
+		h.rooms[event] = r
+	}
+	return r
+}
+
+func (h *Hub) run() {
+	go h.flushLikesLoop()
+	go h.presenceLoop()
+	go h.scheduleLoop()
+	go h.likeCutoffLoop()
+	go h.newPicturesLoop()
+	go h.publishLoop()
+
+	for {
+		select {
+		case c := <-h.unregister:
+			h.mu.Lock()
+			if r, ok := h.rooms[c.event]; ok && r.clients[c] {
+				delete(r.clients, c)
+				c.closeSend()
+				wsDisconnects.Add(1)
+				logInfo("websocket client disconnected (event=%s clients=%d)", c.event, len(r.clients))
+			}
+			h.mu.Unlock()
+		case env := <-h.broadcast:
+			h.deliver(env)
+		case done := <-h.stop:
+			// Deliver broadcasts that were already being published, then
+			// close every client. The loop keeps running so late publishers
+			// don't block; with no clients left their messages go nowhere.
+			for pending := true; pending; {
+				select {
+				case env := <-h.broadcast:
+					h.deliver(env)
+				default:
+					pending = false
+				}
+			}
+			h.closeAll()
+			close(done)
+		}
+	}
+}
+
+// deliver assigns env its sequence number and queues it for every client
+// of its event.
+func (h *Hub) deliver(env *Envelope) {
+	h.mu.Lock()
+	r := h.room(env.event)
+	streamed := !env.transient
+	if streamed {
+		r.seq++
+		env.Seq = r.seq
+	}
+	f, err := prepareEnvelope(env)
+	if err != nil {
+		h.mu.Unlock()
+		logError("prepare hub message %s: %v", env.Type, err)
+		return
+	}
+	if streamed {
+		r.history = append(r.history, f)
+		if len(r.history) > replayBufferSize {
+			r.history = r.history[len(r.history)-replayBufferSize:]
+		}
+	}
+	for c := range r.clients {
+		if c.role < env.minRole || (env.display != "" && env.display != c.display) || !c.receives(env.recipient) || !c.filter.accepts(env) {
+			continue
+		}
+		select {
+		case c.send <- f:
+		default:
+			delete(r.clients, c)
+			c.closeSend()
+			wsSendQueueDrops.Add(1)
+			wsClientsDropped.Add(1)
+			wsDisconnects.Add(1)
+			logWarn("broadcast dropped slow client (event=%s)", c.event)
+		}
+	}
+	h.mu.Unlock()
+	hubBroadcastLatency.observe(time.Since(env.queuedAt))
+}
+
+// closeAll removes every client, telling each that the server is
+// restarting. Callers must not hold h.mu.
+func (h *Hub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.rooms {
+		for c := range r.clients {
+			delete(r.clients, c)
+			c.closeCode = websocket.CloseServiceRestart
+			c.closeReason = shutdownReason
+			c.closeSend()
+			wsDisconnects.Add(1)
+		}
+	}
+}
+
+// revokeDisplay disconnects the clients of a revoked display, here and on
+// the other instances.
+func (h *Hub) revokeDisplay(id string) {
+	h.closeDisplay(id)
+	h.forwardRevoke(id)
+}
+
+// closeDisplay disconnects the local clients of a display with a "display
+// revoked" close frame.
+func (h *Hub) closeDisplay(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.rooms {
+		for c := range r.clients {
+			if c.display != id {
+				continue
+			}
+			delete(r.clients, c)
+			c.closeCode = websocket.ClosePolicyViolation
+			c.closeReason = displayRevokedReason
+			c.closeSend()
+			wsDisconnects.Add(1)
+			logInfo("websocket client disconnected, display %s revoked (event=%s)", id, c.event)
+		}
+	}
+}
+
+// displayStats returns the connection stats of the displays connected to
+// event on this instance, by display ID.
+func (h *Hub) displayStats(event string) map[string]DisplayStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := make(map[string]DisplayStatus)
+	r, ok := h.rooms[event]
+	if !ok {
+		return stats
+	}
+	for c := range r.clients {
+		if c.display == "" {
+			continue
+		}
+		s := stats[c.display]
+		s.Connected++
+		s.FramesSent += c.framesSent.Load()
+		if s.ConnectedAt == nil || c.connectedAt.Before(*s.ConnectedAt) {
+			connectedAt := c.connectedAt
+			s.ConnectedAt = &connectedAt
+		}
+		stats[c.display] = s
+	}
+	return stats
+}
+
+// shutdown stops accepting clients, delivers pending broadcasts (including
+// like counts not yet flushed) and closes every connection with a
+// "server restarting" close frame. It returns once all connections are
+// closed or ctx is done.
+func (h *Hub) shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.closing = true
+	h.mu.Unlock()
+
+	h.flushLikes()
+	done := make(chan struct{})
+	h.stop <- done
+	<-done
+
+	closed := make(chan struct{})
+	go func() {
+		h.conns.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// subscribe adds c to its event's room and queues every buffered frame
+// newer than since that passes its types filter, so nothing broadcast after
+// since is missed. It fails,
+// without subscribing, with errReplayUnavailable when those frames are no
+// longer buffered and the client needs a fresh snapshot instead, and with
+// errHubClosed during shutdown, in which case c is set up to receive a
+// "server restarting" close frame.
+func (h *Hub) subscribe(c *client, since uint64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closing {
+		c.closeCode = websocket.CloseServiceRestart
+		c.closeReason = shutdownReason
+		return errHubClosed
+	}
+	r := h.room(c.event)
+	oldest := r.seq - uint64(len(r.history)) + 1
+	if since > r.seq || since+1 < oldest {
+		return errReplayUnavailable
+	}
+	missed := r.history[len(r.history)-int(r.seq-since):]
+	if len(missed) > cap(c.send)-len(c.send) {
+		return errReplayUnavailable
+	}
+	for _, f := range missed {
+		if c.filter.acceptsType(f.msgType) {
+			c.send <- f
+		}
+	}
+
+	r.clients[c] = true
+	wsConnects.Add(1)
+	c.connectedAt = time.Now().UTC().Truncate(time.Second)
+	logInfo("websocket client connected (event=%s role=%s clients=%d replayed=%d)", c.event, c.role, len(r.clients), len(missed))
+	return nil
+}
+
+// dispatch runs the handler for a client message after checking the
+// client's role. Viewers are read-only unless a handler explicitly allows
+// them.
+func (h *Hub) dispatch(c *client, msg *InboundMessage) {
+	handler, ok := inboundHandlers[msg.Type]
+	if !ok {
+		c.reply(msgError, &ErrorPayload{RequestType: msg.Type, Message: "unknown message type"})
+		return
+	}
+	if c.role < handler.minRole {
+		logWarn("websocket %s message rejected for role %s (event=%s)", msg.Type, c.role, c.event)
+		c.reply(msgError, &ErrorPayload{RequestType: msg.Type, Message: "forbidden"})
+		return
+	}
+	if handler.writes && readOnly.Load() {
+		c.reply(msgError, &ErrorPayload{RequestType: msg.Type, Message: "read-only"})
+		return
+	}
+	if err := handler.fn(c, msg.Payload); err != nil {
+		c.reply(msgError, &ErrorPayload{RequestType: msg.Type, Message: err.Error()})
+	}
+}
+
+// lastSeq returns the sequence number of the most recent broadcast to event.
+func (h *Hub) lastSeq(event string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if r, ok := h.rooms[event]; ok {
+		return r.seq
+	}
+	return 0
+}
+
+// publish queues a message of the given type for delivery to every client
+// subscribed to event. The hub assigns the sequence number.
+func (h *Hub) publish(event, msgType string, payload interface{}) {
+	h.publishTo(event, RoleViewer, msgType, payload)
+}
+
+// publishTo is like publish but only delivers to clients with at least
+// minRole. Messages above RoleViewer carry seq 0 and aren't replayed on
+// resume.
+func (h *Hub) publishTo(event string, minRole Role, msgType string, payload interface{}) {
+	// Privileged messages stay out of the numbered stream so viewers don't
+	// see gaps in it
+	h.send(&Envelope{Type: msgType, Payload: payload, event: event, minRole: minRole, transient: minRole > RoleViewer, queuedAt: time.Now()})
+}
+
+// publishToDisplay delivers a message to the clients of one display of
+// event. Like other messages not every client receives, it carries seq 0
+// and isn't replayed.
+func (h *Hub) publishToDisplay(event, display, msgType string, payload interface{}) {
+	h.send(&Envelope{Type: msgType, Payload: payload, event: event, display: display, transient: true, queuedAt: time.Now()})
+}
+
+// publishToRecipient delivers a message to the clients of event signed in
+// as a user ("user:<id>") or connected from a device ("device:<id>"). It
+// carries seq 0 and isn't replayed.
+func (h *Hub) publishToRecipient(event, recipient, msgType string, payload interface{}) {
+	h.send(&Envelope{Type: msgType, Payload: payload, event: event, recipient: recipient, transient: true, queuedAt: time.Now()})
+}
+
+// publishTransient delivers a message to every client subscribed to event
+// without assigning it a sequence number or buffering it for replay.
+func (h *Hub) publishTransient(event, msgType string, payload interface{}) {
+	h.send(&Envelope{Type: msgType, Payload: payload, event: event, transient: true, queuedAt: time.Now()})
+}
+
+// send queues env for delivery to local clients and relays it to other
+// instances.
+func (h *Hub) send(env *Envelope) {
+	h.broadcast <- env
+	h.forward(env)
+}
+
+// watching returns the number of clients subscribed to event, on this
+// instance and on the others reporting through the backplane.
+func (h *Hub) watching(event string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.remoteWatching(event)
+	if r, ok := h.rooms[event]; ok {
+		n += len(r.clients)
+	}
+	return n
+}
+
+// presenceLoop broadcasts a presence message to every room whose client
+// count changed since its last presence message, once per presenceInterval.
+// Counts include clients of other instances; each instance broadcasts to
+// its own clients only.
+func (h *Hub) presenceLoop() {
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.mu.Lock()
+		local := make(map[string]int)
+		changed := make(map[string]int)
+		for event, r := range h.rooms {
+			local[event] = len(r.clients)
+			if n := len(r.clients) + h.remoteWatching(event); n != r.lastPresence {
+				r.lastPresence = n
+				if len(r.clients) > 0 {
+					changed[event] = n
+				}
+			}
+		}
+		h.mu.Unlock()
+
+		h.forwardPresence(local)
+		for event, n := range changed {
+			h.broadcast <- &Envelope{Type: msgPresence, Payload: &PresencePayload{Watching: n}, event: event, transient: true, queuedAt: time.Now()}
+		}
+	}
+}
+
+// publishLike records a picture's new like count. Counts are broadcast in
+// batches by flushLikesLoop; a like that makes a burst is announced
+// straight away with a transient like_burst message.
+func (h *Hub) publishLike(pic *Picture) {
+	h.likesMu.Lock()
+	pending, ok := h.pendingLikes[pic.EventID]
+	if !ok {
+		pending = make(map[string]int)
+		h.pendingLikes[pic.EventID] = pending
+	}
+	// Concurrent likes may report their counts out of order; keep the highest
+	if pic.Likes > pending[pic.ID] {
+		pending[pic.ID] = pic.Likes
+	}
+	h.likesMu.Unlock()
+
+	now := time.Now()
+	h.trends.record(pic.EventID, pic.ID, now)
+	if burst := h.bursts.record(pic.EventID, pic.ID, now); burst != nil {
+		logInfo("like burst on %s (event=%s count=%d magnitude=%d)", pic.ID, pic.EventID, burst.Count, burst.Magnitude)
+		h.publishTransient(pic.EventID, msgLikeBurst, burst)
+	}
+}
+
+// flushLikesLoop broadcasts the accumulated like counts once per
+// likeFlushInterval.
+func (h *Hub) flushLikesLoop() {
+	ticker := time.NewTicker(likeFlushInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		h.flushLikes()
+		h.bursts.sweep(now)
+		h.trends.sweep(now)
+	}
+}
+
+func (h *Hub) flushLikes() {
+	h.likesMu.Lock()
+	pending := h.pendingLikes
+	h.pendingLikes = make(map[string]map[string]int)
+	h.likesMu.Unlock()
+
+	for event, counts := range pending {
+		payload := &LikesPayload{Likes: make([]LikePayload, 0, len(counts))}
+		for id, likes := range counts {
+			payload.Likes = append(payload.Likes, LikePayload{ID: id, Likes: likes})
+		}
+		env := &Envelope{Type: msgLikes, Payload: payload, event: event, queuedAt: time.Now()}
+		h.rankLikes(env, payload.Likes)
+		h.send(env)
+	}
+}
+
+func (h *Hub) publishPictureAdded(pic *Picture) {
+	h.publish(pic.EventID, msgPictureAdded, &PictureAddedPayload{Picture: pic})
+}
+
+func (h *Hub) publishPictureUpdated(previousID string, pic *Picture) {
+	h.publish(pic.EventID, msgPictureUpdated, &PictureUpdatedPayload{PreviousID: previousID, Picture: pic})
+}
+
+// publishVisibility takes a picture off the wall or puts it back. A picture
+// shown again is sent whole, like an upload, but as picture_shown so
+// displays don't treat it as new.
+func (h *Hub) publishVisibility(pic *Picture) {
+	if pic.Hidden {
+		h.publish(pic.EventID, msgPictureHidden, &PictureHiddenPayload{ID: pic.ID})
+		return
+	}
+	h.publish(pic.EventID, msgPictureShown, &PictureAddedPayload{Picture: pic})
+}
+
+func (h *Hub) publishAnnouncement(a *Announcement) {
+	if a.DisplayID != "" {
+		h.publishToDisplay(a.EventID, a.DisplayID, msgAnnouncement, &AnnouncementPayload{Announcement: a})
+		return
+	}
+	h.publish(a.EventID, msgAnnouncement, &AnnouncementPayload{Announcement: a})
+}
+
+func (h *Hub) publishComment(c *Comment) {
+	h.publish(c.EventID, msgComment, &CommentPayload{Comment: c})
+}
+
+// publishMilestone tells the event that pic reached a milestone, and its
+// uploader's devices that it was their picture.
+func (h *Hub) publishMilestone(pic *Picture) {
+	payload := &MilestonePayload{ID: pic.ID, Likes: pic.Likes, Picture: pic}
+	h.publishTransient(pic.EventID, msgMilestone, payload)
+	if pic.UserID != 0 {
+		h.publishToRecipient(pic.EventID, "user:"+strconv.FormatInt(pic.UserID, 10), msgOwnMilestone, payload)
+	} else if pic.DeviceID != "" {
+		h.publishToRecipient(pic.EventID, "device:"+pic.DeviceID, msgOwnMilestone, payload)
+	}
+}
+
+func (h *Hub) publishGuestbook(m *GuestbookMessage) {
+	h.publish(m.EventID, msgGuestbook, &GuestbookPayload{Message: m})
+}
+
+func (h *Hub) publishGuestbookRemoved(m *GuestbookMessage) {
+	h.publish(m.EventID, msgGuestbookRemoved, &GuestbookRemovedPayload{ID: m.ID})
+}
+
+func (h *Hub) publishActivity(a *Activity) {
+	h.publish(a.EventID, msgActivity, &ActivityPayload{Activity: a})
+}
+
+func (h *Hub) publishSettings(settings *PresentationSettings) {
+	h.publish(settings.EventID, msgSettings, &SettingsPayload{Settings: settings})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// With INGEST_DIR set, images dropped into that directory, by a tethered
+// camera or an FTP server for instance, are adopted as uploads to
+// INGEST_EVENT: moved into the original store and queued for conversion.
+// Files are written progressively, so a file is only adopted once its size
+// and modification time have held for INGEST_SETTLE seconds. Changes in the
+// directory trigger a look at it, and it is looked at every
+// ingestRescanInterval anyway, as file system events can be dropped and
+// aren't sent for network file systems. Files that aren't images, such as
+// raw files next to the JPEGs, and dot files, which FTP servers write
+// before renaming them, are left alone, as are images while the disk is
+// low or INGEST_EVENT has used its storage quota.
+var (
+	ingestDir    string
+	ingestEvent  string
+	ingestSettle time.Duration
+
+	ingestedFiles  atomic.Uint64
+	ingestFailures atomic.Uint64
+)
+
+// ingestRescanInterval is how often the ingest directory is looked at
+// without a file system event.
+const ingestRescanInterval = 30 * time.Second
+
+// ingestExtensions are the extensions of the images adopted, those the
+// conversion decodes.
+var ingestExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true}
+
+// ingestCandidate is a file seen in the ingest directory and not adopted
+// yet.
+type ingestCandidate struct {
+	size    int64
+	modTime time.Time
+	// since is when the file was first seen with this size and time
+	since time.Time
+	// adopted files couldn't be removed; they are left alone
+	adopted bool
+}
+
+// runIngest watches the ingest directory until stop is closed.
+func runIngest(stop <-chan struct{}) {
+	if err := os.MkdirAll(ingestDir, 0755); err != nil {
+		logError("ingest: %v", err)
+		return
+	}
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(ingestDir)
+	}
+	if err != nil {
+		logWarn("ingest: can't watch %s, looking every %s: %v", ingestDir, ingestRescanInterval, err)
+	} else {
+		defer watcher.Close()
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	candidates := map[string]*ingestCandidate{}
+	rescan := time.NewTicker(ingestRescanInterval)
+	defer rescan.Stop()
+	// Candidates are looked at again once they should have settled
+	settle := time.NewTimer(0)
+	defer settle.Stop()
+	for {
+		select {
+		case event := <-events:
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) == 0 {
+				continue
+			}
+		case err := <-errs:
+			logWarn("ingest: %v", err)
+			continue
+		case <-rescan.C:
+		case <-settle.C:
+		case <-stop:
+			return
+		}
+		// Files wait in the folder while nothing may be written
+		if readOnly.Load() {
+			continue
+		}
+		if scanIngestDir(candidates) {
+			settle.Reset(ingestSettle)
+		}
+	}
+}
+
+// scanIngestDir adopts the images in the ingest directory that have
+// settled and updates candidates with the others. It reports whether some
+// are still settling.
+func scanIngestDir(candidates map[string]*ingestCandidate) bool {
+	entries, err := os.ReadDir(ingestDir)
+	if err != nil {
+		logWarn("ingest: %v", err)
+		return false
+	}
+	now := time.Now()
+	seen := make(map[string]bool, len(entries))
+	settling := false
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || !ingestExtensions[strings.ToLower(filepath.Ext(name))] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Removed since the directory was read
+			continue
+		}
+		seen[name] = true
+		c := candidates[name]
+		if c != nil && c.adopted {
+			continue
+		}
+		if c == nil || c.size != info.Size() || !c.modTime.Equal(info.ModTime()) {
+			candidates[name] = &ingestCandidate{size: info.Size(), modTime: info.ModTime(), since: now}
+			settling = true
+			continue
+		}
+		if now.Sub(c.since) < ingestSettle || checkDiskSpace() != nil || checkEventQuota(ingestEvent) != nil {
+			// Tried again once settled, or once there is room
+			settling = true
+			continue
+		}
+		if err := ingestFile(name); err != nil {
+			logWarn("ingest %s: %v", name, err)
+			ingestFailures.Add(1)
+			// Tried again once it settles again
+			c.since = now
+			settling = true
+			continue
+		}
+		ingestedFiles.Add(1)
+		if err := os.Remove(filepath.Join(ingestDir, name)); err != nil {
+			logError("ingest: queued %s but can't remove it, so it is left alone: %v", name, err)
+			c.adopted = true
+			continue
+		}
+		delete(candidates, name)
+	}
+	for name := range candidates {
+		if !seen[name] {
+			delete(candidates, name)
+		}
+	}
+	return settling
+}
+
+// ingestFile adopts the file name in the ingest directory as an upload:
+// copies it to the original store and queues its conversion.
+func ingestFile(name string) error {
+	f, err := os.Open(filepath.Join(ingestDir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	originalName := strconv.FormatInt(time.Now().UnixNano(), 10) + strings.ToLower(filepath.Ext(name))
+	if err := originalStore.Put(context.Background(), originalName, f); err != nil {
+		return fmt.Errorf("save original: %w", err)
+	}
+	if _, err := db.CreateConversionTask(filepath.Join(originalDir, originalName), sanitizeFilename(name), "", ingestEvent, sourceHotFolder, "", "", "", 0, time.Time{}, ""); err != nil {
+		originalStore.Delete(context.Background(), originalName)
+		return fmt.Errorf("queue conversion: %w", err)
+	}
+	logInfo("queued image for conversion: %s (event=%s, from %s)", name, ingestEvent, ingestDir)
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// finalStandingsSize is the number of places a likes_closed message
+// carries.
+const finalStandingsSize = 10
+
+var errLikesClosed = errors.New("likes closed")
+
+// LikesClosedPayload is the payload of a likes_closed message, sent when
+// an event's like cutoff (PresentationSettings.LikesCloseAt) passes. The
+// standings are the most liked pictures, most liked first.
+type LikesClosedPayload struct {
+	ClosedAt  time.Time     `json:"closedAt"`
+	Standings []LikePayload `json:"standings"`
+}
+
+// likesClosedAt returns when an event stopped accepting likes, or false if
+// it still accepts them at now.
+func likesClosedAt(event string, now time.Time) (time.Time, bool) {
+	settings := presentationSettings(event)
+	if settings.LikesCloseAt == nil || now.Before(*settings.LikesCloseAt) {
+		return time.Time{}, false
+	}
+	return *settings.LikesCloseAt, true
+}
+
+// likeCutoffChanged wakes the cutoff loop after presenters change an
+// event's cutoff, so moving it into the past closes likes straight away.
+var likeCutoffChanged = make(chan struct{}, 1)
+
+func notifyLikeCutoffChanged() {
+	select {
+	case likeCutoffChanged <- struct{}{}:
+	default:
+	}
+}
+
+// likeCutoffLoop broadcasts the final standings of each event whose like
+// cutoff passes, checking every scheduleInterval and after cutoff edits.
+// Cutoffs already past at startup were announced before and are skipped.
+// Every instance runs its own loop, so likes_closed messages are delivered
+// to local clients only.
+func (h *Hub) likeCutoffLoop() {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	announced := make(map[string]time.Time)
+	h.applyLikeCutoffs(announced, time.Now(), false)
+	for {
+		select {
+		case <-ticker.C:
+		case <-likeCutoffChanged:
+		}
+		h.applyLikeCutoffs(announced, time.Now(), true)
+	}
+}
+
+// applyLikeCutoffs records in announced the cutoffs that have passed by
+// now and, if broadcast is set, sends the final standings of the ones not
+// announced yet. Events whose cutoff was cleared are forgotten.
+func (h *Hub) applyLikeCutoffs(announced map[string]time.Time, now time.Time, broadcast bool) {
+	cutoffs, err := db.GetLikeCutoffs()
+	if err != nil {
+		logError("get like cutoffs failed: %v", err)
+		return
+	}
+	for event := range announced {
+		if _, ok := cutoffs[event]; !ok {
+			delete(announced, event)
+		}
+	}
+	for event, at := range cutoffs {
+		if at.After(now) || announced[event].Equal(at) {
+			continue
+		}
+		announced[event] = at
+		if !broadcast {
+			continue
+		}
+		pictures, err := db.GetTopPictures(event, finalStandingsSize)
+		if err != nil {
+			logError("get final standings failed: %v", err)
+			continue
+		}
+		payload := &LikesClosedPayload{ClosedAt: at, Standings: make([]LikePayload, 0, len(pictures))}
+		for _, p := range pictures {
+			payload.Standings = append(payload.Standings, LikePayload{ID: p.ID, Likes: p.Likes})
+		}
+		logInfo("likes closed (event=%s)", event)
+		h.broadcast <- &Envelope{Type: msgLikesClosed, Payload: payload, event: event, queuedAt: time.Now()}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Likes over time show organizers when the room came alive: the first
+// dance, the speeches, the cake. The likes table records when each like
+// was given; GET /api/stats/likes counts them by interval, for the whole
+// event and for the pictures liked most in the range.
+
+const (
+	defaultLikeInterval = 5 * time.Minute
+	minLikeInterval     = time.Minute
+	maxLikeInterval     = 24 * time.Hour
+
+	// defaultLikeRange is the range counted without from
+	defaultLikeRange = 24 * time.Hour
+
+	// maxLikeIntervals bounds the points of a series, 24 hours by minute
+	maxLikeIntervals = 1440
+
+	defaultLikeTop = 5
+	maxLikeTop     = 20
+)
+
+// LikeStats is the like count of an event by interval.
+type LikeStats struct {
+	Event string `json:"event"`
+	// Interval is the length of an interval in seconds
+	Interval int       `json:"interval"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Total    int       `json:"total"`
+	// Series is every interval of the range, those without likes
+	// included; Pictures' Likes line up with it
+	Series   []LikePoint     `json:"series"`
+	Pictures []*PictureLikes `json:"pictures"`
+}
+
+// LikePoint is the likes given in the interval starting at Start.
+type LikePoint struct {
+	Start time.Time `json:"start"`
+	Likes int       `json:"likes"`
+}
+
+// PictureLikes is the likes of one picture by interval.
+type PictureLikes struct {
+	Picture *Picture `json:"picture"`
+	Total   int      `json:"total"`
+	Likes   []int    `json:"likes"`
+}
+
+// handleLikeStats counts the likes given to the request's event's pictures
+// by ?interval= (a duration, 1m to 24h, default 5m) from ?from= to ?to=
+// (RFC 3339, default the last 24 hours), overall and for the ?top= (default
+// 5) pictures liked most in that time.
+func handleLikeStats(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	interval := defaultLikeInterval
+	if v := query.Get("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < minLikeInterval || d > maxLikeInterval || d%time.Second != 0 {
+			http.Error(w, "interval must be 1m to 24h", http.StatusBadRequest)
+			return
+		}
+		interval = d
+	}
+	to := time.Now().UTC()
+	if v := query.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "Invalid to", http.StatusBadRequest)
+			return
+		}
+		to = t.UTC()
+	}
+	from := to.Add(-defaultLikeRange)
+	if v := query.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil || !t.Before(to) {
+			http.Error(w, "Invalid from", http.StatusBadRequest)
+			return
+		}
+		from = t.UTC()
+	}
+	// Intervals start on the clock: 20:05, not 20:03
+	from = from.Truncate(interval)
+	if to.Sub(from) > interval*maxLikeIntervals {
+		http.Error(w, "Too many intervals; use a longer interval or a shorter range", http.StatusBadRequest)
+		return
+	}
+	top := defaultLikeTop
+	if v := query.Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxLikeTop {
+			http.Error(w, "top must be 0-20", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+
+	counts, err := db.CountLikes(event, "", from, to, interval)
+	if err != nil {
+		logError("count likes failed: %v", err)
+		http.Error(w, "Error counting likes", http.StatusInternalServerError)
+		return
+	}
+	stats := &LikeStats{
+		Event:    event,
+		Interval: int(interval / time.Second),
+		From:     from,
+		To:       to,
+		Series:   make([]LikePoint, len(counts)),
+		Pictures: []*PictureLikes{},
+	}
+	for i, n := range counts {
+		stats.Series[i] = LikePoint{Start: from.Add(time.Duration(i) * interval), Likes: n}
+		stats.Total += n
+	}
+
+	if top > 0 {
+		if err := stats.addTopPictures(top); err != nil {
+			logError("count likes of top pictures failed: %v", err)
+			http.Error(w, "Error counting likes", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// addTopPictures adds the series of the n visible pictures liked most in
+// the range of s.
+func (s *LikeStats) addTopPictures(n int) error {
+	interval := time.Duration(s.Interval) * time.Second
+	pictures, err := db.GetMostLikedBetween(s.Event, s.From, s.To, n)
+	if err != nil {
+		return err
+	}
+	for _, pic := range pictures {
+		entry := &PictureLikes{Picture: pic}
+		if entry.Likes, err = db.CountLikes(s.Event, pic.ID, s.From, s.To, interval); err != nil {
+			return err
+		}
+		for _, n := range entry.Likes {
+			entry.Total += n
+		}
+		s.Pictures = append(s.Pictures, entry)
+	}
+	return nil
+}
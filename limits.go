@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Uploads being received and images being decoded take memory and disk in
+// proportion to their size, so a burst of them can run a small server out
+// of memory. uploadSlots and decodeSlots bound how many run at once; a
+// request that finds no free slot is answered 503 with Retry-After.
+// The conversion worker waits for a decode slot instead.
+var (
+	uploadSlots = newSemaphore()
+	decodeSlots = newSemaphore()
+
+	uploadsRejected atomic.Uint64
+	decodesRejected atomic.Uint64
+)
+
+// busyRetryAfter is the Retry-After of a 503 for lack of a slot.
+const busyRetryAfter = 5 * time.Second
+
+// semaphore is a counting semaphore whose limit can change while slots are
+// taken, on a configuration reload. A limit of 0 means no limit.
+type semaphore struct {
+	mu    sync.Mutex
+	freed *sync.Cond
+	taken int
+	limit int
+}
+
+func newSemaphore() *semaphore {
+	s := &semaphore{}
+	s.freed = sync.NewCond(&s.mu)
+	return s
+}
+
+// setLimit changes the number of slots. Slots taken beyond a lowered limit
+// stay taken until they are released.
+func (s *semaphore) setLimit(n int) {
+	s.mu.Lock()
+	s.limit = n
+	s.mu.Unlock()
+	s.freed.Broadcast()
+}
+
+func (s *semaphore) full() bool {
+	return s.limit > 0 && s.taken >= s.limit
+}
+
+// tryAcquire takes a slot if one is free and reports whether it did.
+func (s *semaphore) tryAcquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.full() {
+		return false
+	}
+	s.taken++
+	return true
+}
+
+// acquire takes a slot, waiting for one to be free.
+func (s *semaphore) acquire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.full() {
+		s.freed.Wait()
+	}
+	s.taken++
+}
+
+// release frees a slot taken with tryAcquire or acquire.
+func (s *semaphore) release() {
+	s.mu.Lock()
+	s.taken--
+	s.mu.Unlock()
+	s.freed.Signal()
+}
+
+// inUse returns the number of slots taken.
+func (s *semaphore) inUse() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.taken
+}
+
+// serverBusy answers a request that found no free slot.
+func serverBusy(w http.ResponseWriter, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(busyRetryAfter.Seconds())))
+	http.Error(w, msg, http.StatusServiceUnavailable)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+)
+
+// The server listens on a listener inherited from systemd socket
+// activation if there is one, else on socketPath if set, else on TCP port.
+var (
+	socketPath string
+	socketMode fs.FileMode
+)
+
+// listenFDsStart is the first file descriptor systemd passes (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+// listen opens the server's listener and describes it for the log.
+func listen() (net.Listener, string, error) {
+	if ln, err := systemdListener(); ln != nil || err != nil {
+		return ln, "systemd socket", err
+	}
+	if socketPath != "" {
+		ln, err := listenUnix(socketPath, socketMode)
+		return ln, "unix socket " + socketPath, err
+	}
+	ln, err := net.Listen("tcp", ":"+port)
+	return ln, "port " + port, err
+}
+
+// systemdListener returns the first listener passed by systemd socket
+// activation (LISTEN_PID and LISTEN_FDS), or nil if there is none.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	// Child processes such as ffmpeg must not think the sockets are theirs
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if n > 1 {
+		logWarn("systemd passed %d sockets, using the first", n)
+	}
+	f := os.NewFile(listenFDsStart, "systemd socket")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("systemd socket: %w", err)
+	}
+	return ln, nil
+}
+
+// listenUnix listens on a Unix domain socket at path, replacing a stale
+// socket left behind by a previous run, and sets its permissions to mode.
+// The socket file is removed when the listener closes.
+func listenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
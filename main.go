@@ -3,23 +3,38 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"image"
 	"io"
+	"io/fs"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	_ "golang.org/x/image/webp"
 	_ "image/gif"
 	_ "image/jpeg"
@@ -32,78 +47,180 @@ type Picture struct {
 	URL        string    `json:"url"`
 	Likes      int       `json:"likes"`
 	UploadedAt time.Time `json:"uploadedAt"`
-}
-
-type Hub struct {
-	clients    map[*websocket.Conn]bool
-	broadcast  chan []byte
-	register   chan *websocket.Conn
-	unregister chan *websocket.Conn
+	EventID    string    `json:"eventId"`
+	Hidden     bool      `json:"hidden,omitempty"`
+	// IsNew is set if the picture was uploaded within NEW_PICTURE_MINUTES
+	// of when it was read
+	IsNew bool `json:"isNew"`
+	// Size of the converted image and its blurhash placeholder, unset
+	// until known
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	Blurhash string `json:"blurhash,omitempty"`
+	// ProjectorURL serves the projector rendition to displays and
+	// presenters; unset if the picture has none
+	ProjectorURL string `json:"projectorUrl,omitempty"`
+	// FileKey is the key of the image in uploadStore and of the projector
+	// rendition in projectorStore: a sharded key in the event's partition,
+	// or the unpartitioned or flat key of pictures stored before those
+	FileKey string `json:"-"`
+	// DeviceID is the anonymous device that uploaded the picture, "" for
+	// pictures that didn't come through /api/upload
+	DeviceID string `json:"-"`
+	// Moderation is "pending" for an upload waiting for a moderator's
+	// approval and "rejected" for a picture a moderator took down; both
+	// are hidden
+	Moderation string `json:"moderation,omitempty"`
+	// Caption is the uploader's caption, after the text filter
+	Caption string `json:"caption,omitempty"`
+	// UploadedBy is the name of the signed-in user who uploaded the
+	// picture, "" for anonymous uploads
+	UploadedBy string `json:"uploadedBy,omitempty"`
+	// UserID is the ID of that user, 0 for anonymous uploads and those
+	// made before it was recorded
+	UserID int64 `json:"-"`
+	// PendingCaption is the caption held back with MODERATE_TEXT until a
+	// moderator approves it
+	PendingCaption string `json:"-"`
+	// Source is how the picture arrived (sourceWeb...), "" for pictures
+	// from before it was recorded; admins see it in the archive
+	Source string `json:"-"`
+	// PublishAt is when a picture scheduled by an admin is published,
+	// zero for none; it stays hidden until then
+	PublishAt time.Time `json:"-"`
 }
 
 var (
-	db  *Database
-	hub = &Hub{
-		clients:    make(map[*websocket.Conn]bool),
-		broadcast:  make(chan []byte),
-		register:   make(chan *websocket.Conn),
-		unregister: make(chan *websocket.Conn),
-	}
+	db       *Database
+	hub      = newHub()
 	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-	uploadDir   = "uploads"
-	originalDir = "uploads/original"
-	dbPath      = getEnv("DATABASE_PATH", "picsapp.db")
-	logger      = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds)
+		ReadBufferSize:  1024,
+		WriteBufferSize: 16 << 10,
+		// Write buffers are only held while a frame is being written, so
+		// idle connections don't each pin a buffer
+		WriteBufferPool: &sync.Pool{},
+		Subprotocols:    []string{protocolJSON, protocolMsgpack},
+		CheckOrigin:     checkOrigin,
+	}
+	logger = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds)
+)
+
+// Settings, set from the configuration by applyConfig
+var (
+	port           string
+	dbPath         string
+	uploadDir      string
+	originalDir    string
+	maxUploadBytes reloadable[int64]
+	allowedOrigins map[string]bool
+	devMode        bool
+	maxWSClients   reloadable[int]
+	redisURL       string
+	redisChannel   string
 )
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// parseOrigins splits a comma-separated ALLOWED_ORIGINS value into a set of
+// normalized origins ("scheme://host[:port]", lower case, no trailing slash).
+func parseOrigins(value string) map[string]bool {
+	origins := make(map[string]bool)
+	for _, origin := range strings.Split(value, ",") {
+		origin = strings.TrimRight(strings.ToLower(strings.TrimSpace(origin)), "/")
+		if origin != "" {
+			origins[origin] = true
+		}
 	}
-	return defaultValue
+	return origins
 }
 
+// checkOrigin decides whether a WebSocket upgrade may proceed. Requests
+// without an Origin header (non-browser clients) and same-origin requests
+// are always allowed; cross-origin requests must match ALLOWED_ORIGINS
+// ("*" allows any). DEV_MODE=true allows everything so the React dev server
+// on another port can connect.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || devMode || allowedOrigins["*"] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		logWarn("websocket rejected malformed origin %q", origin)
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if allowedOrigins[strings.TrimRight(strings.ToLower(origin), "/")] {
+		return true
+	}
+	logWarn("websocket rejected origin %q", origin)
+	return false
+}
+
+// defaultEventID is the event used when a request doesn't name one.
+const defaultEventID = "default"
+
+// maxCaptionLength bounds the caption of an upload, in characters.
+const maxCaptionLength = 140
+
+var eventIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// eventFromRequest returns the event a request is scoped to, taken from the
+// "event" query or form value. ok is false if the value is malformed.
+func eventFromRequest(r *http.Request) (string, bool) {
+	event := r.FormValue("event")
+	if event == "" {
+		return defaultEventID, true
+	}
+	return event, eventIDPattern.MatchString(event)
+}
+
+// decodeEventRequest decodes a JSON body of at most limit bytes into v and
+// returns the event of the request, answering 400 and returning false if
+// either is invalid. An empty body leaves v as it is. The body has to be
+// decoded first: eventFromRequest's FormValue parses a body sent as a
+// form, which would leave nothing to decode.
+func decodeEventRequest(w http.ResponseWriter, r *http.Request, v interface{}, limit int64) (string, bool) {
+	if err := json.NewDecoder(io.LimitReader(r.Body, limit)).Decode(v); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return "", false
+	}
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return "", false
+	}
+	return event, true
+}
+
+// Log levels; messages below logLevel (LOG_LEVEL) are dropped.
+const (
+	levelInfo int32 = iota
+	levelWarn
+	levelError
+)
+
+var logLevel atomic.Int32
+
+// logLevels maps LOG_LEVEL values to levels.
+var logLevels = map[string]int32{"info": levelInfo, "warn": levelWarn, "error": levelError}
+
 func logInfo(format string, args ...interface{}) {
-	logger.Printf("[INFO] "+format, args...)
+	if logLevel.Load() <= levelInfo {
+		logger.Printf("[INFO] "+format, args...)
+	}
 }
 
 func logWarn(format string, args ...interface{}) {
-	logger.Printf("[WARN] "+format, args...)
+	if logLevel.Load() <= levelWarn {
+		logger.Printf("[WARN] "+format, args...)
+	}
 }
 
 func logError(format string, args ...interface{}) {
 	logger.Printf("[ERROR] "+format, args...)
 }
 
-func (h *Hub) run() {
-	for {
-		select {
-		case conn := <-h.register:
-			h.clients[conn] = true
-			logInfo("websocket client connected (clients=%d)", len(h.clients))
-		case conn := <-h.unregister:
-			if _, ok := h.clients[conn]; ok {
-				delete(h.clients, conn)
-				conn.Close()
-				logInfo("websocket client disconnected (clients=%d)", len(h.clients))
-			}
-		case message := <-h.broadcast:
-			for conn := range h.clients {
-				err := conn.WriteMessage(websocket.TextMessage, message)
-				if err != nil {
-					delete(h.clients, conn)
-					conn.Close()
-					logWarn("broadcast failed to client: %v", err)
-				}
-			}
-		}
-	}
-}
-
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -124,6 +241,11 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the connection's writer.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func (rw *responseWriter) Flush() {
 	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
 		flusher.Flush()
@@ -150,8 +272,41 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := r.ParseMultipartForm(10 << 20) // 10 MB max
+	if signinRequired(r) {
+		http.Error(w, "Sign in to post", http.StatusUnauthorized)
+		return
+	}
+	if banned(deviceFromRequest(r)) {
+		refuseBanned(w)
+		return
+	}
+	if ok, retryAfter := uploadLimiter.allow(deviceFromRequest(r).rateKey(), time.Now()); !ok {
+		uploadsRateLimited.Add(1)
+		tooManyRequests(w, "Too many uploads from this device", retryAfter)
+		return
+	}
+	if !uploadSlots.tryAcquire() {
+		uploadsRejected.Add(1)
+		serverBusy(w, "Too many uploads in progress")
+		return
+	}
+	defer uploadSlots.release()
+
+	if err := checkDiskSpace(); err != nil {
+		uploadsRejectedDisk.Add(1)
+		http.Error(w, "Server is low on disk space; uploads are paused", http.StatusInsufficientStorage)
+		return
+	}
+
+	maxBytes := maxUploadBytes.Load()
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	err := r.ParseMultipartForm(maxBytes)
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Upload exceeds %d MB", maxBytes>>20), http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Error parsing form", http.StatusBadRequest)
 		return
 	}
@@ -163,53 +318,105 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	if err := os.MkdirAll(originalDir, 0755); err != nil {
-		http.Error(w, "Error creating upload directory", http.StatusInternalServerError)
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	// The event may come from the form, which eventAccessMiddleware
+	// doesn't parse
+	if !checkEventAccess(w, r, event) {
+		return
+	}
+	if err := checkEventQuota(event); err != nil {
+		uploadsRejectedQuota.Add(1)
+		http.Error(w, "This event has used its storage quota; uploads are paused", http.StatusInsufficientStorage)
+		return
+	}
+	caption := strings.TrimSpace(r.FormValue("caption"))
+	if utf8.RuneCountInString(caption) > maxCaptionLength {
+		http.Error(w, fmt.Sprintf("Caption is longer than %d characters", maxCaptionLength), http.StatusBadRequest)
+		return
+	}
+	if caption, err = filterText(caption); err != nil {
+		http.Error(w, "Caption contains blocked words or contact details", http.StatusBadRequest)
+		return
+	}
+	publishAt, ok, err := uploadPublishAt(r)
+	if !ok {
+		http.Error(w, "Only admins can schedule pictures", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid publishAt", http.StatusBadRequest)
+		return
+	}
+	if status, msg := checkCaptcha(r); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+	if status, msg := checkTerms(r, event); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+	ok, limit, giveBack, err := takeUpload(r, event)
+	if err != nil {
+		logError("count upload failed: %v", err)
+		http.Error(w, "Error counting upload", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		uploadsRejectedLimit.Add(1)
+		http.Error(w, uploadLimitMessage(r, limit), http.StatusForbidden)
 		return
 	}
 
+	filename := sanitizeFilename(handler.Filename)
 	idBase := strconv.FormatInt(time.Now().UnixNano(), 10)
-	ext := strings.ToLower(filepath.Ext(handler.Filename))
+	ext := strings.ToLower(filepath.Ext(filename))
 	if ext == "" {
 		ext = ".img"
 	}
 	originalName := fmt.Sprintf("%s%s", idBase, ext)
 	originalPath := filepath.Join(originalDir, originalName)
 
-	dst, err := os.Create(originalPath)
-	if err != nil {
-		logError("create original file failed: %v", err)
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
-		return
-	}
-	if _, err := io.Copy(dst, file); err != nil {
-		dst.Close()
-		logError("write original file failed: %v", err)
+	if err := originalStore.Put(r.Context(), originalName, file); err != nil {
+		giveBack()
+		logError("save original file failed: %v", err)
 		http.Error(w, "Error saving file", http.StatusInternalServerError)
 		return
 	}
-	dst.Close()
 
-	if err := db.CreateConversionTask(originalPath, handler.Filename, ""); err != nil {
+	var uploadID int64
+	if err := traceStage(r.Context(), "db queue conversion", func(ctx context.Context) (err error) {
+		uploadID, err = db.CreateConversionTask(originalPath, filename, "", event, uploadSource(r), deviceFromRequest(r).id, caption, uploaderName(r), uploaderID(r), publishAt, traceParent(ctx))
+		return err
+	}); err != nil {
+		giveBack()
 		logError("create conversion task failed: %v", err)
 		http.Error(w, "Error queueing image conversion", http.StatusInternalServerError)
 		return
 	}
 
-	logInfo("queued image for conversion: %s", handler.Filename)
+	logInfo("queued image for conversion: %s (event=%s)", filename, event)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "queued"})
+	json.NewEncoder(w).Encode(&UploadStatus{UploadID: uploadID, Status: "queued"})
 }
 
 func handleList(w http.ResponseWriter, r *http.Request) {
-	pictures, err := db.GetLastPictures(30) // 5x6 = 30
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	gallery, err := galleries.get(event, galleryLatest)
 	if err != nil {
 		log.Printf("Error getting pictures: %v", err)
 		http.Error(w, "Error fetching pictures", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(pictures)
+	w.Write(gallery.body)
 }
 
 func handleLike(w http.ResponseWriter, r *http.Request) {
@@ -221,23 +428,30 @@ func handleLike(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	if err := db.IncrementLikes(id); err != nil {
+	pic, err := db.GetPicture(id)
+	if err != nil || pic.Hidden {
 		http.Error(w, "Picture not found", http.StatusNotFound)
 		return
 	}
-
-	// Broadcast update
-	pictures, err := db.GetAllPicturesSortedByLikes()
-	if err != nil {
-		logError("get pictures for broadcast failed: %v", err)
-	} else {
-		update, _ := json.Marshal(pictures)
-		hub.broadcast <- update
-		logInfo("broadcast likes update (picture=%s)", id)
+	if closedAt, closed := likesClosedAt(pic.EventID, time.Now()); closed {
+		http.Error(w, fmt.Sprintf("Likes closed at %s, the results are in!", closedAt.Format(time.RFC3339)), http.StatusForbidden)
+		return
 	}
 
-	pic, err := db.GetPicture(id)
-	if err != nil {
+	// Counted once per device, broadcast coalesced by the hub
+	pic, err = likePicture(deviceFromRequest(r), id)
+	var limited *rateLimitedError
+	switch {
+	case errors.As(err, &limited):
+		tooManyRequests(w, "Too many likes from this device", limited.retryAfter)
+		return
+	case errors.Is(err, errAlreadyLiked):
+		http.Error(w, "Already liked", http.StatusConflict)
+		return
+	case errors.Is(err, errBanned):
+		refuseBanned(w)
+		return
+	case err != nil:
 		http.Error(w, "Picture not found", http.StatusNotFound)
 		return
 	}
@@ -247,50 +461,319 @@ func handleLike(w http.ResponseWriter, r *http.Request) {
 }
 
 func handlePresentation(w http.ResponseWriter, r *http.Request) {
-	pictures, err := db.GetAllPicturesSortedByLikes()
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	ordering, playlist := slideshowOptions(r, event)
+	if !orderings[ordering] {
+		http.Error(w, "Invalid order", http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Has("offset") || r.URL.Query().Has("limit") {
+		if ordering != orderLikes || playlist != "" {
+			http.Error(w, "Pages need order=likes without a playlist", http.StatusBadRequest)
+			return
+		}
+		handlePresentationPage(w, r, event)
+		return
+	}
+	display := ""
+	if playlist == "" {
+		display = rotationDisplay(r, event)
+	}
+	if ordering == orderLikes && playlist == "" && display == "" {
+		gallery, err := galleries.get(event, galleryByLikes)
+		if err != nil {
+			log.Printf("Error getting pictures: %v", err)
+			http.Error(w, "Error fetching pictures", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Presentation-Order", ordering)
+		w.Write(gallery.body)
+		return
+	}
+
+	now := time.Now()
+	pictures, err := slideshowPictures(event, ordering, playlist, now)
+	if errors.Is(err, errUnknownPlaylist) {
+		http.Error(w, "Playlist not found", http.StatusNotFound)
+		return
+	}
+	if err == nil && display != "" {
+		pictures, err = rotateSlides(display, pictures, now)
+	}
 	if err != nil {
 		log.Printf("Error getting pictures: %v", err)
 		http.Error(w, "Error fetching pictures", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(pictures)
+	if playlist != "" {
+		w.Header().Set("X-Presentation-Playlist", playlist)
+	} else {
+		w.Header().Set("X-Presentation-Order", ordering)
+	}
+	if err := writePictures(w, pictures); err != nil {
+		logWarn("write presentation failed: %v", err)
+	}
+}
+
+// handlePresentationPage streams a page of an event's pictures, most liked
+// first, straight from the database: ?offset= (default 0) and ?limit=
+// (default and at most maxPresentationPage), within maxGalleryPictures.
+func handlePresentationPage(w http.ResponseWriter, r *http.Request, event string) {
+	offset, limit := 0, maxPresentationPage
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPresentationPage {
+			http.Error(w, fmt.Sprintf("Limit must be 1-%d", maxPresentationPage), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	limit = min(limit, max(maxGalleryPictures-offset, 0))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Presentation-Order", orderLikes)
+	stream := newPictureStream(w)
+	if limit > 0 {
+		if err := db.EachPictureSortedByLikes(event, offset, limit, stream.write); err != nil {
+			logError("stream presentation page failed: %v", err)
+			// Once the buffer was flushed the response can only be cut short
+			if !stream.sent() {
+				http.Error(w, "Error fetching pictures", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+	if err := stream.close(); err != nil {
+		logWarn("write presentation page failed: %v", err)
+	}
+}
+
+// slideshowOptions returns the ordering and playlist of a slideshow
+// request. ?order= and ?playlist= override the event's stored settings,
+// e.g. for one display.
+func slideshowOptions(r *http.Request, event string) (ordering, playlist string) {
+	settings := presentationSettings(event)
+	ordering = r.URL.Query().Get("order")
+	if ordering == "" {
+		ordering = settings.Ordering
+	}
+	playlist = r.URL.Query().Get("playlist")
+	if playlist == "" {
+		playlist = settings.Playlist
+	}
+	return ordering, playlist
+}
+
+// slideshowPictures returns the slides of an event: a playlist's visible
+// pictures in its own order, or without one every visible picture in the
+// given ordering. It returns errUnknownPlaylist if the event has no such
+// playlist.
+func slideshowPictures(event, ordering, playlist string, now time.Time) ([]*Picture, error) {
+	if playlist != "" {
+		exists, err := db.PlaylistExists(event, playlist)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, errUnknownPlaylist
+		}
+		return db.GetPlaylistPictures(event, playlist)
+	}
+	pictures, err := db.GetAllPicturesSortedByLikes(event)
+	if err != nil {
+		return nil, err
+	}
+	return orderPictures(pictures, ordering, now), nil
+}
+
+// StatsResponse is returned by /api/stats.
+type StatsResponse struct {
+	Event    string `json:"event"`
+	Watching int    `json:"watching"`
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&StatsResponse{Event: event, Watching: hub.watching(event)})
 }
 
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+
+	// Kiosk displays connect as viewers identified by their display token
+	role := RoleViewer
+	display, err := displayFromRequest(r)
+	switch {
+	case errors.Is(err, errUnknownDisplay), errors.Is(err, errDisplayRevoked):
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	case err != nil:
+		logError("get display failed: %v", err)
+		http.Error(w, "Error checking token", http.StatusInternalServerError)
+		return
+	case display != nil && display.EventID != event:
+		http.Error(w, "Display belongs to another event", http.StatusForbidden)
+		return
+	case display == nil:
+		if role, ok = authenticate(r); !ok {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	filter, err := filterFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Count the connection before upgrading so concurrent upgrades can't
+	// overshoot the limit
+	admitErr := hub.acquire()
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		if admitErr == nil {
+			hub.release()
+		}
 		logError("websocket upgrade failed: %v", err)
 		return
 	}
+	if admitErr != nil {
+		// Browsers can't read the status of a failed handshake, so upgrade
+		// and close with a reason the client can act on
+		code, reason := websocket.CloseServiceRestart, shutdownReason
+		if errors.Is(admitErr, errServerFull) {
+			code, reason = websocket.CloseTryAgainLater, serverFullReason
+			wsRejected.Add(1)
+			logWarn("websocket connection limit reached (max=%d)", maxWSClients.Load())
+		}
+		closeFrame := websocket.FormatCloseMessage(code, reason)
+		conn.WriteControl(websocket.CloseMessage, closeFrame, time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
 
-	hub.register <- conn
-
-	// Send initial data
-	pictures, err := db.GetAllPicturesSortedByLikes()
-	if err != nil {
-		logError("get pictures for websocket failed: %v", err)
-		pictures = []*Picture{}
+	// Frames are mostly small JSON deltas; favour CPU over ratio
+	conn.SetCompressionLevel(flate.BestSpeed)
+
+	c := &client{
+		conn:     conn,
+		event:    event,
+		role:     role,
+		send:     make(chan *frame, clientSendBuffer),
+		encoding: encodingFor(conn.Subprotocol()),
+		filter:   filter,
+		device:   deviceFromRequest(r),
+		reactor:  reactorKey(r),
 	}
-	initial, _ := json.Marshal(pictures)
-	conn.WriteMessage(websocket.TextMessage, initial)
+	if display != nil {
+		c.display = display.ID
+		if !readOnly.Load() {
+			if err := db.TouchDisplay(display.ID, time.Now()); err != nil {
+				logWarn("touch display %s failed: %v", display.ID, err)
+			}
+		}
+	}
+	go c.writePump(hub)
 
-	// Keep connection alive
-	go func() {
-		for {
-			_, _, err := conn.ReadMessage()
-			if err != nil {
-				hub.unregister <- conn
-				logWarn("websocket read error: %v", err)
-				break
+	// Resume from the client's last sequence number if the missed frames
+	// are still buffered, otherwise start over with a snapshot.
+	resumed := false
+	if since, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64); err == nil && r.URL.Query().Get("epoch") == hub.epoch {
+		resumed = hub.subscribe(c, since) == nil
+	}
+	if !resumed {
+		seq := hub.lastSeq(event)
+		pictures, ranked, total := []*Picture{}, 0, 0
+		if gallery, err := galleries.get(event, galleryByLikes); err != nil {
+			logError("get pictures for websocket failed: %v", err)
+		} else {
+			pictures, ranked = gallery.snapshot()
+			total = len(gallery.pictures)
+		}
+		announcements, err := db.GetActiveAnnouncements(event, c.display, time.Now())
+		if err != nil {
+			logError("get announcements for websocket failed: %v", err)
+		}
+		initial, err := prepareEnvelope(&Envelope{
+			Type:    msgSnapshot,
+			Seq:     seq,
+			Payload: &SnapshotPayload{Epoch: hub.epoch, Role: role, Pictures: pictures, Ranked: ranked, Total: total, Announcements: announcements, Settings: presentationSettings(event), Mode: scheduledMode(event, time.Now())},
+		})
+		if err != nil {
+			logError("prepare websocket snapshot failed: %v", err)
+			c.closeSend()
+			return
+		}
+		c.send <- initial
+		// Replays anything broadcast while the snapshot was being read
+		if err := hub.subscribe(c, seq); err != nil {
+			if errors.Is(err, errReplayUnavailable) {
+				logWarn("websocket snapshot fell behind the replay buffer (event=%s)", event)
 			}
+			c.closeSend()
+			return
 		}
-	}()
+	}
+
+	go c.readPump(hub)
 }
 
-func main() {
+// serve runs the server until it is interrupted.
+func serve(args []string) {
+	flags := flag.NewFlagSet("picsapp serve", flag.ContinueOnError)
+	cfg, cfgFile, sources, err := loadConfig(flags, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err == nil && flags.NArg() > 0 {
+		err = fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	applyConfig(cfg)
+	logConfig(cfg, cfgFile, sources)
+	if err := setupStorage(cfg); err != nil {
+		log.Fatalf("Failed to set up storage: %v", err)
+	}
+	if err := setupArchive(cfg); err != nil {
+		log.Fatalf("Failed to set up the originals archive: %v", err)
+	}
+	if err := setupBackups(cfg); err != nil {
+		log.Fatalf("Failed to set up backups: %v", err)
+	}
+	serveArgs, activeConfig = args, cfg
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+
 	// Initialize database
-	var err error
 	db, err = NewDatabase(dbPath)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
@@ -298,6 +781,12 @@ func main() {
 	defer db.Close()
 
 	logInfo("database initialized: %s", dbPath)
+	if err := loadDeviceSecret(); err != nil {
+		log.Fatalf("Failed to load the device secret: %v", err)
+	}
+	if err := bootstrapAdmin(); err != nil {
+		logError("admin account not created: %v", err)
+	}
 
 	// Ensure uploads directory exists
 	if err := os.MkdirAll(uploadDir, 0755); err != nil {
@@ -306,205 +795,800 @@ func main() {
 	if err := os.MkdirAll(originalDir, 0755); err != nil {
 		log.Fatalf("Failed to create original uploads directory: %v", err)
 	}
+	if err := os.MkdirAll(projectorDir, 0755); err != nil {
+		log.Fatalf("Failed to create projector directory: %v", err)
+	}
 	logInfo("uploads directory: %s", uploadDir)
+	if variantCacheBytes > 0 {
+		variants, err = newVariantCache(variantCacheDir, variantCacheBytes)
+		if err != nil {
+			log.Fatalf("Failed to set up the variant cache: %v", err)
+		}
+		files, size := variants.stats()
+		logInfo("variant cache: %s, %d files (%.1f of %d MB)", variantCacheDir, files, float64(size)/(1<<20), variantCacheBytes>>20)
+	}
 
-	if err := enqueueLegacyConversionTasks(); err != nil {
-		logWarn("enqueue legacy conversions: %v", err)
+	conversions := newConversionPool(conversionWorkers)
+	go conversions.run()
+	recapCtx, stopRecaps := context.WithCancel(context.Background())
+	recapsDone := make(chan struct{})
+	go startRecapWorker(recapCtx, recapsDone)
+	stopReloads := make(chan struct{})
+	go watchSIGHUP(stopReloads)
+	stopGC := make(chan struct{})
+	go runGCSchedule(stopGC)
+	stopTrash := make(chan struct{})
+	go runTrashPurger(stopTrash)
+	stopArchiver := make(chan struct{})
+	if archive != nil {
+		go runArchiver(stopArchiver)
+		logInfo("archiving originals older than %s to %s", archiveAfter, archive.location(""))
+	}
+	stopIngest := make(chan struct{})
+	if ingestDir != "" {
+		go runIngest(stopIngest)
+		logInfo("adopting images dropped into %s as uploads to event %s", ingestDir, ingestEvent)
+	}
+	stopNotifier := make(chan struct{})
+	go runNotifier(stopNotifier)
+	stopBackups := make(chan struct{})
+	if backups != nil {
+		go runBackups(stopBackups)
+		logInfo("backing up to %s every %s, keeping %d backups", backups.remote, backups.interval, backups.keep)
 	}
 
-	go startConversionWorker()
+	if redisURL != "" {
+		bp, err := newRedisBackplane(redisURL, redisChannel)
+		if err != nil {
+			log.Fatalf("Failed to connect hub backplane: %v", err)
+		}
+		hub.attachBackplane(bp)
+		logInfo("hub backplane: redis channel %s", redisChannel)
+	}
 
 	// Start hub
 	go hub.run()
 
 	r := mux.NewRouter()
 
+	r.Use(timeoutMiddleware)
+	r.Use(tracingMiddleware)
 	r.Use(loggingMiddleware)
+	r.Use(sessionMiddleware)
+	r.Use(deviceMiddleware)
+
+	r.Use(eventAccessMiddleware)
+	r.Use(readOnlyMiddleware)
 
 	// API routes
 	r.HandleFunc("/api/upload", handleUpload).Methods("POST")
+	r.HandleFunc("/api/upload/{id:[0-9]+}", handleUploadStatus).Methods("GET")
+	r.HandleFunc("/api/upload/captcha", handleCaptchaConfig).Methods("GET")
+	r.HandleFunc("/api/upload/terms", handleTermsConfig).Methods("GET")
 	r.HandleFunc("/api/pictures", handleList).Methods("GET")
+	r.HandleFunc("/api/pictures/grouped", handlePictureGroups).Methods("GET")
+	r.HandleFunc("/api/pictures/export", handleExport).Methods("GET")
+	r.HandleFunc("/api/pictures/{id}", handleGetPicture).Methods("GET")
 	r.HandleFunc("/api/pictures/{id}/like", handleLike).Methods("POST")
+	r.HandleFunc("/api/pictures/{id}/report", handleReport).Methods("POST")
+	r.HandleFunc("/api/pictures/{id}/comments", handleListComments).Methods("GET")
+	r.HandleFunc("/api/pictures/{id}/comments", handleAddComment).Methods("POST")
+	r.HandleFunc("/api/pictures/{id}/reactions", handleGetReactions).Methods("GET")
+	r.HandleFunc("/api/pictures/{id}/share", handleCreateShare).Methods("POST")
+	r.HandleFunc("/api/share/{code}", handleResolveShare).Methods("GET")
+	r.HandleFunc("/api/pictures/{id}/projector", handleProjectorImage).Methods("GET")
+	r.HandleFunc("/api/pictures/{id}/original", handleDownloadOriginal).Methods("GET")
+	r.HandleFunc("/api/pictures/{id}/metadata", handlePictureMetadata).Methods("GET")
 	r.HandleFunc("/api/presentation", handlePresentation).Methods("GET")
+	r.HandleFunc("/api/presentation/spotlight", handleSpotlight).Methods("GET")
+	r.HandleFunc("/api/presentation/manifest", handleManifest).Methods("GET")
+	r.HandleFunc("/api/presentation/settings", handleGetSettings).Methods("GET")
+	r.HandleFunc("/api/presentation/settings", requireRole(RolePresenter, handlePutSettings)).Methods("PUT")
+	r.HandleFunc("/api/playlists", handleListPlaylists).Methods("GET")
+	r.HandleFunc("/api/playlists/{name}", requireRole(RolePresenter, handlePutPlaylist)).Methods("PUT")
+	r.HandleFunc("/api/playlists/{name}", requireRole(RolePresenter, handleDeletePlaylist)).Methods("DELETE")
+	r.HandleFunc("/api/contest/rounds", handleListContests).Methods("GET")
+	r.HandleFunc("/api/contest/rounds/{id}", handleContestResults).Methods("GET")
+	r.HandleFunc("/api/contest/{id}/results", handleAnnouncedResults).Methods("GET")
+	r.HandleFunc("/api/stats", handleStats).Methods("GET")
+	r.HandleFunc("/api/stats/likes", requireRole(RolePresenter, handleLikeStats)).Methods("GET")
+	r.HandleFunc("/api/activity", handleActivity).Methods("GET")
+	r.HandleFunc("/api/guestbook", handleListGuestbook).Methods("GET")
+	r.HandleFunc("/api/guestbook", handleAddGuestbookMessage).Methods("POST")
+	r.HandleFunc("/api/access", handleGetAccess).Methods("GET")
+	r.HandleFunc("/api/access", handleEnterAccessCode).Methods("POST")
+	r.HandleFunc("/api/privacy/delete", handlePrivacyDelete).Methods("POST")
+	r.HandleFunc("/api/privacy/receipts/{id}", handleGetDeletionReceipt).Methods("GET")
+	r.HandleFunc("/api/auth/signup", handleSignup).Methods("POST")
+	r.HandleFunc("/api/auth/login", handleLogin).Methods("POST")
+	r.HandleFunc("/api/auth/logout", handleLogout).Methods("POST")
+	r.HandleFunc("/api/auth/me", handleMe).Methods("GET")
+	r.HandleFunc("/api/auth/config", handleAuthConfig).Methods("GET")
+	r.HandleFunc("/api/auth/oauth/{provider}/login", handleOAuthLogin).Methods("GET")
+	r.HandleFunc("/api/auth/oauth/{provider}/callback", handleOAuthCallback).Methods("GET")
+
+	// Everything under /api/admin needs at least a moderator; moderators
+	// may only moderate, the rest needs an admin
+	admin := r.PathPrefix("/api/admin").Subrouter()
+	admin.Use(requireRoleMiddleware(RoleModerator))
+	admin.HandleFunc("/announce", handleAnnounce).Methods("POST")
+	admin.HandleFunc("/pictures", handleArchive).Methods("GET")
+	admin.HandleFunc("/pictures/{id}/visibility", handleSetVisibility).Methods("PUT")
+	admin.HandleFunc("/pictures/{id}/publish", requireRole(RoleAdmin, handleSchedulePicture)).Methods("PUT")
+	admin.HandleFunc("/pictures/{id}", handleDeletePicture).Methods("DELETE")
+	admin.HandleFunc("/trash", handleTrash).Methods("GET")
+	admin.HandleFunc("/trash/{id}/restore", handleRestorePicture).Methods("POST")
+	admin.HandleFunc("/conversions/failed", requireRole(RoleAdmin, handleListFailedConversions)).Methods("GET")
+	admin.HandleFunc("/conversions/{id:[0-9]+}/original", requireRole(RoleAdmin, handleDownloadFailedOriginal)).Methods("GET")
+	admin.HandleFunc("/moderation/pending", handleListPending).Methods("GET")
+	admin.HandleFunc("/moderation/reported", handleListReported).Methods("GET")
+	admin.HandleFunc("/moderation/rejected", handleListRejected).Methods("GET")
+	admin.HandleFunc("/moderation/bulk", handleBulkModeration).Methods("POST")
+	admin.HandleFunc("/moderation/comments", handleListPendingComments).Methods("GET")
+	admin.HandleFunc("/moderation/comments/{id:[0-9]+}/{action:approve|reject}", handleModerateComment).Methods("POST")
+	admin.HandleFunc("/moderation/guestbook", handleListPendingGuestbook).Methods("GET")
+	admin.HandleFunc("/moderation/guestbook/{id:[0-9]+}/{action:approve|reject}", handleModerateGuestbookMessage).Methods("POST")
+	admin.HandleFunc("/guestbook/{id:[0-9]+}", handleDeleteGuestbookMessage).Methods("DELETE")
+	admin.HandleFunc("/moderation/captions", handleListPendingCaptions).Methods("GET")
+	admin.HandleFunc("/moderation/captions/{id}/{action:approve|reject}", handleModerateCaption).Methods("POST")
+	admin.HandleFunc("/moderation/{id}/{action:approve|reject|restore}", handleModerate).Methods("POST")
+	admin.HandleFunc("/bans", handleListBans).Methods("GET")
+	admin.HandleFunc("/bans", handleAddBan).Methods("POST")
+	admin.HandleFunc("/bans/{id}", handleDeleteBan).Methods("DELETE")
+	admin.HandleFunc("/displays", requireRole(RoleAdmin, handleCreateDisplay)).Methods("POST")
+	admin.HandleFunc("/displays", requireRole(RoleAdmin, handleListDisplays)).Methods("GET")
+	admin.HandleFunc("/displays/{id}", requireRole(RoleAdmin, handleRevokeDisplay)).Methods("DELETE")
+	admin.HandleFunc("/schedule", requireRole(RoleAdmin, handleAddScheduleEntry)).Methods("POST")
+	admin.HandleFunc("/schedule", requireRole(RoleAdmin, handleGetSchedule)).Methods("GET")
+	admin.HandleFunc("/schedule/{id}", requireRole(RoleAdmin, handleDeleteScheduleEntry)).Methods("DELETE")
+	admin.HandleFunc("/contest/rounds", requireRole(RoleAdmin, handleOpenContest)).Methods("POST")
+	admin.HandleFunc("/contest/rounds/{id}/close", requireRole(RoleAdmin, handleCloseContest)).Methods("POST")
+	admin.HandleFunc("/contest/{id}/announce", requireRole(RoleAdmin, handleAnnounceContest)).Methods("POST")
+	admin.HandleFunc("/recap", requireRole(RoleAdmin, handleCreateRecap)).Methods("POST")
+	admin.HandleFunc("/recap", requireRole(RoleAdmin, handleListRecaps)).Methods("GET")
+	admin.HandleFunc("/recap/{id}", requireRole(RoleAdmin, handleGetRecap)).Methods("GET")
+	admin.HandleFunc("/recap/{id}/video", requireRole(RoleAdmin, handleDownloadRecap)).Methods("GET")
+	admin.HandleFunc("/reload", requireRole(RoleAdmin, handleReload)).Methods("POST")
+	admin.HandleFunc("/read-only", requireRole(RoleAdmin, handleReadOnly)).Methods("GET", "PUT")
+	admin.HandleFunc("/gc", requireRole(RoleAdmin, handleGCReport)).Methods("GET")
+	admin.HandleFunc("/gc", requireRole(RoleAdmin, handleGC)).Methods("POST")
+	admin.HandleFunc("/backup/status", requireRole(RoleAdmin, handleBackupStatus)).Methods("GET")
+	admin.HandleFunc("/snapshot", requireRole(RoleAdmin, handleSnapshot)).Methods("GET")
+	admin.HandleFunc("/events", requireRole(RoleAdmin, handleListEventStats)).Methods("GET")
+	admin.HandleFunc("/downloads", requireRole(RoleAdmin, handleDownloadStats)).Methods("GET")
+	admin.HandleFunc("/quota", requireRole(RoleAdmin, handleQuota)).Methods("GET", "PUT", "DELETE")
+	admin.HandleFunc("/access", requireRole(RoleAdmin, handleAccessCode)).Methods("GET", "PUT", "DELETE")
+	admin.HandleFunc("/terms/acceptances", requireRole(RoleAdmin, handleExportTermsAcceptances)).Methods("GET")
+	admin.HandleFunc("/users", requireRole(RoleAdmin, handleListUsers)).Methods("GET")
+	admin.HandleFunc("/users/{id}/role", requireRole(RoleAdmin, handleSetUserRole)).Methods("PUT")
+	admin.HandleFunc("/users/{id}/photographer", requireRole(RoleAdmin, handleSetPhotographer)).Methods("PUT")
+
+	r.HandleFunc("/metrics", handleMetrics).Methods("GET")
+	r.HandleFunc("/healthz", handleHealthz).Methods("GET")
+	r.HandleFunc("/livez", handleLivez).Methods("GET")
+	r.HandleFunc("/readyz", handleReadyz).Methods("GET")
+	if debugAdmin {
+		r.PathPrefix("/debug/").Handler(requireRole(RoleAdmin, debugHandler().ServeHTTP))
+	}
 	r.HandleFunc("/ws", handleWebSocket)
+	r.HandleFunc("/p/{code}", handleSharePage).Methods("GET", "HEAD")
 
 	// Serve uploads
-	r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir(uploadDir))))
-
-	// Serve static files from build directory
-	staticFS := http.FileServer(http.Dir("build/"))
-	r.PathPrefix("/static/").Handler(staticFS)
-
-	// SPA catch-all: serve index.html for all other routes (allows React Router to handle routing)
-	r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check if the requested path is a file (has an extension) and exists
-		path := filepath.Join("build", r.URL.Path)
-		if info, err := os.Stat(path); err == nil && !info.IsDir() {
-			// File exists, serve it
-			staticFS.ServeHTTP(w, r)
-			return
+	r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", serveStored(uploadStore, "uploads"))).Methods("GET", "HEAD")
+
+	// Serve the React build, with index.html for client-side routes
+	frontend, frontendDesc := frontendFS()
+	logInfo("serving %s", frontendDesc)
+	if _, err := fs.Stat(frontend, "index.html"); err != nil {
+		logWarn("%s has no index.html; run npm run build", frontendDesc)
+	}
+	r.PathPrefix("/").Handler(spaHandler(frontend))
+
+	if devMode {
+		logWarn("DEV_MODE enabled: accepting WebSocket connections from any origin")
+	}
+
+	ln, listenDesc, err := listen()
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	srv := newServer("", r, true)
+	var redirectSrv *http.Server
+	if tlsEnabled() {
+		tlsConfig, redirect, err := newTLSConfig()
+		if err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
 		}
-		// Otherwise, serve index.html for SPA routing (React Router will handle the route)
-		indexPath := filepath.Join("build", "index.html")
-		http.ServeFile(w, r, indexPath)
-	})
+		srv.TLSConfig = tlsConfig
+		if httpPort != "" {
+			redirectSrv = newServer(":"+httpPort, redirect, true)
+			logInfo("redirecting HTTP on port %s to HTTPS", httpPort)
+			go func() {
+				if err := redirectSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					log.Fatalf("HTTP redirect server failed: %v", err)
+				}
+			}()
+		}
+		logInfo("server starting on %s (HTTPS)", listenDesc)
+	} else {
+		logInfo("server starting on %s", listenDesc)
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	var debugSrv *http.Server
+	if debugAddr != "" {
+		debugSrv = newServer(debugAddr, debugHandler(), false)
+		if host, _, _ := net.SplitHostPort(debugAddr); !isLoopback(host) {
+			logWarn("debug endpoints on %s are not limited to loopback", debugAddr)
+		}
+		logInfo("debug endpoints on %s", debugAddr)
+		go func() {
+			if err := debugSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("Debug server failed: %v", err)
+			}
+		}()
 	}
 
-	logInfo("server starting on port %s", port)
-	logInfo("database: %s", dbPath)
-	logInfo("uploads: %s", uploadDir)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	// Legacy files are queued while the server already answers /livez, and
+	// it only reports ready once they are
+	go func() {
+		if err := enqueueLegacyConversionTasks(0); err != nil {
+			logWarn("enqueue legacy conversions: %v", err)
+		}
+		if serverState.CompareAndSwap(stateStarting, stateReady) {
+			logInfo("ready")
+		}
+		// Only quotas need the sizes, so it doesn't hold up readiness
+		if !readOnly.Load() {
+			if err := backfillPictureBytes(context.Background()); err != nil {
+				logWarn("store file sizes of older pictures: %v", err)
+			}
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	close(stopReloads)
+	close(stopGC)
+	close(stopTrash)
+	close(stopArchiver)
+	close(stopIngest)
+	close(stopBackups)
+	close(stopNotifier)
+
+	serverState.Store(stateStopping)
+	logInfo("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// Stop the recap being rendered straight away; it is rendered again on
+	// the next run
+	stopRecaps()
+	// Close WebSockets first: the HTTP server doesn't track hijacked
+	// connections, so Shutdown alone would leave them open
+	if err := hub.shutdown(shutdownCtx); err != nil {
+		logWarn("hub shutdown: %v", err)
+	}
+	hub.closeBackplane()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logWarn("http shutdown: %v", err)
+	}
+	if debugSrv != nil {
+		debugSrv.Close()
+	}
+	if redirectSrv != nil {
+		if err := redirectSrv.Shutdown(shutdownCtx); err != nil {
+			logWarn("http redirect shutdown: %v", err)
+		}
+	}
+	// Uploads are all queued by now; let the current conversions finish
+	if err := conversions.shutdown(shutdownCtx); err != nil {
+		logWarn("conversion workers shutdown: %v", err)
+	}
+	select {
+	case <-recapsDone:
+	case <-shutdownCtx.Done():
+		logWarn("recap worker shutdown: %v", shutdownCtx.Err())
+	}
+	if err := db.Checkpoint(); err != nil {
+		logWarn("database checkpoint: %v", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logWarn("tracing shutdown: %v", err)
+	}
+	logInfo("server stopped")
 }
 
-const maxImageDimension = 1600
+// shutdownTimeout bounds how long shutdown waits for clients to close and
+// the workers to stop.
+const shutdownTimeout = 10 * time.Second
+
+// Limits of the web image: its long side and WebP quality
+var (
+	maxImageDimension reloadable[int]
+	webpQuality       reloadable[int]
+)
+
+// convertedImage is an upload re-encoded as WebP.
+type convertedImage struct {
+	web   []byte
+	image image.Image // what web encodes
+	// projector is the projector rendition, nil if the upload has none
+	projector []byte
+}
 
-func convertToWebP(data []byte) ([]byte, error) {
+// convertToWebP re-encodes an uploaded image as WebP, scaled down to
+// maxImageDimension, and encodes its projector rendition. The two are
+// encoded at the same time, on separate cores; see picsapp bench-convert.
+func convertToWebP(data []byte) (*convertedImage, error) {
 	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
 	if err != nil {
 		return nil, err
 	}
+	converted := &convertedImage{image: img}
+	projectorErr := make(chan error, 1)
+	go func() {
+		var err error
+		converted.projector, err = encodeProjectorRendition(img)
+		projectorErr <- err
+	}()
 
 	bounds := img.Bounds()
 	width := bounds.Dx()
 	height := bounds.Dy()
-	if width > maxImageDimension || height > maxImageDimension {
-		img = imaging.Fit(img, maxImageDimension, maxImageDimension, imaging.Lanczos)
+	if maxDim := maxImageDimension.Load(); width > maxDim || height > maxDim {
+		converted.image = imaging.Fit(img, maxDim, maxDim, imaging.Lanczos)
 	}
 
 	buf := &bytes.Buffer{}
-	if err := webp.Encode(buf, img, &webp.Options{Quality: 82}); err != nil {
-		return nil, err
+	webErr := webp.Encode(buf, converted.image, &webp.Options{Quality: float32(webpQuality.Load())})
+	if err := <-projectorErr; err != nil {
+		return nil, fmt.Errorf("projector rendition: %w", err)
+	}
+	if webErr != nil {
+		return nil, webErr
 	}
-	return buf.Bytes(), nil
+	converted.web = buf.Bytes()
+	return converted, nil
 }
 
-func startConversionWorker() {
+// Recovery of conversion tasks left processing by a crash: a task
+// processing for longer than conversionTimeout is requeued, unless it was
+// attempted maxConversionAttempts times, in which case it fails.
+var (
+	conversionTimeout     reloadable[time.Duration]
+	maxConversionAttempts reloadable[int]
+)
+
+const staleTaskCheckInterval = time.Minute
+
+// conversionWorkers is how many uploads are converted at once. Each
+// worker holds a decode slot while it converts, so MAX_CONCURRENT_DECODES
+// still bounds the images in memory.
+var conversionWorkers int
+
+// conversionPool runs conversionWorkers workers on the conversion queue.
+type conversionPool struct {
+	workers []*conversionWorker
+}
+
+func newConversionPool(n int) *conversionPool {
+	p := &conversionPool{}
+	for i := 0; i < n; i++ {
+		p.workers = append(p.workers, newConversionWorker())
+	}
+	return p
+}
+
+// run starts the workers once the tasks interrupted by the previous run
+// are requeued; nothing is being converted yet, so every task still
+// processing was interrupted.
+func (p *conversionPool) run() {
+	recoverStaleTasks(0)
+	for _, cw := range p.workers {
+		go cw.run()
+	}
+}
+
+// shutdown stops every worker as conversionWorker.shutdown does.
+func (p *conversionPool) shutdown(ctx context.Context) error {
+	errs := make(chan error, len(p.workers))
+	for _, cw := range p.workers {
+		go func(cw *conversionWorker) { errs <- cw.shutdown(ctx) }(cw)
+	}
+	var err error
+	for range p.workers {
+		if workerErr := <-errs; workerErr != nil {
+			err = workerErr
+		}
+	}
+	return err
+}
+
+// conversionWorker converts queued uploads one at a time until it is
+// stopped.
+type conversionWorker struct {
+	stop chan struct{}
+	done chan struct{}
+	// current is the ID of the task being converted, 0 while idle
+	current atomic.Int64
+}
+
+func newConversionWorker() *conversionWorker {
+	return &conversionWorker{stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (cw *conversionWorker) run() {
+	defer close(cw.done)
+	lastRecovery := time.Now()
 	for {
+		select {
+		case <-cw.stop:
+			return
+		default:
+		}
+		// Leave tasks queued while nothing may be written
+		if readOnly.Load() {
+			cw.sleep(time.Second)
+			continue
+		}
+		if time.Since(lastRecovery) >= staleTaskCheckInterval {
+			recoverStaleTasks(conversionTimeout.Load())
+			lastRecovery = time.Now()
+		}
+		// Leave tasks queued until there is room for their images
+		if err := checkDiskSpace(); err != nil {
+			cw.sleep(diskRecheckInterval)
+			continue
+		}
 		task, err := db.ClaimNextTask()
 		if err != nil {
 			logError("claim conversion task: %v", err)
-			time.Sleep(time.Second)
+			cw.sleep(time.Second)
 			continue
 		}
 		if task == nil {
-			time.Sleep(400 * time.Millisecond)
+			cw.sleep(400 * time.Millisecond)
 			continue
 		}
-		logInfo("processing conversion task id=%d file=%s", task.ID, task.OriginalName)
-		if err := processConversionTask(task); err != nil {
+		cw.current.Store(task.ID)
+		logInfo("processing conversion task id=%d file=%s source=%s", task.ID, task.OriginalName, task.Source)
+		// Continue the trace of the upload that queued the task
+		ctx, span := tracer.Start(contextWithTraceParent(context.Background(), task.TraceParent), "conversion",
+			trace.WithAttributes(
+				attribute.Int64("task.id", task.ID),
+				attribute.Int("task.attempt", task.Attempts),
+				attribute.String("event.id", task.EventID),
+			))
+		if err := processConversionTask(ctx, task); err != nil {
 			logError("conversion task %d failed: %v", task.ID, err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
 			db.MarkTaskFailed(task.ID, err.Error())
+			quarantineOriginal(ctx, task)
+			notifyConversionFailed(task, err)
 		} else {
-			db.MarkTaskCompleted(task.ID)
+			db.MarkTaskCompleted(task.ID, task.ResultID)
+			task.Status = "completed"
+			hub.publishUploadReceipt(task)
 			logInfo("conversion task %d completed", task.ID)
 		}
+		span.End()
+		cw.current.Store(0)
 	}
 }
 
-func processConversionTask(task *ConversionTask) error {
-	data, err := os.ReadFile(task.OriginalPath)
+// recoverStaleTasks requeues tasks processing for longer than staleAfter,
+// failing those that already had maxConversionAttempts, so an image that
+// crashes the process isn't converted forever; their originals are
+// quarantined.
+func recoverStaleTasks(staleAfter time.Duration) {
+	maxAttempts := maxConversionAttempts.Load()
+	requeued, failed, err := db.RecoverStaleTasks(staleAfter, maxAttempts)
 	if err != nil {
-		return fmt.Errorf("read original: %w", err)
+		logError("recover interrupted conversion tasks: %v", err)
+		return
+	}
+	if requeued > 0 {
+		logWarn("requeued %d interrupted conversion tasks", requeued)
 	}
+	if len(failed) > 0 {
+		for _, task := range failed {
+			quarantineOriginal(context.Background(), task)
+		}
+		logWarn("gave up on %d conversion tasks interrupted %d times", len(failed), maxAttempts)
+		notify(&notice{kind: noticeConversionFailed, text: fmt.Sprintf("⚠️ Gave up on %d conversions interrupted %d times", len(failed), maxAttempts)})
+	}
+}
 
-	processed, err := convertToWebP(data)
-	if err != nil {
-		return fmt.Errorf("convert to webp: %w", err)
+// sleep waits for d, or until the worker is stopped.
+func (cw *conversionWorker) sleep(d time.Duration) {
+	select {
+	case <-cw.stop:
+	case <-time.After(d):
 	}
+}
 
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		return fmt.Errorf("ensure upload dir: %w", err)
+// shutdown stops the worker once its current task is converted. If ctx
+// ends first, the task goes back to pending so the next run converts it
+// again; its original is only removed once a conversion completes.
+func (cw *conversionWorker) shutdown(ctx context.Context) error {
+	close(cw.stop)
+	select {
+	case <-cw.done:
+		return nil
+	case <-ctx.Done():
+		if id := cw.current.Load(); id != 0 {
+			if err := db.RequeueTask(id); err != nil {
+				logWarn("requeue conversion task %d: %v", id, err)
+			} else {
+				logInfo("conversion task %d requeued", id)
+			}
+		}
+		return ctx.Err()
 	}
+}
 
-	base := strconv.FormatInt(time.Now().UnixNano(), 10)
-	if task.PictureID != nil && *task.PictureID != "" {
-		trim := strings.TrimSuffix(*task.PictureID, filepath.Ext(*task.PictureID))
-		if trim != "" {
-			base = trim
+func processConversionTask(ctx context.Context, task *ConversionTask) error {
+	source, sourceKey, err := storedAt(task.OriginalPath)
+	if err != nil {
+		return fmt.Errorf("read original: %w", err)
+	}
+	var data []byte
+	if err := traceStage(ctx, "read original", func(ctx context.Context) error {
+		f, err := source.Get(ctx, sourceKey)
+		if err != nil {
+			return err
 		}
+		defer f.Close()
+		data, err = io.ReadAll(f)
+		return err
+	}); err != nil {
+		return fmt.Errorf("read original: %w", err)
 	}
 
+	oldID := ""
+	if task.PictureID != nil {
+		oldID = *task.PictureID
+	}
+	base := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if trim := strings.TrimSuffix(oldID, filepath.Ext(oldID)); trim != "" {
+		base = trim
+	}
+	// A picture converted again gets a new ID, as its projector rendition
+	// is cached under it
 	newID := base + ".webp"
-	newPath := filepath.Join(uploadDir, newID)
-	if _, err := os.Stat(newPath); err == nil {
-		base = fmt.Sprintf("%s_%d", base, time.Now().UnixNano())
-		newID = base + ".webp"
-		newPath = filepath.Join(uploadDir, newID)
+	if _, err := db.GetPicture(newID); err == nil {
+		newID = fmt.Sprintf("%s_%d.webp", base, time.Now().UnixNano())
 	}
-
-	if err := os.WriteFile(newPath, processed, 0644); err != nil {
-		return fmt.Errorf("write converted file: %w", err)
+	img, err := convertImage(ctx, data, task.EventID, newID)
+	if err != nil {
+		return err
 	}
+	task.ResultID = newID
 
-	if task.PictureID != nil && *task.PictureID != "" {
-		oldID := *task.PictureID
-		if err := db.UpdatePictureFile(oldID, newID, fmt.Sprintf("/uploads/%s", newID)); err != nil {
-			return fmt.Errorf("update picture record: %w", err)
+	if oldID != "" {
+		oldKey := ""
+		if pic, err := db.GetPicture(oldID); err == nil {
+			oldKey = pic.FileKey
 		}
-		oldPath := filepath.Join(uploadDir, oldID)
-		if oldPath != newPath {
-			if err := os.Remove(oldPath); err != nil && !os.IsNotExist(err) {
-				logWarn("warning: remove old file %s: %v", oldPath, err)
+		if err := traceStage(ctx, "db update picture", func(context.Context) error {
+			if err := db.UpdatePictureFile(oldID, newID, uploadStore.URL(img.key), img.key); err != nil {
+				return fmt.Errorf("update picture record: %w", err)
 			}
+			if err := db.SetPictureImage(newID, img.width, img.height, img.blurhash); err != nil {
+				logWarn("store image size of %s: %v", newID, err)
+			}
+			if err := db.SetPictureBytes(newID, img.size); err != nil {
+				logWarn("store file size of %s: %v", newID, err)
+			}
+			if img.projector != "" {
+				if err := db.SetPictureProjector(newID, img.projector); err != nil {
+					logWarn("store projector rendition of %s: %v", newID, err)
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		// The old files were the source of a picture converted again
+		if oldKey != "" && oldKey != img.key {
+			deleteUnusedFiles(ctx, oldKey)
+		}
+		if pic, err := db.GetPicture(newID); err == nil && !pic.Hidden {
+			traceStage(ctx, "broadcast picture_updated", func(context.Context) error {
+				hub.publishPictureUpdated(oldID, pic)
+				return nil
+			})
 		}
 	} else {
 		picture := &Picture{
-			ID:         newID,
-			Filename:   task.OriginalName,
-			URL:        fmt.Sprintf("/uploads/%s", newID),
-			Likes:      0,
-			UploadedAt: time.Now(),
+			ID:           newID,
+			Filename:     task.OriginalName,
+			URL:          uploadStore.URL(img.key),
+			Likes:        0,
+			UploadedAt:   time.Now(),
+			EventID:      task.EventID,
+			Width:        img.width,
+			Height:       img.height,
+			Blurhash:     img.blurhash,
+			ProjectorURL: img.projector,
+			FileKey:      img.key,
+			DeviceID:     task.DeviceID,
+			Caption:      task.Caption,
+			UploadedBy:   task.UploadedBy,
+			UserID:       task.UserID,
+			Source:       task.Source,
+		}
+		// Uploads an admin scheduled stay hidden until their publish time
+		if task.PublishAt.After(time.Now()) {
+			picture.Hidden = true
+			picture.PublishAt = task.PublishAt
+		}
+		// Guests' uploads wait for a moderator when MODERATE_UPLOADS is on
+		if task.DeviceID != "" && moderateUploads.Load() && picture.PublishAt.IsZero() {
+			picture.Hidden = true
+			picture.Moderation = moderationPending
 		}
-		if err := db.AddPicture(picture); err != nil {
+		// and their captions when MODERATE_TEXT is
+		if task.DeviceID != "" && moderateText.Load() {
+			picture.PendingCaption, picture.Caption = picture.Caption, ""
+		}
+		if err := traceStage(ctx, "db insert picture", func(context.Context) error {
+			return db.AddPicture(picture)
+		}); err != nil {
 			return fmt.Errorf("insert picture: %w", err)
 		}
+		if err := db.SetPictureBytes(newID, img.size); err != nil {
+			logWarn("store file size of %s: %v", newID, err)
+		}
+		picture.URL = assetURL(picture.URL, 1)
+		if !picture.Hidden {
+			traceStage(ctx, "broadcast picture_added", func(context.Context) error {
+				hub.publishPictureAdded(picture)
+				return nil
+			})
+			recordUpload(picture)
+			notifyUpload(picture)
+		}
 	}
 
-	if err := os.Remove(task.OriginalPath); err != nil && !os.IsNotExist(err) {
-		logWarn("remove original file %s: %v", task.OriginalPath, err)
+	if source == originalStore {
+		if keepOriginals {
+			if err := db.SetPictureOriginal(newID, sourceKey); err != nil {
+				logWarn("record original file %s: %v", task.OriginalPath, err)
+			}
+		} else if err := source.Delete(ctx, sourceKey); err != nil {
+			logWarn("remove original file %s: %v", task.OriginalPath, err)
+		}
+	}
+	return nil
+}
+
+// storedImage is an original converted and written to the stores.
+type storedImage struct {
+	key           string
+	size          int64
+	width, height int
+	blurhash      string
+	// projector is the URL of the projector rendition, "" for none
+	projector string
+}
+
+// convertImage converts an original to WebP and writes the web image and
+// projector rendition of picture id to event's partition of the stores.
+func convertImage(ctx context.Context, data []byte, event, id string) (*storedImage, error) {
+	img := &storedImage{}
+	var converted *convertedImage
+	if err := traceStage(ctx, "convert", func(context.Context) (err error) {
+		decodeSlots.acquire()
+		defer decodeSlots.release()
+		if converted, err = convertToWebP(data); err != nil {
+			return err
+		}
+		bounds := converted.image.Bounds()
+		img.width, img.height, img.blurhash = bounds.Dx(), bounds.Dy(), encodeBlurhash(converted.image)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("convert to webp: %w", err)
 	}
+	img.key = eventKey(event, shardedKey(converted.web, ".webp"))
+	img.size = int64(len(converted.web) + len(converted.projector))
 
-	if pictures, err := db.GetAllPicturesSortedByLikes(); err == nil {
-		update, _ := json.Marshal(pictures)
-		hub.broadcast <- update
+	if err := traceStage(ctx, "write files", func(ctx context.Context) error {
+		if err := uploadStore.Put(ctx, img.key, bytes.NewReader(converted.web)); err != nil {
+			return fmt.Errorf("write converted file: %w", err)
+		}
+		if converted.projector != nil {
+			if err := projectorStore.Put(ctx, img.key, bytes.NewReader(converted.projector)); err != nil {
+				return fmt.Errorf("write projector rendition: %w", err)
+			}
+			img.projector = projectorURL(id)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
 	}
-	return nil
+	return img, nil
 }
 
-func enqueueLegacyConversionTasks() error {
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		return err
+// deleteUnusedFiles deletes the image and projector rendition under key
+// unless a picture still uses them, as pictures with the same contents
+// share their files.
+func deleteUnusedFiles(ctx context.Context, key string) {
+	if inUse, err := db.FileInUse(key); err != nil || inUse {
+		return
+	}
+	if err := uploadStore.Delete(ctx, key); err != nil {
+		logWarn("remove old file %s: %v", key, err)
+	}
+	if err := projectorStore.Delete(ctx, key); err != nil {
+		logWarn("remove old projector rendition %s: %v", key, err)
 	}
+}
 
+// enqueueLegacyConversionTasks queues the conversion of pictures stored
+// before uploads were converted to WebP, and of original files without a
+// task that are at least minAge old; younger ones may belong to an upload
+// still being saved.
+func enqueueLegacyConversionTasks(minAge time.Duration) error {
 	// Existing picture records with non-webp ids
-	pics, err := db.GetAllPicturesSortedByLikes()
+	pics, err := db.LoadAllPictures()
 	if err != nil {
 		return err
 	}
 	for _, pic := range pics {
 		if !strings.HasSuffix(strings.ToLower(pic.ID), ".webp") {
-			path := filepath.Join(uploadDir, pic.ID)
-			if _, err := os.Stat(path); err == nil {
-				if err := db.CreateConversionTask(path, pic.Filename, pic.ID); err != nil {
+			if _, err := uploadStore.Stat(context.Background(), pic.FileKey); err == nil {
+				path := filepath.Join(uploadDir, filepath.FromSlash(pic.FileKey))
+				if _, err := db.CreateConversionTask(path, pic.Filename, pic.ID, pic.EventID, "", "", "", "", 0, time.Time{}, ""); err != nil {
 					logWarn("queue legacy picture %s: %v", pic.ID, err)
 				}
 			}
 		}
 	}
 
-	// Any original files waiting without tasks
+	// Any original files waiting without tasks, such as files copied into
+	// the directory by hand; files being put start with a dot
+	if _, ok := originalStore.(*dirStorage); !ok {
+		return nil
+	}
+	// Kept originals have been converted
+	kept := map[string]bool{}
+	if keepOriginals {
+		originals, err := db.GetKeptOriginals()
+		if err != nil {
+			return err
+		}
+		for _, o := range originals {
+			kept[o.Key] = true
+		}
+	}
 	entries, err := os.ReadDir(originalDir)
 	if err == nil {
 		for _, entry := range entries {
-			if entry.IsDir() {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || kept[entry.Name()] {
 				continue
 			}
+			if minAge > 0 {
+				info, err := entry.Info()
+				if err != nil || time.Since(info.ModTime()) < minAge {
+					continue
+				}
+			}
 			path := filepath.Join(originalDir, entry.Name())
-			if err := db.CreateConversionTask(path, entry.Name(), ""); err != nil {
+			if _, err := db.CreateConversionTask(path, entry.Name(), "", defaultEventID, sourceRecovered, "", "", "", 0, time.Time{}, ""); err != nil {
 				logWarn("queue legacy original %s: %v", entry.Name(), err)
 			}
 		}
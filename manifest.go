@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// Number of slides in a manifest: the default and the most ?count= may ask
+// for.
+const (
+	defaultManifestSlides = 5
+	maxManifestSlides     = 20
+)
+
+// ManifestResponse is returned by /api/presentation/manifest: the next
+// slides of a display, so it can prefetch their images before they are
+// shown.
+type ManifestResponse struct {
+	Order    string           `json:"order,omitempty"`
+	Playlist string           `json:"playlist,omitempty"`
+	Slides   []*ManifestSlide `json:"slides"`
+}
+
+// ManifestSlide is one upcoming slide. Width, Height and Blurhash are
+// omitted if the image can't be read, ProjectorURL if the picture has no
+// projector rendition.
+type ManifestSlide struct {
+	ID           string `json:"id"`
+	URL          string `json:"url"`
+	ProjectorURL string `json:"projectorUrl,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	Blurhash     string `json:"blurhash,omitempty"`
+}
+
+// handleManifest lists the slides that follow ?after= (the slide on
+// screen) in the request's slideshow, wrapping around. Without ?after=, or
+// if that picture is no longer in the slideshow, it starts at the first
+// slide.
+func handleManifest(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	ordering, playlist := slideshowOptions(r, event)
+	if !orderings[ordering] {
+		http.Error(w, "Invalid order", http.StatusBadRequest)
+		return
+	}
+	count := defaultManifestSlides
+	if v := r.URL.Query().Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid count", http.StatusBadRequest)
+			return
+		}
+		count = min(n, maxManifestSlides)
+	}
+
+	pictures, err := slideshowPictures(event, ordering, playlist, time.Now())
+	if errors.Is(err, errUnknownPlaylist) {
+		http.Error(w, "Playlist not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("get slideshow for manifest failed: %v", err)
+		http.Error(w, "Error fetching pictures", http.StatusInternalServerError)
+		return
+	}
+
+	start := 0
+	if after := r.URL.Query().Get("after"); after != "" {
+		for i, p := range pictures {
+			if p.ID == after {
+				start = i + 1
+				break
+			}
+		}
+	}
+	resp := &ManifestResponse{Slides: []*ManifestSlide{}}
+	if playlist != "" {
+		resp.Playlist = playlist
+	} else {
+		resp.Order = ordering
+	}
+	for i := 0; i < min(count, len(pictures)); i++ {
+		p := pictures[(start+i)%len(pictures)]
+		if p.Width == 0 {
+			if !decodeSlots.tryAcquire() {
+				decodesRejected.Add(1)
+				serverBusy(w, "Too many images being decoded")
+				return
+			}
+			err := measurePicture(p)
+			decodeSlots.release()
+			if err != nil {
+				logWarn("measure picture %s: %v", p.ID, err)
+			}
+		}
+		resp.Slides = append(resp.Slides, &ManifestSlide{
+			ID:           p.ID,
+			URL:          p.URL,
+			ProjectorURL: p.ProjectorURL,
+			Width:        p.Width,
+			Height:       p.Height,
+			Blurhash:     p.Blurhash,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// measurePicture reads the size and blurhash of a picture converted before
+// they were stored, and stores them unless in read-only mode.
+func measurePicture(pic *Picture) error {
+	f, err := uploadStore.Get(context.Background(), pic.FileKey)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img, err := imaging.Decode(f, imaging.AutoOrientation(true))
+	if err != nil {
+		return err
+	}
+	bounds := img.Bounds()
+	pic.Width, pic.Height, pic.Blurhash = bounds.Dx(), bounds.Dy(), encodeBlurhash(img)
+	if readOnly.Load() {
+		return nil
+	}
+	return db.SetPictureImage(pic.ID, pic.Width, pic.Height, pic.Blurhash)
+}
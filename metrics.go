@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Hub metrics, exported in the Prometheus text format by handleMetrics.
+var (
+	wsConnects          atomic.Uint64
+	wsDisconnects       atomic.Uint64
+	wsRejected          atomic.Uint64
+	wsMessagesSent      atomic.Uint64
+	wsBytesSent         atomic.Uint64
+	wsSendQueueDrops    atomic.Uint64
+	wsClientsDropped    atomic.Uint64
+	hubBroadcastLatency = newHistogram([]float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1})
+)
+
+// histogram is a fixed-bucket latency histogram safe for concurrent use.
+type histogram struct {
+	bounds []float64
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	sumNs  atomic.Uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range h.bounds {
+		if seconds <= bound {
+			h.counts[i].Add(1)
+			break
+		}
+	}
+	h.count.Add(1)
+	h.sumNs.Add(uint64(d.Nanoseconds()))
+}
+
+// write prints the histogram with cumulative buckets.
+func (h *histogram) write(w http.ResponseWriter, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+	count := h.count.Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, time.Duration(h.sumNs.Load()).Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+func boolMetric(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "picsapp_ws_connections", "gauge", "Open WebSocket connections.", uint64(hub.connections.Load()))
+	writeMetric(w, "picsapp_ws_connects_total", "counter", "WebSocket clients subscribed to a room.", wsConnects.Load())
+	writeMetric(w, "picsapp_ws_disconnects_total", "counter", "WebSocket clients removed from a room.", wsDisconnects.Load())
+	writeMetric(w, "picsapp_ws_rejected_total", "counter", "WebSocket connections closed because MAX_WS_CLIENTS was reached.", wsRejected.Load())
+	writeMetric(w, "picsapp_ws_messages_sent_total", "counter", "Frames written to WebSocket clients.", wsMessagesSent.Load())
+	writeMetric(w, "picsapp_ws_bytes_sent_total", "counter", "Uncompressed payload bytes written to WebSocket clients.", wsBytesSent.Load())
+	writeMetric(w, "picsapp_ws_send_queue_drops_total", "counter", "Frames not queued because a client's send queue was full.", wsSendQueueDrops.Load())
+	writeMetric(w, "picsapp_ws_clients_dropped_total", "counter", "Slow WebSocket clients disconnected by the hub.", wsClientsDropped.Load())
+	writeMetric(w, "picsapp_uploads_in_progress", "gauge", "Uploads being received.", uint64(uploadSlots.inUse()))
+	writeMetric(w, "picsapp_uploads_rejected_total", "counter", "Uploads answered 503 because MAX_CONCURRENT_UPLOADS were in progress.", uploadsRejected.Load())
+	writeMetric(w, "picsapp_decodes_in_progress", "gauge", "Images being decoded.", uint64(decodeSlots.inUse()))
+	writeMetric(w, "picsapp_decodes_rejected_total", "counter", "Requests answered 503 because MAX_CONCURRENT_DECODES images were being decoded.", decodesRejected.Load())
+	writeMetric(w, "picsapp_disk_free_bytes", "gauge", "Free bytes on the upload volume at the last check.", diskFree.Load())
+	writeMetric(w, "picsapp_disk_low", "gauge", "1 while free disk space is below MIN_FREE_DISK_MB and uploads are refused.", boolMetric(diskLow.Load()))
+	writeMetric(w, "picsapp_uploads_rejected_disk_total", "counter", "Uploads answered 507 because disk space was low.", uploadsRejectedDisk.Load())
+	writeMetric(w, "picsapp_uploads_rejected_quota_total", "counter", "Uploads answered 507 because their event had used its storage quota.", uploadsRejectedQuota.Load())
+	writeMetric(w, "picsapp_captcha_failures_total", "counter", "Uploads refused for a missing or failed CAPTCHA.", captchaFailures.Load())
+	writeMetric(w, "picsapp_captcha_errors_total", "counter", "Uploads refused because the CAPTCHA provider couldn't be reached.", captchaErrors.Load())
+	writeMetric(w, "picsapp_oauth_logins_total", "counter", "Sign-ins through an OAuth provider.", oauthLogins.Load())
+	writeMetric(w, "picsapp_oauth_failures_total", "counter", "OAuth sign-ins that failed at the provider or were refused for the account's email address.", oauthFailures.Load())
+	writeMetric(w, "picsapp_access_denied_total", "counter", "Requests to invite-only events refused for lack of an access code.", accessDenied.Load())
+	writeMetric(w, "picsapp_access_code_failures_total", "counter", "Wrong access codes entered for invite-only events.", accessFailures.Load())
+	writeMetric(w, "picsapp_like_milestones_total", "counter", "Like milestones reached by pictures (LIKE_MILESTONES).", milestonesReached.Load())
+	writeMetric(w, "picsapp_milestone_notify_failures_total", "counter", "Milestone notifications that MILESTONE_WEBHOOK_URL failed to take.", milestoneNotifyFailures.Load())
+	writeMetric(w, "picsapp_notifications_total", "counter", "Notices posted to SLACK_WEBHOOK_URL or DISCORD_WEBHOOK_URL.", notificationsSent.Load())
+	writeMetric(w, "picsapp_notification_failures_total", "counter", "Notices the chat webhooks failed to take, or dropped because the queue was full.", notificationFailures.Load())
+	writeMetric(w, "picsapp_privacy_deletions_total", "counter", "Deletions of a guest's or user's personal data through /api/privacy/delete.", privacyDeletions.Load())
+	writeMetric(w, "picsapp_terms_acceptances_total", "counter", "Acceptances of the terms of use (TERMS_TEXT) recorded with an upload.", termsAccepted.Load())
+	writeMetric(w, "picsapp_uploads_rejected_terms_total", "counter", "Uploads answered 428 because their device hadn't accepted the terms of use.", uploadsRejectedTerms.Load())
+	writeMetric(w, "picsapp_uploads_rejected_limit_total", "counter", "Uploads refused because their device or account reached DEVICE_UPLOAD_LIMIT or USER_UPLOAD_LIMIT for the event.", uploadsRejectedLimit.Load())
+	writeMetric(w, "picsapp_uploads_rate_limited_total", "counter", "Uploads answered 429 because their device exceeded UPLOAD_RATE_LIMIT.", uploadsRateLimited.Load())
+	writeMetric(w, "picsapp_likes_duplicate_total", "counter", "Likes refused because the device had already liked the picture.", likesDuplicate.Load())
+	writeMetric(w, "picsapp_likes_rate_limited_total", "counter", "Likes refused because their device exceeded LIKE_RATE_LIMIT.", likesRateLimited.Load())
+	writeMetric(w, "picsapp_banned_requests_total", "counter", "Uploads, likes and comments refused because their IP or device is banned.", bannedRequests.Load())
+	writeMetric(w, "picsapp_auto_bans_total", "counter", "Devices banned automatically for rejected uploads or reports.", autoBans.Load())
+	writeMetric(w, "picsapp_text_masked_total", "counter", "Captions and comments saved with words or contact details masked.", textMasked.Load())
+	writeMetric(w, "picsapp_text_rejected_total", "counter", "Captions and comments refused for words or contact details, with FILTER_ACTION reject.", textRejected.Load())
+	writeMetric(w, "picsapp_gc_runs_total", "counter", "Garbage collection runs.", gcRuns.Load())
+	writeMetric(w, "picsapp_gc_quarantined_files_total", "counter", "Orphaned files moved to quarantine.", gcQuarantined.Load())
+	writeMetric(w, "picsapp_gc_deleted_files_total", "counter", "Quarantined files deleted after GC_GRACE.", gcDeleted.Load())
+	writeMetric(w, "picsapp_gc_reclaimed_bytes_total", "counter", "Bytes freed by deleting quarantined files.", gcReclaimedBytes.Load())
+	writeMetric(w, "picsapp_gc_missing_images", "gauge", "Pictures whose image was missing at the last garbage collection.", gcMissingImages.Load())
+	writeMetric(w, "picsapp_gc_missing_originals", "gauge", "Pending conversion tasks whose original was missing at the last garbage collection.", gcMissingOriginal.Load())
+	writeMetric(w, "picsapp_archived_originals_total", "counter", "Kept originals shipped to ARCHIVE_BUCKET.", archivedOriginals.Load())
+	writeMetric(w, "picsapp_archived_original_bytes_total", "counter", "Bytes of kept originals shipped to ARCHIVE_BUCKET.", archivedOriginalBytes.Load())
+	writeMetric(w, "picsapp_archive_failures_total", "counter", "Kept originals that failed to upload to ARCHIVE_BUCKET.", archiveFailures.Load())
+	writeMetric(w, "picsapp_ingested_files_total", "counter", "Images dropped into INGEST_DIR and queued for conversion.", ingestedFiles.Load())
+	writeMetric(w, "picsapp_ingest_failures_total", "counter", "Images in INGEST_DIR that failed to be queued for conversion.", ingestFailures.Load())
+	writeMetric(w, "picsapp_backups_total", "counter", "Backup runs.", backupRuns.Load())
+	writeMetric(w, "picsapp_backup_failures_total", "counter", "Backup runs that failed.", backupFailures.Load())
+	writeMetric(w, "picsapp_backup_uploaded_bytes_total", "counter", "Bytes of files and database snapshots uploaded by backups.", backupUploadedBytes.Load())
+	writeMetric(w, "picsapp_backup_last_success_timestamp_seconds", "gauge", "Unix time of the last successful backup, 0 before any.", uint64(backupLastSuccess.Load()))
+	writeMetric(w, "picsapp_snapshots_total", "counter", "Snapshots downloaded whole from /api/admin/snapshot.", snapshotsServed.Load())
+	writeMetric(w, "picsapp_snapshots_rejected_total", "counter", "Snapshot requests answered 429 because another snapshot was streaming.", snapshotsRejected.Load())
+	writeMetric(w, "picsapp_snapshot_bytes_total", "counter", "Bytes of snapshots sent, whole or not.", snapshotBytes.Load())
+	var variantFiles int
+	var variantBytes int64
+	if variants != nil {
+		variantFiles, variantBytes = variants.stats()
+	}
+	hotFiles, hotBytes := hot.stats()
+	writeMetric(w, "picsapp_gallery_cache_hits_total", "counter", "Gallery requests and WebSocket snapshots answered from the gallery cache.", galleryCacheHits.Load())
+	writeMetric(w, "picsapp_gallery_cache_misses_total", "counter", "Galleries read from the database because the pictures had changed.", galleryCacheMisses.Load())
+	writeMetric(w, "picsapp_hot_image_hits_total", "counter", "Images served from memory as one of the most liked pictures.", hotImageHits.Load())
+	writeMetric(w, "picsapp_hot_images", "gauge", "Images of the most liked pictures held in memory.", uint64(hotFiles))
+	writeMetric(w, "picsapp_hot_image_bytes", "gauge", "Size of the images of the most liked pictures held in memory.", uint64(hotBytes))
+	writeMetric(w, "picsapp_variant_cache_hits_total", "counter", "Variants served from the variant cache.", variantCacheHits.Load())
+	writeMetric(w, "picsapp_variant_cache_misses_total", "counter", "Variants looked up but not in the variant cache.", variantCacheMisses.Load())
+	writeMetric(w, "picsapp_variant_cache_evictions_total", "counter", "Least recently used variants deleted to stay within VARIANT_CACHE_MB.", variantCacheEvictions.Load())
+	writeMetric(w, "picsapp_variant_cache_files", "gauge", "Variants in the variant cache.", uint64(variantFiles))
+	writeMetric(w, "picsapp_variant_cache_bytes", "gauge", "Size of the variants in the variant cache.", uint64(variantBytes))
+	writeMetric(w, "picsapp_sendfile_responses_total", "counter", "Files handed to the reverse proxy with SENDFILE_HEADER.", sendfileResponses.Load())
+	hubBroadcastLatency.write(w, "picsapp_hub_broadcast_latency_seconds", "Time from publishing a broadcast until it is queued for every client.")
+}
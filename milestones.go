@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// When a picture's likes reach one of LIKE_MILESTONES, the event is sent a
+// milestone message, the uploader's phones an own_milestone one to
+// celebrate, and the organizers a notification on MILESTONE_WEBHOOK_URL
+// and in their chat (notify.go). A milestone counts once per picture: it
+// is recorded in the activity feed, which keeps the first.
+
+var (
+	// likeMilestones are the like counts of LIKE_MILESTONES, ascending
+	likeMilestones      reloadable[[]int]
+	milestoneWebhookURL reloadable[string]
+
+	milestonesReached       atomic.Uint64
+	milestoneNotifyFailures atomic.Uint64
+)
+
+// MilestoneNotification is the body posted to MILESTONE_WEBHOOK_URL.
+type MilestoneNotification struct {
+	Type      string `json:"type"`
+	EventID   string `json:"eventId"`
+	PictureID string `json:"pictureId"`
+	Likes     int    `json:"likes"`
+	// URL is the picture's image, absolute with PUBLIC_URL; "" without it
+	// unless the image is served from elsewhere
+	URL        string    `json:"url"`
+	UploadedBy string    `json:"uploadedBy,omitempty"`
+	Caption    string    `json:"caption,omitempty"`
+	ReachedAt  time.Time `json:"reachedAt"`
+}
+
+// parseMilestones parses LIKE_MILESTONES, comma-separated like counts,
+// into ascending order.
+func parseMilestones(raw string) ([]int, error) {
+	var counts []int
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid like count %q", field)
+		}
+		counts = append(counts, n)
+	}
+	slices.Sort(counts)
+	return slices.Compact(counts), nil
+}
+
+// checkMilestone celebrates a picture whose likes just reached a
+// milestone, the first time they do.
+func checkMilestone(pic *Picture) {
+	if pic.Hidden || !slices.Contains(likeMilestones.Load(), pic.Likes) {
+		return
+	}
+	a := newActivity(activityMilestone, pic)
+	a.Likes = pic.Likes
+	if !recordActivity(a) {
+		return
+	}
+	milestonesReached.Add(1)
+	hub.publishMilestone(pic)
+	logInfo("picture %s reached %d likes (event=%s)", pic.ID, pic.Likes, pic.EventID)
+	if milestoneWebhookURL.Load() != "" {
+		go notifyMilestone(pic, a.CreatedAt)
+	}
+	text := fmt.Sprintf("🎉 A picture of %s just reached %d likes", pic.EventID, pic.Likes)
+	if pic.UploadedBy != "" {
+		text += " (by " + pic.UploadedBy + ")"
+	}
+	u := absolutePublicURL(pic.URL)
+	notify(&notice{kind: noticeMilestone, text: text, link: u, image: u})
+}
+
+// notifyMilestone posts a milestone to MILESTONE_WEBHOOK_URL. Failures are
+// logged and counted; they aren't retried.
+func notifyMilestone(pic *Picture, at time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	err := postJSON(ctx, milestoneWebhookURL.Load(), &MilestoneNotification{
+		Type:       msgMilestone,
+		EventID:    pic.EventID,
+		PictureID:  pic.ID,
+		Likes:      pic.Likes,
+		URL:        absolutePublicURL(pic.URL),
+		UploadedBy: pic.UploadedBy,
+		Caption:    pic.Caption,
+		ReachedAt:  at,
+	})
+	if err != nil {
+		milestoneNotifyFailures.Add(1)
+		logWarn("milestone webhook for %s: %v", pic.ID, err)
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Moderators keep the public screen clean from their phone: with
+// MODERATE_UPLOADS, guests' uploads are held back until approved; with
+// MODERATE_TEXT, their comments, guestbook messages and upload captions
+// are too; guests report pictures they find offensive; and rejected
+// pictures are taken off the wall but kept, so a mistake can be restored.
+const (
+	moderationPending  = "pending"
+	moderationRejected = "rejected"
+
+	// maxRejectedListed bounds the recent deletions listed
+	maxRejectedListed = 100
+	// maxBulkModeration bounds the pictures of one bulk operation
+	maxBulkModeration = 200
+	// reportsPerMinute limits reports per device, like LIKE_RATE_LIMIT
+	reportsPerMinute = 10
+)
+
+var (
+	moderateUploads atomic.Bool
+	moderateText    atomic.Bool
+
+	reportLimiter = &rateLimiter{perMinute: reportsPerMinute, buckets: map[string]*tokenBucket{}}
+
+	// reportReasons are the reasons a picture can be reported for
+	reportReasons = map[string]bool{
+		"inappropriate": true,
+		"offensive":     true,
+		"privacy":       true,
+		"spam":          true,
+		"other":         true,
+	}
+
+	errPictureRejected    = errors.New("picture was rejected")
+	errPictureNotRejected = errors.New("picture isn't rejected")
+)
+
+// ReportRequest is the body of POST /api/pictures/{id}/report.
+type ReportRequest struct {
+	Reason string `json:"reason"`
+}
+
+// ReportedPicture is a picture with unresolved reports, counted per reason.
+type ReportedPicture struct {
+	*Picture
+	Reports        int            `json:"reports"`
+	Reasons        map[string]int `json:"reasons"`
+	LastReportedAt time.Time      `json:"lastReportedAt"`
+}
+
+// RejectedPicture is a picture a moderator took down, which can be
+// restored.
+type RejectedPicture struct {
+	*Picture
+	RejectedAt time.Time `json:"rejectedAt"`
+	RejectedBy string    `json:"rejectedBy"`
+}
+
+// HeldCaption is a picture whose caption waits for a moderator.
+type HeldCaption struct {
+	*Picture
+	PendingCaption string `json:"pendingCaption"`
+}
+
+// BulkModerationRequest is the body of POST /api/admin/moderation/bulk.
+type BulkModerationRequest struct {
+	Action string   `json:"action"`
+	IDs    []string `json:"ids"`
+}
+
+// BulkModerationResponse lists the pictures a bulk operation was applied
+// to, and why it failed for the others.
+type BulkModerationResponse struct {
+	Done   []string          `json:"done"`
+	Failed map[string]string `json:"failed"`
+}
+
+// handleReport records a device's report of a picture on the public wall.
+func handleReport(w http.ResponseWriter, r *http.Request) {
+	var req ReportRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&req); err != nil || !reportReasons[req.Reason] {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	pic, err := db.GetPicture(id)
+	if err != nil || pic.Hidden {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	d := deviceFromRequest(r)
+	if ok, retryAfter := reportLimiter.allow(d.rateKey(), time.Now()); !ok {
+		tooManyRequests(w, "Too many reports from this device", retryAfter)
+		return
+	}
+	added, err := db.AddReport(id, d.id, req.Reason, time.Now())
+	if err != nil {
+		logError("add report failed: %v", err)
+		http.Error(w, "Error reporting picture", http.StatusInternalServerError)
+		return
+	}
+	if !added {
+		http.Error(w, "Already reported", http.StatusConflict)
+		return
+	}
+	logInfo("picture %s reported: %s (event=%s)", id, req.Reason, pic.EventID)
+	notifyReport(pic, req.Reason)
+	checkAutoBan(pic.DeviceID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListPending lists the request's event's pictures waiting for
+// approval, oldest first.
+func handleListPending(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	pictures, err := db.GetPendingPictures(event)
+	if err != nil {
+		logError("get pending pictures failed: %v", err)
+		http.Error(w, "Error fetching pictures", http.StatusInternalServerError)
+		return
+	}
+	if pictures == nil {
+		pictures = []*Picture{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pictures)
+}
+
+// handleListReported lists the request's event's reported pictures, most
+// reported first.
+func handleListReported(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	pictures, err := db.GetReportedPictures(event)
+	if err != nil {
+		logError("get reported pictures failed: %v", err)
+		http.Error(w, "Error fetching pictures", http.StatusInternalServerError)
+		return
+	}
+	if pictures == nil {
+		pictures = []*ReportedPicture{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pictures)
+}
+
+// handleListRejected lists the request's event's recently rejected
+// pictures, most recent first.
+func handleListRejected(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	pictures, err := db.GetRejectedPictures(event, maxRejectedListed)
+	if err != nil {
+		logError("get rejected pictures failed: %v", err)
+		http.Error(w, "Error fetching pictures", http.StatusInternalServerError)
+		return
+	}
+	if pictures == nil {
+		pictures = []*RejectedPicture{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pictures)
+}
+
+// handleModerate approves, rejects or restores one picture.
+func handleModerate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pic, err := moderatePicture(vars["action"], vars["id"], moderatorName(r))
+	if err != nil {
+		status, msg := moderationError(err)
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pic)
+}
+
+// handleBulkModeration applies one action to several pictures, such as
+// approving a backlog of uploads at once. Each picture succeeds or fails
+// on its own.
+func handleBulkModeration(w http.ResponseWriter, r *http.Request) {
+	var req BulkModerationRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case req.Action != "approve" && req.Action != "reject" && req.Action != "restore":
+		http.Error(w, "Action must be approve, reject or restore", http.StatusBadRequest)
+		return
+	case len(req.IDs) == 0 || len(req.IDs) > maxBulkModeration:
+		http.Error(w, "ids must list 1-200 pictures", http.StatusBadRequest)
+		return
+	}
+
+	resp := BulkModerationResponse{Done: []string{}, Failed: map[string]string{}}
+	by := moderatorName(r)
+	for _, id := range req.IDs {
+		if _, err := moderatePicture(req.Action, id, by); err != nil {
+			_, msg := moderationError(err)
+			resp.Failed[id] = msg
+			continue
+		}
+		resp.Done = append(resp.Done, id)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// moderatePicture applies a moderation action to a picture and tells
+// connected clients:
+//   - approve puts a pending picture on the wall as a new upload, or
+//     dismisses the reports of a visible one
+//   - reject takes a picture off the wall and resolves its reports
+//   - restore puts a rejected picture back on the wall
+func moderatePicture(action, id, by string) (*Picture, error) {
+	pic, err := db.GetPicture(id)
+	if err != nil {
+		return nil, err
+	}
+	wasHidden, wasPending := pic.Hidden, pic.Moderation == moderationPending
+	switch action {
+	case "approve":
+		if pic.Moderation == moderationRejected {
+			return nil, errPictureRejected
+		}
+		pic.Hidden = pic.Hidden && !wasPending
+	case "reject":
+		pic.Hidden = true
+		pic.Moderation = moderationRejected
+	case "restore":
+		if pic.Moderation != moderationRejected {
+			return nil, errPictureNotRejected
+		}
+		pic.Hidden = false
+	}
+	if action != "reject" {
+		pic.Moderation = ""
+	}
+	if err := db.ModeratePicture(id, pic.Hidden, pic.Moderation, by, time.Now()); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case wasHidden && !pic.Hidden && wasPending:
+		hub.publishPictureAdded(pic)
+		recordUpload(pic)
+		notifyUpload(pic)
+	case wasHidden != pic.Hidden:
+		hub.publishVisibility(pic)
+	}
+	logInfo("picture %s %s by %s (event=%s)", pic.ID, action, by, pic.EventID)
+	if action == "reject" {
+		checkAutoBan(pic.DeviceID)
+	}
+	return pic, nil
+}
+
+// moderationError maps an error of moderatePicture to a status and message.
+func moderationError(err error) (int, string) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return http.StatusNotFound, "Picture not found"
+	case errors.Is(err, errPictureRejected):
+		return http.StatusConflict, "Picture was rejected; restore it instead"
+	case errors.Is(err, errPictureNotRejected):
+		return http.StatusConflict, "Picture isn't rejected"
+	default:
+		logError("moderate picture failed: %v", err)
+		return http.StatusInternalServerError, "Error updating picture"
+	}
+}
+
+// handleListPendingComments lists the request's event's comments waiting
+// for approval, oldest first.
+func handleListPendingComments(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	comments, err := db.GetPendingComments(event)
+	if err != nil {
+		logError("get pending comments failed: %v", err)
+		http.Error(w, "Error fetching comments", http.StatusInternalServerError)
+		return
+	}
+	if comments == nil {
+		comments = []*Comment{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comments)
+}
+
+// handleModerateComment approves a pending comment, broadcasting it as if
+// it were new, or rejects it. Rejected comments are kept, never shown.
+func handleModerateComment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	comment, err := db.GetComment(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("get comment failed: %v", err)
+		http.Error(w, "Error updating comment", http.StatusInternalServerError)
+		return
+	}
+	if comment.Moderation != moderationPending {
+		http.Error(w, "Comment isn't pending", http.StatusConflict)
+		return
+	}
+	comment.Moderation = ""
+	if vars["action"] == "reject" {
+		comment.Moderation = moderationRejected
+	}
+	by := moderatorName(r)
+	err = db.ModerateComment(id, comment.Moderation, by, time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		// Another moderator got there first
+		http.Error(w, "Comment isn't pending", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logError("moderate comment failed: %v", err)
+		http.Error(w, "Error updating comment", http.StatusInternalServerError)
+		return
+	}
+	if comment.Moderation == "" {
+		hub.publishComment(comment)
+		if pic, err := db.GetPicture(comment.PictureID); err == nil && !pic.Hidden {
+			recordComment(comment, pic)
+		}
+	}
+	logInfo("comment %d on picture %s %s by %s (event=%s)", id, comment.PictureID, vars["action"], by, comment.EventID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comment)
+}
+
+// handleListPendingGuestbook lists the request's event's guestbook
+// messages waiting for approval, oldest first.
+func handleListPendingGuestbook(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	messages, err := db.GetPendingGuestbookMessages(event)
+	if err != nil {
+		logError("get pending guestbook failed: %v", err)
+		http.Error(w, "Error fetching guestbook", http.StatusInternalServerError)
+		return
+	}
+	if messages == nil {
+		messages = []*GuestbookMessage{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// handleModerateGuestbookMessage approves a pending guestbook message,
+// broadcasting it as if it were new, or rejects it.
+func handleModerateGuestbookMessage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	msg, err := db.GetGuestbookMessage(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("get guestbook message failed: %v", err)
+		http.Error(w, "Error updating message", http.StatusInternalServerError)
+		return
+	}
+	if msg.Moderation != moderationPending {
+		http.Error(w, "Message isn't pending", http.StatusConflict)
+		return
+	}
+	msg.Moderation = ""
+	if vars["action"] == "reject" {
+		msg.Moderation = moderationRejected
+	}
+	by := moderatorName(r)
+	err = db.ModerateGuestbookMessage(id, msg.Moderation, by, time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Message isn't pending", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logError("moderate guestbook message failed: %v", err)
+		http.Error(w, "Error updating message", http.StatusInternalServerError)
+		return
+	}
+	if msg.Moderation == "" {
+		hub.publishGuestbook(msg)
+	}
+	logInfo("guestbook message %d %s by %s (event=%s)", id, vars["action"], by, msg.EventID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+// handleListPendingCaptions lists the request's event's pictures whose
+// caption waits for approval, oldest first.
+func handleListPendingCaptions(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	pictures, err := db.GetPendingCaptions(event)
+	if err != nil {
+		logError("get pending captions failed: %v", err)
+		http.Error(w, "Error fetching pictures", http.StatusInternalServerError)
+		return
+	}
+	held := make([]*HeldCaption, 0, len(pictures))
+	for _, pic := range pictures {
+		held = append(held, &HeldCaption{Picture: pic, PendingCaption: pic.PendingCaption})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(held)
+}
+
+// handleModerateCaption puts a picture's pending caption on it, telling
+// clients if the picture is on the wall, or drops the caption.
+func handleModerateCaption(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, approved := vars["id"], vars["action"] == "approve"
+	pic, err := db.GetPicture(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("get picture failed: %v", err)
+		http.Error(w, "Error updating picture", http.StatusInternalServerError)
+		return
+	}
+	err = db.ModerateCaption(id, approved)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Picture has no pending caption", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logError("moderate caption failed: %v", err)
+		http.Error(w, "Error updating picture", http.StatusInternalServerError)
+		return
+	}
+	if approved {
+		pic.Caption = pic.PendingCaption
+		if !pic.Hidden {
+			hub.publishPictureUpdated(pic.ID, pic)
+		}
+	}
+	pic.PendingCaption = ""
+	logInfo("caption of picture %s %s by %s (event=%s)", id, vars["action"], moderatorName(r), pic.EventID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pic)
+}
+
+// moderatorName names who made a moderation decision: the signed-in user,
+// or "admin token".
+func moderatorName(r *http.Request) string {
+	if user := userFromRequest(r); user != nil && requestToken(r) == "" {
+		return user.Username
+	}
+	return "admin token"
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"time"
+)
+
+// Pictures uploaded within the last NEW_PICTURE_MINUTES are new: the
+// database sets IsNew on them as it reads them, so the grid can highlight
+// them without comparing uploadedAt to a phone's clock that may be minutes
+// off. When a picture stops being new, a pictures_aged message tells the
+// clients to drop the highlight, and the cached galleries are read again.
+var newPictureWindow reloadable[time.Duration]
+
+// newPictureSweep is how often pictures that stopped being new are looked
+// for; the pictures_aged message may come this late.
+const newPictureSweep = 5 * time.Second
+
+// PicturesAgedPayload is the payload of a pictures_aged message: the
+// pictures of the event that stopped being new.
+type PicturesAgedPayload struct {
+	IDs []string `json:"ids"`
+}
+
+// isNew reports whether p is new at now.
+func (p *Picture) isNew(now time.Time) bool {
+	window := newPictureWindow.Load()
+	return window > 0 && now.Sub(p.UploadedAt) < window
+}
+
+// newPicturesLoop sends a pictures_aged message for the pictures that
+// stopped being new since the last sweep, every newPictureSweep. Every
+// instance runs its own loop, so pictures_aged messages are delivered to
+// local clients only.
+func (h *Hub) newPicturesLoop() {
+	ticker := time.NewTicker(newPictureSweep)
+	defer ticker.Stop()
+	last := time.Now()
+	for now := range ticker.C {
+		h.ageNewPictures(last, now)
+		last = now
+	}
+}
+
+// ageNewPictures broadcasts the visible pictures that stopped being new
+// after since and by now, by event.
+func (h *Hub) ageNewPictures(since, now time.Time) {
+	window := newPictureWindow.Load()
+	if window == 0 {
+		return
+	}
+	pictures, err := db.GetPicturesUploadedBetween(since.Add(-window), now.Add(-window))
+	if err != nil {
+		logError("get aged pictures failed: %v", err)
+		return
+	}
+	if len(pictures) == 0 {
+		return
+	}
+	// The cached galleries still have IsNew set on them
+	db.PicturesChanged()
+	aged := make(map[string][]string)
+	for _, pic := range pictures {
+		aged[pic.EventID] = append(aged[pic.EventID], pic.ID)
+	}
+	for event, ids := range aged {
+		h.broadcast <- &Envelope{Type: msgPicturesAged, Payload: &PicturesAgedPayload{IDs: ids}, event: event, queuedAt: time.Now()}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Organizers backstage can follow an event in a chat channel instead of
+// the logs: new pictures on the wall, reported pictures, failed
+// conversions, the disk running low and like milestones are posted to
+// SLACK_WEBHOOK_URL and DISCORD_WEBHOOK_URL, those of NOTIFY_EVENTS only.
+// Notices are queued and posted one at a time by runNotifier, so the
+// request or worker that raised one never waits on the chat service.
+
+// Kinds of notices, as listed in NOTIFY_EVENTS.
+const (
+	noticeUpload           = "upload"
+	noticeReport           = "report"
+	noticeConversionFailed = "conversion_failed"
+	noticeDiskLow          = "disk_low"
+	noticeMilestone        = "milestone"
+)
+
+const (
+	// webhookTimeout bounds each post to a webhook
+	webhookTimeout = 10 * time.Second
+	// notifyQueueSize is the number of notices queued before new ones are
+	// dropped
+	notifyQueueSize = 256
+	// notifyInterval spaces out posts, within Slack's and Discord's rate
+	// limits for a webhook
+	notifyInterval = time.Second
+)
+
+var (
+	// noticeKinds are the kinds NOTIFY_EVENTS may list
+	noticeKinds = []string{noticeUpload, noticeReport, noticeConversionFailed, noticeDiskLow, noticeMilestone}
+
+	slackWebhookURL   reloadable[string]
+	discordWebhookURL reloadable[string]
+	// notifyEvents are the kinds of NOTIFY_EVENTS
+	notifyEvents reloadable[map[string]bool]
+
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+	notices       = make(chan *notice, notifyQueueSize)
+
+	notificationsSent    atomic.Uint64
+	notificationFailures atomic.Uint64
+
+	// slackEscaper escapes the characters Slack reads as markup
+	slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+)
+
+// notice is a message for the organizers' chat.
+type notice struct {
+	kind string
+	// text is the message, plain text
+	text string
+	// link is where it points, and image a picture to show with it; both
+	// absolute URLs or ""
+	link  string
+	image string
+}
+
+// parseNoticeKinds parses NOTIFY_EVENTS, comma-separated notice kinds.
+func parseNoticeKinds(raw string) (map[string]bool, error) {
+	kinds := map[string]bool{}
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !slices.Contains(noticeKinds, field) {
+			return nil, fmt.Errorf("unknown notice kind %q", field)
+		}
+		kinds[field] = true
+	}
+	return kinds, nil
+}
+
+// notify queues a notice for the chat webhooks, if any is set and its kind
+// is one of NOTIFY_EVENTS. A full queue drops it.
+func notify(n *notice) {
+	if slackWebhookURL.Load() == "" && discordWebhookURL.Load() == "" {
+		return
+	}
+	if !notifyEvents.Load()[n.kind] {
+		return
+	}
+	select {
+	case notices <- n:
+	default:
+		notificationFailures.Add(1)
+		logWarn("notification queue full, dropped %s notice", n.kind)
+	}
+}
+
+// absolutePublicURL makes a URL served by us absolute with PUBLIC_URL. It
+// returns "" for a path when PUBLIC_URL isn't set, as chat services can't
+// fetch it.
+func absolutePublicURL(u string) string {
+	if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
+		return u
+	}
+	if publicURL == "" || !strings.HasPrefix(u, "/") {
+		return ""
+	}
+	return publicURL + u
+}
+
+// notifyUpload tells the organizers a picture went on the wall.
+func notifyUpload(pic *Picture) {
+	text := "📷 New picture on the wall of " + pic.EventID
+	if pic.UploadedBy != "" {
+		text += " by " + pic.UploadedBy
+	}
+	if pic.Caption != "" {
+		text += ": “" + pic.Caption + "”"
+	}
+	u := absolutePublicURL(pic.URL)
+	notify(&notice{kind: noticeUpload, text: text, link: u, image: u})
+}
+
+// notifyReport tells the organizers a picture was reported. It isn't
+// linked, so that the chat doesn't show it.
+func notifyReport(pic *Picture, reason string) {
+	notify(&notice{
+		kind: noticeReport,
+		text: fmt.Sprintf("🚩 A picture of %s was reported as %s; review it in the moderation dashboard", pic.EventID, reason),
+	})
+}
+
+// notifyConversionFailed tells the organizers an upload couldn't be
+// converted and won't be shown.
+func notifyConversionFailed(task *ConversionTask, err error) {
+	notify(&notice{
+		kind: noticeConversionFailed,
+		text: fmt.Sprintf("⚠️ Conversion of %s for %s failed: %v", task.OriginalName, task.EventID, err),
+	})
+}
+
+// runNotifier posts queued notices until stop is closed, then drops those
+// left.
+func runNotifier(stop <-chan struct{}) {
+	for {
+		select {
+		case n := <-notices:
+			postNotice(n)
+		case <-stop:
+			return
+		}
+		select {
+		case <-time.After(notifyInterval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// postNotice posts a notice to the chat webhooks. Failures are logged and
+// counted; they aren't retried.
+func postNotice(n *notice) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	if u := slackWebhookURL.Load(); u != "" {
+		if err := postJSON(ctx, u, slackMessage(n)); err != nil {
+			notificationFailures.Add(1)
+			logWarn("slack %s notice: %v", n.kind, err)
+		} else {
+			notificationsSent.Add(1)
+		}
+	}
+	if u := discordWebhookURL.Load(); u != "" {
+		if err := postJSON(ctx, u, discordMessage(n)); err != nil {
+			notificationFailures.Add(1)
+			logWarn("discord %s notice: %v", n.kind, err)
+		} else {
+			notificationsSent.Add(1)
+		}
+	}
+}
+
+// slackMessage is the body of a Slack incoming webhook for n.
+func slackMessage(n *notice) map[string]interface{} {
+	text := slackEscaper.Replace(n.text)
+	if n.link != "" {
+		text += fmt.Sprintf(" <%s|View>", n.link)
+	}
+	msg := map[string]interface{}{"text": text}
+	if n.image != "" {
+		msg["blocks"] = []map[string]interface{}{
+			{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": text}},
+			{"type": "image", "image_url": n.image, "alt_text": "picture"},
+		}
+	}
+	return msg
+}
+
+// discordMessage is the body of a Discord webhook for n. Mentions in the
+// text aren't resolved.
+func discordMessage(n *notice) map[string]interface{} {
+	text := n.text
+	if n.link != "" && n.image == "" {
+		text += " " + n.link
+	}
+	msg := map[string]interface{}{
+		"content":          text,
+		"allowed_mentions": map[string][]string{"parse": {}},
+	}
+	if n.image != "" {
+		msg["embeds"] = []map[string]interface{}{
+			{"title": "View", "url": n.link, "image": map[string]string{"url": n.image}},
+		}
+	}
+	return msg
+}
+
+// postJSON posts body as JSON to target and checks for a 2xx answer.
+// Errors leave the URL out: webhook URLs are secrets.
+func postJSON(ctx context.Context, target string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return errors.New("invalid webhook URL")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Users can also sign in with an OAuth provider, Google to start, so that
+// corporate events can require sign-in without a password to manage. The
+// first sign-in with an identity creates a viewer account named after its
+// email address; signing in while already signed in links the identity to
+// that account instead. The user's real name is taken from the provider
+// at every sign-in, and their uploads are attributed to it.
+// OAUTH_GOOGLE_DOMAINS keeps out addresses outside the company. Providers
+// redirect back to PUBLIC_URL/api/auth/oauth/{provider}/callback.
+const (
+	oauthStateCookieName = "picsapp_oauth"
+	// oauthStateTTL bounds the time a user takes at the provider
+	oauthStateTTL = 10 * time.Minute
+	// oauthTimeout bounds a request to the provider
+	oauthTimeout = 10 * time.Second
+	// maxUserNameLength bounds the real name kept for a user, in
+	// characters
+	maxUserNameLength = 100
+)
+
+var (
+	oauthProviders map[string]*oauthProvider
+
+	oauthClient = &http.Client{Timeout: oauthTimeout}
+
+	oauthLogins   atomic.Uint64
+	oauthFailures atomic.Uint64
+
+	errIdentityTaken = errors.New("identity linked to another user")
+)
+
+// oauthProvider is an OAuth 2.0 provider users sign in with through the
+// authorization code flow.
+type oauthProvider struct {
+	// name is shown on the sign-in button
+	name        string
+	authURL     string
+	tokenURL    string
+	userInfoURL string
+	scope       string
+
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	// domains are the email domains allowed to sign in, all if empty
+	domains []string
+}
+
+// oauthProfile is the part of a provider's OpenID Connect userinfo picsapp
+// uses.
+type oauthProfile struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// AuthProvider is a provider users can sign in with.
+type AuthProvider struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// AuthConfig is the response of GET /api/auth/config.
+type AuthConfig struct {
+	Providers     []AuthProvider `json:"providers"`
+	AllowSignup   bool           `json:"allowSignup"`
+	RequireSignin bool           `json:"requireSignin"`
+}
+
+// configuredOAuthProviders returns the providers cfg has client
+// credentials for, by ID.
+func configuredOAuthProviders(cfg *Config) map[string]*oauthProvider {
+	providers := map[string]*oauthProvider{}
+	if cfg.OAuthGoogleClientID != "" {
+		providers["google"] = &oauthProvider{
+			name:         "Google",
+			authURL:      "https://accounts.google.com/o/oauth2/v2/auth",
+			tokenURL:     "https://oauth2.googleapis.com/token",
+			userInfoURL:  "https://openidconnect.googleapis.com/v1/userinfo",
+			scope:        "openid email profile",
+			clientID:     cfg.OAuthGoogleClientID,
+			clientSecret: cfg.OAuthGoogleClientSecret,
+			redirectURL:  strings.TrimSuffix(cfg.PublicURL, "/") + "/api/auth/oauth/google/callback",
+			domains:      parseDomains(strings.ToLower(cfg.OAuthGoogleDomains)),
+		}
+	}
+	return providers
+}
+
+// allows reports whether an email address may sign in with p.
+func (p *oauthProvider) allows(email string) bool {
+	if len(p.domains) == 0 {
+		return true
+	}
+	_, domain, ok := strings.Cut(strings.ToLower(email), "@")
+	if !ok {
+		return false
+	}
+	for _, d := range p.domains {
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+// profile exchanges an authorization code for an access token and fetches
+// the user's profile with it.
+func (p *oauthProvider) profile(ctx context.Context, code string) (*oauthProfile, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"client_id":     {p.clientID},
+		"client_secret": {p.clientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := oauthRequest(req, &token); err != nil {
+		return nil, fmt.Errorf("token: %w", err)
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("token: no access_token")
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, p.userInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	var profile oauthProfile
+	if err := oauthRequest(req, &profile); err != nil {
+		return nil, fmt.Errorf("userinfo: %w", err)
+	}
+	if profile.Subject == "" {
+		return nil, errors.New("userinfo: no sub")
+	}
+	return &profile, nil
+}
+
+// oauthRequest sends a request to a provider and decodes its JSON
+// response into v.
+func oauthRequest(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(v)
+}
+
+// localRedirect returns next if it is a path on this server, and "/"
+// otherwise, so that sign-ins can't be used to send users elsewhere.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// handleAuthConfig tells the web app how users can sign in.
+func handleAuthConfig(w http.ResponseWriter, r *http.Request) {
+	resp := AuthConfig{Providers: []AuthProvider{}, AllowSignup: allowSignup, RequireSignin: requireSignin.Load()}
+	for id, p := range oauthProviders {
+		resp.Providers = append(resp.Providers, AuthProvider{ID: id, Name: p.name})
+	}
+	sort.Slice(resp.Providers, func(i, j int) bool { return resp.Providers[i].ID < resp.Providers[j].ID })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleOAuthLogin sends the browser to a provider's sign-in page. The
+// state parameter, kept in a short-lived cookie with the page to return
+// to, ties the callback to this browser.
+func handleOAuthLogin(w http.ResponseWriter, r *http.Request) {
+	p, ok := oauthProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		http.Error(w, "Unknown sign-in provider", http.StatusNotFound)
+		return
+	}
+	state, err := randomHex(16)
+	if err != nil {
+		logError("generate oauth state failed: %v", err)
+		http.Error(w, "Error signing in", http.StatusInternalServerError)
+		return
+	}
+	next := localRedirect(r.URL.Query().Get("next"))
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookieName,
+		Value:    state + "." + base64.RawURLEncoding.EncodeToString([]byte(next)),
+		Path:     "/api/auth/oauth/",
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || sessionCookieSecure,
+		// Sent with the provider's top-level redirect back
+		SameSite: http.SameSiteLaxMode,
+	})
+	q := url.Values{
+		"client_id":     {p.clientID},
+		"redirect_uri":  {p.redirectURL},
+		"response_type": {"code"},
+		"scope":         {p.scope},
+		"state":         {state},
+		"prompt":        {"select_account"},
+	}
+	http.Redirect(w, r, p.authURL+"?"+q.Encode(), http.StatusFound)
+}
+
+// handleOAuthCallback completes a sign-in: it checks the state, fetches
+// the user's profile from the provider, finds, links or creates their
+// account, starts a session and returns to the page the sign-in started
+// from.
+func handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["provider"]
+	p, ok := oauthProviders[id]
+	if !ok {
+		http.Error(w, "Unknown sign-in provider", http.StatusNotFound)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookieName,
+		Path:     "/api/auth/oauth/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || sessionCookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	q := r.URL.Query()
+	cookie, err := r.Cookie(oauthStateCookieName)
+	if err != nil {
+		http.Error(w, "Sign-in expired; please try again", http.StatusBadRequest)
+		return
+	}
+	state, encodedNext, _ := strings.Cut(cookie.Value, ".")
+	next, err := base64.RawURLEncoding.DecodeString(encodedNext)
+	if err != nil || !tokenMatches(q.Get("state"), state) {
+		http.Error(w, "Sign-in expired; please try again", http.StatusBadRequest)
+		return
+	}
+	if q.Get("error") != "" || q.Get("code") == "" {
+		http.Error(w, "Sign-in was cancelled", http.StatusUnauthorized)
+		return
+	}
+
+	profile, err := p.profile(r.Context(), q.Get("code"))
+	if err != nil {
+		oauthFailures.Add(1)
+		logError("%s sign-in failed: %v", id, err)
+		http.Error(w, fmt.Sprintf("Couldn't sign in with %s; please try again", p.name), http.StatusBadGateway)
+		return
+	}
+	if !profile.EmailVerified || !p.allows(profile.Email) {
+		oauthFailures.Add(1)
+		logWarn("%s sign-in refused for %s", id, profile.Email)
+		http.Error(w, "This account isn't allowed to sign in", http.StatusForbidden)
+		return
+	}
+	user, err := oauthUser(r, id, profile)
+	if errors.Is(err, errIdentityTaken) {
+		http.Error(w, fmt.Sprintf("This %s account is linked to another user", p.name), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logError("%s sign-in failed: %v", id, err)
+		http.Error(w, "Error signing in", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	if err := db.DeleteExpiredSessions(now); err != nil {
+		logWarn("delete expired sessions: %v", err)
+	}
+	if err := startSession(w, r, user); err != nil {
+		logError("start session failed: %v", err)
+		http.Error(w, "Error signing in", http.StatusInternalServerError)
+		return
+	}
+	if err := db.TouchUserLogin(user.ID, now); err != nil {
+		logWarn("record login of user %s: %v", user.Username, err)
+	}
+	oauthLogins.Add(1)
+	logInfo("user %s signed in with %s", user.Username, id)
+	http.Redirect(w, r, localRedirect(string(next)), http.StatusFound)
+}
+
+// oauthUser returns the account to sign a provider identity in to and
+// links the identity to it: the signed-in user's, else the account the
+// identity was linked to before, else a new one. The account's name is
+// updated from the profile.
+func oauthUser(r *http.Request, provider string, profile *oauthProfile) (*User, error) {
+	user := userFromRequest(r)
+	if user == nil {
+		var err error
+		user, err = db.GetUserByIdentity(provider, profile.Subject)
+		if err == sql.ErrNoRows {
+			user, err = createOAuthUser(profile.Email)
+			if err == nil {
+				logInfo("user %s signed up with %s", user.Username, provider)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := db.AddUserIdentity(provider, profile.Subject, profile.Email, user.ID, time.Now()); err != nil {
+		return nil, err
+	}
+
+	name := strings.TrimSpace(profile.Name)
+	if utf8.RuneCountInString(name) > maxUserNameLength {
+		name = string([]rune(name)[:maxUserNameLength])
+	}
+	if name != "" && name != user.Name {
+		if err := db.SetUserName(user.ID, name); err != nil {
+			return nil, err
+		}
+		user.Name = name
+	}
+	return user, nil
+}
+
+// createOAuthUser adds a viewer account without a password, named after
+// the local part of an email address: "jane.doe" for jane.doe@example.com,
+// or "jane.doe-2" if that is taken.
+func createOAuthUser(email string) (*User, error) {
+	local, _, _ := strings.Cut(email, "@")
+	base := strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-' {
+			return c
+		}
+		return -1
+	}, local)
+	if len(base) > 28 {
+		base = base[:28]
+	}
+	for len(base) < 3 {
+		base += "_"
+	}
+	for i := 1; i <= 100; i++ {
+		username := base
+		if i > 1 {
+			username = fmt.Sprintf("%s-%d", base, i)
+		}
+		user := &User{Username: username, Role: RoleViewer, CreatedAt: time.Now().UTC().Truncate(time.Second)}
+		// An empty hash never matches, so the account can't sign in with a
+		// password
+		err := db.AddUser(user, "")
+		if errors.Is(err, errUsernameTaken) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+	return nil, errUsernameTaken
+}
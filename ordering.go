@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Slideshow orderings for /api/presentation.
+const (
+	// orderLikes shows the most liked pictures first (the leaderboard).
+	orderLikes = "likes"
+	// orderShuffle is a random order in which recent uploads tend to come
+	// early.
+	orderShuffle = "shuffle"
+	// orderFair takes pictures from each upload window in turn, so one
+	// burst of uploads can't fill a long stretch of slides.
+	orderFair = "fair"
+	// orderWeighted is a random order in which liked pictures tend to come
+	// early, without hiding the rest.
+	orderWeighted = "weighted"
+)
+
+var orderings = map[string]bool{
+	orderLikes:    true,
+	orderShuffle:  true,
+	orderFair:     true,
+	orderWeighted: true,
+}
+
+const (
+	// recencyBoost and recencyHalfLife shape the shuffle: a new upload is
+	// 1+recencyBoost times as likely to be drawn next as an old one, and
+	// the extra weight halves every recencyHalfLife.
+	recencyBoost    = 4.0
+	recencyHalfLife = 30 * time.Minute
+
+	// fairWindow is the upload window orderFair takes turns between.
+	fairWindow = 10 * time.Minute
+)
+
+// orderPictures reorders pictures, which must be sorted by likes, for the
+// given ordering. Random orderings draw a new order on every call.
+func orderPictures(pictures []*Picture, ordering string, now time.Time) []*Picture {
+	switch ordering {
+	case orderShuffle:
+		return weightedShuffle(pictures, func(p *Picture) float64 {
+			age := now.Sub(p.UploadedAt)
+			if age < 0 {
+				age = 0
+			}
+			return 1 + recencyBoost*math.Exp2(-float64(age)/float64(recencyHalfLife))
+		})
+	case orderWeighted:
+		return weightedShuffle(pictures, func(p *Picture) float64 {
+			return 1 + float64(p.Likes)
+		})
+	case orderFair:
+		return roundRobin(pictures)
+	default:
+		return pictures
+	}
+}
+
+// weightedShuffle returns a random permutation in which each remaining
+// picture is drawn next with probability proportional to its weight
+// (Efraimidis-Spirakis sampling).
+func weightedShuffle(pictures []*Picture, weight func(*Picture) float64) []*Picture {
+	keys := make(map[*Picture]float64, len(pictures))
+	for _, p := range pictures {
+		keys[p] = math.Pow(rand.Float64(), 1/weight(p))
+	}
+	shuffled := append([]*Picture(nil), pictures...)
+	sort.SliceStable(shuffled, func(i, j int) bool {
+		return keys[shuffled[i]] > keys[shuffled[j]]
+	})
+	return shuffled
+}
+
+// roundRobin groups pictures by fairWindow of upload time and takes one
+// from each group in turn, newest group first. Within a group the most
+// liked picture goes first.
+func roundRobin(pictures []*Picture) []*Picture {
+	groups := make(map[int64][]*Picture)
+	var windows []int64
+	for _, p := range pictures {
+		w := p.UploadedAt.UnixNano() / int64(fairWindow)
+		if _, ok := groups[w]; !ok {
+			windows = append(windows, w)
+		}
+		groups[w] = append(groups[w], p)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i] > windows[j] })
+
+	ordered := make([]*Picture, 0, len(pictures))
+	for round := 0; len(ordered) < len(pictures); round++ {
+		for _, w := range windows {
+			if round < len(groups[w]) {
+				ordered = append(ordered, groups[w][round])
+			}
+		}
+	}
+	return ordered
+}
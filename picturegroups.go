@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Archive views show an event's pictures in sections of an hour or a day
+// ("8 PM — 143 photos"). The groups and their counts are worked out by
+// SQLite, so browsers don't bucket thousands of pictures themselves.
+
+const (
+	groupByHour = "hour"
+	groupByDay  = "day"
+
+	// minGroupOffset and maxGroupOffset bound the tz of a grouping, in
+	// minutes east of UTC: UTC-12:00 to UTC+14:00
+	minGroupOffset = -12 * 60
+	maxGroupOffset = 14 * 60
+)
+
+// PictureGroup is the pictures of an event uploaded in one hour or day.
+// Count is how many there are; Pictures lists them newest first, or the
+// newest of them if the request capped them.
+type PictureGroup struct {
+	Start    time.Time  `json:"start"`
+	Count    int        `json:"count"`
+	Pictures []*Picture `json:"pictures"`
+}
+
+// handlePictureGroups returns the visible pictures of the request's event
+// grouped by the hour or day (?by=) they were uploaded, newest first. ?tz=
+// is the viewer's offset from UTC in minutes, so that groups start on the
+// hour of their clock, and ?per= caps the pictures listed in each group.
+func handlePictureGroups(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	by := query.Get("by")
+	if by != groupByHour && by != groupByDay {
+		http.Error(w, "by must be hour or day", http.StatusBadRequest)
+		return
+	}
+	offset := 0
+	if v := query.Get("tz"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minGroupOffset || n > maxGroupOffset {
+			http.Error(w, "Invalid tz", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	per := 0
+	if v := query.Get("per"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid per", http.StatusBadRequest)
+			return
+		}
+		per = n
+	}
+
+	groups, err := db.GetPictureGroups(event, by == groupByDay, offset, per)
+	if err != nil {
+		logError("get picture groups failed: %v", err)
+		http.Error(w, "Error fetching pictures", http.StatusInternalServerError)
+		return
+	}
+	if groups == nil {
+		groups = []*PictureGroup{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
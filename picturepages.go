@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// A snapshot of a whole gallery can be megabytes in one frame, more than a
+// phone on venue Wi-Fi takes in before its send queue fills up. Snapshots
+// carry the SNAPSHOT_TOP most liked pictures and the SNAPSHOT_NEWEST newest
+// of the others; clients ask for the rest of the likes ordering with more
+// messages, or pages of /api/presentation.
+
+// actionMore is the client message type asking for a page of the gallery.
+const actionMore = "more"
+
+// maxMorePictures is the most pictures of a pictures reply.
+const maxMorePictures = 100
+
+var (
+	snapshotTop    int
+	snapshotNewest int
+)
+
+var errPicturesUnavailable = errors.New("pictures unavailable")
+
+// MorePayload is the payload of a more message: a page of the event's
+// pictures, most liked first. Limit defaults to maxMorePictures, which is
+// also the most it can be.
+type MorePayload struct {
+	Offset int `json:"offset"`
+	Limit  int `json:"limit,omitempty"`
+}
+
+// PicturesPayload answers a more message. Total is the size of the whole
+// gallery; an empty page at Offset means the client has every picture.
+type PicturesPayload struct {
+	Offset   int        `json:"offset"`
+	Total    int        `json:"total"`
+	Pictures []*Picture `json:"pictures"`
+}
+
+func init() {
+	inboundHandlers[actionMore] = inboundHandler{minRole: RoleViewer, fn: handleMoreAction}
+}
+
+// snapshot returns the pictures of a WebSocket snapshot of a gallery
+// sorted by likes: its first snapshotTop pictures, then the newest
+// snapshotNewest of the others, newest first. ranked is how many of them
+// are the head of the likes ordering, where paging carries on. It is
+// worked out once per gallery.
+func (g *gallery) snapshot() (pictures []*Picture, ranked int) {
+	g.snapshotOnce.Do(func() {
+		g.ranked = min(len(g.pictures), snapshotTop)
+		rest := append([]*Picture(nil), g.pictures[g.ranked:]...)
+		sort.SliceStable(rest, func(i, j int) bool {
+			return rest[i].UploadedAt.After(rest[j].UploadedAt)
+		})
+		rest = rest[:min(len(rest), snapshotNewest)]
+		g.snapshotPictures = append(append([]*Picture{}, g.pictures[:g.ranked]...), rest...)
+	})
+	return g.snapshotPictures, g.ranked
+}
+
+// handleMoreAction replies with a page of the client's event's pictures,
+// most liked first, read from the gallery cache like the snapshot.
+func handleMoreAction(c *client, payload json.RawMessage) error {
+	var more MorePayload
+	if err := json.Unmarshal(payload, &more); err != nil || more.Offset < 0 || more.Limit < 0 || more.Limit > maxMorePictures {
+		return errInvalidPayload
+	}
+	if more.Limit == 0 {
+		more.Limit = maxMorePictures
+	}
+	g, err := galleries.get(c.event, galleryByLikes)
+	if err != nil {
+		logError("get pictures for websocket page failed: %v", err)
+		return errPicturesUnavailable
+	}
+	start := min(more.Offset, len(g.pictures))
+	page := g.pictures[start:min(start+more.Limit, len(g.pictures))]
+	if page == nil {
+		page = []*Picture{}
+	}
+	c.reply(msgPictures, &PicturesPayload{Offset: start, Total: len(g.pictures), Pictures: page})
+	return nil
+}
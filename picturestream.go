@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+)
+
+// A gallery of a few thousand pictures is megabytes of JSON. Pages of
+// /api/presentation are streamed from the database, marshalling one picture
+// at a time as the rows are read. Other slideshows have to be loaded whole
+// to be ordered, shuffled or rotated, so they are held in memory but still
+// marshalled one at a time rather than into one buffer. Every gallery stops
+// at MAX_GALLERY_PICTURES, the most liked ones.
+
+// maxPresentationPage is the most pictures of a page of /api/presentation.
+const maxPresentationPage = 500
+
+// maxGalleryPictures caps the pictures of an event's gallery, slideshow
+// and pages.
+var maxGalleryPictures int
+
+// pictureStream writes pictures as a JSON array, one at a time.
+type pictureStream struct {
+	w     *bufio.Writer
+	out   sentWriter
+	count int
+}
+
+func newPictureStream(w io.Writer) *pictureStream {
+	s := &pictureStream{out: sentWriter{w: w}}
+	s.w = bufio.NewWriterSize(&s.out, 32<<10)
+	return s
+}
+
+// sent reports whether any of the array has left the buffer. Until then
+// the response can still be replaced by an error.
+func (s *pictureStream) sent() bool {
+	return s.out.sent
+}
+
+// sentWriter records whether anything was written through it.
+type sentWriter struct {
+	w    io.Writer
+	sent bool
+}
+
+func (w *sentWriter) Write(b []byte) (int, error) {
+	w.sent = true
+	return w.w.Write(b)
+}
+
+// write adds a picture to the array.
+func (s *pictureStream) write(p *Picture) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	sep := byte(',')
+	if s.count == 0 {
+		sep = '['
+	}
+	s.count++
+	s.w.WriteByte(sep)
+	_, err = s.w.Write(b)
+	return err
+}
+
+// close ends the array, with a newline as json.Encoder writes it, and
+// flushes it.
+func (s *pictureStream) close() error {
+	if s.count == 0 {
+		s.w.WriteByte('[')
+	}
+	s.w.WriteString("]\n")
+	return s.w.Flush()
+}
+
+// writePictures streams a list of pictures as a JSON array.
+func writePictures(w io.Writer, pictures []*Picture) error {
+	s := newPictureStream(w)
+	for _, p := range pictures {
+		if err := s.write(p); err != nil {
+			return err
+		}
+	}
+	return s.close()
+}
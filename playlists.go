@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxPlaylistSize bounds the number of pictures in one playlist.
+const maxPlaylistSize = 1000
+
+// Playlist is a curated selection of an event's pictures (e.g. "ceremony",
+// "party") shown by the slideshow in its own order. Names follow the
+// same rules as event IDs.
+type Playlist struct {
+	EventID   string    `json:"eventId"`
+	Name      string    `json:"name"`
+	Pictures  []string  `json:"pictures"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// PutPlaylistRequest is the body of PUT /api/playlists/{name}: the
+// playlist's pictures in slideshow order.
+type PutPlaylistRequest struct {
+	Pictures []string `json:"pictures"`
+}
+
+// PlaylistPayload is the payload of a playlist message, sent when a
+// playlist is saved or deleted so displays showing it refetch their order.
+type PlaylistPayload struct {
+	Name    string `json:"name"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// handleListPlaylists lists the request event's playlists.
+func handleListPlaylists(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	playlists, err := db.GetPlaylists(event)
+	if err != nil {
+		logError("get playlists failed: %v", err)
+		http.Error(w, "Error fetching playlists", http.StatusInternalServerError)
+		return
+	}
+	if playlists == nil {
+		playlists = []*Playlist{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(playlists)
+}
+
+// handlePutPlaylist creates a playlist of the request event or replaces its
+// pictures.
+func handlePutPlaylist(w http.ResponseWriter, r *http.Request) {
+	var req PutPlaylistRequest
+	event, ok := decodeEventRequest(w, r, &req, 256<<10)
+	if !ok {
+		return
+	}
+	if req.Pictures == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if !eventIDPattern.MatchString(name) {
+		http.Error(w, "Invalid playlist name", http.StatusBadRequest)
+		return
+	}
+	if len(req.Pictures) > maxPlaylistSize {
+		http.Error(w, fmt.Sprintf("A playlist holds at most %d pictures", maxPlaylistSize), http.StatusBadRequest)
+		return
+	}
+	seen := make(map[string]bool, len(req.Pictures))
+	for _, id := range req.Pictures {
+		if seen[id] {
+			http.Error(w, fmt.Sprintf("Duplicate picture %q", id), http.StatusBadRequest)
+			return
+		}
+		seen[id] = true
+		// Hidden pictures may be listed; they are skipped while hidden
+		if pic, err := db.GetPicture(id); err != nil || pic.EventID != event {
+			http.Error(w, fmt.Sprintf("Unknown picture %q", id), http.StatusBadRequest)
+			return
+		}
+	}
+
+	playlist := &Playlist{
+		EventID:   event,
+		Name:      name,
+		Pictures:  req.Pictures,
+		UpdatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if err := db.SavePlaylist(playlist); err != nil {
+		logError("save playlist failed: %v", err)
+		http.Error(w, "Error saving playlist", http.StatusInternalServerError)
+		return
+	}
+	hub.publish(event, msgPlaylist, &PlaylistPayload{Name: name})
+
+	logInfo("playlist %s saved with %d pictures (event=%s)", name, len(playlist.Pictures), event)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(playlist)
+}
+
+// handleDeletePlaylist deletes a playlist of the request event. If it was
+// the event's slideshow playlist, displays go back to every picture.
+func handleDeletePlaylist(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if err := db.DeletePlaylist(event, name); err == sql.ErrNoRows {
+		http.Error(w, "Playlist not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError("delete playlist failed: %v", err)
+		http.Error(w, "Error deleting playlist", http.StatusInternalServerError)
+		return
+	}
+
+	if settings := presentationSettings(event); settings.Playlist == name {
+		settings.Playlist = ""
+		if err := db.SavePresentationSettings(settings); err != nil {
+			logError("save presentation settings failed: %v", err)
+		} else {
+			hub.publishSettings(settings)
+		}
+	}
+	hub.publish(event, msgPlaylist, &PlaylistPayload{Name: name, Deleted: true})
+
+	logInfo("playlist %s deleted (event=%s)", name, event)
+	w.WriteHeader(http.StatusNoContent)
+}
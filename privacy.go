@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A guest can have everything they left at the event deleted: the pictures
+// they uploaded, in the trash too, with their files and kept originals,
+// their uploads still waiting for conversion, and their likes, comments,
+// reports and reactions. A signed-in user's account goes with them. The
+// device is the one of the request's cookie, or of a device token, the
+// value of that cookie, sent from elsewhere. No IP address or user agent
+// is stored of guests, except in bans, which are kept against abuse. The
+// response is a receipt, kept with its counts only, so it can be looked up
+// later without saying whose data it was.
+
+var privacyDeletions atomic.Uint64
+
+// PrivacyDeleteRequest is the body of POST /api/privacy/delete.
+type PrivacyDeleteRequest struct {
+	// DeviceToken is the value of a device's picsapp_device cookie; ""
+	// for the request's own device
+	DeviceToken string `json:"deviceToken,omitempty"`
+}
+
+// DeletionCounts counts what a deletion of personal data removed.
+type DeletionCounts struct {
+	Pictures       int `json:"pictures"`
+	PendingUploads int `json:"pendingUploads"`
+	Likes          int `json:"likes"`
+	Comments       int `json:"comments"`
+	Reports        int `json:"reports"`
+	Reactions      int `json:"reactions"`
+	Guestbook      int `json:"guestbook"`
+}
+
+// DeletionReceipt confirms a deletion of personal data.
+type DeletionReceipt struct {
+	ID        string    `json:"id"`
+	DeletedAt time.Time `json:"deletedAt"`
+	// Device and Account are whether a device's and an account's data
+	// were deleted
+	Device  bool           `json:"device"`
+	Account bool           `json:"account"`
+	Deleted DeletionCounts `json:"deleted"`
+}
+
+// deletePersonalFiles deletes the files of the pictures and uploads of a
+// deletion; the GC collects those that fail.
+func deletePersonalFiles(ctx context.Context, data *DeletedData) {
+	for _, pic := range data.Pictures {
+		if pic.FileKey != "" {
+			deleteUnusedFiles(ctx, pic.FileKey)
+		}
+	}
+	for _, o := range data.Originals {
+		if o.Location != "" {
+			if archive == nil {
+				logWarn("privacy: original %s is archived at %s, but ARCHIVE_BUCKET isn't set", o.Key, o.Location)
+			} else if err := archive.remove(ctx, o.Location); err != nil {
+				logWarn("privacy: remove archived original %s: %v", o.Location, err)
+			}
+			continue
+		}
+		if err := originalStore.Delete(ctx, o.Key); err != nil {
+			logWarn("privacy: remove original %s: %v", o.Key, err)
+		}
+	}
+	for _, path := range data.Uploads {
+		store, key, err := storedAt(path)
+		if err != nil {
+			logWarn("privacy: remove upload: %v", err)
+			continue
+		}
+		if err := store.Delete(ctx, key); err != nil {
+			logWarn("privacy: remove upload %s: %v", path, err)
+		}
+	}
+}
+
+// handlePrivacyDelete deletes the personal data of the request's device,
+// or of the device of a token, and of its signed-in user, and returns a
+// receipt.
+func handlePrivacyDelete(w http.ResponseWriter, r *http.Request) {
+	var req PrivacyDeleteRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	deviceID, own := "", false
+	if req.DeviceToken != "" {
+		if deviceID = verifyDevice(req.DeviceToken); deviceID == "" {
+			http.Error(w, "Invalid device token", http.StatusBadRequest)
+			return
+		}
+	} else if d := deviceFromRequest(r); d.known {
+		deviceID, own = d.id, true
+	}
+	user := userFromRequest(r)
+	var userID int64
+	if user != nil {
+		userID = user.ID
+	}
+	if deviceID == "" && userID == 0 {
+		http.Error(w, "Send a device token or sign in", http.StatusBadRequest)
+		return
+	}
+	if user != nil && user.Role == RoleAdmin {
+		admins, err := db.CountUsersWithRole(RoleAdmin)
+		if err != nil {
+			logError("count admins failed: %v", err)
+			http.Error(w, "Error deleting data", http.StatusInternalServerError)
+			return
+		}
+		if admins <= 1 {
+			http.Error(w, "The last admin can't delete their account", http.StatusConflict)
+			return
+		}
+	}
+
+	// Their pictures in the trash go for good first, without waiting for
+	// TRASH_HOURS
+	trashed, err := db.GetTrashOf(deviceID, userID)
+	if err != nil {
+		logError("get trashed pictures failed: %v", err)
+		http.Error(w, "Error deleting data", http.StatusInternalServerError)
+		return
+	}
+	for _, t := range trashed {
+		if err := purgeTrashedPicture(r.Context(), t); err != nil {
+			logError("purge trashed picture failed: %v", err)
+			http.Error(w, "Error deleting data", http.StatusInternalServerError)
+			return
+		}
+	}
+	data, err := db.DeletePersonalData(deviceID, userID)
+	if err != nil {
+		logError("delete personal data failed: %v", err)
+		http.Error(w, "Error deleting data", http.StatusInternalServerError)
+		return
+	}
+	for _, pic := range data.Pictures {
+		if !pic.Hidden {
+			pic.Hidden = true
+			hub.publishVisibility(pic)
+		}
+	}
+	for _, msg := range data.Guestbook {
+		if msg.Moderation == "" {
+			hub.publishGuestbookRemoved(msg)
+		}
+	}
+	deletePersonalFiles(r.Context(), data)
+
+	id, err := randomHex(16)
+	if err != nil {
+		logError("new receipt: %v", err)
+		http.Error(w, "Error deleting data", http.StatusInternalServerError)
+		return
+	}
+	receipt := &DeletionReceipt{
+		ID:        id,
+		DeletedAt: time.Now().UTC().Truncate(time.Second),
+		Device:    deviceID != "",
+		Account:   data.Account,
+		Deleted: DeletionCounts{
+			Pictures:       len(data.Pictures) + len(trashed),
+			PendingUploads: data.PendingUploads,
+			Likes:          data.Likes,
+			Comments:       data.Comments,
+			Reports:        data.Reports,
+			Reactions:      data.Reactions,
+			Guestbook:      len(data.Guestbook),
+		},
+	}
+	if err := db.AddDeletionReceipt(receipt); err != nil {
+		logWarn("store deletion receipt %s: %v", receipt.ID, err)
+	}
+	privacyDeletions.Add(1)
+	logInfo("privacy: deletion %s removed %d pictures, %d pending uploads, %d likes, %d comments, %d reports, %d reactions and %d guestbook messages",
+		receipt.ID, receipt.Deleted.Pictures, receipt.Deleted.PendingUploads, receipt.Deleted.Likes,
+		receipt.Deleted.Comments, receipt.Deleted.Reports, receipt.Deleted.Reactions, receipt.Deleted.Guestbook)
+
+	// The request's own device and session are gone with its data
+	if own {
+		http.SetCookie(w, &http.Cookie{
+			Name:     deviceCookieName,
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   r.TLS != nil || sessionCookieSecure,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	if data.Account {
+		clearSessionCookie(w, r)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
+
+// handleGetDeletionReceipt returns a stored deletion receipt.
+func handleGetDeletionReceipt(w http.ResponseWriter, r *http.Request) {
+	receipt, err := db.GetDeletionReceipt(mux.Vars(r)["id"])
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("get deletion receipt failed: %v", err)
+		http.Error(w, "Error fetching receipt", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
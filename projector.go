@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"net/http"
+
+	"github.com/chai2010/webp"
+	"github.com/disintegration/imaging"
+	"github.com/gorilla/mux"
+)
+
+// Projector renditions are a second, larger and higher quality WebP of each
+// upload that exceeds maxImageDimension, sized for the screens the
+// slideshow runs on. They are kept outside uploadDir and only served to
+// displays and presenters, so phones browsing the wall don't pull 4K
+// images.
+var (
+	// projectorMaxDimension bounds the long side of a rendition; 0 turns
+	// renditions off
+	projectorMaxDimension reloadable[int]
+	projectorQuality      reloadable[int]
+	projectorDir          string
+)
+
+// encodeProjectorRendition encodes the projector rendition of an upload's
+// decoded image. It returns nil if the image fits within
+// maxImageDimension, in which case the web image is already full size, or
+// if renditions are off.
+func encodeProjectorRendition(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+	maxDim, webDim := projectorMaxDimension.Load(), maxImageDimension.Load()
+	if maxDim <= webDim || (bounds.Dx() <= webDim && bounds.Dy() <= webDim) {
+		return nil, nil
+	}
+	if bounds.Dx() > maxDim || bounds.Dy() > maxDim {
+		img = imaging.Fit(img, maxDim, maxDim, imaging.Lanczos)
+	}
+	buf := &bytes.Buffer{}
+	if err := webp.Encode(buf, img, &webp.Options{Quality: float32(projectorQuality.Load())}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// projectorURL is the URL a picture's projector rendition is served at.
+func projectorURL(id string) string {
+	return "/api/pictures/" + id + "/projector"
+}
+
+// handleProjectorImage serves a picture's projector rendition to a display
+// of its event, or to a presenter or admin.
+func handleProjectorImage(w http.ResponseWriter, r *http.Request) {
+	display, err := displayFromRequest(r)
+	if errors.Is(err, errUnknownDisplay) || errors.Is(err, errDisplayRevoked) {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logError("get display failed: %v", err)
+		http.Error(w, "Error fetching picture", http.StatusInternalServerError)
+		return
+	}
+	if display == nil {
+		role, ok := authenticate(r)
+		switch {
+		case !ok:
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		case role < RolePresenter && requestToken(r) == "" && userFromRequest(r) == nil:
+			http.Error(w, "Token required", http.StatusUnauthorized)
+			return
+		case role < RolePresenter:
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	pic, err := db.GetPicture(mux.Vars(r)["id"])
+	if err != nil || pic.Hidden || pic.ProjectorURL == "" || (display != nil && pic.EventID != display.EventID) {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	info, err := projectorStore.Stat(r.Context(), pic.FileKey)
+	if err != nil {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	f, err := projectorStore.Get(r.Context(), pic.FileKey)
+	if err != nil {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	// Renditions are immutable under their ID, but only for the token
+	// holder's eyes
+	w.Header().Set("Content-Type", "image/webp")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if sendStored(w, projectorStore, "projector", pic.FileKey) {
+		return
+	}
+	http.ServeContent(w, r, pic.ID, info.ModTime, f)
+}
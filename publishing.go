@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Admins can schedule a picture to be published later, so that a
+// photographer's shots are revealed at a set moment: the picture is
+// converted as usual but stays hidden until its publish time, when the
+// publisher puts it on the wall as a new upload. Scheduling is given with
+// the upload, as the publishAt form field, or afterwards with PUT
+// /api/admin/pictures/{id}/publish. Showing or hiding the picture by hand,
+// or moderating it, cancels the schedule.
+
+// publishInterval is how often the publisher looks for pictures due; a
+// picture may go on the wall this late.
+const publishInterval = 5 * time.Second
+
+// PublishRequest is the body of PUT /api/admin/pictures/{id}/publish.
+type PublishRequest struct {
+	PublishAt time.Time `json:"publishAt"`
+}
+
+// formatPublishAt is how publish times are stored, "" for none.
+func formatPublishAt(at time.Time) string {
+	if at.IsZero() {
+		return ""
+	}
+	return at.UTC().Format(time.RFC3339)
+}
+
+// parsePublishAt reads a stored publish time.
+func parsePublishAt(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// uploadPublishAt returns the publish time an upload was given in its
+// publishAt field, zero for none or one already past. Only admins may
+// schedule uploads; ok is false for others that tried.
+func uploadPublishAt(r *http.Request) (at time.Time, ok bool, err error) {
+	value := r.FormValue("publishAt")
+	if value == "" {
+		return time.Time{}, true, nil
+	}
+	if role, _ := authenticate(r); role < RoleAdmin {
+		return time.Time{}, false, nil
+	}
+	if at, err = time.Parse(time.RFC3339, value); err != nil {
+		return time.Time{}, true, err
+	}
+	if !at.After(time.Now()) {
+		return time.Time{}, true, nil
+	}
+	return at.UTC().Truncate(time.Second), true, nil
+}
+
+// publishLoop publishes the pictures that are due every publishInterval.
+// Every instance runs its own publisher; the database lets only one of
+// them publish each picture, which is announced to every instance.
+func (h *Hub) publishLoop() {
+	ticker := time.NewTicker(publishInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		// Due pictures are published once writes are allowed again
+		if !readOnly.Load() {
+			h.publishDuePictures(now)
+		}
+	}
+}
+
+// publishDuePictures puts the pictures scheduled by now on the wall.
+func (h *Hub) publishDuePictures(now time.Time) {
+	pictures, err := db.PublishDuePictures(now)
+	for _, pic := range pictures {
+		logInfo("picture %s published as scheduled (event=%s)", pic.ID, pic.EventID)
+		h.publishPictureAdded(pic)
+		recordUpload(pic)
+		notifyUpload(pic)
+	}
+	if err != nil {
+		logError("publish scheduled pictures failed: %v", err)
+	}
+}
+
+// handleSchedulePicture schedules a picture to be published at a later
+// time, taking it off the wall until then.
+func handleSchedulePicture(w http.ResponseWriter, r *http.Request) {
+	var req PublishRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !req.PublishAt.After(time.Now()) {
+		http.Error(w, "publishAt must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	pic, err := db.GetPicture(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("get picture failed: %v", err)
+		http.Error(w, "Error updating picture", http.StatusInternalServerError)
+		return
+	}
+	// A moderator decides when a held picture goes on the wall
+	if pic.Moderation != "" {
+		http.Error(w, "Picture is in moderation", http.StatusConflict)
+		return
+	}
+	publishAt := req.PublishAt.UTC().Truncate(time.Second)
+	if err := db.SetPicturePublishAt(id, publishAt); err != nil {
+		logError("schedule picture failed: %v", err)
+		http.Error(w, "Error updating picture", http.StatusInternalServerError)
+		return
+	}
+	wasHidden := pic.Hidden
+	pic.Hidden, pic.PublishAt = true, publishAt
+	if !wasHidden {
+		hub.publishVisibility(pic)
+	}
+	logInfo("picture %s scheduled for %s (event=%s)", pic.ID, publishAt.Format(time.RFC3339), pic.EventID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(archivedPicture(pic))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// Every event's files are stored in its own partition of the stores (see
+// eventKey), and an event may be given a quota on their size: the default
+// EVENT_QUOTA_MB, or its own set through /api/admin/quota. Uploads to an
+// event that has reached its quota are refused, and its images dropped
+// into INGEST_DIR wait, while the other events carry on. The images
+// already uploaded are still converted, so an event can end up a little
+// over its quota. Originals aren't counted.
+var (
+	defaultEventQuota reloadable[int64]
+
+	uploadsRejectedQuota atomic.Uint64
+)
+
+// EventQuota is an event's storage use against its quota.
+type EventQuota struct {
+	EventID string `json:"eventId"`
+	Bytes   int64  `json:"bytes"`
+	// QuotaBytes is 0 for no quota
+	QuotaBytes int64 `json:"quotaBytes"`
+	// Default is true when the event has no quota of its own and
+	// EVENT_QUOTA_MB applies
+	Default   bool `json:"default"`
+	OverQuota bool `json:"overQuota"`
+}
+
+// eventQuota returns an event's quota, 0 for none, and whether it is the
+// default.
+func eventQuota(event string) (int64, bool, error) {
+	quota, ok, err := db.GetEventQuota(event)
+	if err != nil {
+		return 0, false, err
+	}
+	if !ok {
+		return defaultEventQuota.Load(), true, nil
+	}
+	return quota, false, nil
+}
+
+// getEventQuota returns an event's storage use and quota.
+func getEventQuota(event string) (*EventQuota, error) {
+	quota, isDefault, err := eventQuota(event)
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := db.GetEventBytes(event)
+	if err != nil {
+		return nil, err
+	}
+	return &EventQuota{
+		EventID:    event,
+		Bytes:      bytes,
+		QuotaBytes: quota,
+		Default:    isDefault,
+		OverQuota:  quota > 0 && bytes >= quota,
+	}, nil
+}
+
+// checkEventQuota returns an error if an event has reached its quota. The
+// quota is not enforced if it can't be read.
+func checkEventQuota(event string) error {
+	q, err := getEventQuota(event)
+	if err != nil {
+		logWarn("read storage quota of event %s: %v", event, err)
+		return nil
+	}
+	if q.OverQuota {
+		return fmt.Errorf("event %s has used %d of its %d MB", event, q.Bytes>>20, q.QuotaBytes>>20)
+	}
+	return nil
+}
+
+// eventStats returns the stats of every event with pictures, with their
+// quotas.
+func eventStats() ([]*EventStats, error) {
+	stats, err := db.GetEventStats()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range stats {
+		if s.QuotaBytes, _, err = eventQuota(s.EventID); err != nil {
+			return nil, err
+		}
+		s.OverQuota = s.QuotaBytes > 0 && s.Bytes >= s.QuotaBytes
+	}
+	return stats, nil
+}
+
+// backfillPictureBytes stores the size of the files of pictures stored by
+// versions before quotas, so that they count against them.
+func backfillPictureBytes(ctx context.Context) error {
+	pictures, err := db.GetPicturesWithoutBytes()
+	if err != nil {
+		return err
+	}
+	for _, pic := range pictures {
+		info, err := uploadStore.Stat(ctx, pic.FileKey)
+		if err != nil {
+			continue
+		}
+		size := info.Size
+		if pic.ProjectorURL != "" {
+			if info, err := projectorStore.Stat(ctx, pic.FileKey); err == nil {
+				size += info.Size
+			}
+		}
+		if err := db.SetPictureBytes(pic.ID, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleListEventStats returns the stats of every event with pictures,
+// with their storage use and quotas.
+func handleListEventStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := eventStats()
+	if err != nil {
+		logError("get event stats failed: %v", err)
+		http.Error(w, "Error fetching event stats", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// QuotaRequest sets an event's quota in MB; 0 for none.
+type QuotaRequest struct {
+	QuotaMB *int64 `json:"quotaMB"`
+}
+
+// handleQuota returns an event's storage use and quota, after setting the
+// quota with PUT or going back to the default with DELETE.
+func handleQuota(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		var req QuotaRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&req); err != nil || req.QuotaMB == nil || *req.QuotaMB < 0 {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err = db.SetEventQuota(event, *req.QuotaMB<<20); err == nil {
+			logInfo("storage quota of event %s set to %d MB", event, *req.QuotaMB)
+		}
+	case http.MethodDelete:
+		if err = db.DeleteEventQuota(event); err == nil {
+			logInfo("storage quota of event %s back to the default", event)
+		}
+	}
+	if err != nil {
+		logError("set storage quota failed: %v", err)
+		http.Error(w, "Error setting quota", http.StatusInternalServerError)
+		return
+	}
+	q, err := getEventQuota(event)
+	if err != nil {
+		logError("get storage quota failed: %v", err)
+		http.Error(w, "Error fetching quota", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Every emoji reaction is broadcast for the presentation's floating
+// emojis, and the first of each emoji from a device, or from a signed-in
+// user on any of their devices, is counted. Clients read the counts and
+// their own reactions back to render filled reaction buttons after a
+// reload.
+
+// reactionEmojis are the reactions clients may send, in the order they
+// are listed.
+var reactionEmojis = []string{"❤️", "🔥", "😂", "😮", "👏", "🎉"}
+
+// ReactionCount is the number of reactions to a picture with one emoji.
+type ReactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	// Reacted is whether the requesting device or user sent it
+	Reacted bool `json:"reacted"`
+}
+
+// PictureReactions is the response of GET /api/pictures/{id}/reactions.
+type PictureReactions struct {
+	PictureID string          `json:"pictureId"`
+	Reactions []ReactionCount `json:"reactions"`
+}
+
+// validReaction reports whether clients may send an emoji.
+func validReaction(emoji string) bool {
+	return slices.Contains(reactionEmojis, emoji)
+}
+
+// reactorKey returns the key a request's reactions are counted under: its
+// signed-in user, else its device, or "" if it has neither.
+func reactorKey(r *http.Request) string {
+	if user := userFromRequest(r); user != nil {
+		return "user:" + strconv.FormatInt(user.ID, 10)
+	}
+	if d := deviceFromRequest(r); d.id != "" {
+		return "device:" + d.id
+	}
+	return ""
+}
+
+// handleGetReactions returns the reaction counts of a picture on the
+// public wall, for every emoji, and which of them the caller sent.
+func handleGetReactions(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	pic, err := db.GetPicture(id)
+	if err != nil || pic.Hidden {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	counts, mine, err := db.GetReactions(id, reactorKey(r))
+	if err != nil {
+		logError("get reactions failed: %v", err)
+		http.Error(w, "Error fetching reactions", http.StatusInternalServerError)
+		return
+	}
+	resp := PictureReactions{PictureID: id, Reactions: make([]ReactionCount, 0, len(reactionEmojis))}
+	for _, emoji := range reactionEmojis {
+		resp.Reactions = append(resp.Reactions, ReactionCount{Emoji: emoji, Count: counts[emoji], Reacted: mine[emoji]})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// In read-only mode the gallery and the presentation stay up, but nothing
+// is written: uploads, likes, reactions, comments and admin changes are
+// refused with 503, downloads and exports aren't counted, spotlights,
+// slides shown and display connections aren't recorded, and the
+// conversion and recap workers, the hot folder, scheduled publishing, the
+// archiver, the trash purger and the garbage collector wait until the
+// mode is turned off. Only signing in and entering access codes still
+// write, and starting the server migrates the schema as it always does.
+// It's for showing the gallery after the event, and for maintenance on
+// the database. READ_ONLY sets it at startup and on each reload; PUT
+// /api/admin/read-only turns it on or off in between.
+
+// readOnly is whether the server refuses writes.
+var readOnly reloadable[bool]
+
+// readOnlyMessage is the error of a write refused in read-only mode.
+const readOnlyMessage = "The gallery is read-only"
+
+// readOnlyExempt are the routes that still write in read-only mode:
+// signing in and out and entering an access code, without which the
+// gallery can't be viewed, and turning the mode off.
+var readOnlyExempt = map[string]bool{
+	"/api/auth/login":      true,
+	"/api/auth/logout":     true,
+	"/api/access":          true,
+	"/api/admin/read-only": true,
+	"/api/admin/reload":    true,
+}
+
+// ReadOnlyState is the body of GET and PUT /api/admin/read-only.
+type ReadOnlyState struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+// readOnlyMiddleware refuses requests that would write while in read-only
+// mode.
+func readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if readOnly.Load() && writes(r) {
+			http.Error(w, readOnlyMessage, http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writes reports whether a request may write: any but GET, HEAD and
+// OPTIONS, outside readOnlyExempt.
+func writes(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil && readOnlyExempt[strings.TrimSuffix(tmpl, "/")] {
+			return false
+		}
+	}
+	return true
+}
+
+// handleReadOnly returns whether the server is read-only, or turns the
+// mode on or off.
+func handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var req ReadOnlyState
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		readOnly.Store(req.ReadOnly)
+		if req.ReadOnly {
+			logWarn("read-only mode turned on by %s", moderatorName(r))
+		} else {
+			logInfo("read-only mode turned off by %s", moderatorName(r))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&ReadOnlyState{ReadOnly: readOnly.Load()})
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Recaps are slideshow videos of an event's most liked pictures, rendered
+// by ffmpeg in the background. One recap renders at a time; the others wait
+// as pending tasks.
+var (
+	ffmpegPath    string
+	recapMusicDir string
+	recapDir      string
+)
+
+// Bounds of a recap request.
+const (
+	defaultRecapPictures = 20
+	maxRecapPictures     = 100
+	defaultRecapDuration = 60
+	minRecapDuration     = 10
+	maxRecapDuration     = 600
+)
+
+// Shape of a rendered recap. Every slide fades in and out over
+// recapFadeSeconds; the music fades out over the last recapFadeSeconds*4.
+const (
+	recapWidth       = 1920
+	recapHeight      = 1080
+	recapFrameRate   = 30
+	recapFadeSeconds = 0.5
+	recapTimeout     = 30 * time.Minute
+)
+
+// Statuses of a recap task.
+const (
+	recapPending   = "pending"
+	recapRunning   = "running"
+	recapCompleted = "completed"
+	recapFailed    = "failed"
+)
+
+// RecapTask is a recap video being rendered, or rendered.
+type RecapTask struct {
+	ID       int64   `json:"id"`
+	EventID  string  `json:"eventId"`
+	Status   string  `json:"status"`
+	Progress float64 `json:"progress"`
+	// Pictures is the number of top pictures asked for; the video has
+	// fewer if the event has fewer visible pictures
+	Pictures   int        `json:"pictures"`
+	Duration   int        `json:"duration"`
+	Music      string     `json:"music,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// DownloadURL serves the video once the task is completed
+	DownloadURL string `json:"downloadUrl,omitempty"`
+}
+
+// RecapRequest is the body of POST /api/admin/recap. Zero values take the
+// defaults.
+type RecapRequest struct {
+	Pictures int    `json:"pictures"`
+	Duration int    `json:"duration"`
+	Music    string `json:"music"`
+}
+
+// recapQueued wakes the recap worker when a task is created.
+var recapQueued = make(chan struct{}, 1)
+
+// recapPath is where a recap's video is stored.
+func recapPath(id int64) string {
+	return filepath.Join(recapDir, fmt.Sprintf("recap-%d.mp4", id))
+}
+
+// handleCreateRecap queues a recap of the request event's top pictures.
+func handleCreateRecap(w http.ResponseWriter, r *http.Request) {
+	var req RecapRequest
+	event, ok := decodeEventRequest(w, r, &req, 64<<10)
+	if !ok {
+		return
+	}
+	if req.Pictures == 0 {
+		req.Pictures = defaultRecapPictures
+	}
+	if req.Pictures < 1 || req.Pictures > maxRecapPictures {
+		http.Error(w, fmt.Sprintf("Pictures must be 1-%d", maxRecapPictures), http.StatusBadRequest)
+		return
+	}
+	if req.Duration == 0 {
+		req.Duration = defaultRecapDuration
+	}
+	if req.Duration < minRecapDuration || req.Duration > maxRecapDuration {
+		http.Error(w, fmt.Sprintf("Duration must be %d-%d seconds", minRecapDuration, maxRecapDuration), http.StatusBadRequest)
+		return
+	}
+	if req.Music != "" {
+		// Only files of the music directory, by name
+		if req.Music != filepath.Base(req.Music) || strings.HasPrefix(req.Music, ".") {
+			http.Error(w, "Invalid music file", http.StatusBadRequest)
+			return
+		}
+		if info, err := os.Stat(filepath.Join(recapMusicDir, req.Music)); err != nil || info.IsDir() {
+			http.Error(w, fmt.Sprintf("Music file %q not found", req.Music), http.StatusBadRequest)
+			return
+		}
+	}
+	if _, err := exec.LookPath(ffmpegPath); err != nil {
+		http.Error(w, "Recap rendering is unavailable: ffmpeg not found", http.StatusServiceUnavailable)
+		return
+	}
+	if top, err := db.GetTopPictures(event, 1); err != nil {
+		logError("get top pictures failed: %v", err)
+		http.Error(w, "Error creating recap", http.StatusInternalServerError)
+		return
+	} else if len(top) == 0 {
+		http.Error(w, "No pictures to recap", http.StatusConflict)
+		return
+	}
+
+	task := &RecapTask{
+		EventID:   event,
+		Status:    recapPending,
+		Pictures:  req.Pictures,
+		Duration:  req.Duration,
+		Music:     req.Music,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if err := db.AddRecapTask(task); err != nil {
+		logError("add recap task failed: %v", err)
+		http.Error(w, "Error creating recap", http.StatusInternalServerError)
+		return
+	}
+	select {
+	case recapQueued <- struct{}{}:
+	default:
+	}
+
+	logInfo("recap %d queued: %d pictures over %ds (event=%s)", task.ID, task.Pictures, task.Duration, event)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(task)
+}
+
+// handleListRecaps lists the request event's recaps, newest first.
+func handleListRecaps(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	tasks, err := db.GetRecapTasks(event)
+	if err != nil {
+		logError("get recap tasks failed: %v", err)
+		http.Error(w, "Error fetching recaps", http.StatusInternalServerError)
+		return
+	}
+	if tasks == nil {
+		tasks = []*RecapTask{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tasks)
+}
+
+// handleGetRecap returns a recap's status and progress.
+func handleGetRecap(w http.ResponseWriter, r *http.Request) {
+	task, ok := recapFromRequest(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
+// handleDownloadRecap serves a completed recap's video.
+func handleDownloadRecap(w http.ResponseWriter, r *http.Request) {
+	task, ok := recapFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if task.Status != recapCompleted {
+		http.Error(w, "Recap not ready", http.StatusConflict)
+		return
+	}
+	path := recapPath(task.ID)
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "Recap not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Recap not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="recap-%s-%d.mp4"`, task.EventID, task.ID))
+	if sendFile(w, "recaps/"+filepath.Base(path), path) {
+		return
+	}
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// recapFromRequest returns the recap named by a request's {id}, writing a
+// 404 if there is none.
+func recapFromRequest(w http.ResponseWriter, r *http.Request) (*RecapTask, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Recap not found", http.StatusNotFound)
+		return nil, false
+	}
+	task, err := db.GetRecapTask(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Recap not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		logError("get recap task failed: %v", err)
+		http.Error(w, "Error fetching recap", http.StatusInternalServerError)
+		return nil, false
+	}
+	return task, true
+}
+
+// startRecapWorker renders pending recaps one at a time until ctx is
+// cancelled, then closes done. Recaps a previous run left running, or
+// that were stopped by the cancellation, are rendered again from the start.
+// Pending recaps wait in read-only mode.
+func startRecapWorker(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	requeued := false
+	for ctx.Err() == nil {
+		if readOnly.Load() {
+			sleepContext(ctx, time.Second)
+			continue
+		}
+		if !requeued {
+			if err := db.RequeueRunningRecapTasks(); err != nil {
+				logWarn("requeue interrupted recaps: %v", err)
+			}
+			requeued = true
+		}
+		task, err := db.ClaimNextRecapTask()
+		if err != nil {
+			logError("claim recap task: %v", err)
+			sleepContext(ctx, time.Second)
+			continue
+		}
+		if task == nil {
+			select {
+			case <-recapQueued:
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		logInfo("rendering recap %d (event=%s)", task.ID, task.EventID)
+		err = renderRecap(ctx, task)
+		switch {
+		case ctx.Err() != nil:
+			if err := db.RequeueRunningRecapTasks(); err != nil {
+				logWarn("requeue recap %d: %v", task.ID, err)
+			}
+			logInfo("recap %d stopped, requeued", task.ID)
+		case err != nil:
+			logError("recap %d failed: %v", task.ID, err)
+			db.FinishRecapTask(task.ID, recapFailed, err.Error(), time.Now())
+		default:
+			db.FinishRecapTask(task.ID, recapCompleted, "", time.Now())
+			logInfo("recap %d completed", task.ID)
+		}
+	}
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// renderRecap renders a recap's video with ffmpeg, storing its progress as
+// ffmpeg reports it. Cancelling ctx kills ffmpeg.
+func renderRecap(ctx context.Context, task *RecapTask) error {
+	pictures, err := db.GetTopPictures(task.EventID, task.Pictures)
+	if err != nil {
+		return fmt.Errorf("get top pictures: %w", err)
+	}
+	if len(pictures) == 0 {
+		return fmt.Errorf("no pictures to recap")
+	}
+	if err := os.MkdirAll(recapDir, 0755); err != nil {
+		return fmt.Errorf("ensure recap dir: %w", err)
+	}
+
+	// ffmpeg reads files; pictures that aren't in a directory store are
+	// copied into a temporary one
+	inputDir, err := os.MkdirTemp("", "picsapp-recap-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(inputDir)
+	inputs := make([]string, len(pictures))
+	for i, p := range pictures {
+		// The projector rendition, where there is one, is closer to the
+		// video's resolution
+		store := uploadStore
+		if p.ProjectorURL != "" {
+			store = projectorStore
+		}
+		if inputs[i], err = localFile(ctx, store, p.FileKey, inputDir); err != nil {
+			return fmt.Errorf("read picture %s: %w", p.ID, err)
+		}
+	}
+
+	out := recapPath(task.ID)
+	tmp := out + ".part.mp4"
+	defer os.Remove(tmp)
+	args := recapArgs(task, inputs, tmp)
+
+	ctx, cancel := context.WithTimeout(ctx, recapTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := &tailBuffer{max: 2048}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start ffmpeg: %w", err)
+	}
+
+	// -progress writes key=value lines; out_time_us is how much of the
+	// video is encoded
+	total := float64(task.Duration) * 1e6
+	var lastStored time.Time
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		v, ok := strings.CutPrefix(scanner.Text(), "out_time_us=")
+		if !ok {
+			continue
+		}
+		us, err := strconv.ParseFloat(v, 64)
+		if err != nil || time.Since(lastStored) < time.Second {
+			continue
+		}
+		lastStored = time.Now()
+		if err := db.SetRecapProgress(task.ID, min(max(us/total, 0), 0.99)); err != nil {
+			logWarn("store recap %d progress: %v", task.ID, err)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return os.Rename(tmp, out)
+}
+
+// recapArgs returns the ffmpeg arguments rendering the picture files at
+// inputs, most liked first, into a task's video at out. Every picture is
+// shown for an equal share of the duration, letterboxed to recapWidth x
+// recapHeight.
+func recapArgs(task *RecapTask, inputs []string, out string) []string {
+	slide := float64(task.Duration) / float64(len(inputs))
+	seconds := strconv.FormatFloat(slide, 'f', 3, 64)
+	args := []string{"-hide_banner", "-nostats", "-loglevel", "error", "-progress", "pipe:1", "-y"}
+	var filters, concat strings.Builder
+	for i, path := range inputs {
+		args = append(args, "-loop", "1", "-t", seconds, "-i", path)
+		fmt.Fprintf(&filters, "[%d:v]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=%d,format=yuv420p,"+
+			"fade=t=in:st=0:d=%g,fade=t=out:st=%.3f:d=%g[v%d];",
+			i, recapWidth, recapHeight, recapWidth, recapHeight, recapFrameRate, recapFadeSeconds, slide-recapFadeSeconds, recapFadeSeconds, i)
+		fmt.Fprintf(&concat, "[v%d]", i)
+	}
+	fmt.Fprintf(&filters, "%sconcat=n=%d:v=1:a=0[v]", concat.String(), len(inputs))
+	maps := []string{"-map", "[v]"}
+	if task.Music != "" {
+		args = append(args, "-stream_loop", "-1", "-i", filepath.Join(recapMusicDir, task.Music))
+		fade := recapFadeSeconds * 4
+		fmt.Fprintf(&filters, ";[%d:a]afade=t=out:st=%g:d=%g[a]", len(inputs), float64(task.Duration)-fade, fade)
+		maps = append(maps, "-map", "[a]", "-c:a", "aac", "-b:a", "192k")
+	}
+	args = append(args, "-filter_complex", filters.String())
+	args = append(args, maps...)
+	return append(args,
+		"-c:v", "libx264", "-preset", "medium", "-crf", "20", "-pix_fmt", "yuv420p",
+		"-t", strconv.Itoa(task.Duration), "-movflags", "+faststart", out)
+}
+
+// tailBuffer keeps the last max bytes written to it, for error messages
+// from chatty commands.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.buf)
+}
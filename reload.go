@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// A reload, on SIGHUP or POST /api/admin/reload, reads the configuration
+// again from the same file, environment and flags as at startup, applies
+// the settings tagged reload, and queues conversions for files that need
+// them, without interrupting the event. Other settings only change on a
+// restart.
+var (
+	reloadMu     sync.Mutex
+	serveArgs    []string
+	activeConfig *Config
+)
+
+// reloadSettle is how old an original file without a conversion task must
+// be for a reload to queue it, as the upload saving it may not have queued
+// it yet.
+const reloadSettle = time.Minute
+
+// reloadable is a setting that a reload can change while it is being read.
+type reloadable[T any] struct {
+	v atomic.Pointer[T]
+}
+
+// Load returns the setting, the zero value if it was never stored.
+func (r *reloadable[T]) Load() T {
+	if v := r.v.Load(); v != nil {
+		return *v
+	}
+	var zero T
+	return zero
+}
+
+// Store sets the setting.
+func (r *reloadable[T]) Store(v T) {
+	r.v.Store(&v)
+}
+
+// ReloadResponse is the body of POST /api/admin/reload.
+type ReloadResponse struct {
+	// Changed are the settings that changed and were applied
+	Changed []string `json:"changed"`
+	// RestartRequired are the settings that changed but only take effect
+	// on a restart
+	RestartRequired []string `json:"restartRequired"`
+}
+
+// reloadConfig reads the configuration again and applies the settings that
+// can change while running. An invalid configuration is rejected as a
+// whole, leaving the running one in place.
+func reloadConfig() (*ReloadResponse, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	fs := flag.NewFlagSet("picsapp serve", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cfg, _, _, err := loadConfig(fs, serveArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &ReloadResponse{Changed: []string{}, RestartRequired: []string{}}
+	running := configFields(activeConfig)
+	for i, f := range configFields(cfg) {
+		if reflect.DeepEqual(f.value.Interface(), running[i].value.Interface()) {
+			continue
+		}
+		if !f.reload {
+			resp.RestartRequired = append(resp.RestartRequired, f.key)
+			logWarn("reload: %s changed; restart to apply it", f.key)
+			continue
+		}
+		resp.Changed = append(resp.Changed, f.key)
+		logInfo("reload: %s=%v", f.key, f.value.Interface())
+		running[i].value.Set(f.value)
+	}
+	applyReloadable(activeConfig)
+	return resp, nil
+}
+
+// reload reloads the configuration and queues the conversions of legacy
+// files and of originals left without a task, such as files copied into
+// the upload directory by hand.
+func reload() (*ReloadResponse, error) {
+	resp, err := reloadConfig()
+	if err != nil {
+		return nil, err
+	}
+	// Picture URLs depend on PUBLIC_ASSET_BASE_URL
+	db.PicturesChanged()
+	if err := enqueueLegacyConversionTasks(reloadSettle); err != nil {
+		logWarn("reload: queue legacy files: %v", err)
+	}
+	logInfo("reload: %d settings changed", len(resp.Changed))
+	return resp, nil
+}
+
+// watchSIGHUP reloads on every SIGHUP until stop is closed.
+func watchSIGHUP(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			logInfo("reload: SIGHUP received")
+			if _, err := reload(); err != nil {
+				logError("reload failed, keeping the running configuration: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	resp, err := reload()
+	if err != nil {
+		logError("reload failed, keeping the running configuration: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Whatever the ordering, a big event's slideshow can go hours without
+// reaching a picture nobody liked, and a kiosk restarted now and then
+// starts over with the same ones. Displays report each slide they show,
+// and the server keeps when each display last showed each picture. The
+// slideshow order a display fetches puts the pictures it hasn't shown
+// within ROTATION_MINUTES first, the longest unseen first, so every
+// picture on the wall comes round at least that often as long as the
+// slideshow has time to show them all.
+
+// rotationPeriod is how often every picture should be on each display, 0
+// to leave the slideshow order alone.
+var rotationPeriod reloadable[time.Duration]
+
+// actionShown is the client message type a display reports a slide with.
+const actionShown = "shown"
+
+var errNotDisplay = errors.New("not a display")
+
+func init() {
+	inboundHandlers[actionShown] = inboundHandler{minRole: RoleViewer, fn: handleShownAction}
+}
+
+// handleShownAction records that the client's display showed a picture of
+// its event as a slide. Nothing is recorded in read-only mode, or with
+// rotation off.
+func handleShownAction(c *client, payload json.RawMessage) error {
+	if c.display == "" {
+		return errNotDisplay
+	}
+	var action PictureAction
+	if err := json.Unmarshal(payload, &action); err != nil {
+		return errInvalidPayload
+	}
+	if _, err := eventPicture(action.ID, c.event); err != nil {
+		return err
+	}
+	if readOnly.Load() || rotationPeriod.Load() == 0 {
+		return nil
+	}
+	if err := db.RecordSlideShown(c.display, action.ID, time.Now()); err != nil {
+		logError("record slide shown failed: %v", err)
+	}
+	return nil
+}
+
+// rotationDisplay returns the ID of the display of event a slideshow
+// request comes from, or "" if it doesn't come from one or rotation is
+// off.
+func rotationDisplay(r *http.Request, event string) string {
+	if rotationPeriod.Load() == 0 {
+		return ""
+	}
+	display, err := displayFromRequest(r)
+	if err != nil && !errors.Is(err, errUnknownDisplay) && !errors.Is(err, errDisplayRevoked) {
+		logWarn("get display failed: %v", err)
+	}
+	if display == nil || display.EventID != event {
+		return ""
+	}
+	return display.ID
+}
+
+// rotateSlides moves the pictures a display hasn't shown within the
+// rotation period to the front of its slides, never shown ones first, then
+// the one shown longest ago. The others keep their order behind them.
+func rotateSlides(display string, pictures []*Picture, now time.Time) ([]*Picture, error) {
+	shown, err := db.GetSlidesShown(display)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := now.Add(-rotationPeriod.Load())
+	var due, rest []*Picture
+	for _, p := range pictures {
+		if shown[p.ID].After(cutoff) {
+			rest = append(rest, p)
+		} else {
+			due = append(due, p)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return shown[due[i].ID].Before(shown[due[j].ID])
+	})
+	return append(due, rest...), nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// With STORAGE=s3 the stores are prefixes of one bucket on Amazon S3 or
+// any S3-compatible server such as MinIO: S3_PREFIX followed by original/,
+// uploads/ and projector/. Converted images are fetched by clients from
+// S3_PUBLIC_URL when the bucket (or a CDN in front of it) is public, else
+// /uploads/ redirects them to presigned URLs valid for S3_PRESIGN_EXPIRY.
+// Projector renditions stay private and go through the server.
+
+// s3PartSize is the part size of uploads of unknown size.
+const s3PartSize = 5 << 20
+
+// newS3Client connects to S3_ENDPOINT, with static keys or the credentials
+// of the environment.
+func newS3Client(cfg *Config) (*minio.Client, error) {
+	creds := credentials.NewStaticV4(cfg.S3AccessKey, cfg.S3SecretKey, "")
+	if cfg.S3AccessKey == "" {
+		// The environment, ~/.aws/credentials or an instance role
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+		})
+	}
+	client, err := minio.New(cfg.S3Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: cfg.S3UseSSL,
+		Region: cfg.S3Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 client: %w", err)
+	}
+	return client, nil
+}
+
+// newS3Stores creates the stores in the configured bucket.
+func newS3Stores(cfg *Config) (*stores, error) {
+	client, err := newS3Client(cfg)
+	if err != nil {
+		return nil, err
+	}
+	expiry := time.Duration(cfg.S3PresignExpiry) * time.Second
+	store := func(area string) *s3Storage {
+		return &s3Storage{
+			client: client,
+			bucket: cfg.S3Bucket,
+			prefix: cfg.S3Prefix + area + "/",
+			expiry: expiry,
+		}
+	}
+	uploads := store("uploads")
+	uploads.urlPrefix = "/uploads/"
+	if cfg.S3PublicURL != "" {
+		uploads.publicURL = strings.TrimSuffix(cfg.S3PublicURL, "/") + "/"
+	}
+	return &stores{
+		original:  store("original"),
+		uploads:   uploads,
+		projector: store("projector"),
+	}, nil
+}
+
+// s3Storage keeps files as the objects under a prefix of a bucket.
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+	expiry time.Duration
+	// urlPrefix is the server path the files are served at, redirecting
+	// to presigned URLs, unless publicURL, the base URL of the bucket,
+	// is set
+	urlPrefix string
+	publicURL string
+}
+
+func (s *s3Storage) object(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return s.prefix + key, nil
+}
+
+// s3Error maps a missing object to fs.ErrNotExist.
+func s3Error(key string, err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+// Put uploads r as one object, which only becomes visible once complete.
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader) error {
+	name, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	size := int64(-1)
+	if seeker, ok := r.(io.Seeker); ok {
+		// Files and byte readers know their size, which saves buffering
+		// the upload in parts
+		if end, err := seeker.Seek(0, io.SeekEnd); err == nil {
+			if start, err := seeker.Seek(0, io.SeekStart); err == nil {
+				size = end - start
+			}
+		}
+	}
+	_, err = s.client.PutObject(ctx, s.bucket, name, r, size, minio.PutObjectOptions{
+		ContentType: mime.TypeByExtension(filepath.Ext(key)),
+		PartSize:    s3PartSize,
+	})
+	return err
+}
+
+// Get returns the object, which reads and seeks with range requests.
+func (s *s3Storage) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(key, err)
+	}
+	// GetObject doesn't reach the server until the object is used
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, s3Error(key, err)
+	}
+	return obj, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	name, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{})
+}
+
+func (s *s3Storage) Stat(ctx context.Context, key string) (FileInfo, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return FileInfo{}, s3Error(key, err)
+	}
+	return FileInfo{Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *s3Storage) URL(key string) string {
+	switch {
+	case s.publicURL != "":
+		return s.publicURL + (&url.URL{Path: s.prefix + key}).EscapedPath()
+	case s.urlPrefix != "":
+		return s.urlPrefix + key
+	}
+	return ""
+}
+
+func (s *s3Storage) presignedURL(ctx context.Context, key string) (string, time.Duration, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return "", 0, err
+	}
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, name, s.expiry, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	return u.String(), s.expiry, nil
+}
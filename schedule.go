@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Presentation modes. Scheduled entries switch displays between the
+// slideshow and the leaderboard; outside every entry displays are idle.
+// Events without a schedule are in manual mode and only follow the
+// presenter's remote.
+const (
+	modeSlideshow   = "slideshow"
+	modeLeaderboard = "leaderboard"
+	modeIdle        = "idle"
+	modeManual      = "manual"
+)
+
+var scheduleModes = map[string]bool{
+	modeSlideshow:   true,
+	modeLeaderboard: true,
+}
+
+// scheduleInterval is how often the scheduler checks for mode changes.
+const scheduleInterval = 5 * time.Second
+
+// ScheduleEntry runs the presentation in Mode from StartsAt until EndsAt.
+// Entries may overlap: the one that started last wins, so a short
+// leaderboard segment can be placed inside a longer slideshow window.
+type ScheduleEntry struct {
+	ID       int64     `json:"id"`
+	EventID  string    `json:"eventId"`
+	Mode     string    `json:"mode"`
+	StartsAt time.Time `json:"startsAt"`
+	EndsAt   time.Time `json:"endsAt"`
+}
+
+// ModePayload is the payload of a mode message and the snapshot's mode.
+// Until is when the current entry ends; Next, for idle, is when the next
+// entry starts, if one is scheduled.
+type ModePayload struct {
+	Mode  string     `json:"mode"`
+	Until *time.Time `json:"until,omitempty"`
+	Next  *time.Time `json:"next,omitempty"`
+}
+
+// scheduleChanged wakes the scheduler after admins edit a schedule.
+var scheduleChanged = make(chan struct{}, 1)
+
+func notifyScheduleChanged() {
+	select {
+	case scheduleChanged <- struct{}{}:
+	default:
+	}
+}
+
+// currentMode returns the mode entries put the presentation in at now.
+func currentMode(entries []*ScheduleEntry, now time.Time) *ModePayload {
+	var active, next *ScheduleEntry
+	for _, e := range entries {
+		switch {
+		case !e.StartsAt.After(now) && e.EndsAt.After(now):
+			if active == nil || !e.StartsAt.Before(active.StartsAt) {
+				active = e
+			}
+		case e.StartsAt.After(now):
+			if next == nil || e.StartsAt.Before(next.StartsAt) {
+				next = e
+			}
+		}
+	}
+	if active != nil {
+		return &ModePayload{Mode: active.Mode, Until: &active.EndsAt}
+	}
+	mode := &ModePayload{Mode: modeIdle}
+	if next != nil {
+		mode.Next = &next.StartsAt
+	}
+	return mode
+}
+
+// scheduledMode returns an event's current mode, or nil if it has no
+// schedule.
+func scheduledMode(event string, now time.Time) *ModePayload {
+	entries, err := db.GetSchedule(event)
+	if err != nil {
+		logError("get schedule failed: %v", err)
+		return nil
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return currentMode(entries, now)
+}
+
+// scheduleLoop broadcasts a mode message whenever an event's scheduled
+// mode changes, checking every scheduleInterval and after schedule edits.
+// Every instance runs its own scheduler, so mode messages are delivered to
+// local clients only.
+func (h *Hub) scheduleLoop() {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	modes := make(map[string]string)
+	for {
+		h.applySchedule(modes, time.Now())
+		select {
+		case <-ticker.C:
+		case <-scheduleChanged:
+		}
+	}
+}
+
+// applySchedule compares each scheduled event's mode with the one last
+// broadcast (kept in modes) and broadcasts the changes. Events whose
+// schedule was cleared go back to manual.
+func (h *Hub) applySchedule(modes map[string]string, now time.Time) {
+	events, err := db.GetScheduledEvents()
+	if err != nil {
+		logError("get scheduled events failed: %v", err)
+		return
+	}
+	scheduled := make(map[string]bool, len(events))
+	for _, event := range events {
+		scheduled[event] = true
+		mode := scheduledMode(event, now)
+		if mode == nil || modes[event] == mode.Mode {
+			continue
+		}
+		modes[event] = mode.Mode
+		logInfo("presentation mode %s (event=%s)", mode.Mode, event)
+		h.broadcast <- &Envelope{Type: msgMode, Payload: mode, event: event, queuedAt: time.Now()}
+	}
+	for event := range modes {
+		if !scheduled[event] {
+			delete(modes, event)
+			logInfo("presentation mode %s (event=%s)", modeManual, event)
+			h.broadcast <- &Envelope{Type: msgMode, Payload: &ModePayload{Mode: modeManual}, event: event, queuedAt: time.Now()}
+		}
+	}
+}
+
+// handleAddScheduleEntry adds an entry to the request event's schedule.
+func handleAddScheduleEntry(w http.ResponseWriter, r *http.Request) {
+	var entry ScheduleEntry
+	event, ok := decodeEventRequest(w, r, &entry, 4<<10)
+	if !ok {
+		return
+	}
+	if !scheduleModes[entry.Mode] {
+		http.Error(w, "Invalid mode", http.StatusBadRequest)
+		return
+	}
+	if entry.StartsAt.IsZero() || !entry.EndsAt.After(entry.StartsAt) {
+		http.Error(w, "endsAt must be after startsAt", http.StatusBadRequest)
+		return
+	}
+
+	entry.ID = 0
+	entry.EventID = event
+	entry.StartsAt = entry.StartsAt.UTC().Truncate(time.Second)
+	entry.EndsAt = entry.EndsAt.UTC().Truncate(time.Second)
+	if err := db.AddScheduleEntry(&entry); err != nil {
+		logError("add schedule entry failed: %v", err)
+		http.Error(w, "Error saving schedule", http.StatusInternalServerError)
+		return
+	}
+	notifyScheduleChanged()
+
+	logInfo("schedule entry %d for event %s: %s %s-%s", entry.ID, event, entry.Mode, entry.StartsAt.Format(time.RFC3339), entry.EndsAt.Format(time.RFC3339))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&entry)
+}
+
+// handleGetSchedule lists the request event's schedule.
+func handleGetSchedule(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	entries, err := db.GetSchedule(event)
+	if err != nil {
+		logError("get schedule failed: %v", err)
+		http.Error(w, "Error fetching schedule", http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []*ScheduleEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// handleDeleteScheduleEntry removes an entry from the schedule.
+func handleDeleteScheduleEntry(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Schedule entry not found", http.StatusNotFound)
+		return
+	}
+	if err := db.DeleteScheduleEntry(id); err == sql.ErrNoRows {
+		http.Error(w, "Schedule entry not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError("delete schedule entry failed: %v", err)
+		http.Error(w, "Error deleting schedule entry", http.StatusInternalServerError)
+		return
+	}
+	notifyScheduleChanged()
+
+	logInfo("schedule entry %d deleted", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// picsapp seed fills an event's wall before guests arrive, with the
+// couple's engagement shots or last year's best for instance. It converts
+// the images of a directory itself, several at once, and adds them as
+// pictures of the event straight away: nothing is broadcast or posted to
+// the organizers' channels, and the pictures are visible once a server
+// reads them. A server already running keeps serving the galleries it
+// cached, so seed before starting it.
+
+// seedJob is an image picsapp seed imports, the nth of the directory.
+type seedJob struct {
+	n    int
+	path string
+}
+
+func runSeed(args []string) error {
+	var dir, event string
+	var workers int
+	fset, cfg, err := setupCommandConfig("seed", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&dir, "dir", "", "directory of images to import, subdirectories included")
+		fs.StringVar(&event, "event", defaultEventID, "event to add the pictures to")
+		fs.IntVar(&workers, "workers", 0, "images converted at once (default: conversion_workers)")
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := noArgs(fset); err != nil {
+		return err
+	}
+	if err := validEvent(event); err != nil {
+		return err
+	}
+	if dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+	if workers == 0 {
+		workers = cfg.ConversionWorkers
+	}
+	if workers < 1 {
+		return fmt.Errorf("-workers must be at least 1")
+	}
+
+	paths, err := seedImages(dir)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no images in %s", dir)
+	}
+	// Seeding is often the first thing done on a new install, whose free
+	// disk space is read from the upload directory
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		return err
+	}
+
+	jobs := make(chan seedJob)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var added, failed int
+	start := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				pic, err := seedImage(context.Background(), job.path, event)
+				// One line per image, in whatever order they finish
+				mu.Lock()
+				if err != nil {
+					failed++
+					fmt.Printf("[%d/%d] %s: failed: %v\n", job.n, len(paths), job.path, err)
+				} else {
+					added++
+					fmt.Printf("[%d/%d] %s -> %s\n", job.n, len(paths), job.path, pic.ID)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i, path := range paths {
+		jobs <- seedJob{n: i + 1, path: path}
+	}
+	close(jobs)
+	wg.Wait()
+
+	fmt.Printf("seeded %d pictures into event %s in %s\n", added, event, time.Since(start).Round(time.Second))
+	if failed > 0 {
+		return fmt.Errorf("%d of %d images failed", failed, len(paths))
+	}
+	return nil
+}
+
+// seedImages returns the images in dir and its subdirectories, those with
+// the extensions the hot folder adopts, by path. Dot files and directories
+// are left out.
+func seedImages(dir string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && ingestExtensions[strings.ToLower(filepath.Ext(path))] {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+	return paths, err
+}
+
+// seedImage converts the image at path and adds it as a picture of event,
+// keeping its original with KEEP_ORIGINALS.
+func seedImage(ctx context.Context, path, event string) (*Picture, error) {
+	if err := checkDiskSpace(); err != nil {
+		return nil, err
+	}
+	if err := checkEventQuota(event); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	base := strconv.FormatInt(time.Now().UnixNano(), 10)
+	id := base + ".webp"
+	img, err := convertImage(ctx, data, event, id)
+	if err != nil {
+		return nil, err
+	}
+	picture := &Picture{
+		ID:           id,
+		Filename:     sanitizeFilename(filepath.Base(path)),
+		URL:          uploadStore.URL(img.key),
+		UploadedAt:   time.Now(),
+		EventID:      event,
+		Width:        img.width,
+		Height:       img.height,
+		Blurhash:     img.blurhash,
+		ProjectorURL: img.projector,
+		FileKey:      img.key,
+		Source:       sourceSeed,
+	}
+	if err := db.AddPicture(picture); err != nil {
+		deleteUnusedFiles(ctx, img.key)
+		return nil, fmt.Errorf("insert picture: %w", err)
+	}
+	if err := db.SetPictureBytes(id, img.size); err != nil {
+		logWarn("store file size of %s: %v", id, err)
+	}
+
+	if keepOriginals {
+		originalName := base + strings.ToLower(filepath.Ext(path))
+		if err := originalStore.Put(ctx, originalName, bytes.NewReader(data)); err != nil {
+			logWarn("keep original of %s: %v", path, err)
+		} else if err := db.SetPictureOriginal(id, originalName); err != nil {
+			logWarn("record original file %s: %v", originalName, err)
+		}
+	}
+	return picture, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Behind nginx, Apache or lighttpd, SENDFILE_HEADER hands the transfer of
+// image and video files to the proxy: handlers still check the request and
+// that the file exists, then answer with an empty body and a header naming
+// the file, which the proxy sends from disk with range and conditional
+// requests. X-Accel-Redirect (nginx) names an internal URI, SENDFILE_PREFIX
+// followed by uploads/, projector/ or recaps/ and the file's key;
+// X-Sendfile (Apache, lighttpd) names the file's absolute path. Only files
+// in local directories are handed off; other stores are served as before.
+var (
+	sendfileHeader string
+	sendfilePrefix string
+
+	sendfileResponses atomic.Uint64
+)
+
+// sendfileHeaders are the values of SENDFILE_HEADER; "" serves files from
+// Go.
+var sendfileHeaders = map[string]bool{"": true, "X-Accel-Redirect": true, "X-Sendfile": true}
+
+// sendStored hands the file under key in store, an area such as uploads,
+// to the proxy, reporting false if it must be served by the caller.
+func sendStored(w http.ResponseWriter, store Storage, area, key string) bool {
+	ds, ok := store.(*dirStorage)
+	if !ok || sendfileHeader == "" {
+		return false
+	}
+	path, err := ds.path(key)
+	if err != nil {
+		return false
+	}
+	return sendFile(w, area+"/"+key, path)
+}
+
+// sendFile hands the file at path, at uri under SENDFILE_PREFIX, to the
+// proxy, reporting false if SENDFILE_HEADER isn't set. Headers set before,
+// such as Content-Type and Cache-Control, are passed on by the proxy.
+func sendFile(w http.ResponseWriter, uri, path string) bool {
+	switch sendfileHeader {
+	case "X-Accel-Redirect":
+		w.Header().Set("X-Accel-Redirect", (&url.URL{Path: sendfilePrefix + uri}).EscapedPath())
+	case "X-Sendfile":
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return false
+		}
+		w.Header().Set("X-Sendfile", abs)
+	default:
+		return false
+	}
+	sendfileResponses.Add(1)
+	w.WriteHeader(http.StatusOK)
+	return true
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Slide transitions displays may use between slides.
+var transitions = map[string]bool{
+	"fade":  true,
+	"slide": true,
+	"zoom":  true,
+	"none":  true,
+}
+
+const (
+	minSlideInterval = 3
+	maxSlideInterval = 600
+)
+
+// PresentationSettings configures an event's presentation displays. Events
+// without stored settings use defaultPresentationSettings.
+type PresentationSettings struct {
+	EventID string `json:"eventId"`
+	// SlideInterval is how long each slide is shown, in seconds.
+	SlideInterval int    `json:"slideInterval"`
+	Transition    string `json:"transition"`
+	Ordering      string `json:"ordering"`
+	ShowLikes     bool   `json:"showLikes"`
+	// InterruptOnUpload shows new uploads as soon as they arrive instead
+	// of waiting for their turn in the rotation.
+	InterruptOnUpload bool `json:"interruptOnUpload"`
+	// Playlist is the playlist displays run the slideshow from, or empty
+	// for every picture of the event.
+	Playlist string `json:"playlist"`
+	// LikesCloseAt is when the event stops accepting likes, freezing the
+	// standings; nil to accept them throughout.
+	LikesCloseAt *time.Time `json:"likesCloseAt"`
+}
+
+func defaultPresentationSettings(eventID string) *PresentationSettings {
+	return &PresentationSettings{
+		EventID:       eventID,
+		SlideInterval: 8,
+		Transition:    "fade",
+		Ordering:      orderLikes,
+		ShowLikes:     true,
+	}
+}
+
+// validate checks that every field has an allowed value.
+func (s *PresentationSettings) validate() error {
+	if s.SlideInterval < minSlideInterval || s.SlideInterval > maxSlideInterval {
+		return fmt.Errorf("slideInterval must be %d-%d seconds", minSlideInterval, maxSlideInterval)
+	}
+	if !transitions[s.Transition] {
+		return fmt.Errorf("invalid transition %q", s.Transition)
+	}
+	if !orderings[s.Ordering] {
+		return fmt.Errorf("invalid ordering %q", s.Ordering)
+	}
+	return nil
+}
+
+// presentationSettings returns an event's settings, falling back to the
+// defaults if they can't be read.
+func presentationSettings(event string) *PresentationSettings {
+	settings, err := db.GetPresentationSettings(event)
+	if err != nil {
+		logError("get presentation settings failed: %v", err)
+		return defaultPresentationSettings(event)
+	}
+	return settings
+}
+
+func handleGetSettings(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presentationSettings(event))
+}
+
+// handlePutSettings updates an event's settings and broadcasts them so
+// displays reconfigure without reloading. Fields missing from the body keep
+// their current values.
+func handlePutSettings(w http.ResponseWriter, r *http.Request) {
+	var body json.RawMessage
+	event, ok := decodeEventRequest(w, r, &body, 4<<10)
+	if !ok {
+		return
+	}
+
+	current, err := db.GetPresentationSettings(event)
+	if err != nil {
+		logError("get presentation settings failed: %v", err)
+		http.Error(w, "Error loading settings", http.StatusInternalServerError)
+		return
+	}
+	settings := *current
+	if err := json.Unmarshal(body, &settings); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	settings.EventID = event
+	if err := settings.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if settings.Playlist != "" && settings.Playlist != current.Playlist {
+		exists, err := db.PlaylistExists(event, settings.Playlist)
+		if err != nil {
+			logError("check playlist failed: %v", err)
+			http.Error(w, "Error saving settings", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, fmt.Sprintf("unknown playlist %q", settings.Playlist), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if settings.LikesCloseAt != nil {
+		at := settings.LikesCloseAt.UTC().Truncate(time.Second)
+		settings.LikesCloseAt = &at
+	}
+
+	if err := db.SavePresentationSettings(&settings); err != nil {
+		logError("save presentation settings failed: %v", err)
+		http.Error(w, "Error saving settings", http.StatusInternalServerError)
+		return
+	}
+	hub.publishSettings(&settings)
+	notifyLikeCutoffChanged()
+
+	logInfo("presentation settings updated (event=%s ordering=%s interval=%ds playlist=%q)", event, settings.Ordering, settings.SlideInterval, settings.Playlist)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&settings)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Pictures get a short share code on first share, so a guest can text a
+// link like /p/x7Kq2 rather than the picture's timestamp ID. The code
+// stays with the picture, and /p/{code} renders a small landing page with
+// Open Graph tags, so messengers show a preview of the photo.
+
+const (
+	// shareCodeLength is the length of a share code; 59^5 codes leave
+	// collisions rare, and they are retried
+	shareCodeLength = 5
+	// shareCodeAttempts bounds the codes tried before giving up
+	shareCodeAttempts = 5
+	// shareCodeAlphabet leaves out l, I and O, which read like 1 and 0
+	shareCodeAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ0123456789"
+)
+
+// publicURL is PUBLIC_URL without a trailing slash, which share links
+// point at; "" uses the request's host.
+var publicURL string
+
+// ShareLink is a picture's share code and the link to its landing page.
+type ShareLink struct {
+	Code      string `json:"code"`
+	PictureID string `json:"pictureId"`
+	URL       string `json:"url"`
+}
+
+// newShareCode returns a random share code.
+func newShareCode() (string, error) {
+	max := big.NewInt(int64(len(shareCodeAlphabet)))
+	code := make([]byte, shareCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = shareCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// baseURL returns the address clients reach the server at: PUBLIC_URL, or
+// the request's host.
+func baseURL(r *http.Request) string {
+	if publicURL != "" {
+		return publicURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// absoluteURL makes a picture URL served by us absolute; URLs of a public
+// bucket already are.
+func absoluteURL(r *http.Request, u string) string {
+	if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
+		return u
+	}
+	return baseURL(r) + u
+}
+
+// sharedPicture returns the picture a share code points at, or nil if the
+// code is unknown or the picture isn't on the public wall.
+func sharedPicture(code string) (*Picture, error) {
+	id, err := db.GetSharedPictureID(code)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pic, err := db.GetPicture(id)
+	if err != nil || pic.Hidden {
+		return nil, nil
+	}
+	return pic, nil
+}
+
+// handleCreateShare returns the share link of a picture on the public
+// wall, creating its code on first share.
+func handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	pic, err := db.GetPicture(id)
+	if err != nil || pic.Hidden {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	code, err := db.GetOrCreateShareCode(id, newShareCode, shareCodeAttempts)
+	if err != nil {
+		logError("create share code failed: %v", err)
+		http.Error(w, "Error creating share link", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ShareLink{Code: code, PictureID: id, URL: baseURL(r) + "/p/" + code})
+}
+
+// handleResolveShare returns the picture a share code points at.
+func handleResolveShare(w http.ResponseWriter, r *http.Request) {
+	pic, err := sharedPicture(mux.Vars(r)["code"])
+	if err != nil {
+		logError("resolve share code failed: %v", err)
+		http.Error(w, "Error resolving share link", http.StatusInternalServerError)
+		return
+	}
+	if pic == nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pic)
+}
+
+var sharePage = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<meta property="og:type" content="website">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:url" content="{{.URL}}">
+<meta property="og:image" content="{{.ImageURL}}">
+{{- if .Width}}
+<meta property="og:image:width" content="{{.Width}}">
+<meta property="og:image:height" content="{{.Height}}">
+{{- end}}
+<meta name="twitter:card" content="summary_large_image">
+<style>
+body { margin: 0; min-height: 100vh; display: flex; flex-direction: column; align-items: center; justify-content: center; gap: 1rem; background: #111; color: #eee; font-family: system-ui, sans-serif; }
+img { max-width: 100vw; max-height: 80vh; object-fit: contain; }
+p { margin: 0; padding: 0 1rem; text-align: center; }
+a { color: #8cf; }
+</style>
+</head>
+<body>
+<img src="{{.ImageURL}}" alt="{{.Title}}">
+{{- if .Caption}}
+<p>{{.Caption}}</p>
+{{- end}}
+{{- if .UploadedBy}}
+<p>Uploaded by {{.UploadedBy}}</p>
+{{- end}}
+<p><a href="/">See all photos</a></p>
+</body>
+</html>
+`))
+
+// handleSharePage renders the landing page of a share link, with Open
+// Graph tags for link previews.
+func handleSharePage(w http.ResponseWriter, r *http.Request) {
+	code := mux.Vars(r)["code"]
+	pic, err := sharedPicture(code)
+	if err != nil {
+		logError("resolve share code failed: %v", err)
+		http.Error(w, "Error resolving share link", http.StatusInternalServerError)
+		return
+	}
+	if pic == nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	title := pic.Caption
+	if title == "" {
+		title = "A photo from the wall"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// Revalidated, so a picture hidden later stops being shown
+	w.Header().Set("Cache-Control", "no-cache")
+	sharePage.Execute(w, map[string]any{
+		"Title":      title,
+		"URL":        baseURL(r) + "/p/" + code,
+		"ImageURL":   absoluteURL(r, pic.URL),
+		"Width":      pic.Width,
+		"Height":     pic.Height,
+		"Caption":    pic.Caption,
+		"UploadedBy": pic.UploadedBy,
+	})
+}
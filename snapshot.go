@@ -0,0 +1,183 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GET /api/admin/snapshot streams a tar.gz of a snapshot of the database
+// and the image files, laid out as the server's own directories, so that an
+// organizer can take a full copy home from a browser. Only one snapshot is
+// streamed at a time and at most SNAPSHOT_RATE_MB per second, so that it
+// doesn't starve the guests' uploads and the displays.
+var (
+	snapshotRate reloadable[int64]
+	snapshotMu   sync.Mutex
+
+	snapshotsServed   atomic.Uint64
+	snapshotsRejected atomic.Uint64
+	snapshotBytes     atomic.Uint64
+)
+
+const (
+	// snapshotRetryAfter is the Retry-After of a 429 while another
+	// snapshot is streaming
+	snapshotRetryAfter = time.Minute
+	// snapshotStallTimeout is how long a client may take to accept each
+	// write before the snapshot is abandoned
+	snapshotStallTimeout = time.Minute
+)
+
+// snapshotDirs are the directories of the snapshot the files of each area
+// are put in.
+var snapshotDirs = map[string]string{
+	"original":  "uploads/original/",
+	"uploads":   "uploads/",
+	"projector": "projector/",
+}
+
+// throttledWriter writes at most rate bytes per second to w, 0 for no
+// limit, and pushes back the write deadline of the response before every
+// write, so that only a client that stops reading is cut off.
+type throttledWriter struct {
+	w       io.Writer
+	rc      *http.ResponseController
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	if t.rate > 0 {
+		due := t.start.Add(time.Duration(float64(t.written) / float64(t.rate) * float64(time.Second)))
+		time.Sleep(time.Until(due))
+	}
+	t.rc.SetWriteDeadline(time.Now().Add(snapshotStallTimeout))
+	n, err := t.w.Write(p)
+	t.written += int64(n)
+	return n, err
+}
+
+// handleSnapshot streams a tar.gz of the database and the image files.
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !snapshotMu.TryLock() {
+		snapshotsRejected.Add(1)
+		w.Header().Set("Retry-After", strconv.Itoa(int(snapshotRetryAfter.Seconds())))
+		http.Error(w, "A snapshot is already being downloaded", http.StatusTooManyRequests)
+		return
+	}
+	defer snapshotMu.Unlock()
+
+	// The database is copied first, so that a failure can still be
+	// answered with an error
+	dir, err := os.MkdirTemp("", "picsapp-snapshot-")
+	if err != nil {
+		logError("snapshot: %v", err)
+		http.Error(w, "Error creating snapshot", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "picsapp.db")
+	if err := db.Snapshot(dbFile); err != nil {
+		logError("snapshot: database: %v", err)
+		http.Error(w, "Error creating snapshot", http.StatusInternalServerError)
+		return
+	}
+	sources, err := backupSources()
+	if err != nil {
+		logError("snapshot: %v", err)
+		http.Error(w, "Error creating snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	name := "picsapp-snapshot-" + time.Now().UTC().Format(backupIDFormat)
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.tar.gz"`)
+	tw := &throttledWriter{w: w, rc: http.NewResponseController(w), rate: snapshotRate.Load(), start: time.Now()}
+	// Images are WebP or JPEG already; compressing them harder would only
+	// cost CPU
+	gz, _ := gzip.NewWriterLevel(tw, gzip.BestSpeed)
+	tarw := tar.NewWriter(gz)
+	files, err := writeSnapshot(r.Context(), tarw, name+"/", dbFile, sources)
+	if err == nil {
+		err = tarw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	snapshotBytes.Add(uint64(tw.written))
+	if err != nil {
+		// Too late for an error status; the client gets a truncated
+		// archive
+		logWarn("snapshot: stopped after %d files: %v", files, err)
+		return
+	}
+	snapshotsServed.Add(1)
+	logInfo("snapshot: sent %d files (%.1f MB) in %s", files, float64(tw.written)/(1<<20), time.Since(tw.start).Round(time.Second))
+}
+
+// writeSnapshot writes the database file and the files of sources to tw
+// under prefix, and returns how many files it wrote. Files missing from
+// their store are skipped.
+func writeSnapshot(ctx context.Context, tw *tar.Writer, prefix, dbFile string, sources []backupSource) (int, error) {
+	f, err := os.Open(dbFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err := writeTarFile(tw, prefix+"picsapp.db", f, info.Size(), info.ModTime()); err != nil {
+		return 0, err
+	}
+	files := 1
+	for _, src := range sources {
+		if err := ctx.Err(); err != nil {
+			return files, err
+		}
+		info, err := src.store.Stat(ctx, src.key)
+		if err != nil {
+			logWarn("snapshot: %s/%s: %v", src.area, src.key, err)
+			continue
+		}
+		f, err := src.store.Get(ctx, src.key)
+		if err != nil {
+			logWarn("snapshot: %s/%s: %v", src.area, src.key, err)
+			continue
+		}
+		err = writeTarFile(tw, prefix+snapshotDirs[src.area]+src.key, f, info.Size, info.ModTime)
+		f.Close()
+		if err != nil {
+			return files, fmt.Errorf("%s/%s: %w", src.area, src.key, err)
+		}
+		files++
+	}
+	return files, nil
+}
+
+// writeTarFile writes size bytes of r to tw as the file name.
+func writeTarFile(tw *tar.Writer, name string, r io.Reader, size int64, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime,
+	}); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tw, r, size)
+	return err
+}
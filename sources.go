@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Every picture records how it arrived, so that admins can tell a batch
+// a script posted twice from one the hot folder adopted again. The source
+// is set when the upload is queued and carried from the conversion task
+// to the picture; pictures from before it was recorded have none.
+const (
+	// sourceWeb is an upload from a browser through /api/upload
+	sourceWeb = "web"
+	// sourceAPI is an upload to /api/upload with a bearer token, as
+	// scripts and importers send
+	sourceAPI = "api"
+	// sourceHotFolder is an image adopted from INGEST_DIR
+	sourceHotFolder = "hot_folder"
+	// sourceRecovered is an original found without a conversion task at
+	// startup, such as a file copied into the originals by hand
+	sourceRecovered = "recovered"
+	// sourceSeed is an image imported with picsapp seed
+	sourceSeed = "seed"
+	// sourceUnknown counts the pictures from before sources in stats
+	sourceUnknown = "unknown"
+)
+
+// uploadSource returns the source of an upload to /api/upload.
+func uploadSource(r *http.Request) string {
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return sourceAPI
+	}
+	return sourceWeb
+}
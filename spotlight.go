@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A spotlight is one picture chosen for the big screen. Pictures shown to
+// a display within spotlightCooldown are held back, and come back
+// gradually as the cooldown runs out.
+var spotlightCooldown reloadable[time.Duration]
+
+const (
+	// spotlightRecencyHalfLife is how fast the recency score of an upload
+	// fades.
+	spotlightRecencyHalfLife = 20 * time.Minute
+
+	// trendHalfLife is how fast a like stops counting towards a picture's
+	// trend.
+	trendHalfLife = 10 * time.Minute
+
+	// trendScale is the trend at which the trending score reaches 63%.
+	trendScale = 5.0
+
+	// popularityWeight scales the score of a picture's total likes,
+	// relative to the event's most liked picture.
+	popularityWeight = 0.5
+)
+
+// Spotlight reasons: the part of the score that made a picture win.
+const (
+	reasonRecent   = "recent"
+	reasonTrending = "trending"
+	reasonPopular  = "popular"
+)
+
+// SpotlightResponse is returned by /api/presentation/spotlight.
+type SpotlightResponse struct {
+	Picture *Picture `json:"picture"`
+	Reason  string   `json:"reason"`
+	Score   float64  `json:"score"`
+}
+
+// likeTrends keeps an exponentially decaying like count per picture, so
+// pictures being liked right now can be told from ones liked long ago.
+type likeTrends struct {
+	mu       sync.Mutex
+	pictures map[burstKey]*trend
+}
+
+type trend struct {
+	value float64
+	at    time.Time
+}
+
+func newLikeTrends() *likeTrends {
+	return &likeTrends{pictures: make(map[burstKey]*trend)}
+}
+
+func (t *trend) decayed(now time.Time) float64 {
+	return t.value * math.Exp2(-float64(now.Sub(t.at))/float64(trendHalfLife))
+}
+
+// record counts a like received at now.
+func (l *likeTrends) record(event, id string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := burstKey{event, id}
+	t, ok := l.pictures[key]
+	if !ok {
+		t = &trend{}
+		l.pictures[key] = t
+	}
+	t.value = t.decayed(now) + 1
+	t.at = now
+}
+
+// score returns a picture's decayed like count at now.
+func (l *likeTrends) score(event, id string, now time.Time) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t, ok := l.pictures[burstKey{event, id}]; ok {
+		return t.decayed(now)
+	}
+	return 0
+}
+
+// sweep forgets pictures whose trend has faded out.
+func (l *likeTrends) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, t := range l.pictures {
+		if t.decayed(now) < 0.01 {
+			delete(l.pictures, key)
+		}
+	}
+}
+
+// pickSpotlight scores pictures on how recent they are, how fast they are
+// being liked and how many likes they have, damps the ones shown within
+// the cooldown (lastShown holds when each was last shown) and returns the
+// best. If every picture is cooling down, the one shown longest ago wins.
+func pickSpotlight(pictures []*Picture, lastShown map[string]time.Time, trendOf func(*Picture) float64, now time.Time) *SpotlightResponse {
+	maxLikes := 0
+	for _, p := range pictures {
+		if p.Likes > maxLikes {
+			maxLikes = p.Likes
+		}
+	}
+
+	var best *SpotlightResponse
+	var oldest *Picture
+	for _, p := range pictures {
+		age := now.Sub(p.UploadedAt)
+		if age < 0 {
+			age = 0
+		}
+		parts := map[string]float64{
+			reasonRecent:   math.Exp2(-float64(age) / float64(spotlightRecencyHalfLife)),
+			reasonTrending: 1 - math.Exp(-trendOf(p)/trendScale),
+		}
+		if maxLikes > 0 {
+			parts[reasonPopular] = popularityWeight * float64(p.Likes) / float64(maxLikes)
+		}
+		reason, score := reasonRecent, 0.0
+		for _, r := range []string{reasonRecent, reasonTrending, reasonPopular} {
+			score += parts[r]
+			if parts[r] > parts[reason] {
+				reason = r
+			}
+		}
+
+		if shown, ok := lastShown[p.ID]; ok {
+			if oldest == nil || shown.Before(lastShown[oldest.ID]) {
+				oldest = p
+			}
+			if since, cooldown := now.Sub(shown), spotlightCooldown.Load(); since < cooldown {
+				f := float64(since) / float64(cooldown)
+				score *= f * f
+			}
+		}
+		if score > 0 && (best == nil || score > best.Score) {
+			best = &SpotlightResponse{Picture: p, Reason: reason, Score: score}
+		}
+	}
+	if best == nil && oldest != nil {
+		best = &SpotlightResponse{Picture: oldest, Reason: reasonRecent}
+	}
+	if best != nil {
+		best.Score = math.Round(best.Score*1000) / 1000
+	}
+	return best
+}
+
+// handleSpotlight picks the next picture to spotlight on a display and
+// records that it was shown, except in read-only mode. Displays are told apart by their display
+// token, or by a ?display= name chosen by the client.
+func handleSpotlight(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	screen := r.URL.Query().Get("display")
+	display, err := displayFromRequest(r)
+	switch {
+	case errors.Is(err, errUnknownDisplay), errors.Is(err, errDisplayRevoked):
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	case err != nil:
+		logError("get display failed: %v", err)
+		http.Error(w, "Error checking token", http.StatusInternalServerError)
+		return
+	case display != nil && display.EventID != event:
+		http.Error(w, "Display belongs to another event", http.StatusForbidden)
+		return
+	case display != nil:
+		screen = display.ID
+	case screen != "" && !eventIDPattern.MatchString(screen):
+		http.Error(w, "Invalid display", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	pictures, err := db.GetAllPicturesSortedByLikes(event)
+	if err != nil {
+		logError("get pictures for spotlight failed: %v", err)
+		http.Error(w, "Error fetching pictures", http.StatusInternalServerError)
+		return
+	}
+	cooldown := spotlightCooldown.Load()
+	lastShown, err := db.GetSpotlightHistory(event, screen, now.Add(-cooldown))
+	if err != nil {
+		logError("get spotlight history failed: %v", err)
+		http.Error(w, "Error fetching pictures", http.StatusInternalServerError)
+		return
+	}
+	spotlight := pickSpotlight(pictures, lastShown, func(p *Picture) float64 {
+		return hub.trends.score(event, p.ID, now)
+	}, now)
+	if spotlight == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !readOnly.Load() {
+		if err := db.RecordSpotlight(event, screen, spotlight.Picture.ID, now, now.Add(-cooldown)); err != nil {
+			logWarn("record spotlight failed: %v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(spotlight)
+}
@@ -1,14 +1,18 @@
 import React from 'react';
 import { BrowserRouter as Router, Routes, Route, NavLink, useLocation } from 'react-router-dom';
 import MainPage from './components/MainPage';
+import AccessGate from './components/AccessGate';
 import Presentation from './components/Presentation';
+import Remote from './components/Remote';
 import './App.css';
 
 const NavLinks = () => {
+  // Keep ?event= when switching pages so both views show the same gallery
+  const { search } = useLocation();
   return (
     <nav className="navbar">
-      <NavLink to="/" className={({ isActive }) => `nav-link ${isActive ? 'active' : ''}`}>Home</NavLink>
-      <NavLink to="/presentation" className={({ isActive }) => `nav-link ${isActive ? 'active' : ''}`}>Presentation</NavLink>
+      <NavLink to={{ pathname: '/', search }} className={({ isActive }) => `nav-link ${isActive ? 'active' : ''}`}>Home</NavLink>
+      <NavLink to={{ pathname: '/presentation', search }} className={({ isActive }) => `nav-link ${isActive ? 'active' : ''}`}>Presentation</NavLink>
     </nav>
   );
 };
@@ -19,8 +23,9 @@ function App() {
       <div className="app">
         <NavLinks />
         <Routes>
-          <Route path="/" element={<MainPage />} />
+          <Route path="/" element={<AccessGate><MainPage /></AccessGate>} />
           <Route path="/presentation" element={<Presentation />} />
+          <Route path="/remote" element={<Remote />} />
         </Routes>
       </div>
     </Router>
@@ -0,0 +1,77 @@
+import React, { useEffect, useState } from 'react';
+import { withEvent } from '../event';
+import './AccessGate.css';
+
+// AccessGate shows its children once the request has access to the event:
+// invite-only events (an access code set by an admin) ask for the code
+// first, and the server remembers it in a cookie.
+function AccessGate({ children }) {
+  // null while checking, then whether the page may show the event
+  const [granted, setGranted] = useState(null);
+  const [code, setCode] = useState('');
+  const [error, setError] = useState('');
+  const [submitting, setSubmitting] = useState(false);
+
+  useEffect(() => {
+    fetch(withEvent('/api/access'))
+      .then((response) => (response.ok ? response.json() : null))
+      .then((access) => setGranted(!access || access.granted))
+      .catch((error) => {
+        console.error('Error checking event access:', error);
+        setGranted(true);
+      });
+  }, []);
+
+  const handleSubmit = async (e) => {
+    e.preventDefault();
+    setSubmitting(true);
+    setError('');
+    try {
+      const response = await fetch(withEvent('/api/access'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ code }),
+      });
+      if (response.ok) {
+        setGranted(true);
+      } else {
+        // Wrong code or too many attempts: say why
+        setError(await response.text());
+      }
+    } catch (error) {
+      console.error('Error entering access code:', error);
+      setError('Something went wrong. Please try again.');
+    } finally {
+      setSubmitting(false);
+    }
+  };
+
+  if (granted === null) {
+    return <div className="loading">Loading...</div>;
+  }
+  if (granted) {
+    return children;
+  }
+  return (
+    <form className="access-gate" onSubmit={handleSubmit}>
+      <h2>This event is private</h2>
+      <p>Enter the access code from your invitation to see the photos.</p>
+      <input
+        type="text"
+        value={code}
+        onChange={(e) => setCode(e.target.value)}
+        placeholder="Access code"
+        autoComplete="off"
+        autoCapitalize="off"
+        aria-label="Access code"
+        autoFocus
+      />
+      <button type="submit" disabled={submitting || !code.trim()}>
+        {submitting ? 'Checking…' : 'Enter'}
+      </button>
+      {error && <div className="access-error" role="alert">{error}</div>}
+    </form>
+  );
+}
+
+export default AccessGate;
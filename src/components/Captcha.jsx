@@ -0,0 +1,72 @@
+import React, { useEffect, useRef } from 'react';
+
+// Widget scripts of the providers the server can ask for (CAPTCHA_PROVIDER)
+const SCRIPTS = {
+  hcaptcha: { src: 'https://js.hcaptcha.com/1/api.js?render=explicit', global: 'hcaptcha' },
+  turnstile: { src: 'https://challenges.cloudflare.com/turnstile/v0/api.js?render=explicit', global: 'turnstile' },
+};
+
+const loading = {};
+
+// Loads a provider's script once and resolves with its global API.
+function loadScript(provider) {
+  const { src, global } = SCRIPTS[provider];
+  if (!loading[provider]) {
+    loading[provider] = new Promise((resolve, reject) => {
+      const script = document.createElement('script');
+      script.src = src;
+      script.async = true;
+      script.onload = () => resolve(window[global]);
+      script.onerror = () => {
+        delete loading[provider];
+        reject(new Error(`Failed to load ${provider}`));
+      };
+      document.head.appendChild(script);
+    });
+  }
+  return loading[provider];
+}
+
+// Captcha renders the upload challenge and reports its token through
+// onToken, or null once it expires. Changing resetKey resets the widget
+// for the next upload, as tokens can only be used once.
+function Captcha({ provider, siteKey, onToken, resetKey }) {
+  const containerRef = useRef(null);
+  const widgetRef = useRef(null);
+  const apiRef = useRef(null);
+
+  useEffect(() => {
+    let cancelled = false;
+    loadScript(provider)
+      .then((api) => {
+        if (cancelled || !containerRef.current) {
+          return;
+        }
+        apiRef.current = api;
+        widgetRef.current = api.render(containerRef.current, {
+          sitekey: siteKey,
+          callback: (token) => onToken(token),
+          'expired-callback': () => onToken(null),
+        });
+      })
+      .catch((error) => console.error('CAPTCHA error:', error));
+    return () => {
+      cancelled = true;
+      if (apiRef.current && widgetRef.current !== null) {
+        apiRef.current.remove(widgetRef.current);
+      }
+      widgetRef.current = null;
+    };
+  }, [provider, siteKey]);
+
+  useEffect(() => {
+    if (resetKey && apiRef.current && widgetRef.current !== null) {
+      apiRef.current.reset(widgetRef.current);
+      onToken(null);
+    }
+  }, [resetKey]);
+
+  return <div className="upload-captcha" ref={containerRef}></div>;
+}
+
+export default Captcha;
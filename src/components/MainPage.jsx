@@ -1,14 +1,40 @@
 import React, { useState, useEffect, useRef } from 'react';
 import Upload from './Upload';
+import Captcha from './Captcha';
 import PictureGrid from './PictureGrid';
+import { applyHubMessage, createStreamPosition, hubProtocols, parseHubFrame, restartDelay, resumeUrl, sendAction, SERVER_FULL, SERVER_FULL_RETRY_MS, SERVICE_RESTART, trackMessage } from '../hubMessages';
+import { withEvent } from '../event';
 import './MainPage.css';
 
+// Times an upload answered 503 (server busy) is retried
+const UPLOAD_BUSY_RETRIES = 5;
+// How long a milestone of one of the guest's pictures is celebrated, in ms
+const MILESTONE_SHOW_MS = 8000;
+// How long the receipt of one of the guest's uploads is shown, in ms
+const RECEIPT_SHOW_MS = 20000;
+
 function MainPage() {
   const [pictures, setPictures] = useState([]);
   const [loading, setLoading] = useState(true);
   const [dragActive, setDragActive] = useState(false);
   const [uploading, setUploading] = useState(false);
   const [uploadMessage, setUploadMessage] = useState('');
+  // Set once the event stops accepting likes (the likesCloseAt setting)
+  const [likesClosed, setLikesClosed] = useState(false);
+  // Like milestone one of the guest's own pictures just reached
+  const [milestone, setMilestone] = useState(null);
+  // Receipt of the guest's last converted upload, with its share link
+  const [receipt, setReceipt] = useState(null);
+  // CAPTCHA the server asks uploads for, if any, and the widget's token
+  const [captcha, setCaptcha] = useState(null);
+  const [captchaToken, setCaptchaToken] = useState(null);
+  const [captchaReset, setCaptchaReset] = useState(0);
+  // Terms of use the first upload must accept, if any, and the checkbox
+  const [terms, setTerms] = useState(null);
+  const [termsChecked, setTermsChecked] = useState(false);
+  // Providers users can sign in with, and the signed-in user
+  const [authProviders, setAuthProviders] = useState([]);
+  const [user, setUser] = useState(null);
   const fileInputRef = useRef(null);
   const wsRef = useRef(null);
 
@@ -26,7 +52,7 @@ function MainPage() {
 
   const fetchPictures = async () => {
     try {
-      const response = await fetch('/api/pictures');
+      const response = await fetch(withEvent('/api/pictures'));
       if (!response.ok) {
         throw new Error('Failed to fetch pictures');
       }
@@ -40,11 +66,36 @@ function MainPage() {
     }
   };
 
+  const fetchTerms = () => {
+    fetch('/api/upload/terms')
+      .then((response) => (response.ok ? response.json() : null))
+      .then((config) => setTerms(config && config.version && !config.accepted ? config : null))
+      .catch((error) => console.error('Error fetching terms of use:', error));
+  };
+
+  useEffect(() => {
+    fetchTerms();
+    fetch('/api/upload/captcha')
+      .then((response) => (response.ok ? response.json() : null))
+      .then((config) => setCaptcha(config && config.provider ? config : null))
+      .catch((error) => console.error('Error fetching CAPTCHA settings:', error));
+    fetch('/api/auth/config')
+      .then((response) => (response.ok ? response.json() : null))
+      .then((config) => setAuthProviders(config ? config.providers : []))
+      .catch((error) => console.error('Error fetching sign-in settings:', error));
+    fetch('/api/auth/me')
+      .then((response) => (response.ok ? response.json() : null))
+      .then(setUser)
+      .catch((error) => console.error('Error fetching user:', error));
+  }, []);
+
   useEffect(() => {
     fetchPictures();
 
     let isMounted = true;
     let reconnectTimeout = null;
+    let milestoneTimeout = null;
+    let receiptTimeout = null;
 
     // WebSocket connection
     // In development, connect directly to the Go server on port 8080
@@ -52,12 +103,14 @@ function MainPage() {
     const isDev = window.location.hostname === 'localhost' && window.location.port === '3000';
     const wsHost = isDev ? 'localhost:8080' : window.location.host;
     const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-    const wsUrl = `${protocol}//${wsHost}/ws`;
+    const wsUrl = withEvent(`${protocol}//${wsHost}/ws`);
+    const position = createStreamPosition();
 
     const connectWebSocket = () => {
       if (!isMounted) return;
 
-      const ws = new WebSocket(wsUrl);
+      const ws = new WebSocket(resumeUrl(wsUrl, position), hubProtocols());
+      ws.binaryType = 'arraybuffer';
 
       ws.onopen = () => {
         console.log('WebSocket connected');
@@ -70,9 +123,50 @@ function MainPage() {
 
       ws.onmessage = (event) => {
         try {
-          const data = JSON.parse(event.data);
+          const message = parseHubFrame(event.data);
+          if (!trackMessage(position, message)) {
+            // Missed a frame: reconnect for a fresh snapshot
+            ws.close(4000, 'resync');
+            return;
+          }
+          if (message.type === 'error') {
+            if (isMounted && message.payload && message.payload.message === 'likes closed') {
+              setLikesClosed(true);
+              return;
+            }
+            console.warn('WebSocket request rejected:', message.payload);
+            return;
+          }
+          if (message.type === 'likes_closed') {
+            if (isMounted) {
+              setLikesClosed(true);
+            }
+            return;
+          }
+          if (message.type === 'own_milestone') {
+            if (isMounted && message.payload) {
+              setMilestone(message.payload);
+              clearTimeout(milestoneTimeout);
+              milestoneTimeout = setTimeout(() => setMilestone(null), MILESTONE_SHOW_MS);
+            }
+            return;
+          }
+          if (message.type === 'upload_receipt') {
+            if (isMounted && message.payload) {
+              setReceipt(message.payload);
+              setUploadMessage('');
+              clearTimeout(receiptTimeout);
+              receiptTimeout = setTimeout(() => setReceipt(null), RECEIPT_SHOW_MS);
+            }
+            return;
+          }
+          if ((message.type === 'snapshot' || message.type === 'settings') && isMounted && message.payload && message.payload.settings) {
+            // A cutoff still ahead is announced with likes_closed
+            const closeAt = message.payload.settings.likesCloseAt;
+            setLikesClosed(Boolean(closeAt) && new Date(closeAt).getTime() <= Date.now());
+          }
           if (isMounted) {
-            setPictures(selectHomePictures(data));
+            setPictures((prev) => selectHomePictures(applyHubMessage(prev, message)));
             setLoading(false);
             setUploadMessage('');
           }
@@ -88,7 +182,22 @@ function MainPage() {
       ws.onclose = (event) => {
         if (!isMounted) return;
 
-        if (event.wasClean) {
+        if (event.code === SERVER_FULL) {
+          console.log('WebSocket server full, polling instead');
+          fetchPictures();
+          reconnectTimeout = setTimeout(() => {
+            if (isMounted) {
+              connectWebSocket();
+            }
+          }, SERVER_FULL_RETRY_MS);
+        } else if (event.code === SERVICE_RESTART) {
+          console.log('WebSocket server restarting, reconnecting shortly...');
+          reconnectTimeout = setTimeout(() => {
+            if (isMounted) {
+              connectWebSocket();
+            }
+          }, restartDelay());
+        } else if (event.wasClean && event.code !== 4000) {
           console.log('WebSocket disconnected cleanly');
         } else {
           console.log('WebSocket connection lost, attempting to reconnect...');
@@ -111,6 +220,8 @@ function MainPage() {
       if (reconnectTimeout) {
         clearTimeout(reconnectTimeout);
       }
+      clearTimeout(milestoneTimeout);
+      clearTimeout(receiptTimeout);
       if (wsRef.current) {
         if (wsRef.current.readyState === WebSocket.OPEN || wsRef.current.readyState === WebSocket.CONNECTING) {
           wsRef.current.close();
@@ -124,20 +235,59 @@ function MainPage() {
       alert('Please select an image file');
       return;
     }
+    if (captcha && !captchaToken) {
+      alert('Please complete the challenge below the upload area first');
+      return;
+    }
+    if (terms && !termsChecked) {
+      alert('Please accept the terms of use below the upload area first');
+      return;
+    }
 
     setUploading(true);
     const formData = new FormData();
     formData.append('picture', file);
+    if (captcha) {
+      formData.append('captcha', captchaToken);
+    }
+    if (terms) {
+      formData.append('acceptTerms', terms.version);
+    }
 
     try {
-      const response = await fetch('/api/upload', {
-        method: 'POST',
-        body: formData,
-      });
+      let response;
+      // A busy server answers 503 with Retry-After; wait and try again
+      for (let attempt = 0; ; attempt++) {
+        response = await fetch(withEvent('/api/upload'), {
+          method: 'POST',
+          body: formData,
+        });
+        if (response.status !== 503 || attempt >= UPLOAD_BUSY_RETRIES) {
+          break;
+        }
+        const retryAfter = Number(response.headers.get('Retry-After')) || 5;
+        setUploadMessage('Server busy, retrying…');
+        await new Promise((resolve) => setTimeout(resolve, retryAfter * 1000));
+      }
 
       if (response.ok) {
         setUploadMessage('Image queued. Processing…');
+        // Accepted with this upload
+        setTerms(null);
+      } else if (response.status === 428) {
+        // The terms changed since they were shown: show the new ones
+        setUploadMessage('');
+        setTermsChecked(false);
+        fetchTerms();
+        alert(await response.text());
+      } else if ([401, 403, 413, 502, 507].includes(response.status)) {
+        // Signed out with REQUIRE_SIGNIN, too large, refused (a ban, an
+        // upload limit or the CAPTCHA), or the server is out of disk
+        // space: say why
+        setUploadMessage('');
+        alert(await response.text());
       } else {
+        setUploadMessage('');
         alert('Upload failed. Please try again.');
       }
     } catch (error) {
@@ -145,6 +295,10 @@ function MainPage() {
       alert('Upload failed. Please try again.');
     } finally {
       setUploading(false);
+      if (captcha) {
+        // Tokens are single-use
+        setCaptchaReset((n) => n + 1);
+      }
     }
   };
 
@@ -182,10 +336,19 @@ function MainPage() {
   };
 
   const handleLike = async (id) => {
+    if (likesClosed) {
+      return;
+    }
+    if (sendAction(wsRef.current, 'like', { id })) {
+      return;
+    }
     try {
-      await fetch(`/api/pictures/${id}/like`, {
+      const response = await fetch(`/api/pictures/${id}/like`, {
         method: 'POST',
       });
+      if (response.status === 403) {
+        setLikesClosed(true);
+      }
     } catch (error) {
       console.error('Error liking picture:', error);
     }
@@ -200,14 +363,72 @@ function MainPage() {
       onDrop={handleDrop}
     >
       <div className="container">
+        {user ? (
+          <div className="signin">Signed in as {user.name || user.username}</div>
+        ) : authProviders.length > 0 && (
+          <div className="signin">
+            {authProviders.map((provider) => (
+              <a
+                key={provider.id}
+                className="signin-link"
+                href={`/api/auth/oauth/${provider.id}/login?next=${encodeURIComponent(window.location.pathname + window.location.search)}`}
+              >
+                Sign in with {provider.name}
+              </a>
+            ))}
+          </div>
+        )}
         <Upload 
           fileInputRef={fileInputRef}
           onFileSelect={handleFileInput}
           uploading={uploading}
         />
+        {captcha && (
+          <Captcha
+            provider={captcha.provider}
+            siteKey={captcha.siteKey}
+            onToken={setCaptchaToken}
+            resetKey={captchaReset}
+          />
+        )}
+        {terms && (
+          <div className="terms">
+            <div className="terms-text">{terms.text}</div>
+            <label className="terms-accept">
+              <input
+                type="checkbox"
+                checked={termsChecked}
+                onChange={(e) => setTermsChecked(e.target.checked)}
+              />
+              I accept the terms of use
+            </label>
+          </div>
+        )}
         {uploadMessage && (
           <div className="upload-status">{uploadMessage}</div>
         )}
+        {receipt && (
+          <div className="upload-receipt" role="status">
+            {receipt.shareUrl ? (
+              <span>Your picture is up! Share it: <a href={receipt.shareUrl}>{receipt.shareUrl}</a></span>
+            ) : receipt.hidden ? (
+              <span>Your picture will appear once it's approved.</span>
+            ) : receipt.status === 'failed' ? (
+              <span>Your picture couldn't be processed.</span>
+            ) : (
+              <span>Your picture is up!</span>
+            )}
+          </div>
+        )}
+        {milestone && (
+          <div className="own-milestone" role="status">
+            {milestone.picture && <img src={milestone.picture.url} alt="" />}
+            <span>🎉 Your picture just reached {milestone.likes} likes!</span>
+          </div>
+        )}
+        {likesClosed && (
+          <div className="likes-closed" role="status">Voting is over, the results are in. Thanks for taking part!</div>
+        )}
         {loading ? (
           <div className="loading">Loading pictures...</div>
         ) : (
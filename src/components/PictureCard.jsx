@@ -4,6 +4,7 @@ import './PictureCard.css';
 function PictureCard({ picture, onLike }) {
   const [liked, setLiked] = useState(false);
   const [imageLoaded, setImageLoaded] = useState(false);
+  const [copied, setCopied] = useState(false);
 
   const handleLike = (e) => {
     e.stopPropagation();
@@ -14,10 +15,32 @@ function PictureCard({ picture, onLike }) {
     }
   };
 
+  // Shares the picture's short link, through the share sheet where there
+  // is one and the clipboard otherwise
+  const handleShare = async (e) => {
+    e.stopPropagation();
+    try {
+      const response = await fetch(`/api/pictures/${encodeURIComponent(picture.id)}/share`, { method: 'POST' });
+      if (!response.ok) return;
+      const { url } = await response.json();
+      if (navigator.share) {
+        await navigator.share({ url, title: picture.caption || undefined });
+      } else {
+        await navigator.clipboard.writeText(url);
+        setCopied(true);
+        setTimeout(() => setCopied(false), 2000);
+      }
+    } catch (error) {
+      // Closing the share sheet rejects too
+      console.error('Error sharing picture:', error);
+    }
+  };
+
   return (
     <div className="picture-card">
       <div className="picture-wrapper">
         {!imageLoaded && <div className="image-placeholder" />}
+        {picture.isNew && <span className="new-badge">New</span>}
         <img
           src={picture.url}
           alt={picture.filename}
@@ -26,6 +49,9 @@ function PictureCard({ picture, onLike }) {
           style={{ display: imageLoaded ? 'block' : 'none' }}
         />
         <div className="picture-overlay">
+          {picture.uploadedBy && (
+            <span className="picture-uploader">{picture.uploadedBy}</span>
+          )}
           <button
             className={`like-button ${liked ? 'liked' : ''}`}
             onClick={handleLike}
@@ -34,6 +60,22 @@ function PictureCard({ picture, onLike }) {
             <span className="like-icon">❤️</span>
             <span className="like-count">{picture.likes}</span>
           </button>
+          <button
+            className="share-button"
+            onClick={handleShare}
+            aria-label="Share picture"
+          >
+            {copied ? 'Link copied' : 'Share'}
+          </button>
+          <a
+            className="share-button"
+            href={`/api/pictures/${encodeURIComponent(picture.id)}/original`}
+            onClick={(e) => e.stopPropagation()}
+            aria-label="Save picture"
+            download
+          >
+            Save
+          </a>
         </div>
       </div>
     </div>
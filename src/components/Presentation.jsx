@@ -1,10 +1,118 @@
 import React, { useState, useEffect, useRef } from 'react';
+import { applyHubMessage, createStreamPosition, hubFilterParams, hubProtocols, leaderboardSize, parseHubFrame, restartDelay, resumeUrl, sendAction, SERVER_FULL, SERVER_FULL_RETRY_MS, SERVICE_RESTART, slideImageUrl, sortByLikes, trackMessage, withToken } from '../hubMessages';
+import { withEvent } from '../event';
 import './Presentation.css';
 
+// Display settings used until the server sends the event's presentation
+// settings (GET/PUT /api/presentation/settings).
+const DEFAULT_SETTINGS = {
+  slideInterval: 8,
+  transition: 'fade',
+  ordering: 'likes',
+  showLikes: true,
+  interruptOnUpload: false,
+  playlist: '',
+};
+
+// Playlist chosen in the page URL (?playlist=), which a kiosk display
+// keeps across reloads. It takes precedence over the remote and the
+// event's settings.
+const PAGE_PLAYLIST = new URLSearchParams(window.location.search).get('playlist') || '';
+
+// Kiosk displays, which carry a display token in the page URL, report each
+// slide they show so the server can bring round the pictures they haven't
+// shown lately (ROTATION_MINUTES).
+const IS_DISPLAY = (new URLSearchParams(window.location.search).get('token') || '').startsWith('dsp_');
+
+// Number of upcoming slides whose images are loaded ahead of time.
+const PRELOAD_SLIDES = 2;
+
+// Pictures asked for per more message after a snapshot of a large gallery.
+const PICTURE_PAGE = 100;
+
+// How long the winners of a contest round stay on screen once it closes.
+const CONTEST_RESULT_MS = 30000;
+
+// A guestbook message takes the turn of every GUESTBOOK_EVERY-th slide.
+const GUESTBOOK_EVERY = 5;
+
+// Returns the slideshow order: the IDs of the pictures in the order the
+// server returned them (see the presentation ordering setting), followed by
+// pictures added since. A playlist is closed: only its own pictures are
+// shown.
+function slideIds(pictures, order, closed) {
+  const present = new Set(pictures.map((pic) => pic.id));
+  const ids = order.filter((id) => present.has(id));
+  if (closed) {
+    return ids;
+  }
+  const ordered = new Set(ids);
+  pictures.forEach((pic) => {
+    if (!ordered.has(pic.id)) {
+      ids.push(pic.id);
+    }
+  });
+  return ids;
+}
+
+// Returns the ID delta places after currentId, wrapping around. Coming
+// from the leaderboard, next starts at the first slide and previous at the
+// last one.
+function stepSlide(ids, currentId, delta) {
+  if (ids.length === 0) {
+    return null;
+  }
+  const index = ids.indexOf(currentId);
+  if (index === -1) {
+    return ids[delta > 0 ? 0 : ids.length - 1];
+  }
+  return ids[(index + delta + ids.length) % ids.length];
+}
+
+// Returns the announcement to show: high priority before normal, newest
+// first among equals. Expired announcements are ignored.
+function currentAnnouncement(announcements, now) {
+  const rank = (a) => (a.priority === 'high' ? 1 : 0);
+  return announcements
+    .filter((a) => new Date(a.expiresAt).getTime() > now)
+    .sort((a, b) => rank(b) - rank(a) || b.id - a.id)[0] || null;
+}
+
 function Presentation() {
   const [pictures, setPictures] = useState([]);
   const [loading, setLoading] = useState(true);
+  const [watching, setWatching] = useState(0);
+  const [reactions, setReactions] = useState([]);
+  // Pictures in a like burst, by ID, mapped to the burst's magnitude
+  const [bursts, setBursts] = useState({});
+  // Set by the remote control (/remote): the picture shown full screen, or
+  // null for the leaderboard
+  const [slideId, setSlideId] = useState(null);
+  const slideIdRef = useRef(null);
+  const slideOrderRef = useRef([]);
+  const [paused, setPaused] = useState(false);
+  // Announcements pushed by admins (POST /api/admin/announce)
+  const [announcements, setAnnouncements] = useState([]);
+  // Guestbook messages (GET /api/guestbook) interleaved with the slides,
+  // and the one on screen instead of a slide, or null
+  const guestbookRef = useRef([]);
+  const guestbookNextRef = useRef(0);
+  const slidesSinceWishRef = useRef(0);
+  const [wish, setWish] = useState(null);
+  // Contest round whose winners are on screen (POST
+  // /api/admin/contest/rounds/{id}/close)
+  const [contestResult, setContestResult] = useState(null);
+  // Announced round counting down to its winners ({ round, revealAt }),
+  // and the seconds left (POST /api/admin/contest/{id}/announce)
+  const [contestReveal, setContestReveal] = useState(null);
+  const [revealCountdown, setRevealCountdown] = useState(0);
+  const [settings, setSettings] = useState(DEFAULT_SETTINGS);
+  // Scheduled presentation mode ({ mode, until, next }); null while the
+  // event has no schedule
+  const [mode, setMode] = useState(null);
+  const settingsRef = useRef(DEFAULT_SETTINGS);
   const wsRef = useRef(null);
+  const picturesRef = useRef([]);
   const prevPositionsRef = useRef(new Map());
   const [swappingIds, setSwappingIds] = useState(new Set());
   const [isInitialLoad, setIsInitialLoad] = useState(true);
@@ -24,13 +132,116 @@ function Presentation() {
   const prevOrderRef = useRef([]);
   const animStateRef = useRef({ active: false, progress: 0, start: {}, end: {}, startOrder: [], endOrder: [] });
 
+  // Playlist picked with the remote for this display, or null to follow
+  // the event's settings
+  const playlistOverrideRef = useRef(null);
+
+  slideIdRef.current = slideId;
+
+  const activePlaylist = () => PAGE_PLAYLIST || playlistOverrideRef.current || settingsRef.current.playlist || '';
+
+  const presentationUrl = () => {
+    const playlist = activePlaylist();
+    const url = withToken(withEvent('/api/presentation'));
+    if (!playlist) {
+      return url;
+    }
+    return `${url}${url.includes('?') ? '&' : '?'}playlist=${encodeURIComponent(playlist)}`;
+  };
+
+  // Fetches a new slideshow order. Random orderings differ on every fetch.
+  const refreshSlideOrder = () => fetch(presentationUrl())
+    .then((res) => (res.ok ? res.json() : Promise.reject(new Error('Failed to fetch presentation'))))
+    .then((data) => {
+      if (Array.isArray(data)) {
+        slideOrderRef.current = data.map((pic) => pic.id);
+      }
+    })
+    .catch((err) => console.error('Error fetching slideshow order:', err));
+
+  // Moves the slideshow delta slides along. Wrapping around after the last
+  // slide fetches the order for the next round.
+  const advanceSlide = (delta) => {
+    const ids = slideIds(picturesRef.current, slideOrderRef.current, activePlaylist() !== '');
+    const current = slideIdRef.current;
+    const next = stepSlide(ids, current, delta);
+    if (delta > 0 && current !== null && ids.indexOf(next) <= ids.indexOf(current)) {
+      refreshSlideOrder();
+    }
+    slideIdRef.current = next;
+    setSlideId(next);
+    setWish(null);
+  };
+
   useEffect(() => {
     let ws = null;
     let isMounted = true;
     let reconnectTimeout = null;
+    // With ?top=N only the first N places are shown. The full list is
+    // still tracked so pictures climbing into the top N can be placed.
+    const top = leaderboardSize();
+    const visible = (list) => (top ? list.slice(0, top) : list);
+
+    // A snapshot of a large gallery carries its most liked and newest
+    // pictures; the rest of the ranking is asked for page by page and
+    // merged in as pictures messages arrive
+    const loadMorePictures = (offset, total) => {
+      if (offset >= total || (top && offset >= top)) {
+        return;
+      }
+      sendAction(ws, 'more', { offset, limit: PICTURE_PAGE });
+    };
+
+    const applyControl = ({ command, id }) => {
+      switch (command) {
+        case 'next':
+          advanceSlide(1);
+          break;
+        case 'previous':
+          advanceSlide(-1);
+          break;
+        case 'jump':
+          setSlideId(id);
+          setWish(null);
+          break;
+        case 'pause':
+          setPaused(true);
+          break;
+        case 'resume':
+          setPaused(false);
+          break;
+        case 'leaderboard':
+          setSlideId(null);
+          setWish(null);
+          setPaused(false);
+          break;
+        case 'playlist':
+          playlistOverrideRef.current = id || null;
+          refreshSlideOrder();
+          break;
+        default:
+          break;
+      }
+    };
 
-    // Initial fetch
-    fetch('/api/presentation')
+    // Follows the event's schedule: switches between the slideshow and the
+    // leaderboard, or shows the standby screen while idle
+    const applyMode = (payload) => {
+      if (!payload || payload.mode === 'manual') {
+        setMode(null);
+        return;
+      }
+      setMode(payload);
+      if (payload.mode === 'slideshow' && slideIdRef.current === null) {
+        applyControl({ command: 'next' });
+      } else if (payload.mode === 'leaderboard') {
+        applyControl({ command: 'leaderboard' });
+      }
+    };
+
+    // Fetches the full list over REST, on load and while the WebSocket
+    // server is full
+    const fetchPresentation = () => fetch(presentationUrl())
       .then((res) => {
         if (!res.ok) {
           throw new Error('Failed to fetch presentation');
@@ -39,14 +250,18 @@ function Presentation() {
       })
       .then((data) => {
         if (isMounted) {
-          const newPictures = Array.isArray(data) ? data : [];
+          const ordered = Array.isArray(data) ? data : [];
+          slideOrderRef.current = ordered.map((pic) => pic.id);
+          // The wall is a leaderboard whatever the slideshow order
+          const newPictures = sortByLikes(ordered);
           // Initialize previous positions
           const positions = new Map();
           newPictures.forEach((pic, index) => {
             positions.set(pic.id, index);
           });
           prevPositionsRef.current = positions;
-          setPictures(newPictures);
+          picturesRef.current = newPictures;
+          setPictures(visible(newPictures));
           setLoading(false);
           isInitialLoadRef.current = false;
           setIsInitialLoad(false);
@@ -60,18 +275,32 @@ function Presentation() {
         }
       });
 
+    fetchPresentation();
+
+    fetch(withEvent('/api/guestbook'))
+      .then((res) => (res.ok ? res.json() : Promise.reject(new Error('Failed to fetch guestbook'))))
+      .then((data) => {
+        if (isMounted && Array.isArray(data)) {
+          guestbookRef.current = data;
+        }
+      })
+      .catch((err) => console.error('Error fetching guestbook:', err));
+
     // WebSocket connection
     // In development, connect directly to the Go server on port 8080
     // In production, use the same host
     const isDev = window.location.hostname === 'localhost' && window.location.port === '3000';
     const wsHost = isDev ? 'localhost:8080' : window.location.host;
     const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-    const wsUrl = `${protocol}//${wsHost}/ws`;
+    // Kiosk screens carry their display token in the page URL
+    const wsUrl = hubFilterParams(withToken(withEvent(`${protocol}//${wsHost}/ws`)), top);
+    const position = createStreamPosition(top > 0);
 
     const connectWebSocket = () => {
       if (!isMounted) return;
 
-      ws = new WebSocket(wsUrl);
+      ws = new WebSocket(resumeUrl(wsUrl, position), hubProtocols());
+      ws.binaryType = 'arraybuffer';
 
       ws.onopen = () => {
         console.log('WebSocket connected');
@@ -83,9 +312,138 @@ function Presentation() {
 
       ws.onmessage = (event) => {
         try {
-          const data = JSON.parse(event.data);
+          const message = parseHubFrame(event.data);
+          if (!trackMessage(position, message)) {
+            // Missed a frame: reconnect for a fresh snapshot
+            ws.close(4000, 'resync');
+            return;
+          }
+          if (message.type === 'presence') {
+            if (isMounted) {
+              setWatching(message.payload ? message.payload.watching : 0);
+            }
+            return;
+          }
+          if (message.type === 'snapshot' && isMounted) {
+            setAnnouncements((message.payload && message.payload.announcements) || []);
+          }
+          if (message.type === 'mode') {
+            if (isMounted) {
+              applyMode(message.payload);
+            }
+            return;
+          }
+          if ((message.type === 'snapshot' || message.type === 'settings') && isMounted && message.payload && message.payload.settings) {
+            const next = { ...DEFAULT_SETTINGS, ...message.payload.settings };
+            const reorder = next.ordering !== settingsRef.current.ordering || next.playlist !== settingsRef.current.playlist;
+            settingsRef.current = next;
+            setSettings(next);
+            if (reorder) {
+              refreshSlideOrder();
+            }
+            if (message.type === 'settings') {
+              return;
+            }
+          }
+          if (message.type === 'playlist') {
+            const payload = message.payload || {};
+            if (isMounted && payload.deleted && playlistOverrideRef.current === payload.name) {
+              playlistOverrideRef.current = null;
+            }
+            if (isMounted && (payload.deleted || payload.name === activePlaylist())) {
+              refreshSlideOrder();
+            }
+            return;
+          }
+          if (message.type === 'contest') {
+            // Only a closed round has winners to announce
+            if (isMounted && message.payload && message.payload.closedAt) {
+              setContestResult(message.payload);
+            }
+            return;
+          }
+          if (message.type === 'contest_reveal') {
+            // Count down from when the message arrived, whatever the
+            // display's clock says, then show the winners
+            const payload = message.payload || {};
+            if (isMounted && payload.round) {
+              setContestResult(null);
+              setContestReveal({ round: payload.round, revealAt: Date.now() + (payload.countdown || 0) * 1000 });
+            }
+            return;
+          }
+          if (message.type === 'announcement') {
+            if (isMounted && message.payload && message.payload.announcement) {
+              const announcement = message.payload.announcement;
+              setAnnouncements((prev) => [...prev.filter((a) => a.id !== announcement.id), announcement]);
+            }
+            return;
+          }
+          if (message.type === 'guestbook') {
+            const msg = message.payload && message.payload.message;
+            if (isMounted && msg && !guestbookRef.current.some((m) => m.id === msg.id)) {
+              guestbookRef.current = [...guestbookRef.current, msg];
+            }
+            return;
+          }
+          if (message.type === 'guestbook_removed') {
+            const id = message.payload && message.payload.id;
+            if (isMounted) {
+              guestbookRef.current = guestbookRef.current.filter((m) => m.id !== id);
+              setWish((current) => (current && current.id === id ? null : current));
+            }
+            return;
+          }
+          if (message.type === 'control') {
+            if (isMounted && message.payload) {
+              applyControl(message.payload);
+            }
+            return;
+          }
+          if (message.type === 'like_burst') {
+            if (isMounted && message.payload) {
+              const { id, magnitude } = message.payload;
+              // A shower of hearts that grows with the magnitude
+              const hearts = Array.from({ length: Math.min(6 * magnitude, 30) }, (_, i) => ({
+                key: `${Date.now()}-${i}-${Math.random()}`,
+                emoji: '❤️',
+                left: 5 + Math.random() * 90,
+                delay: Math.random() * 0.8,
+                burst: true,
+              }));
+              setReactions((prev) => [...prev.slice(-30), ...hearts]);
+              setBursts((prev) => ({ ...prev, [id]: magnitude }));
+              setTimeout(() => {
+                if (isMounted) {
+                  const keys = new Set(hearts.map((h) => h.key));
+                  setReactions((prev) => prev.filter((r) => !keys.has(r.key)));
+                  setBursts((prev) => {
+                    const next = { ...prev };
+                    if (next[id] === magnitude) {
+                      delete next[id];
+                    }
+                    return next;
+                  });
+                }
+              }, 3300);
+            }
+            return;
+          }
+          if (message.type === 'reaction') {
+            if (isMounted && message.payload) {
+              // Float the emoji up the screen, then drop it
+              const reaction = { key: `${Date.now()}-${Math.random()}`, emoji: message.payload.emoji, left: 5 + Math.random() * 90 };
+              setReactions((prev) => [...prev.slice(-30), reaction]);
+              setTimeout(() => {
+                if (isMounted) {
+                  setReactions((prev) => prev.filter((r) => r.key !== reaction.key));
+                }
+              }, 2500);
+            }
+            return;
+          }
           if (isMounted) {
-            const newPictures = Array.isArray(data) ? data : [];
+            const newPictures = sortByLikes(applyHubMessage(picturesRef.current, message));
             
             // Detect position changes
             const newPositions = new Map();
@@ -107,8 +465,8 @@ function Presentation() {
               }
             });
             
-            // Update swapping state
-            if (changedIds.size > 0 && !isInitialLoadRef.current) {
+            // Update swapping state; pages of the gallery only fill it in
+            if (changedIds.size > 0 && !isInitialLoadRef.current && message.type !== 'pictures') {
               setSwappingIds(new Set(changedIds));
               // Clear swapping state after animation
               setTimeout(() => {
@@ -120,7 +478,34 @@ function Presentation() {
             
             // Update previous positions
             prevPositionsRef.current = newPositions;
-            setPictures(newPictures);
+            picturesRef.current = newPictures;
+            setPictures(visible(newPictures));
+
+            // A running slideshow may cut to new uploads straight away,
+            // unless it is showing a playlist
+            if (message.type === 'picture_added' && message.payload && message.payload.picture
+              && settingsRef.current.interruptOnUpload && slideIdRef.current !== null && activePlaylist() === '') {
+              slideIdRef.current = message.payload.picture.id;
+              setSlideId(message.payload.picture.id);
+            }
+            // A picture taken off the wall mustn't stay on the screen
+            if (message.type === 'picture_hidden' && message.payload
+              && slideIdRef.current === message.payload.id) {
+              advanceSlide(1);
+            }
+            // Applied once the pictures are known so a scheduled slideshow
+            // has something to start with
+            if (message.type === 'snapshot') {
+              applyMode(message.payload && message.payload.mode);
+              const { ranked = 0, total = 0 } = message.payload || {};
+              loadMorePictures(ranked, total);
+            }
+            if (message.type === 'pictures' && message.payload) {
+              const { offset = 0, pictures: page = [], total = 0 } = message.payload;
+              if (page.length > 0) {
+                loadMorePictures(offset + page.length, total);
+              }
+            }
             if (isInitialLoadRef.current) {
               isInitialLoadRef.current = false;
               setIsInitialLoad(false);
@@ -138,7 +523,22 @@ function Presentation() {
       ws.onclose = (event) => {
         if (!isMounted) return;
 
-        if (event.wasClean) {
+        if (event.code === SERVER_FULL) {
+          console.log('WebSocket server full, polling instead');
+          fetchPresentation();
+          reconnectTimeout = setTimeout(() => {
+            if (isMounted) {
+              connectWebSocket();
+            }
+          }, SERVER_FULL_RETRY_MS);
+        } else if (event.code === SERVICE_RESTART) {
+          console.log('WebSocket server restarting, reconnecting shortly...');
+          reconnectTimeout = setTimeout(() => {
+            if (isMounted) {
+              connectWebSocket();
+            }
+          }, restartDelay());
+        } else if (event.wasClean && event.code !== 4000) {
           console.log('WebSocket disconnected cleanly');
         } else {
           console.log('WebSocket connection lost, attempting to reconnect...');
@@ -186,6 +586,9 @@ function Presentation() {
   const safePictures = pictures || [];
   const limitedPictures = safePictures.slice(0, 30);
   const idsKey = limitedPictures.map((p) => p.id).join('|');
+  const slideRank = slideId === null ? 0 : picturesRef.current.findIndex((p) => p.id === slideId) + 1;
+  const slide = slideRank > 0 ? picturesRef.current[slideRank - 1] : null;
+  const announcement = currentAnnouncement(announcements, Date.now());
 
   // Sync layout with hash changes
   useEffect(() => {
@@ -200,6 +603,94 @@ function Presentation() {
     return () => window.removeEventListener('hashchange', handleHashChange);
   }, []);
 
+  // Advance the slideshow until a presenter pauses it or returns to the
+  // leaderboard. Every few slides a guestbook message, the next in turn,
+  // is shown for as long as a slide instead.
+  useEffect(() => {
+    if (slideId === null || paused) {
+      return undefined;
+    }
+    const timer = setTimeout(() => {
+      const messages = guestbookRef.current;
+      if (wish === null && messages.length > 0) {
+        slidesSinceWishRef.current += 1;
+        if (slidesSinceWishRef.current >= GUESTBOOK_EVERY) {
+          slidesSinceWishRef.current = 0;
+          setWish(messages[guestbookNextRef.current % messages.length]);
+          guestbookNextRef.current += 1;
+          return;
+        }
+      }
+      advanceSlide(1);
+    }, settings.slideInterval * 1000);
+    return () => clearTimeout(timer);
+  }, [slideId, paused, settings.slideInterval, wish]);
+
+  // Tell the server which picture this display is showing
+  useEffect(() => {
+    if (slideId !== null && IS_DISPLAY) {
+      sendAction(wsRef.current, 'shown', { id: slideId });
+    }
+  }, [slideId]);
+
+  // Load the images of the next slides in the background, so they show
+  // without a loading flash
+  useEffect(() => {
+    if (slideId === null) {
+      return;
+    }
+    const ids = slideIds(picturesRef.current, slideOrderRef.current, activePlaylist() !== '');
+    let id = slideId;
+    for (let i = 0; i < PRELOAD_SLIDES; i += 1) {
+      id = stepSlide(ids, id, 1);
+      const pic = picturesRef.current.find((p) => p.id === id);
+      if (pic) {
+        new Image().src = slideImageUrl(pic);
+      }
+    }
+  }, [slideId]);
+
+  // Count down to an announced round's winners, then show them
+  useEffect(() => {
+    if (!contestReveal) {
+      return undefined;
+    }
+    const tick = () => {
+      const left = Math.ceil((contestReveal.revealAt - Date.now()) / 1000);
+      if (left <= 0) {
+        setContestReveal(null);
+        setContestResult(contestReveal.round);
+        return;
+      }
+      setRevealCountdown(left);
+    };
+    tick();
+    const timer = setInterval(tick, 250);
+    return () => clearInterval(timer);
+  }, [contestReveal]);
+
+  // Hide the contest winners after a while
+  useEffect(() => {
+    if (!contestResult) {
+      return undefined;
+    }
+    const timer = setTimeout(() => setContestResult(null), CONTEST_RESULT_MS);
+    return () => clearTimeout(timer);
+  }, [contestResult]);
+
+  // Drop announcements when they expire, which also re-renders the overlay
+  useEffect(() => {
+    if (announcements.length === 0) {
+      return undefined;
+    }
+    const nextExpiry = Math.min(...announcements.map((a) => new Date(a.expiresAt).getTime()));
+    const timer = setTimeout(() => {
+      const now = Date.now();
+      setAnnouncements((prev) => prev.filter((a) => new Date(a.expiresAt).getTime() > now));
+    }, Math.max(0, nextExpiry - Date.now()) + 50);
+    return () => clearTimeout(timer);
+  }, [announcements]);
+
   // Update targets whenever data or size changes
   useEffect(() => {
     if (layout !== 'spiral') return;
@@ -460,7 +951,7 @@ function Presentation() {
   };
 
   return (
-    <div className="presentation-page">
+    <div className={`presentation-page ${settings.showLikes ? '' : 'hide-likes'}`}>
       <div className="container">
         <div className="presentation-header">
           <div className="layout-switch">
@@ -507,9 +998,40 @@ function Presentation() {
               </>
             )}
           </div>
+          {watching > 0 && (
+            <div className="watching-badge">
+              <span className="watching-icon">👀</span>
+              <span className="watching-count">{watching}</span>
+              <span>{watching === 1 ? 'person watching' : 'people watching'}</span>
+            </div>
+          )}
         </div>
 
-        {limitedPictures.length === 0 ? (
+        {slide && wish ? (
+          <div className="slideshow">
+            <figure key={`wish-${wish.id}`} className={`guestbook-card transition-${settings.transition}`}>
+              <blockquote className="guestbook-text">{wish.text}</blockquote>
+              {wish.name && <figcaption className="guestbook-name">— {wish.name}</figcaption>}
+            </figure>
+            {paused && (
+              <div className="slideshow-info">
+                <span className="slideshow-paused">Paused</span>
+              </div>
+            )}
+          </div>
+        ) : slide ? (
+          <div className="slideshow">
+            <img key={slide.id} src={slideImageUrl(slide)} alt={slide.filename} className={`slideshow-image transition-${settings.transition}`} />
+            <div className="slideshow-info">
+              <span className="slideshow-rank">#{slideRank}</span>
+              <span className="slideshow-likes">
+                <span className="likes-icon">❤️</span>
+                <span className="likes-count">{slide.likes}</span>
+              </span>
+              {paused && <span className="slideshow-paused">Paused</span>}
+            </div>
+          </div>
+        ) : limitedPictures.length === 0 ? (
           <div className="empty-state">
             <div className="empty-icon">🖼️</div>
             <div className="empty-text">No pictures yet.</div>
@@ -526,6 +1048,7 @@ function Presentation() {
                 >
                   <div className="card-rank">#{index + 1}</div>
                   <img src={picture.url} alt={picture.filename} className="presentation-image" />
+                  {bursts[picture.id] && <div className="card-burst" aria-hidden="true" />}
                   <div className="card-info">
                     <div className="card-likes">
                       <span className="likes-icon">❤️</span>
@@ -540,6 +1063,58 @@ function Presentation() {
           renderSpiral()
         )}
       </div>
+      <div className="reaction-layer" aria-hidden="true">
+        {reactions.map((reaction) => (
+          <span
+            key={reaction.key}
+            className={`reaction-float ${reaction.burst ? 'burst' : ''}`}
+            style={{ left: `${reaction.left}%`, animationDelay: `${reaction.delay || 0}s` }}
+          >
+            {reaction.emoji}
+          </span>
+        ))}
+      </div>
+      {mode && mode.mode === 'idle' && (
+        <div className="standby" role="status">
+          <div className="standby-title">📸 Back soon</div>
+          {mode.next && (
+            <div className="standby-next">
+              The show starts at {new Date(mode.next).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' })}
+            </div>
+          )}
+        </div>
+      )}
+      {contestReveal && (
+        <div className="contest-result" role="status">
+          <div className="contest-result-title">🏆 {contestReveal.round.title}</div>
+          <div className="contest-reveal-countdown">{revealCountdown}</div>
+        </div>
+      )}
+      {contestResult && (
+        <div className="contest-result" role="status">
+          <div className="contest-result-title">🏆 {contestResult.title}</div>
+          {contestResult.winners && contestResult.winners.length > 0 ? (
+            <>
+              <div className="contest-result-winners">
+                {contestResult.winners.map((id) => {
+                  const pic = picturesRef.current.find((p) => p.id === id);
+                  return pic ? <img key={id} src={pic.url} alt={pic.filename} className="contest-result-image" /> : null;
+                })}
+              </div>
+              <div className="contest-result-votes">
+                {contestResult.entries[0].votes} {contestResult.entries[0].votes === 1 ? 'vote' : 'votes'}
+              </div>
+            </>
+          ) : (
+            <div className="contest-result-votes">No votes were cast</div>
+          )}
+        </div>
+      )}
+      {announcement && (
+        <div className={`announcement announcement-${announcement.priority}`} role="status">
+          <div className="announcement-message">{announcement.message}</div>
+        </div>
+      )}
     </div>
   );
 }
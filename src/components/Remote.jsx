@@ -0,0 +1,128 @@
+import React, { useState, useEffect, useRef } from 'react';
+import { applyHubMessage, parseHubFrame, sendAction, withToken } from '../hubMessages';
+import { withEvent } from '../event';
+import './Remote.css';
+
+// Remote control for the presentation, meant for a presenter's phone. It
+// needs a presenter or admin token in the page URL (/remote?token=...);
+// commands are relayed by the hub to every display of the event, or to one
+// display with ?display=<display id>.
+function Remote() {
+  const [pictures, setPictures] = useState([]);
+  const [playlists, setPlaylists] = useState([]);
+  const [status, setStatus] = useState('Connecting…');
+  const [authorized, setAuthorized] = useState(false);
+  const wsRef = useRef(null);
+
+  useEffect(() => {
+    let isMounted = true;
+    let reconnectTimeout = null;
+
+    const isDev = window.location.hostname === 'localhost' && window.location.port === '3000';
+    const wsHost = isDev ? 'localhost:8080' : window.location.host;
+    const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+    // The remote only lists pictures to jump to, so like counts aren't needed
+    const baseUrl = withToken(withEvent(`${protocol}//${wsHost}/ws`));
+    const wsUrl = `${baseUrl}${baseUrl.includes('?') ? '&' : '?'}types=picture_added,picture_updated,picture_hidden,picture_shown,playlist`;
+
+    const fetchPlaylists = () => fetch(withEvent('/api/playlists'))
+      .then((res) => (res.ok ? res.json() : Promise.reject(new Error('Failed to fetch playlists'))))
+      .then((data) => {
+        if (isMounted && Array.isArray(data)) {
+          setPlaylists(data.map((playlist) => playlist.name));
+        }
+      })
+      .catch((error) => console.error('Error fetching playlists:', error));
+
+    const connectWebSocket = () => {
+      if (!isMounted) return;
+
+      const ws = new WebSocket(wsUrl);
+
+      ws.onmessage = (event) => {
+        try {
+          const message = parseHubFrame(event.data);
+          if (!isMounted) return;
+          if (message.type === 'snapshot') {
+            const role = message.payload ? message.payload.role : 'viewer';
+            setAuthorized(role !== 'viewer');
+            setStatus(role === 'viewer' ? 'Open this page with a presenter token (?token=…)' : 'Connected');
+          }
+          if (message.type === 'error') {
+            setStatus(`Rejected: ${message.payload ? message.payload.message : 'unknown error'}`);
+            return;
+          }
+          if (message.type === 'snapshot' || message.type === 'playlist') {
+            fetchPlaylists();
+          }
+          setPictures((prev) => applyHubMessage(prev, message));
+        } catch (error) {
+          console.error('Error parsing WebSocket message:', error);
+        }
+      };
+
+      ws.onclose = () => {
+        if (!isMounted) return;
+        setStatus('Disconnected, reconnecting…');
+        reconnectTimeout = setTimeout(connectWebSocket, 3000);
+      };
+
+      wsRef.current = ws;
+    };
+
+    connectWebSocket();
+
+    return () => {
+      isMounted = false;
+      if (reconnectTimeout) {
+        clearTimeout(reconnectTimeout);
+      }
+      if (wsRef.current) {
+        wsRef.current.close();
+      }
+    };
+  }, []);
+
+  const send = (command, id) => {
+    const payload = id ? { command, id } : { command };
+    const display = new URLSearchParams(window.location.search).get('display');
+    if (display) {
+      payload.display = display;
+    }
+    if (!sendAction(wsRef.current, 'control', payload)) {
+      setStatus('Not connected');
+    }
+  };
+
+  return (
+    <div className="remote-page">
+      <div className="remote-status">{status}</div>
+      <div className="remote-controls">
+        <button className="remote-btn" disabled={!authorized} onClick={() => send('previous')}>◀ Previous</button>
+        <button className="remote-btn primary" disabled={!authorized} onClick={() => send('next')}>Next ▶</button>
+        <button className="remote-btn" disabled={!authorized} onClick={() => send('pause')}>Pause</button>
+        <button className="remote-btn" disabled={!authorized} onClick={() => send('resume')}>Resume</button>
+        <button className="remote-btn wide" disabled={!authorized} onClick={() => send('leaderboard')}>Show leaderboard</button>
+      </div>
+      {authorized && playlists.length > 0 && (
+        <div className="remote-playlists">
+          <button className="remote-btn" onClick={() => send('playlist')}>All pictures</button>
+          {playlists.map((name) => (
+            <button key={name} className="remote-btn" onClick={() => send('playlist', name)}>{name}</button>
+          ))}
+        </div>
+      )}
+      {authorized && pictures.length > 0 && (
+        <div className="remote-pictures">
+          {pictures.map((picture) => (
+            <button key={picture.id} className="remote-thumb" onClick={() => send('jump', picture.id)}>
+              <img src={picture.url} alt={picture.filename} />
+            </button>
+          ))}
+        </div>
+      )}
+    </div>
+  );
+}
+
+export default Remote;
@@ -0,0 +1,18 @@
+// The event (gallery) the page is showing, taken from the ?event= query
+// parameter. Pages without it use the server's default event.
+export function getEventId() {
+  if (typeof window === 'undefined') {
+    return '';
+  }
+  return new URLSearchParams(window.location.search).get('event') || '';
+}
+
+// Appends the current event to an API or WebSocket URL.
+export function withEvent(url) {
+  const eventId = getEventId();
+  if (!eventId) {
+    return url;
+  }
+  const separator = url.includes('?') ? '&' : '?';
+  return `${url}${separator}event=${encodeURIComponent(eventId)}`;
+}
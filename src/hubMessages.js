@@ -0,0 +1,183 @@
+import { decode } from './msgpack';
+
+// Applies a hub message from the WebSocket feed to a list of pictures.
+// Every frame is an envelope of the form {type, seq, payload}. The server
+// sends a snapshot on connect and incremental updates afterwards; pages of
+// a large gallery asked for with a more message arrive as pictures
+// messages. Unknown message types leave the list untouched.
+export function applyHubMessage(pictures, message) {
+  const list = Array.isArray(pictures) ? pictures : [];
+  if (!message || typeof message !== 'object') {
+    return list;
+  }
+  const payload = message.payload || {};
+
+  switch (message.type) {
+    case 'snapshot':
+      return Array.isArray(payload.pictures) ? payload.pictures : [];
+    case 'pictures': {
+      const known = new Set(list.map((pic) => pic.id));
+      return [...list, ...(payload.pictures || []).filter((pic) => !known.has(pic.id))];
+    }
+    case 'likes': {
+      const counts = new Map((payload.likes || []).map((entry) => [entry.id, entry.likes]));
+      return list.map((pic) => (counts.has(pic.id) ? { ...pic, likes: counts.get(pic.id) } : pic));
+    }
+    case 'picture_added':
+    case 'picture_shown':
+      if (!payload.picture || list.some((pic) => pic.id === payload.picture.id)) {
+        return list;
+      }
+      return [payload.picture, ...list];
+    case 'picture_updated':
+      if (!payload.picture) {
+        return list;
+      }
+      return list.map((pic) => (pic.id === payload.previousId ? payload.picture : pic));
+    case 'picture_hidden':
+      return list.filter((pic) => pic.id !== payload.id);
+    case 'pictures_aged': {
+      const aged = new Set(payload.ids || []);
+      return list.map((pic) => (aged.has(pic.id) ? { ...pic, isNew: false } : pic));
+    }
+    default:
+      return list;
+  }
+}
+
+// Sorts pictures the same way the server ranks them (the "likes"
+// presentation ordering): likes descending, then newest first.
+export function sortByLikes(pictures) {
+  return [...pictures].sort((a, b) => {
+    if (b.likes !== a.likes) {
+      return b.likes - a.likes;
+    }
+    return new Date(b.uploadedAt).getTime() - new Date(a.uploadedAt).getTime();
+  });
+}
+
+// Tracks a client's position in the hub stream so a reconnect can resume
+// with ?since= and receive only the frames it missed. A filtered stream
+// (see hubFilterParams) skips sequence numbers by design, so gaps in it
+// aren't treated as missed frames.
+export function createStreamPosition(filtered = false) {
+  return { epoch: null, seq: null, filtered };
+}
+
+// Records a received message. Returns false when a frame was skipped, in
+// which case the caller should reconnect without resuming to get a fresh
+// snapshot.
+export function trackMessage(position, message) {
+  if (!message || typeof message.seq !== 'number') {
+    return true;
+  }
+  if (message.seq === 0 && message.type !== 'snapshot') {
+    // Presence, errors and other transient frames aren't part of the stream
+    return true;
+  }
+  if (message.type === 'snapshot') {
+    position.epoch = message.payload ? message.payload.epoch : null;
+    position.seq = message.seq;
+    return true;
+  }
+  if (position.seq !== null && message.seq <= position.seq) {
+    // Already applied (e.g. replayed after a snapshot)
+    return true;
+  }
+  if (position.seq !== null && message.seq !== position.seq + 1 && !position.filtered) {
+    position.epoch = null;
+    position.seq = null;
+    return false;
+  }
+  position.seq = message.seq;
+  return true;
+}
+
+// Adds resume parameters to a WebSocket URL when the position is known.
+export function resumeUrl(url, position) {
+  if (!position || !position.epoch || position.seq === null) {
+    return url;
+  }
+  const separator = url.includes('?') ? '&' : '?';
+  return `${url}${separator}since=${position.seq}&epoch=${encodeURIComponent(position.epoch)}`;
+}
+
+// Leaderboard size requested with ?top=N in the page URL, or 0 for the
+// whole gallery.
+export function leaderboardSize() {
+  const top = parseInt(new URLSearchParams(window.location.search).get('top'), 10);
+  return top > 0 ? top : 0;
+}
+
+// Adds server-side subscription filters to a WebSocket URL. A leaderboard
+// screen only needs likes that can change its top places.
+export function hubFilterParams(url, top) {
+  if (!top) {
+    return url;
+  }
+  const separator = url.includes('?') ? '&' : '?';
+  return `${url}${separator}top=${top}`;
+}
+
+// Adds the token from the page URL (?token=) to a WebSocket or image URL: a
+// presenter or admin token, or the display token of a kiosk screen.
+export function withToken(url) {
+  const token = new URLSearchParams(window.location.search).get('token');
+  if (!token) {
+    return url;
+  }
+  const separator = url.includes('?') ? '&' : '?';
+  return `${url}${separator}token=${encodeURIComponent(token)}`;
+}
+
+// Returns the URL to show a picture full screen at: its projector rendition
+// on pages with a token, which the server only serves to displays and
+// presenters, otherwise the web image.
+export function slideImageUrl(pic) {
+  if (!pic.projectorUrl || !new URLSearchParams(window.location.search).get('token')) {
+    return pic.url;
+  }
+  return withToken(pic.projectorUrl);
+}
+
+// Close code the server sends when it is at its connection limit. Clients
+// should fetch the REST API instead and retry the socket after
+// SERVER_FULL_RETRY_MS, which polls the gallery until a slot frees up.
+export const SERVER_FULL = 1013;
+export const SERVER_FULL_RETRY_MS = 15000;
+
+// Sends a client action (e.g. a like) over an open WebSocket. Returns false
+// when the socket isn't open so the caller can fall back to the REST API.
+export function sendAction(ws, type, payload) {
+  if (!ws || ws.readyState !== WebSocket.OPEN) {
+    return false;
+  }
+  ws.send(JSON.stringify({ type, payload }));
+  return true;
+}
+
+// Close code sent when the server shuts down for a restart. Clients should
+// reconnect after a short random delay so a whole venue doesn't reconnect
+// at the same instant.
+export const SERVICE_RESTART = 1012;
+
+export function restartDelay() {
+  return 1000 + Math.random() * 4000;
+}
+
+// WebSocket subprotocols requested from the hub. Displays on weak hardware
+// can opt into binary msgpack frames with ?encoding=msgpack in the page URL;
+// everything else uses JSON.
+export function hubProtocols() {
+  const params = new URLSearchParams(window.location.search);
+  return params.get('encoding') === 'msgpack' ? ['picsapp.msgpack', 'picsapp.json'] : ['picsapp.json'];
+}
+
+// Parses a hub frame: JSON text, or msgpack when the socket's binaryType is
+// 'arraybuffer' and msgpack was negotiated.
+export function parseHubFrame(data) {
+  if (typeof data === 'string') {
+    return JSON.parse(data);
+  }
+  return decode(new Uint8Array(data));
+}
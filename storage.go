@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Image files are kept in three stores: the originals waiting for
+// conversion, the converted web images, public under /uploads/, and the
+// projector renditions, which are only served to displays and presenters.
+// With STORAGE=local they are directories on disk (originalDir, uploadDir
+// and projectorDir); with STORAGE=s3 objects in a bucket (see s3storage.go);
+// with STORAGE=memory they live in memory and are lost on restart, for
+// trying the server out and testing the pipeline.
+var (
+	originalStore  Storage
+	uploadStore    Storage
+	projectorStore Storage
+)
+
+// storageBackends are the valid STORAGE values.
+var storageBackends = map[string]bool{"local": true, "memory": true, "s3": true}
+
+// Storage holds files under keys: file names, or paths of names separated
+// by slashes, as in the sharded layout of converted files (see shardedKey).
+type Storage interface {
+	// Put stores the contents of r under key, replacing the file there.
+	// Readers never see a partly written file.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get opens the file under key. Its error wraps fs.ErrNotExist if
+	// there is none.
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	// Delete removes the file under key; a missing file is not an error.
+	Delete(ctx context.Context, key string) error
+	// Stat describes the file under key, like Get when there is none.
+	Stat(ctx context.Context, key string) (FileInfo, error)
+	// URL returns the URL clients fetch the file at, or "" if the store
+	// isn't public.
+	URL(key string) string
+}
+
+// FileInfo describes a stored file.
+type FileInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// setupStorage creates the stores for the configured backend.
+func setupStorage(cfg *Config) error {
+	stores, err := openStores(cfg, cfg.Storage)
+	if err != nil {
+		return err
+	}
+	originalStore, uploadStore, projectorStore = stores.original, stores.uploads, stores.projector
+	return nil
+}
+
+// stores are the three stores of one backend.
+type stores struct {
+	original  Storage
+	uploads   Storage
+	projector Storage
+}
+
+// openStores creates the stores of backend, one of storageBackends, from
+// the configuration, which need not be the configured backend: the storage
+// migration reads from one and writes to another.
+func openStores(cfg *Config, backend string) (*stores, error) {
+	switch backend {
+	case "s3":
+		return newS3Stores(cfg)
+	case "memory":
+		return &stores{
+			original:  newMemStorage(""),
+			uploads:   newMemStorage("/uploads/"),
+			projector: newMemStorage(""),
+		}, nil
+	}
+	return &stores{
+		original:  newDirStorage(originalDir, ""),
+		uploads:   newDirStorage(uploadDir, "/uploads/"),
+		projector: newDirStorage(projectorDir, ""),
+	}, nil
+}
+
+// storedAt returns the store and key of a file recorded by its path in the
+// local directories, as conversion tasks record their original: an upload
+// in originalDir, or a picture in uploadDir or projectorDir when it is
+// converted again. originalDir is inside uploadDir, so it comes first.
+func storedAt(path string) (Storage, string, error) {
+	for _, s := range []struct {
+		dir   string
+		store Storage
+	}{
+		{originalDir, originalStore},
+		{uploadDir, uploadStore},
+		{projectorDir, projectorStore},
+	} {
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return s.store, filepath.ToSlash(rel), nil
+	}
+	return nil, "", fmt.Errorf("%s is not in a storage directory", path)
+}
+
+// checkKey rejects keys that would reach outside a store.
+func checkKey(key string) error {
+	if key == "" || key == "." || key == ".." || strings.HasPrefix(key, "../") || path.IsAbs(key) ||
+		path.Clean(key) != key || strings.Contains(key, `\`) {
+		return fmt.Errorf("invalid storage key %q: %w", key, fs.ErrInvalid)
+	}
+	return nil
+}
+
+// shardedKey returns the key a converted file with these contents is stored
+// under, ab/cd/abcd….webp: the hex SHA-256 of the contents with ext, in two
+// levels of directories named after its first bytes, so that no directory
+// holds more than a few files even with hundreds of thousands of pictures.
+// Pictures with the same contents share their file.
+func shardedKey(data []byte, ext string) string {
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:])
+	return name[0:2] + "/" + name[2:4] + "/" + name + ext
+}
+
+// isShardedKey reports whether key has the form shardedKey returns.
+func isShardedKey(key string) bool {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 || !isShardDir(parts[0]) || !isShardDir(parts[1]) {
+		return false
+	}
+	return strings.HasPrefix(parts[2], parts[0]+parts[1])
+}
+
+// eventPartition is the directory of the stores holding the events'
+// partitions.
+const eventPartition = "events"
+
+// eventKey returns the key of a file of event under key in its partition:
+// events/party/ab/cd/abcd….webp for the sharded key ab/cd/abcd….webp.
+// Every event's files are under their own prefix, so they can be counted,
+// backed up or given bucket rules of their own; pictures of different
+// events don't share files.
+func eventKey(event, key string) string {
+	return eventPartition + "/" + event + "/" + key
+}
+
+// splitEventKey returns the event and the key within its partition of a
+// key returned by eventKey, or "" and key for files stored before the
+// partitions.
+func splitEventKey(key string) (event, rest string) {
+	prefix, rest, ok := strings.Cut(key, "/")
+	if !ok || prefix != eventPartition {
+		return "", key
+	}
+	event, rest, ok = strings.Cut(rest, "/")
+	if !ok || !eventIDPattern.MatchString(event) {
+		return "", key
+	}
+	return event, rest
+}
+
+// isPictureKey reports whether key is one pictures' files are stored
+// under: sharded, in an event's partition or not, or flat.
+func isPictureKey(key string) bool {
+	event, rest := splitEventKey(key)
+	if event == "" && !strings.Contains(key, "/") {
+		return !strings.HasPrefix(key, ".")
+	}
+	return isShardedKey(rest)
+}
+
+// isShardDir reports whether name is a directory of the sharded layout: two
+// lowercase hex digits.
+func isShardDir(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	for _, c := range name {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicAssetBaseURL is PUBLIC_ASSET_BASE_URL without a trailing slash.
+var publicAssetBaseURL reloadable[string]
+
+// assetURL returns the URL clients fetch a picture's image at, given the
+// URL stored for it and the version of its file. Paths on this server are
+// prefixed with PUBLIC_ASSET_BASE_URL, whose host pulls them from here, and
+// a file rewritten in place gets its version as a query parameter so that
+// caches holding the earlier file miss. Absolute URLs, as into a public
+// bucket, keep their host.
+func assetURL(stored string, version int) string {
+	u := stored
+	if base := publicAssetBaseURL.Load(); base != "" && strings.HasPrefix(u, "/") {
+		u = base + u
+	}
+	if version > 1 {
+		sep := "?"
+		if strings.Contains(u, "?") {
+			sep = "&"
+		}
+		u += sep + "v=" + strconv.Itoa(version)
+	}
+	return u
+}
+
+// presigner is a store whose files clients can fetch from it directly,
+// at URLs that expire.
+type presigner interface {
+	presignedURL(ctx context.Context, key string) (string, time.Duration, error)
+}
+
+// serveStored serves the files of store, named by the request path
+// (without the route's prefix), with range and conditional requests, or
+// redirects to a presigned URL if the store has them, or hands them to the
+// proxy under area with SENDFILE_HEADER. Only flat and sharded keys are
+// served: the originals waiting for conversion are in a directory of the
+// upload directory.
+func serveStored(store Storage, area string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Path
+		// Nor temporary files being written (see writeFileAtomic)
+		if !isPictureKey(key) {
+			http.NotFound(w, r)
+			return
+		}
+		if p, ok := store.(presigner); ok {
+			url, expiry, err := p.presignedURL(r.Context(), key)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			// Browsers may reuse the redirect for half the URL's life
+			w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(expiry.Seconds())/2))
+			http.Redirect(w, r, url, http.StatusFound)
+			return
+		}
+		if store == uploadStore && serveHotImage(w, r, key) {
+			return
+		}
+		info, err := store.Stat(r.Context(), key)
+		if err != nil {
+			if store == uploadStore && redirectAliasedFile(w, r, key) {
+				return
+			}
+			http.NotFound(w, r)
+			return
+		}
+		if sendStored(w, store, area, key) {
+			return
+		}
+		f, err := store.Get(r.Context(), key)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		http.ServeContent(w, r, key, info.ModTime, f)
+	})
+}
+
+// localFile returns a path external programs such as ffmpeg can read the
+// file under key at: its own path in a directory store, else a copy in dir
+// named after the key's last element.
+func localFile(ctx context.Context, store Storage, key, dir string) (string, error) {
+	if ds, ok := store.(*dirStorage); ok {
+		return ds.path(key)
+	}
+	src, err := store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	local := filepath.Join(dir, path.Base(key))
+	dst, err := os.Create(local)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return "", err
+	}
+	return local, dst.Close()
+}
+
+// walkDirStore calls fn with the key and path of every file of the
+// directory store in dir: the files directly in it and in its shard
+// directories, and those of the events' partitions. Other subdirectories,
+// such as the originals waiting for conversion in the upload directory,
+// are skipped. A missing dir has no files.
+func walkDirStore(dir string, fn func(key, path string, info fs.FileInfo) error) error {
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if entry.IsDir() {
+			if key == "." || key == eventPartition {
+				return nil
+			}
+			rest := key
+			if event, r := splitEventKey(key + "/"); event != "" {
+				if r == "" {
+					return nil
+				}
+				rest = strings.TrimSuffix(r, "/")
+			}
+			first, second, nested := strings.Cut(rest, "/")
+			if isShardDir(first) && (!nested || isShardDir(second)) {
+				return nil
+			}
+			return filepath.SkipDir
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Removed since the directory was read
+			return nil
+		}
+		return fn(key, path, info)
+	})
+}
+
+// dirStorage keeps files in a directory, created when the first file is
+// put.
+type dirStorage struct {
+	dir       string
+	urlPrefix string
+}
+
+func newDirStorage(dir, urlPrefix string) *dirStorage {
+	return &dirStorage{dir: dir, urlPrefix: urlPrefix}
+}
+
+func (s *dirStorage) path(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes the file with writeFileAtomic, creating the key's
+// directories.
+func (s *dirStorage) Put(ctx context.Context, key string, r io.Reader) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	_, err = writeFileAtomic(path, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	return err
+}
+
+// writeFileAtomic writes the file at path with write, creating its
+// directory: to a temporary file next to it, flushed to disk and renamed
+// into place, so that neither readers nor a crash ever see a partly written
+// file at path. It returns the file's size. Temporary files left by a crash
+// start with a dot; they are never served, and prune and the garbage
+// collector remove them.
+func writeFileAtomic(path string, write func(io.Writer) error) (int64, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(dir, ".put-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	if err := write(f); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return 0, err
+	}
+	// Without it, a crash soon after the rename can leave an empty file
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return info.Size(), os.Rename(f.Name(), path)
+}
+
+func (s *dirStorage) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *dirStorage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *dirStorage) Stat(ctx context.Context, key string) (FileInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if info.IsDir() {
+		return FileInfo{}, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+	}
+	return FileInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *dirStorage) URL(key string) string {
+	if s.urlPrefix == "" {
+		return ""
+	}
+	return s.urlPrefix + key
+}
+
+// memStorage keeps files in memory.
+type memStorage struct {
+	mu        sync.RWMutex
+	files     map[string]memFile
+	urlPrefix string
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemStorage(urlPrefix string) *memStorage {
+	return &memStorage{files: make(map[string]memFile), urlPrefix: urlPrefix}
+}
+
+func (s *memStorage) Put(ctx context.Context, key string, r io.Reader) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.files[key] = memFile{data: data, modTime: time.Now()}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memStorage) file(key string) (memFile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.files[key]
+	if !ok {
+		return memFile{}, &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+	}
+	return f, nil
+}
+
+func (s *memStorage) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	f, err := s.file(key)
+	if err != nil {
+		return nil, err
+	}
+	// Put replaces the slice rather than writing to it, so it can be read
+	// without the lock
+	return nopSeekCloser{bytes.NewReader(f.data)}, nil
+}
+
+func (s *memStorage) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.files, key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memStorage) Stat(ctx context.Context, key string) (FileInfo, error) {
+	f, err := s.file(key)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Size: int64(len(f.data)), ModTime: f.modTime}, nil
+}
+
+func (s *memStorage) URL(key string) string {
+	if s.urlPrefix == "" {
+		return ""
+	}
+	return s.urlPrefix + key
+}
+
+// nopSeekCloser is an io.ReadSeekCloser whose Close does nothing.
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
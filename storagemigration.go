@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+)
+
+// picsapp migrate-storage copies the image files from the stores of one
+// backend to those of another, such as from the local directories to S3,
+// while the server keeps running on the first. Each file is hashed on the
+// way and read back from the destination to check its SHA-256 before it is
+// recorded in storage_migrations, so a run that stops halfway resumes
+// where it was and files are never copied twice. Pictures are pointed at
+// their new URLs batch by batch, once all of a batch's files are copied.
+// The source files are left in place: clients holding their URLs and a
+// server not yet switched keep working, and running the command again
+// after switching STORAGE copies what was uploaded in the meantime.
+
+// storageMigration is the outcome of a storage migration run.
+type storageMigration struct {
+	Copied      int
+	CopiedBytes int64
+	// Skipped files were copied by an earlier run
+	Skipped int
+	// Missing files are recorded but not in the source store
+	Missing int
+	Failed  int
+	// Rewritten pictures had their URL changed
+	Rewritten int
+}
+
+// storageTarget names where the stores of backend keep their files, to
+// tell apart the migrations to different buckets or directories.
+func storageTarget(cfg *Config, backend string) string {
+	switch backend {
+	case "s3":
+		return "s3://" + cfg.S3Bucket + "/" + cfg.S3Prefix
+	case "local":
+		if dir, err := filepath.Abs(uploadDir); err == nil {
+			return "local:" + dir
+		}
+		return "local:" + uploadDir
+	}
+	return backend
+}
+
+// migrateStorage copies the files of every picture, kept original and
+// pending conversion from one backend's stores to another's, batch pictures
+// at a time, recording them under target.
+func migrateStorage(ctx context.Context, from, to *stores, target string, batch int) (*storageMigration, error) {
+	done, err := db.GetMigratedFiles(target)
+	if err != nil {
+		return nil, err
+	}
+	m := &storageMigration{}
+	area := func(name string, src, dst Storage, key string) bool {
+		id := name + "/" + key
+		if done[id] {
+			m.Skipped++
+			return true
+		}
+		sum, size, err := copyVerified(ctx, src, dst, key)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			logWarn("migrate %s: not in the source store", id)
+			m.Missing++
+			return false
+		case err != nil:
+			logWarn("migrate %s: %v", id, err)
+			m.Failed++
+			return false
+		}
+		if err := db.AddMigratedFile(target, name, key, sum, size); err != nil {
+			logWarn("migrate %s: %v", id, err)
+			m.Failed++
+			return false
+		}
+		done[id] = true
+		m.Copied++
+		m.CopiedBytes += size
+		return true
+	}
+
+	pictures, err := db.LoadAllPictures()
+	if err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(pictures); start += batch {
+		end := min(start+batch, len(pictures))
+		urls := map[string]string{}
+		for _, pic := range pictures[start:end] {
+			ok := area("uploads", from.uploads, to.uploads, pic.FileKey)
+			if pic.ProjectorURL != "" {
+				ok = area("projector", from.projector, to.projector, pic.FileKey) && ok
+			}
+			// Pictures keep their old URL until all their files are there
+			if ok {
+				urls[pic.ID] = to.uploads.URL(pic.FileKey)
+			}
+		}
+		n, err := db.SetPictureURLs(urls)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite URLs: %w", err)
+		}
+		m.Rewritten += n
+		logInfo("migrate: %d of %d pictures done", end, len(pictures))
+	}
+
+	originals, err := db.GetKeptOriginals()
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range originals {
+		// Archived originals are no longer in the original store
+		if o.Location == "" {
+			area("original", from.original, to.original, o.Key)
+		}
+	}
+	tasks, err := db.GetActiveConversionTasks()
+	if err != nil {
+		return nil, err
+	}
+	for _, task := range tasks {
+		// Tasks record their original by its path in the local
+		// directories whatever the backend; those converting a picture
+		// again use its files, copied above
+		if store, key, err := storedAt(task.OriginalPath); err == nil && store == originalStore {
+			area("original", from.original, to.original, key)
+		}
+	}
+	return m, nil
+}
+
+// copyVerified copies the file under key from src to dst and checks the
+// copy's SHA-256 against the original's, returning them and the size.
+func copyVerified(ctx context.Context, src, dst Storage, key string) (string, int64, error) {
+	f, err := src.Get(ctx, key)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	sum := h.Sum(nil)
+	// Put is given the file itself, which S3 uploads in one request as
+	// its size is known
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	if err := dst.Put(ctx, key, f); err != nil {
+		return "", 0, err
+	}
+
+	copied, err := dst.Get(ctx, key)
+	if err != nil {
+		return "", 0, fmt.Errorf("read back: %w", err)
+	}
+	defer copied.Close()
+	h.Reset()
+	if _, err := io.Copy(h, copied); err != nil {
+		return "", 0, fmt.Errorf("read back: %w", err)
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return "", 0, errors.New("checksum mismatch after copy")
+	}
+	return hex.EncodeToString(sum), size, nil
+}
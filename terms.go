@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Venues may require guests to accept terms of use before their pictures
+// are shown. With TERMS_TEXT set, the first upload from a device must
+// carry acceptTerms with the version of the terms, which is recorded with
+// the time, device and account for the venue's records; a new version
+// asks again. The web app learns the text from GET /api/upload/terms.
+// When a guest's data is deleted, their acceptances stay on the record
+// without the device and account.
+
+var (
+	termsConfig atomic.Pointer[termsSettings]
+
+	termsAccepted        atomic.Uint64
+	uploadsRejectedTerms atomic.Uint64
+)
+
+// termsSettings are the TERMS_ settings. version is "" when uploads don't
+// need the terms accepted.
+type termsSettings struct {
+	text    string
+	version string
+}
+
+// newTermsSettings returns the settings for text, versioned by version or
+// else by a hash of text, so that editing it asks guests again.
+func newTermsSettings(text, version string) *termsSettings {
+	if text == "" {
+		return &termsSettings{}
+	}
+	if version == "" {
+		sum := sha256.Sum256([]byte(text))
+		version = hex.EncodeToString(sum[:])[:12]
+	}
+	return &termsSettings{text: text, version: version}
+}
+
+// TermsAcceptance records a device's or user's acceptance of a version of
+// the terms.
+type TermsAcceptance struct {
+	ID      int64  `json:"id"`
+	Version string `json:"version"`
+	// EventID is the event of the upload the terms were accepted with
+	EventID  string `json:"eventId"`
+	DeviceID string `json:"deviceId,omitempty"`
+	UserID   int64  `json:"userId,omitempty"`
+	// Username is the account's, "" for anonymous guests
+	Username   string    `json:"username,omitempty"`
+	AcceptedAt time.Time `json:"acceptedAt"`
+}
+
+// TermsResponse is the response of GET /api/upload/terms.
+type TermsResponse struct {
+	// Version is "" when uploads don't need the terms accepted
+	Version string `json:"version"`
+	Text    string `json:"text,omitempty"`
+	// Accepted is whether the request's device or user has accepted this
+	// version, or doesn't need to
+	Accepted bool `json:"accepted"`
+}
+
+// handleTermsConfig tells the web app which terms to show, and whether the
+// guest still has to accept them.
+func handleTermsConfig(w http.ResponseWriter, r *http.Request) {
+	resp := TermsResponse{Accepted: true}
+	if t := termsConfig.Load(); t != nil && t.version != "" {
+		accepted, err := termsAcceptedBy(r, t.version)
+		if err != nil {
+			logError("check terms acceptance failed: %v", err)
+			http.Error(w, "Error checking terms", http.StatusInternalServerError)
+			return
+		}
+		resp = TermsResponse{Version: t.version, Text: t.text, Accepted: accepted}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// termsExempt reports whether a request uploads without accepting the
+// terms: the staff that aren't challenged with a CAPTCHA either.
+func termsExempt(r *http.Request) bool {
+	return captchaExempt(r)
+}
+
+// termsAcceptedBy reports whether the request's device or signed-in user
+// accepted version, or doesn't need to.
+func termsAcceptedBy(r *http.Request, version string) (bool, error) {
+	if termsExempt(r) {
+		return true, nil
+	}
+	return db.HasAcceptedTerms(version, deviceFromRequest(r).id, uploaderID(r))
+}
+
+// checkTerms checks that an upload's device or user has accepted the
+// current terms, recording the acceptance its parsed form carries. It
+// returns an HTTP status and message if the upload must be refused.
+func checkTerms(r *http.Request, event string) (int, string) {
+	t := termsConfig.Load()
+	if t == nil || t.version == "" {
+		return 0, ""
+	}
+	accepted, err := termsAcceptedBy(r, t.version)
+	if err != nil {
+		logError("check terms acceptance failed: %v", err)
+		return http.StatusInternalServerError, "Error checking terms"
+	}
+	if accepted {
+		return 0, ""
+	}
+	if r.FormValue("acceptTerms") != t.version {
+		uploadsRejectedTerms.Add(1)
+		return http.StatusPreconditionRequired, "Accept the terms of use to upload"
+	}
+	a := &TermsAcceptance{
+		Version:    t.version,
+		EventID:    event,
+		DeviceID:   deviceFromRequest(r).id,
+		UserID:     uploaderID(r),
+		AcceptedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if err := db.AddTermsAcceptance(a); err != nil {
+		logError("record terms acceptance failed: %v", err)
+		return http.StatusInternalServerError, "Error recording terms acceptance"
+	}
+	termsAccepted.Add(1)
+	logInfo("terms %s accepted (event=%s)", t.version, event)
+	return 0, ""
+}
+
+// handleExportTermsAcceptances lists the recorded acceptances, oldest
+// first, as JSON or, with format=csv, as a CSV download. version limits
+// them to one version of the terms.
+func handleExportTermsAcceptances(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return
+	}
+	acceptances, err := db.GetTermsAcceptances(r.URL.Query().Get("version"))
+	if err != nil {
+		logError("get terms acceptances failed: %v", err)
+		http.Error(w, "Error fetching acceptances", http.StatusInternalServerError)
+		return
+	}
+	if format != "csv" {
+		if acceptances == nil {
+			acceptances = []*TermsAcceptance{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(acceptances)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="terms-acceptances.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"accepted_at", "version", "event_id", "device_id", "user_id", "username"})
+	for _, a := range acceptances {
+		userID := ""
+		if a.UserID != 0 {
+			userID = strconv.FormatInt(a.UserID, 10)
+		}
+		cw.Write([]string{a.AcceptedAt.Format(time.RFC3339), a.Version, a.EventID, a.DeviceID, userID, csvCell(a.Username)})
+	}
+	cw.Flush()
+}
+
+// csvCell keeps a spreadsheet from reading a cell as a formula.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
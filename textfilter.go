@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// Guests' captions and comments end up on the big screen, so they are run
+// through a filter first: words from FILTER_WORDS, matched as whole words
+// after undoing leetspeak and stretched letters ("sh1t", "shiiit"), and,
+// with FILTER_PII, phone numbers and email addresses. FILTER_ACTION decides
+// whether text with a match is masked or rejected.
+var (
+	textFilterConfig atomic.Pointer[textFilter]
+
+	textMasked   atomic.Uint64
+	textRejected atomic.Uint64
+
+	errTextBlocked = errors.New("text contains blocked words or contact details")
+)
+
+const (
+	filterMask   = "mask"
+	filterReject = "reject"
+)
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+	// phonePattern matches 9-15 digits, optionally after a +, separated by
+	// spaces, dots, dashes or parentheses; fewer are more likely dates or
+	// scores
+	phonePattern = regexp.MustCompile(`\+?\(?\d(?:[\s().-]{0,3}\d){8,14}`)
+
+	// leetLetters undoes the usual letter substitutions
+	leetLetters = map[rune]rune{
+		'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '9': 'g',
+		'@': 'a', '$': 's', '!': 'i', '|': 'l', '+': 't',
+	}
+)
+
+// textFilter is a compiled filter configuration.
+type textFilter struct {
+	// words holds the blocked words, normalized; stretched the length of
+	// the shortest of them by their letters with repeats collapsed
+	words     map[string]bool
+	stretched map[string]int
+	pii       bool
+	reject    bool
+}
+
+// newTextFilter compiles the FILTER_ settings. words is comma-separated.
+func newTextFilter(words string, pii bool, action string) *textFilter {
+	f := &textFilter{words: map[string]bool{}, stretched: map[string]int{}, pii: pii, reject: action == filterReject}
+	for _, w := range strings.Split(words, ",") {
+		w = normalizeWord([]rune(strings.TrimSpace(w)))
+		if w == "" {
+			continue
+		}
+		f.words[w] = true
+		c := collapseRepeats(w)
+		if n, ok := f.stretched[c]; !ok || len(w) < n {
+			f.stretched[c] = len(w)
+		}
+	}
+	return f
+}
+
+// normalizeWord lower-cases a word and undoes leetspeak, so "Sh1T" and
+// "shit" compare equal.
+func normalizeWord(word []rune) string {
+	var b strings.Builder
+	for _, r := range word {
+		if l, ok := leetLetters[r]; ok {
+			r = l
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// collapseRepeats collapses runs of the same letter of a normalized word.
+func collapseRepeats(word string) string {
+	var b strings.Builder
+	var last rune
+	for _, r := range word {
+		if r != last {
+			b.WriteRune(r)
+		}
+		last = r
+	}
+	return b.String()
+}
+
+// blocked reports whether a word is a blocked word, or one stretched by
+// repeating letters ("shiiit"). Words are only stretched by making them
+// longer, so that "as" isn't taken for a blocked "ass".
+func (f *textFilter) blocked(word []rune) bool {
+	w := normalizeWord(word)
+	if w == "" {
+		return false
+	}
+	if f.words[w] {
+		return true
+	}
+	n, ok := f.stretched[collapseRepeats(w)]
+	return ok && len(w) > n
+}
+
+// isWordRune reports whether r is part of a word: a letter, or a character
+// leetspeak stands for one with.
+func isWordRune(r rune) bool {
+	_, leet := leetLetters[r]
+	return unicode.IsLetter(r) || leet
+}
+
+// filterText runs guest text through the configured filter. It returns
+// the text with matches masked, or errTextBlocked if FILTER_ACTION is
+// reject and anything matched.
+func filterText(text string) (string, error) {
+	f := textFilterConfig.Load()
+	if f == nil {
+		return text, nil
+	}
+	runes := []rune(text)
+	masked := make([]bool, len(runes))
+	matched := false
+
+	if len(f.words) > 0 {
+		for start := 0; start < len(runes); {
+			if !isWordRune(runes[start]) {
+				start++
+				continue
+			}
+			end := start
+			for end < len(runes) && isWordRune(runes[end]) {
+				end++
+			}
+			// Leetspeak characters at the edges may be punctuation, as in
+			// "damn!"
+			s, e := start, end
+			for s < e && !unicode.IsLetter(runes[s]) {
+				s++
+			}
+			for e > s && !unicode.IsLetter(runes[e-1]) {
+				e--
+			}
+			if f.blocked(runes[start:end]) || f.blocked(runes[s:e]) {
+				for i := start; i < end; i++ {
+					masked[i] = true
+				}
+				matched = true
+			}
+			start = end
+		}
+	}
+
+	if f.pii {
+		for _, pattern := range []*regexp.Regexp{emailPattern, phonePattern} {
+			for _, loc := range pattern.FindAllStringIndex(text, -1) {
+				from := len([]rune(text[:loc[0]]))
+				to := from + len([]rune(text[loc[0]:loc[1]]))
+				for i := from; i < to; i++ {
+					masked[i] = true
+				}
+				matched = true
+			}
+		}
+	}
+
+	if !matched {
+		return text, nil
+	}
+	if f.reject {
+		textRejected.Add(1)
+		return "", errTextBlocked
+	}
+	textMasked.Add(1)
+	for i := range runes {
+		if masked[i] && !unicode.IsSpace(runes[i]) {
+			runes[i] = '*'
+		}
+	}
+	return string(runes), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Every server limits how long a client may take to send its request
+// headers and how long an idle keep-alive connection stays open, and caps
+// the size of the headers, so slow or stalled clients can't tie up the
+// venue server's connections. The main server and the HTTPS redirect also
+// bound whole requests with readTimeout and writeTimeout, except
+// WebSockets, which stay open for the whole event, the long transfers
+// of longTransferRoutes, which get uploadTimeout to cope with phones on a
+// crowded network, and snapshots and ZIP exports, which take as long as
+// they take and push back their own write deadline.
+var (
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	uploadTimeout     time.Duration
+	maxHeaderBytes    int
+)
+
+// longTransferRoutes are the route templates whose requests get
+// uploadTimeout instead of readTimeout and writeTimeout.
+var longTransferRoutes = map[string]bool{
+	"/api/upload":                 true,
+	"/api/admin/recap/{id}/video": true,
+	"/debug/":                     true, // CPU profiles and traces run for ?seconds=
+}
+
+// newServer returns a server for handler with the connection limits, and,
+// with bounded, the whole-request timeouts. The debug server isn't bounded,
+// as profiles take as long as they are asked to.
+func newServer(addr string, handler http.Handler, bounded bool) *http.Server {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+	if bounded {
+		srv.ReadTimeout = readTimeout
+		srv.WriteTimeout = writeTimeout
+	}
+	return srv
+}
+
+// timeoutMiddleware lifts the server's deadlines for WebSockets and long
+// transfers, and gives other requests a context that ends with their write
+// deadline, so handlers stop working for a client that is gone. It must
+// come first, so that it sees the connection's own ResponseWriter.
+func timeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		var deadline time.Time
+		switch {
+		case r.URL.Path == "/ws", route == "/api/admin/snapshot", route == "/api/pictures/export":
+			// The hijacked connection would keep the server's deadlines,
+			// which would cut it off; snapshots and exports set their own
+		case longTransferRoutes[route]:
+			if uploadTimeout > 0 {
+				deadline = time.Now().Add(uploadTimeout)
+			}
+		default:
+			if writeTimeout > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), writeTimeout)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		// An error means the connection can't change its deadlines, and the
+		// server's stand
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(deadline)
+		rc.SetWriteDeadline(deadline)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// HTTPS is served on port when a certificate is configured, either from
+// tlsCertFile/tlsKeyFile or obtained from Let's Encrypt for tlsDomains. With
+// httpPort set, plain HTTP on it is redirected to HTTPS (and answers ACME
+// HTTP-01 challenges); without it, autocert uses the TLS-ALPN-01 challenge
+// on port.
+var (
+	tlsCertFile string
+	tlsKeyFile  string
+	tlsDomains  []string
+	tlsCacheDir string
+	tlsEmail    string
+	httpPort    string
+)
+
+// tlsEnabled reports whether the server serves HTTPS.
+func tlsEnabled() bool {
+	return tlsCertFile != "" || len(tlsDomains) > 0
+}
+
+// parseDomains splits a comma-separated TLS_DOMAINS value.
+func parseDomains(raw string) []string {
+	var domains []string
+	for _, d := range strings.Split(raw, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// newTLSConfig returns the server's TLS configuration, and the handler that
+// httpPort serves: a redirect to HTTPS, wrapped by autocert so ACME
+// challenges are answered.
+func newTLSConfig() (*tls.Config, http.Handler, error) {
+	redirect := http.HandlerFunc(redirectToHTTPS)
+	if tlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("load certificate: %w", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, redirect, nil
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(tlsDomains...),
+		Cache:      autocert.DirCache(tlsCacheDir),
+		Email:      tlsEmail,
+	}
+	cfg := m.TLSConfig()
+	cfg.MinVersion = tls.VersionTLS12
+	return cfg, m.HTTPHandler(redirect), nil
+}
+
+// redirectToHTTPS permanently redirects a plain HTTP request to the same
+// URL on the HTTPS port.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Pictures a moderator deletes go to the trash rather than away, as
+// misclicks happen during a busy event: the picture leaves the wall and
+// every list, and its row moves to trashed_pictures, keeping its likes,
+// comments and other rows. With local storage its files move to
+// uploads/trash/, where they aren't served. A moderator can restore it for
+// TRASH_HOURS, after which the purger deletes it for good, files and all.
+// A guest deleting their personal data purges their pictures in the trash
+// straight away.
+
+// trashCheckInterval is how often the purger looks for pictures in the
+// trash for longer than trashRetention.
+const trashCheckInterval = 10 * time.Minute
+
+// trashDir is where pictures in the trash keep their files with local
+// storage, under the name of their gcArea.
+var trashDir string
+
+// trashRetention is how long a picture stays in the trash.
+var trashRetention reloadable[time.Duration]
+
+// TrashedPicture is a picture in the trash, with who deleted it and when,
+// and when it is purged.
+type TrashedPicture struct {
+	*Picture
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy"`
+	PurgeAt   time.Time `json:"purgeAt"`
+	// OriginalKey and OriginalLocation are those of the picture's kept
+	// original; see KeptOriginal
+	OriginalKey      string `json:"-"`
+	OriginalLocation string `json:"-"`
+}
+
+// withPurgeAt sets when t is purged with the current retention.
+func (t *TrashedPicture) withPurgeAt() *TrashedPicture {
+	t.PurgeAt = t.DeletedAt.Add(trashRetention.Load())
+	return t
+}
+
+// trashFile is a file of a picture with local storage: where it's served
+// from and where it waits in the trash.
+type trashFile struct {
+	area    string
+	live    string
+	trashed string
+}
+
+// trashFiles returns the files of a picture with local storage. Its image
+// and projector rendition are left out while another picture has them, as
+// are archived originals.
+func trashFiles(t *TrashedPicture) ([]trashFile, error) {
+	if _, ok := uploadStore.(*dirStorage); !ok {
+		return nil, nil
+	}
+	inUse, err := db.FileInUse(t.FileKey)
+	if err != nil {
+		return nil, err
+	}
+	var files []trashFile
+	for _, area := range gcAreas() {
+		key := t.FileKey
+		if area.name == "original" {
+			key = t.OriginalKey
+			if key == "" || t.OriginalLocation != "" {
+				continue
+			}
+		} else if inUse {
+			continue
+		}
+		files = append(files, trashFile{
+			area:    area.name,
+			live:    filepath.Join(area.dir, filepath.FromSlash(key)),
+			trashed: filepath.Join(trashDir, area.name, filepath.FromSlash(key)),
+		})
+	}
+	return files, nil
+}
+
+// moveToTrash moves the files of a picture just put in the trash there.
+func moveToTrash(t *TrashedPicture) {
+	files, err := trashFiles(t)
+	if err != nil {
+		logWarn("trash: files of %s: %v", t.ID, err)
+		return
+	}
+	for _, f := range files {
+		if err := moveFile(f.live, f.trashed); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logWarn("trash: move %s: %v", f.live, err)
+		}
+	}
+}
+
+// moveFromTrash moves the files of a picture about to be restored back,
+// unless they're there already. It fails if a file can't be moved, so that
+// the picture isn't restored without it.
+func moveFromTrash(t *TrashedPicture) error {
+	files, err := trashFiles(t)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f.live); err == nil {
+			continue
+		}
+		if err := moveFile(f.trashed, f.live); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	removeEmptyDirs(trashDir)
+	return nil
+}
+
+// purgeTrashedPicture deletes a picture in the trash for good, with its
+// files unless another picture, in the trash or not, has them.
+func purgeTrashedPicture(ctx context.Context, t *TrashedPicture) error {
+	if err := db.PurgeTrashedPicture(t.ID); err != nil {
+		return err
+	}
+	shared, err := db.FileTrashed(t.FileKey)
+	if err != nil {
+		logWarn("trash: files of %s: %v", t.ID, err)
+		shared = true
+	}
+
+	if _, ok := uploadStore.(*dirStorage); ok {
+		files, err := trashFiles(t)
+		if err != nil {
+			logWarn("trash: files of %s: %v", t.ID, err)
+		}
+		for _, f := range files {
+			if shared && f.area != "original" {
+				continue
+			}
+			if err := os.Remove(f.trashed); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				logWarn("trash: remove %s: %v", f.trashed, err)
+			}
+		}
+		removeEmptyDirs(trashDir)
+	} else {
+		if !shared {
+			deleteUnusedFiles(ctx, t.FileKey)
+		}
+		if t.OriginalKey != "" && t.OriginalLocation == "" {
+			if err := originalStore.Delete(ctx, t.OriginalKey); err != nil {
+				logWarn("trash: remove original %s: %v", t.OriginalKey, err)
+			}
+		}
+	}
+	if t.OriginalLocation != "" {
+		if archive == nil {
+			logWarn("trash: original %s is archived at %s, but ARCHIVE_BUCKET isn't set", t.OriginalKey, t.OriginalLocation)
+		} else if err := archive.remove(ctx, t.OriginalLocation); err != nil {
+			logWarn("trash: remove archived original %s: %v", t.OriginalLocation, err)
+		}
+	}
+	return nil
+}
+
+// purgeTrash purges the pictures in the trash for longer than
+// trashRetention.
+func purgeTrash(ctx context.Context) {
+	trashed, err := db.GetTrashDeletedBefore(time.Now().Add(-trashRetention.Load()))
+	if err != nil {
+		logError("trash: %v", err)
+		return
+	}
+	for _, t := range trashed {
+		if err := purgeTrashedPicture(ctx, t); err != nil {
+			logError("trash: purge %s: %v", t.ID, err)
+			continue
+		}
+		logInfo("trash: purged %s, deleted by %s at %s (event=%s)", t.ID, t.DeletedBy, t.DeletedAt.Format(time.RFC3339), t.EventID)
+	}
+}
+
+// runTrashPurger purges the trash every trashCheckInterval until stop is
+// closed, except in read-only mode.
+func runTrashPurger(stop <-chan struct{}) {
+	ticker := time.NewTicker(trashCheckInterval)
+	defer ticker.Stop()
+	for {
+		if !readOnly.Load() {
+			purgeTrash(context.Background())
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// handleDeletePicture puts a picture in the trash, taking it off the wall.
+func handleDeletePicture(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	trashed, err := db.TrashPicture(id, moderatorName(r), time.Now())
+	if err == sql.ErrNoRows {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("trash picture failed: %v", err)
+		http.Error(w, "Error deleting picture", http.StatusInternalServerError)
+		return
+	}
+	moveToTrash(trashed)
+	if !trashed.Hidden {
+		hub.publishVisibility(&Picture{ID: trashed.ID, EventID: trashed.EventID, Hidden: true})
+	}
+	logInfo("picture %s deleted by %s (event=%s)", trashed.ID, trashed.DeletedBy, trashed.EventID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trashed.withPurgeAt())
+}
+
+// handleTrash lists the pictures of the request's event in the trash, last
+// deleted first.
+func handleTrash(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	trashed, err := db.GetTrash(event)
+	if err != nil {
+		logError("get trash failed: %v", err)
+		http.Error(w, "Error fetching trash", http.StatusInternalServerError)
+		return
+	}
+	for _, t := range trashed {
+		t.withPurgeAt()
+	}
+	if trashed == nil {
+		trashed = []*TrashedPicture{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trashed)
+}
+
+// handleRestorePicture takes a picture out of the trash, back on the wall
+// unless it was hidden.
+func handleRestorePicture(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	trashed, err := db.GetTrashedPicture(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Picture not in the trash", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("get trashed picture failed: %v", err)
+		http.Error(w, "Error restoring picture", http.StatusInternalServerError)
+		return
+	}
+	if err := moveFromTrash(trashed); err != nil {
+		logError("restore files of %s failed: %v", id, err)
+		http.Error(w, "Error restoring picture", http.StatusInternalServerError)
+		return
+	}
+	pic, err := db.RestorePicture(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Picture not in the trash", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("restore picture failed: %v", err)
+		http.Error(w, "Error restoring picture", http.StatusInternalServerError)
+		return
+	}
+	if !pic.Hidden {
+		hub.publishVisibility(pic)
+	}
+	logInfo("picture %s restored by %s (event=%s)", pic.ID, moderatorName(r), pic.EventID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(archivedPicture(pic))
+}
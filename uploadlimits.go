@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+// Guests may upload a limited number of pictures to an event:
+// DEVICE_UPLOAD_LIMIT per device, or USER_UPLOAD_LIMIT per account for
+// signed-in users. Uploads are counted in the database when they are
+// accepted, so the limit holds across restarts and instances, and pictures
+// later hidden or rejected still count. Accounts an admin marks as
+// photographers, and admins, aren't limited.
+var (
+	deviceUploadLimit reloadable[int]
+	userUploadLimit   reloadable[int]
+
+	uploadsRejectedLimit atomic.Uint64
+)
+
+// uploadAllowance returns the key a request's uploads are counted under and
+// the limit that applies to it, 0 for none.
+func uploadAllowance(r *http.Request) (string, int) {
+	if role, _ := authenticate(r); role == RoleAdmin {
+		return "", 0
+	}
+	if user := userFromRequest(r); user != nil {
+		if user.Photographer {
+			return "", 0
+		}
+		return "user:" + strconv.FormatInt(user.ID, 10), userUploadLimit.Load()
+	}
+	return "device:" + deviceFromRequest(r).id, deviceUploadLimit.Load()
+}
+
+// takeUpload counts an upload of a request to an event against its limit.
+// It returns false if the limit was reached, and otherwise a function that
+// gives the upload back, for uploads that fail before they are queued.
+func takeUpload(r *http.Request, event string) (bool, int, func(), error) {
+	key, limit := uploadAllowance(r)
+	if limit <= 0 {
+		return true, 0, func() {}, nil
+	}
+	ok, err := db.TakeUpload(event, key, limit)
+	if err != nil || !ok {
+		return false, limit, nil, err
+	}
+	return true, limit, func() {
+		if err := db.ReturnUpload(event, key); err != nil {
+			logError("return upload failed: %v", err)
+		}
+	}, nil
+}
+
+// uploadLimitMessage explains a refused upload.
+func uploadLimitMessage(r *http.Request, limit int) string {
+	if userFromRequest(r) != nil {
+		return fmt.Sprintf("Upload limit reached: %d pictures per account for this event", limit)
+	}
+	return fmt.Sprintf("Upload limit reached: %d pictures per device for this event", limit)
+}
+
+// SetPhotographerRequest is the body of PUT
+// /api/admin/users/{id}/photographer.
+type SetPhotographerRequest struct {
+	Photographer *bool `json:"photographer"`
+}
+
+// handleSetPhotographer marks a user as a photographer, exempt from the
+// upload limits, or not.
+func handleSetPhotographer(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	var req SetPhotographerRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&req); err != nil || req.Photographer == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := db.SetUserPhotographer(id, *req.Photographer); err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError("set user photographer failed: %v", err)
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		return
+	}
+	user, err := db.GetUser(id)
+	if err != nil {
+		logError("get user failed: %v", err)
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		return
+	}
+	logInfo("user %s: photographer %v", user.Username, user.Photographer)
+	writeUser(w, http.StatusOK, user)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// POST /api/upload answers with the ID of the upload's conversion task,
+// which its uploader polls at GET /api/upload/{id} until the picture is
+// converted. Its receipt then names the picture and, once it's on the
+// public wall, its short share link, so a guest can find and like their
+// own photo straight away. Uploaders connected to the hub don't need to
+// poll: their devices get the receipt as an upload_receipt message when
+// the conversion finishes.
+
+// UploadStatus is the receipt of an upload.
+type UploadStatus struct {
+	UploadID int64 `json:"uploadId"`
+	// Status is queued, processing, completed or failed
+	Status string `json:"status"`
+	// PictureID is the converted picture, once completed and unless it
+	// was deleted since
+	PictureID string `json:"pictureId,omitempty"`
+	// Hidden is set while the picture waits for a moderator or its
+	// publish time, or after it was hidden or rejected; it has no share
+	// link then
+	Hidden   bool   `json:"hidden,omitempty"`
+	ShareURL string `json:"shareUrl,omitempty"`
+}
+
+// uploadStatuses are the statuses of uploads by task status.
+var uploadStatuses = map[string]string{
+	"pending":    "queued",
+	"processing": "processing",
+	"completed":  "completed",
+	"failed":     "failed",
+}
+
+// uploadStatus returns the receipt of an upload's task, with a share link
+// on base, "" for a link relative to the server. Share codes aren't
+// created in read-only mode.
+func uploadStatus(task *ConversionTask, base string) (*UploadStatus, error) {
+	status := &UploadStatus{UploadID: task.ID, Status: uploadStatuses[task.Status]}
+	if task.Status != "completed" || task.ResultID == "" {
+		return status, nil
+	}
+	pic, err := db.GetPicture(task.ResultID)
+	if err == sql.ErrNoRows {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	status.PictureID = pic.ID
+	status.Hidden = pic.Hidden
+	if pic.Hidden || readOnly.Load() {
+		return status, nil
+	}
+	code, err := db.GetOrCreateShareCode(pic.ID, newShareCode, shareCodeAttempts)
+	if err != nil {
+		return nil, err
+	}
+	status.ShareURL = base + "/p/" + code
+	return status, nil
+}
+
+// ownsUpload reports whether the request comes from the device or user
+// that uploaded a task's original, or from an admin.
+func ownsUpload(r *http.Request, task *ConversionTask) bool {
+	if device := deviceFromRequest(r).id; device != "" && device == task.DeviceID {
+		return true
+	}
+	if user := uploaderID(r); user != 0 && user == task.UserID {
+		return true
+	}
+	role, ok := authenticate(r)
+	return ok && role >= RoleAdmin
+}
+
+// handleUploadStatus returns the receipt of an upload to its uploader.
+func handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	task, err := db.GetConversionTask(id)
+	if err == sql.ErrNoRows || (err == nil && !ownsUpload(r, task)) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("get conversion task failed: %v", err)
+		http.Error(w, "Error fetching upload", http.StatusInternalServerError)
+		return
+	}
+	status, err := uploadStatus(task, baseURL(r))
+	if err != nil {
+		logError("upload status failed: %v", err)
+		http.Error(w, "Error fetching upload", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(status)
+}
+
+// publishUploadReceipt tells the devices of a task's uploader that their
+// upload was converted. The share link is on PUBLIC_URL, or relative to
+// the server without it.
+func (h *Hub) publishUploadReceipt(task *ConversionTask) {
+	if task.UserID == 0 && task.DeviceID == "" {
+		return
+	}
+	status, err := uploadStatus(task, publicURL)
+	if err != nil {
+		logWarn("receipt of upload %d: %v", task.ID, err)
+		return
+	}
+	if task.UserID != 0 {
+		h.publishToRecipient(task.EventID, "user:"+strconv.FormatInt(task.UserID, 10), msgUploadReceipt, status)
+	} else {
+		h.publishToRecipient(task.EventID, "device:"+task.DeviceID, msgUploadReceipt, status)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users sign in with a username and password and are kept signed in by a
+// session cookie. The cookie holds a random token; the server keeps its
+// hash, as it does for display tokens, so a copy of the database can't be
+// used to sign in. A signed-in user's role applies to requests without a
+// token, so that admins can use the admin endpoints from a browser.
+// Accounts are created with picsapp create-user, or by anyone through
+// /api/auth/signup with ALLOW_SIGNUP. The first admin account is created
+// at startup from ADMIN_USERNAME and ADMIN_PASSWORD.
+var (
+	allowSignup         bool
+	sessionTTL          time.Duration
+	sessionCookieSecure bool
+	adminUsername       string
+	adminPassword       string
+	requireSignin       reloadable[bool]
+
+	errUsernameTaken = errors.New("username taken")
+	errLastAdmin     = errors.New("the last admin can't be demoted")
+)
+
+const (
+	sessionCookieName = "picsapp_session"
+	minPasswordLength = 8
+	// maxPasswordLength is the most bcrypt hashes
+	maxPasswordLength = 72
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+// dummyPasswordHash is compared against when a username is unknown, so
+// that logins take as long whether the user exists or not.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("picsapp-dummy-password"), bcrypt.DefaultCost)
+
+// User is an account.
+type User struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	// Name is the user's real name from their OAuth provider, "" if they
+	// never signed in with one
+	Name string `json:"name,omitempty"`
+	Role Role   `json:"role"`
+	// Photographer exempts the user from the upload limits
+	Photographer bool       `json:"photographer"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	LastLoginAt  *time.Time `json:"lastLoginAt,omitempty"`
+}
+
+// Credentials is the body of a login or sign-up.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// validCredentials checks the username and password of a new account.
+func validCredentials(username, password string) error {
+	if !usernamePattern.MatchString(username) {
+		return errors.New("username must be 3-32 characters from A-Z a-z 0-9 _ . -")
+	}
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return errors.New("password must be 8-72 bytes")
+	}
+	return nil
+}
+
+// createUser adds an account with a hashed password.
+func createUser(username, password string, role Role) (*User, error) {
+	if err := validCredentials(username, password); err != nil {
+		return nil, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	user := &User{Username: username, Role: role, CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	if err := db.AddUser(user, string(hash)); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// bootstrapAdmin creates the ADMIN_USERNAME account with ADMIN_PASSWORD
+// when no admin account exists yet. Once one does, ADMIN_PASSWORD is
+// ignored, so changing it doesn't reset anyone's password. An account of
+// another role with that username is never promoted: whoever signed up
+// with it first would otherwise become admin.
+func bootstrapAdmin() error {
+	if adminPassword == "" {
+		return nil
+	}
+	admins, err := db.CountUsersWithRole(RoleAdmin)
+	if err != nil || admins > 0 {
+		return err
+	}
+	user, err := createUser(adminUsername, adminPassword, RoleAdmin)
+	if errors.Is(err, errUsernameTaken) {
+		return fmt.Errorf("%s is taken by a non-admin account; promote it with picsapp set-role", adminUsername)
+	}
+	if err != nil {
+		return err
+	}
+	logInfo("created admin account %s", user.Username)
+	return nil
+}
+
+// setUserRole changes the role of a user, refusing to demote the last
+// admin, who would have no way back in without the command line.
+func setUserRole(user *User, role Role) error {
+	if user.Role == RoleAdmin && role != RoleAdmin {
+		admins, err := db.CountUsersWithRole(RoleAdmin)
+		if err != nil {
+			return err
+		}
+		if admins <= 1 {
+			return errLastAdmin
+		}
+	}
+	if err := db.SetUserRole(user.ID, role); err != nil {
+		return err
+	}
+	user.Role = role
+	return nil
+}
+
+// uploaderName returns the name a request's uploads are attributed to:
+// the signed-in user's real name, or username, or "" if anonymous.
+func uploaderName(r *http.Request) string {
+	user := userFromRequest(r)
+	switch {
+	case user == nil:
+		return ""
+	case user.Name != "":
+		return user.Name
+	default:
+		return user.Username
+	}
+}
+
+// uploaderID returns the ID of the signed-in user of a request, or 0.
+func uploaderID(r *http.Request) int64 {
+	if user := userFromRequest(r); user != nil {
+		return user.ID
+	}
+	return 0
+}
+
+// signinRequired reports whether a request must sign in before it posts,
+// with REQUIRE_SIGNIN. Requests with the presenter or admin token don't.
+func signinRequired(r *http.Request) bool {
+	if !requireSignin.Load() || userFromRequest(r) != nil {
+		return false
+	}
+	role, _ := authenticate(r)
+	return role < RolePresenter
+}
+
+type userContextKey struct{}
+
+// userFromRequest returns the signed-in user of a request, or nil.
+func userFromRequest(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey{}).(*User)
+	return user
+}
+
+// sessionMiddleware attaches the user of a valid session cookie to the
+// request. Requests without one go on anonymous.
+func sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil || cookie.Value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, err := db.GetSessionUser(hashDisplayToken(cookie.Value), time.Now())
+		switch {
+		case err == sql.ErrNoRows:
+			// Expired or signed out elsewhere
+			clearSessionCookie(w, r)
+		case err != nil:
+			logError("get session failed: %v", err)
+		default:
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, user))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startSession signs user in: it stores a new session and sets its cookie.
+func startSession(w http.ResponseWriter, r *http.Request, user *User) error {
+	token, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	expires := now.Add(sessionTTL)
+	if err := db.AddSession(hashDisplayToken(token), user.ID, now, expires); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || sessionCookieSecure,
+		// Not sent with cross-site form posts, which would otherwise act
+		// with the user's role
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || sessionCookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// decodeCredentials reads the credentials of a login or sign-up.
+func decodeCredentials(w http.ResponseWriter, r *http.Request) (*Credentials, bool) {
+	var c Credentials
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&c); err != nil || c.Username == "" || c.Password == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return nil, false
+	}
+	return &c, true
+}
+
+func writeUser(w http.ResponseWriter, status int, user *User) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(user)
+}
+
+// handleLogin checks a username and password and starts a session.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	c, ok := decodeCredentials(w, r)
+	if !ok {
+		return
+	}
+	user, hash, err := db.GetUserByUsername(c.Username)
+	if err != nil && err != sql.ErrNoRows {
+		logError("get user failed: %v", err)
+		http.Error(w, "Error signing in", http.StatusInternalServerError)
+		return
+	}
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(c.Password))
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(c.Password)) != nil {
+		logWarn("failed login for user %s", user.Username)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	now := time.Now()
+	if err := db.DeleteExpiredSessions(now); err != nil {
+		logWarn("delete expired sessions: %v", err)
+	}
+	if err := startSession(w, r, user); err != nil {
+		logError("start session failed: %v", err)
+		http.Error(w, "Error signing in", http.StatusInternalServerError)
+		return
+	}
+	if err := db.TouchUserLogin(user.ID, now); err != nil {
+		logWarn("record login of user %s: %v", user.Username, err)
+	}
+	loggedIn := now.UTC().Truncate(time.Second)
+	user.LastLoginAt = &loggedIn
+	logInfo("user %s signed in", user.Username)
+	writeUser(w, http.StatusOK, user)
+}
+
+// handleLogout ends the request's session, if any.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		if err := db.DeleteSession(hashDisplayToken(cookie.Value)); err != nil {
+			logError("delete session failed: %v", err)
+			http.Error(w, "Error signing out", http.StatusInternalServerError)
+			return
+		}
+	}
+	clearSessionCookie(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSignup creates a viewer account and signs it in, with ALLOW_SIGNUP.
+func handleSignup(w http.ResponseWriter, r *http.Request) {
+	if !allowSignup {
+		http.Error(w, "Sign-up is disabled", http.StatusForbidden)
+		return
+	}
+	c, ok := decodeCredentials(w, r)
+	if !ok {
+		return
+	}
+	user, err := createUser(c.Username, c.Password, RoleViewer)
+	switch {
+	case errors.Is(err, errUsernameTaken):
+		http.Error(w, "Username is taken", http.StatusConflict)
+		return
+	case err != nil && validCredentials(c.Username, c.Password) != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		logError("create user failed: %v", err)
+		http.Error(w, "Error creating account", http.StatusInternalServerError)
+		return
+	}
+	if err := startSession(w, r, user); err != nil {
+		logError("start session failed: %v", err)
+		http.Error(w, "Error signing in", http.StatusInternalServerError)
+		return
+	}
+	logInfo("user %s signed up", user.Username)
+	writeUser(w, http.StatusCreated, user)
+}
+
+// handleMe returns the signed-in user.
+func handleMe(w http.ResponseWriter, r *http.Request) {
+	user := userFromRequest(r)
+	if user == nil {
+		http.Error(w, "Not signed in", http.StatusUnauthorized)
+		return
+	}
+	writeUser(w, http.StatusOK, user)
+}
+
+// handleListUsers lists the user accounts.
+func handleListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := db.GetUsers()
+	if err != nil {
+		logError("get users failed: %v", err)
+		http.Error(w, "Error fetching users", http.StatusInternalServerError)
+		return
+	}
+	if users == nil {
+		users = []*User{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// SetRoleRequest is the body of PUT /api/admin/users/{id}/role.
+type SetRoleRequest struct {
+	Role *Role `json:"role"`
+}
+
+// handleSetUserRole changes the role of a user. The change applies to the
+// user's next request, as roles are read with the session.
+func handleSetUserRole(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	var req SetRoleRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&req); err != nil || req.Role == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	user, err := db.GetUser(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("get user failed: %v", err)
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		return
+	}
+	old := user.Role
+	switch err := setUserRole(user, *req.Role); {
+	case errors.Is(err, errLastAdmin):
+		http.Error(w, "The last admin can't be demoted", http.StatusConflict)
+		return
+	case err != nil:
+		logError("set user role failed: %v", err)
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		return
+	}
+	logInfo("user %s: role %s -> %s", user.Username, old, user.Role)
+	writeUser(w, http.StatusOK, user)
+}
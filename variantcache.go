@@ -0,0 +1,183 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Variants of pictures generated on request, such as resized or
+// re-encoded copies, are kept in VARIANT_CACHE_DIR, capped at
+// VARIANT_CACHE_MB. Variants are named by a key of the caller's choosing,
+// e.g. the picture's file key and the variant's parameters, and stored
+// under its SHA-256 in the sharded layout of converted images. Writes go
+// through writeFileAtomic, so readers never see a partial variant, and the
+// least recently read variants are evicted once the cap
+// is exceeded. Reads set the modification time, so the order survives
+// restarts.
+var (
+	variantCacheDir   string
+	variantCacheBytes int64
+	variants          *variantCache
+
+	variantCacheHits      atomic.Uint64
+	variantCacheMisses    atomic.Uint64
+	variantCacheEvictions atomic.Uint64
+)
+
+// variantCache is a size-capped LRU cache of files in a directory.
+type variantCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *variantEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type variantEntry struct {
+	name string // path under dir, slash-separated
+	size int64
+}
+
+// newVariantCache creates the cache in dir, adding the variants already
+// there by their modification time and evicting down to maxBytes.
+// Temporary files left by a crash are removed.
+func newVariantCache(dir string, maxBytes int64) (*variantCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &variantCache{dir: dir, maxBytes: maxBytes, lru: list.New(), entries: map[string]*list.Element{}}
+	type found struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var files []found
+	err := walkDirStore(dir, func(key, path string, info fs.FileInfo) error {
+		if strings.HasPrefix(filepath.Base(key), ".") {
+			os.Remove(path)
+			return nil
+		}
+		files = append(files, found{key, info.Size(), info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Oldest first, so the most recent end up at the front
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range files {
+		c.entries[f.name] = c.lru.PushFront(&variantEntry{f.name, f.size})
+		c.size += f.size
+	}
+	c.evictLocked()
+	return c, nil
+}
+
+// name returns the path under the cache directory of the variant key.
+func (c *variantCache) name(key string) string {
+	return shardedKey([]byte(key), filepath.Ext(key))
+}
+
+// Open returns the variant under key, or false if it isn't cached.
+func (c *variantCache) Open(key string) (*os.File, fs.FileInfo, bool) {
+	name := c.name(key)
+	c.mu.Lock()
+	elem, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+	if !ok {
+		variantCacheMisses.Add(1)
+		return nil, nil, false
+	}
+	path := filepath.Join(c.dir, filepath.FromSlash(name))
+	f, err := os.Open(path)
+	if err != nil {
+		// Removed behind the cache's back
+		c.remove(name)
+		variantCacheMisses.Add(1)
+		return nil, nil, false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		variantCacheMisses.Add(1)
+		return nil, nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	variantCacheHits.Add(1)
+	return f, info, true
+}
+
+// Put stores the variant write produces under key, replacing any cached
+// one, then evicts the least recently used variants over the cap.
+func (c *variantCache) Put(key string, write func(io.Writer) error) error {
+	name := c.name(key)
+	path := filepath.Join(c.dir, filepath.FromSlash(name))
+	size, err := writeFileAtomic(path, write)
+	if err != nil {
+		return err
+	}
+	// The same clock as reads, as file systems stamp writes coarsely
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[name]; ok {
+		c.size -= elem.Value.(*variantEntry).size
+		c.lru.Remove(elem)
+	}
+	c.entries[name] = c.lru.PushFront(&variantEntry{name, size})
+	c.size += size
+	c.evictLocked()
+	return nil
+}
+
+// remove forgets a variant whose file is gone.
+func (c *variantCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[name]; ok {
+		c.size -= elem.Value.(*variantEntry).size
+		c.lru.Remove(elem)
+		delete(c.entries, name)
+	}
+}
+
+// evictLocked deletes the least recently used variants until the cache
+// fits in maxBytes. Readers that have a variant open keep reading it.
+func (c *variantCache) evictLocked() {
+	for c.size > c.maxBytes && c.lru.Len() > 0 {
+		elem := c.lru.Back()
+		entry := elem.Value.(*variantEntry)
+		c.lru.Remove(elem)
+		delete(c.entries, entry.name)
+		c.size -= entry.size
+		if err := os.Remove(filepath.Join(c.dir, filepath.FromSlash(entry.name))); err != nil && !os.IsNotExist(err) {
+			logWarn("evict variant %s: %v", entry.name, err)
+		}
+		variantCacheEvictions.Add(1)
+	}
+}
+
+// stats returns the number and total size of the cached variants.
+func (c *variantCache) stats() (files int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len(), c.size
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// VisibilityRequest is the body of PUT /api/admin/pictures/{id}/visibility.
+// Hidden pictures stay in the archive but are left out of the public
+// lists, the presentation and every broadcast.
+type VisibilityRequest struct {
+	Hidden *bool `json:"hidden"`
+}
+
+// ArchivedPicture is a picture as the archive lists it, with how it
+// arrived and when it is published if it's scheduled.
+type ArchivedPicture struct {
+	*Picture
+	Source    string     `json:"source,omitempty"`
+	PublishAt *time.Time `json:"publishAt,omitempty"`
+}
+
+func archivedPicture(pic *Picture) *ArchivedPicture {
+	archived := &ArchivedPicture{Picture: pic, Source: pic.Source}
+	if !pic.PublishAt.IsZero() {
+		archived.PublishAt = &pic.PublishAt
+	}
+	return archived
+}
+
+// handleArchive lists every picture of the request's event, hidden ones
+// included, newest first.
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	event, ok := eventFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	pictures, err := db.GetArchivedPictures(event)
+	if err != nil {
+		logError("get archived pictures failed: %v", err)
+		http.Error(w, "Error fetching pictures", http.StatusInternalServerError)
+		return
+	}
+	archived := make([]*ArchivedPicture, len(pictures))
+	for i, pic := range pictures {
+		archived[i] = archivedPicture(pic)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(archived)
+}
+
+// handleSetVisibility hides a picture from the public wall or shows it
+// again, and tells connected clients to drop or restore it.
+func handleSetVisibility(w http.ResponseWriter, r *http.Request) {
+	var req VisibilityRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&req); err != nil || req.Hidden == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	pic, err := db.GetPicture(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Picture not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("get picture failed: %v", err)
+		http.Error(w, "Error updating picture", http.StatusInternalServerError)
+		return
+	}
+	if pic.Hidden != *req.Hidden {
+		if err := db.SetPictureHidden(id, *req.Hidden); err != nil {
+			logError("set picture visibility failed: %v", err)
+			http.Error(w, "Error updating picture", http.StatusInternalServerError)
+			return
+		}
+		pic.Hidden, pic.PublishAt = *req.Hidden, time.Time{}
+		hub.publishVisibility(pic)
+		logInfo("picture %s hidden=%t (event=%s)", pic.ID, pic.Hidden, pic.EventID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pic)
+}